@@ -0,0 +1,580 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every folder has a visibility: public, authenticated (anybody logged in) or
+// restricted to a minimum role. A folder inherits the rule of its closest
+// ancestor that has one, so a subfolder can be opened up again below a
+// restricted one and the other way around. Users or groups can be let into a
+// restricted folder with a path grant regardless of their role, and admins
+// always get in. Rows with source "file" come from the -acl file and are
+// rewritten on every start.
+//
+// Everything serving content below the root has to go through canAccessPath.
+
+const (
+	visibilityPublic        = "public"
+	visibilityAuthenticated = "authenticated"
+	visibilityRestricted    = "restricted"
+)
+
+type FolderRule struct {
+	Path       string
+	Visibility string
+	MinRole    string // only used with visibilityRestricted
+	Source     string
+}
+
+// PathGrant lets either Email or every member of Group into Path.
+type PathGrant struct {
+	ID        int64
+	Path      string
+	Email     string
+	Group     string
+	GrantedBy string
+	CreatedAt time.Time
+	Source    string
+}
+
+type GroupMember struct {
+	Group  string
+	Email  string
+	Source string
+}
+
+type AccessRequest struct {
+	ID        int64
+	Email     string
+	Path      string
+	Message   string
+	CreatedAt time.Time
+}
+
+// cleanRel normalises a slash separated path below the content root, "" being the root.
+func cleanRel(rel string) string {
+	return strings.Trim(path.Clean("/"+filepath.ToSlash(rel)), "/")
+}
+
+// ancestors returns rel and every folder above it, deepest first, ending with the root.
+func ancestors(rel string) []any {
+	rel = cleanRel(rel)
+	list := []any{rel}
+	for rel != "" {
+		rel = path.Dir(rel)
+		if rel == "." {
+			rel = ""
+		}
+		list = append(list, rel)
+	}
+	return list
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// folderRule returns the rule governing rel, or nil when it is unrestricted.
+func folderRule(db *sql.DB, rel string) (*FolderRule, error) {
+	paths := ancestors(rel)
+	var rule FolderRule
+	err := db.QueryRow("SELECT path, visibility, min_role FROM folder_rules WHERE path IN ("+placeholders(len(paths))+
+		") ORDER BY length(path) DESC LIMIT 1", paths...).Scan(&rule.Path, &rule.Visibility, &rule.MinRole)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// canAccessPath reports whether email may see rel, a file or folder below the content root.
+func canAccessPath(db *sql.DB, email, rel string) (bool, error) {
+	rule, err := folderRule(db, rel)
+	if err != nil {
+		return false, err
+	}
+	if rule == nil || rule.Visibility == visibilityPublic {
+		return true, nil
+	}
+	if email == "" {
+		return false, nil
+	}
+	if rule.Visibility == visibilityAuthenticated {
+		return true, nil
+	}
+	if role := userRole(db, email); role == roleAdmin || roleAtLeast(role, rule.MinRole) {
+		return true, nil
+	}
+
+	paths := ancestors(rel)
+	var n int
+	err = db.QueryRow(`SELECT COUNT(*) FROM path_grants WHERE path IN (`+placeholders(len(paths))+`)
+		AND (email = ? OR group_name IN (SELECT group_name FROM group_members WHERE email = ?))`,
+		append(paths, email, email)...).Scan(&n)
+	return n > 0, err
+}
+
+// checkPathAccess writes the access denied page unless the visitor may see rel.
+func checkPathAccess(tmpl *template.Template, db *sql.DB, w http.ResponseWriter, r *http.Request, rel string) bool {
+	email := emailFromRequest(r)
+	ok, err := canAccessPath(db, email, rel)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		failRequest(w, r, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return false
+	}
+	if ok {
+		return true
+	}
+	if isAPI(r) {
+		details := map[string]string{"path": cleanRel(rel)}
+		if email == "" {
+			writeAPIError(w, r, http.StatusUnauthorized, errCodeUnauthorized, "log in for this folder", details)
+		} else {
+			writeAPIError(w, r, http.StatusForbidden, errCodeForbidden, "no access to this folder", details)
+		}
+		return false
+	}
+
+	var pending bool
+	if email != "" {
+		err := db.QueryRow("SELECT COUNT(*) > 0 FROM access_requests WHERE email = ? AND path = ? AND resolved_at IS NULL",
+			email, cleanRel(rel)).Scan(&pending)
+		if err != nil {
+			log.Printf("%s", err.Error())
+		}
+	}
+
+	data := struct {
+		Version   string
+		CSRF      string
+		UserEmail string
+		Path      string
+		Pending   bool
+	}{
+		Version:   GetVersion(),
+		CSRF:      csrfToken(r),
+		UserEmail: email,
+		Path:      cleanRel(rel),
+		Pending:   pending,
+	}
+	if email == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+	} else {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	if err := tmpl.ExecuteTemplate(w, "access_denied.html", data); err != nil {
+		log.Printf("%s", err.Error())
+	}
+	return false
+}
+
+func adminEmails(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT email FROM users WHERE role = ?", roleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var e string
+		if err := rows.Scan(&e); err != nil {
+			return nil, err
+		}
+		emails = append(emails, e)
+	}
+	return emails, rows.Err()
+}
+
+// accessRequestSubmit files a request for the folder the user was turned away
+// from and lets the admins know about it.
+func accessRequestSubmit(db *sql.DB, n *notifier) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+		email := emailFromRequest(r)
+		rel := cleanRel(r.FormValue("path"))
+		message := strings.TrimSpace(r.FormValue("message"))
+		if len(message) > 500 {
+			message = message[:500]
+		}
+
+		var pending int
+		if err := db.QueryRow("SELECT COUNT(*) FROM access_requests WHERE email = ? AND path = ? AND resolved_at IS NULL",
+			email, rel).Scan(&pending); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not request access", http.StatusInternalServerError)
+			return
+		}
+
+		if pending == 0 {
+			res, err := db.Exec("INSERT INTO access_requests (email, path, message, created_at) VALUES (?, ?, ?, ?)",
+				email, rel, message, time.Now())
+			if err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, "could not request access", http.StatusInternalServerError)
+				return
+			}
+			id, _ := res.LastInsertId()
+
+			admins, err := adminEmails(db)
+			if err != nil {
+				log.Printf("%s", err.Error())
+			}
+			for _, admin := range admins {
+				n.notify(admin, fmt.Sprintf("%s requested access to /%s", email, rel), fmt.Sprintf("/access#request-%d", id))
+			}
+		}
+
+		http.Redirect(w, r, "/files/"+rel, http.StatusSeeOther)
+	}
+}
+
+func listFolderRules(db *sql.DB) ([]FolderRule, error) {
+	rows, err := db.Query("SELECT path, visibility, min_role, source FROM folder_rules ORDER BY path")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []FolderRule
+	for rows.Next() {
+		var rule FolderRule
+		if err := rows.Scan(&rule.Path, &rule.Visibility, &rule.MinRole, &rule.Source); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func listPathGrants(db *sql.DB) ([]PathGrant, error) {
+	rows, err := db.Query("SELECT id, path, email, group_name, granted_by, created_at, source FROM path_grants ORDER BY path, group_name, email")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []PathGrant
+	for rows.Next() {
+		var g PathGrant
+		if err := rows.Scan(&g.ID, &g.Path, &g.Email, &g.Group, &g.GrantedBy, &g.CreatedAt, &g.Source); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+func listGroupMembers(db *sql.DB) ([]GroupMember, error) {
+	rows, err := db.Query("SELECT group_name, email, source FROM group_members ORDER BY group_name, email")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []GroupMember
+	for rows.Next() {
+		var m GroupMember
+		if err := rows.Scan(&m.Group, &m.Email, &m.Source); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func listAccessRequests(db *sql.DB) ([]AccessRequest, error) {
+	rows, err := db.Query("SELECT id, email, path, message, created_at FROM access_requests WHERE resolved_at IS NULL ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []AccessRequest
+	for rows.Next() {
+		var a AccessRequest
+		if err := rows.Scan(&a.ID, &a.Email, &a.Path, &a.Message, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		requests = append(requests, a)
+	}
+	return requests, rows.Err()
+}
+
+func renderAccess(tmpl *template.Template, db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules, err := listFolderRules(db)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		grants, err := listPathGrants(db)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		members, err := listGroupMembers(db)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requests, err := listAccessRequests(db)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Version   string
+			CSRF      string
+			UserEmail string
+			Rules     []FolderRule
+			Grants    []PathGrant
+			Members   []GroupMember
+			Requests  []AccessRequest
+			Roles     []string
+			NewPath   string
+		}{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: emailFromRequest(r),
+			Rules:     rules,
+			Grants:    grants,
+			Members:   members,
+			Requests:  requests,
+			Roles:     roles,
+			NewPath:   r.URL.Query().Get("path"),
+		}
+		if err := tmpl.ExecuteTemplate(w, "access.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// parseVisibility accepts "public", "authenticated" and "restricted:<role>".
+func parseVisibility(value string) (visibility, minRole string, ok bool) {
+	visibility, minRole, _ = strings.Cut(value, ":")
+	switch visibility {
+	case visibilityPublic, visibilityAuthenticated:
+		return visibility, "", minRole == ""
+	case visibilityRestricted:
+		return visibility, minRole, isValidRole(minRole)
+	}
+	return "", "", false
+}
+
+// folderRuleSubmit sets the visibility of a folder, an empty one removes the
+// rule so the folder inherits from its parent again.
+func folderRuleSubmit(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+		rel := cleanRel(r.FormValue("path"))
+
+		var err error
+		if r.FormValue("visibility") == "" {
+			_, err = db.Exec("DELETE FROM folder_rules WHERE path = ? AND source = 'db'", rel)
+		} else if visibility, role, ok := parseVisibility(r.FormValue("visibility")); !ok {
+			http.Error(w, "unknown visibility", http.StatusBadRequest)
+			return
+		} else {
+			_, err = db.Exec(`INSERT INTO folder_rules (path, visibility, min_role) VALUES (?, ?, ?) ON CONFLICT (path)
+				DO UPDATE SET visibility = excluded.visibility, min_role = excluded.min_role, source = 'db'`, rel, visibility, role)
+		}
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not save rule", http.StatusInternalServerError)
+			return
+		}
+		events.publish(eventAccessChanged, emailFromRequest(r), rel, nil)
+		http.Redirect(w, r, "/access", http.StatusSeeOther)
+	}
+}
+
+// accessRequestResolve closes a request by granting the folder, raising the
+// user's role, or turning it down. The requester is told either way.
+func accessRequestResolve(db *sql.DB, n *notifier) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+		admin := emailFromRequest(r)
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "could not resolve request", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var req AccessRequest
+		err = tx.QueryRow("SELECT id, email, path FROM access_requests WHERE id = ? AND resolved_at IS NULL", id).
+			Scan(&req.ID, &req.Email, &req.Path)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "request not found or already resolved", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not resolve request", http.StatusInternalServerError)
+			return
+		}
+
+		var message string
+		resolution := r.FormValue("action")
+		switch resolution {
+		case "grant":
+			_, err = tx.Exec("INSERT INTO path_grants (path, email, granted_by, created_at) VALUES (?, ?, ?, ?)",
+				req.Path, req.Email, admin, time.Now())
+			message = fmt.Sprintf("You now have access to /%s", req.Path)
+		case "role":
+			role := r.FormValue("role")
+			if !isValidRole(role) || role == roleAdmin {
+				http.Error(w, "unknown role", http.StatusBadRequest)
+				return
+			}
+			var res sql.Result
+			res, err = tx.Exec("UPDATE users SET role = ? WHERE email = ?", role, req.Email)
+			if err == nil {
+				if affected, _ := res.RowsAffected(); affected == 0 {
+					http.Error(w, "the user has no local account to change the role of", http.StatusConflict)
+					return
+				}
+			}
+			resolution = "role:" + role
+			message = fmt.Sprintf("You are now %s, which gives you access to /%s", role, req.Path)
+		case "deny":
+			message = fmt.Sprintf("Your request for access to /%s was declined", req.Path)
+		default:
+			http.Error(w, "unknown action", http.StatusBadRequest)
+			return
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE access_requests SET resolved_at = ?, resolved_by = ?, resolution = ? WHERE id = ?",
+				time.Now(), admin, resolution, req.ID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not resolve request", http.StatusInternalServerError)
+			return
+		}
+
+		n.notify(req.Email, message, "/files/"+req.Path)
+		http.Redirect(w, r, "/access", http.StatusSeeOther)
+	}
+}
+
+// pathGrantSubmit lets a user, or a whole group given as group:name, into a folder.
+func pathGrantSubmit(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+		email, group := parseGrantee(r.FormValue("grantee"))
+		if email == "" && group == "" {
+			http.Error(w, "grant to an email address or group:name", http.StatusBadRequest)
+			return
+		}
+
+		_, err := db.Exec("INSERT INTO path_grants (path, email, group_name, granted_by, created_at) VALUES (?, ?, ?, ?, ?)",
+			cleanRel(r.FormValue("path")), email, group, emailFromRequest(r), time.Now())
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not save grant", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/access", http.StatusSeeOther)
+	}
+}
+
+// parseGrantee splits "group:acme" and "bob@example.com" into the group or email they name.
+func parseGrantee(s string) (email, group string) {
+	s = strings.TrimSpace(s)
+	if name, ok := strings.CutPrefix(s, "group:"); ok {
+		return "", strings.TrimSpace(name)
+	}
+	if !strings.Contains(s, "@") {
+		return "", ""
+	}
+	return s, ""
+}
+
+func groupMemberSubmit(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+		group := strings.TrimSpace(r.FormValue("group"))
+		email := strings.TrimSpace(r.FormValue("email"))
+		if group == "" || !strings.Contains(email, "@") {
+			http.Error(w, "a group name and an email address are required", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := db.Exec("INSERT INTO group_members (group_name, email) VALUES (?, ?) ON CONFLICT DO NOTHING", group, email); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not add member", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/access", http.StatusSeeOther)
+	}
+}
+
+func groupMemberRemove(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM group_members WHERE group_name = ? AND email = ? AND source = 'db'",
+			r.PathValue("group"), r.FormValue("email")); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not remove member", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/access", http.StatusSeeOther)
+	}
+}
+
+func pathGrantRevoke(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := db.Exec("DELETE FROM path_grants WHERE id = ? AND source = 'db'", r.PathValue("id")); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not revoke grant", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/access", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// applyACLFile replaces the access rules that came from the -acl file with its
+// current contents. The file has one directive per line:
+//
+//	restrict clients       editor            # folder and everything below needs editor or a grant
+//	restrict clients/acme  admin             # nobody but admins and grants
+//	public   clients/press                   # open to everybody again
+//	authenticated internal                   # anybody logged in
+//	grant    clients/acme  group:acme        # let a group in
+//	grant    clients/acme  bob@example.com   # or a single user
+//	group    acme          alice@acme.com bob@acme.com
+//
+// Anything after a # is a comment.
+func applyACLFile(db *sql.DB, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"folder_rules", "path_grants", "group_members"} {
+		if _, err := tx.Exec("DELETE FROM " + table + " WHERE source = 'file'"); err != nil {
+			return err
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == visibilityPublic || fields[0] == visibilityAuthenticated {
+			fields = append(fields, "")
+		}
+		if len(fields) < 3 {
+			return fmt.Errorf("%s:%d: expected a directive, a name and a value", path, line)
+		}
+
+		switch fields[0] {
+		case "restrict", visibilityPublic, visibilityAuthenticated:
+			visibility, role := visibilityRestricted, fields[2]
+			if fields[0] != "restrict" {
+				visibility, role = fields[0], ""
+			} else if !isValidRole(role) {
+				return fmt.Errorf("%s:%d: unknown role %q", path, line, role)
+			}
+			_, err = tx.Exec("INSERT INTO folder_rules (path, visibility, min_role, source) VALUES (?, ?, ?, 'file') "+
+				"ON CONFLICT (path) DO UPDATE SET visibility = excluded.visibility, min_role = excluded.min_role, source = 'file'",
+				cleanRel(fields[1]), visibility, role)
+		case "grant":
+			for _, grantee := range fields[2:] {
+				email, group := parseGrantee(grantee)
+				if email == "" && group == "" {
+					return fmt.Errorf("%s:%d: %q is neither an email address nor group:name", path, line, grantee)
+				}
+				_, err = tx.Exec("INSERT INTO path_grants (path, email, group_name, granted_by, created_at, source) VALUES (?, ?, ?, ?, ?, 'file')",
+					cleanRel(fields[1]), email, group, path, time.Now())
+				if err != nil {
+					break
+				}
+			}
+		case "group":
+			for _, email := range fields[2:] {
+				_, err = tx.Exec("INSERT INTO group_members (group_name, email, source) VALUES (?, ?, 'file') "+
+					"ON CONFLICT DO UPDATE SET source = 'file'", fields[1], email)
+				if err != nil {
+					break
+				}
+			}
+		default:
+			return fmt.Errorf("%s:%d: unknown directive %q", path, line, fields[0])
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// announcementSeverities are the kinds of banner, in the order the form offers them.
+var announcementSeverities = []string{"info", "warning", "critical"}
+
+type Announcement struct {
+	ID        int64      `json:"id"`
+	Message   string     `json:"message"`
+	Severity  string     `json:"severity"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (a Announcement) Expired() bool {
+	return a.ExpiresAt != nil && !a.ExpiresAt.After(time.Now())
+}
+
+// announcements holds what admins want everybody to read, planned downtime or
+// house rules, shown as a banner on top of every page. Every page asks, so the
+// current ones are kept in memory and only read again after a change or when
+// the next one might have run out.
+type announcements struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	active []Announcement
+	until  time.Time // active is good until then
+}
+
+// current returns the announcements that have not expired, newest first.
+func (b *announcements) current() []Announcement {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.until) {
+		return b.active
+	}
+	list, err := listAnnouncements(b.db, false)
+	if err != nil {
+		log.Printf("could not load announcements: %v", err)
+		return b.active
+	}
+	b.active, b.until = list, time.Now().Add(time.Minute)
+	for _, a := range list {
+		if a.ExpiresAt != nil && a.ExpiresAt.Before(b.until) {
+			b.until = *a.ExpiresAt
+		}
+	}
+	return b.active
+}
+
+func (b *announcements) changed() {
+	b.mu.Lock()
+	b.until = time.Time{}
+	b.mu.Unlock()
+}
+
+// listAnnouncements returns the active announcements, or with all the expired
+// ones too.
+func listAnnouncements(db *sql.DB, all bool) ([]Announcement, error) {
+	query := "SELECT id, message, severity, created_by, created_at, expires_at FROM announcements"
+	var args []any
+	if !all {
+		query += " WHERE expires_at IS NULL OR expires_at > ?"
+		args = append(args, time.Now())
+	}
+	rows, err := db.Query(query+" ORDER BY created_at DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Announcement
+	for rows.Next() {
+		var a Announcement
+		var expires sql.NullTime
+		if err := rows.Scan(&a.ID, &a.Message, &a.Severity, &a.CreatedBy, &a.CreatedAt, &expires); err != nil {
+			return nil, err
+		}
+		if expires.Valid {
+			a.ExpiresAt = &expires.Time
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+func renderAnnouncements(tmpl *template.Template, db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := listAnnouncements(db, true)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Version       string
+			CSRF          string
+			UserEmail     string
+			Announcements []Announcement
+			Severities    []string
+		}{
+			Version:       GetVersion(),
+			CSRF:          csrfToken(r),
+			UserEmail:     emailFromRequest(r),
+			Announcements: list,
+			Severities:    announcementSeverities,
+		}
+		if err := tmpl.ExecuteTemplate(w, "announcements.html", data); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// announcementCreate posts an announcement. expires is a datetime-local value
+// in the server's time zone, empty for one that stays until deleted.
+func announcementCreate(db *sql.DB, board *announcements) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+		message := strings.TrimSpace(r.FormValue("message"))
+		if message == "" {
+			http.Error(w, "an announcement needs a message", http.StatusBadRequest)
+			return
+		}
+		severity := r.FormValue("severity")
+		known := false
+		for _, s := range announcementSeverities {
+			known = known || s == severity
+		}
+		if !known {
+			http.Error(w, "severity must be info, warning or critical", http.StatusBadRequest)
+			return
+		}
+		var expires *time.Time
+		if v := r.FormValue("expires"); v != "" {
+			t, err := time.ParseInLocation("2006-01-02T15:04", v, time.Local)
+			if err != nil {
+				http.Error(w, "invalid expiry date", http.StatusBadRequest)
+				return
+			}
+			expires = &t
+		}
+
+		email := emailFromRequest(r)
+		res, err := db.Exec("INSERT INTO announcements (message, severity, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+			message, severity, email, time.Now(), expires)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not post announcement", http.StatusInternalServerError)
+			return
+		}
+		id, _ := res.LastInsertId()
+		board.changed()
+		audit(db, r, email, auditAnnouncementPost, strconv.FormatInt(id, 10), message)
+		http.Redirect(w, r, "/announcements", http.StatusSeeOther)
+	}
+}
+
+func announcementDelete(db *sql.DB, board *announcements) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid announcement id", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec("DELETE FROM announcements WHERE id = ?", id)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not delete announcement", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "announcement not found", http.StatusNotFound)
+			return
+		}
+		board.changed()
+		audit(db, r, emailFromRequest(r), auditAnnouncementDelete, r.PathValue("id"), "")
+		http.Redirect(w, r, "/announcements", http.StatusSeeOther)
+	}
+}
+
+// apiAnnouncements lists the current announcements as JSON, for everybody who
+// would see the banner.
+func apiAnnouncements(board *announcements) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list := board.current()
+		if list == nil {
+			list = []Announcement{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]any{"items": list}); err != nil {
+			log.Printf("%s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// The routes under /api/ are for scripts, which shouldn't have to parse
+// sentences to tell what went wrong. Their errors all come as apiError, with a
+// code from this list that stays the same when the message gets reworded.
+// openapi.yaml has them too, keep both in step.
+const (
+	errCodeUnauthorized = "unauthorized"
+	errCodeInvalidToken = "invalid_token"
+	errCodeForbidden    = "forbidden"
+	errCodeTerms        = "terms_not_accepted"
+	errCodeReadOnly     = "read_only"
+	errCodeQuota        = "quota_exceeded"
+	errCodeNotFound     = "not_found"
+	errCodeVersionGone  = "api_version_gone"
+	errCodeInternal     = "internal"
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// apiError is the body of every error an /api/ route answers with.
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func isAPI(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// writeAPIError answers r with an apiError. Internal errors go to the log with
+// the request id, so the one a client reports can be found there.
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, code, message string, details any) {
+	e := apiError{Code: code, Message: message, Details: details, RequestID: requestID(r)}
+	if status >= 500 {
+		log.Printf("request %s: %s", e.RequestID, message)
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+// failRequest is http.Error for the checks every route goes through, which
+// also guard the API: /api/ gets an apiError with code, the rest the message.
+func failRequest(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if isAPI(r) {
+		writeAPIError(w, r, status, code, message, nil)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// apiNotFound answers everything under /api/ that no route takes.
+func apiNotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, r, http.StatusNotFound, errCodeNotFound, "no such endpoint, see /api/"+newestAPIVersion().name+"/openapi.yaml", nil)
+}
+
+func renderOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPISpec)
+}
+
+const requestIDKey contextKey = "request-id"
+
+// validRequestID keeps what a proxy in front sends as X-Request-Id to
+// something that is safe in logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID gives every request an id, the one the proxy in front sent or
+// a new one, and hands it back in X-Request-Id.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID.MatchString(id) {
+			id = newCommentID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
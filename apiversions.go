@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiVersion is one version of the API under /api/<name>/. The newest is last
+// and its handlers answer for all of them: an older one has its requests sent
+// to the newest and the answers turned back into what it used to give.
+type apiVersion struct {
+	name       string
+	deprecated time.Time // zero while still recommended
+	sunset     time.Time // when it may be gone, zero if not planned
+	// shims turn the JSON of the newest version into this one's, by endpoint
+	// pattern. Endpoints answering the same in both have none.
+	shims map[string]func(any) any
+}
+
+var apiVersions = []apiVersion{
+	{
+		name:       "v1",
+		deprecated: time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+		sunset:     time.Date(2027, 10, 14, 0, 0, 0, 0, time.UTC),
+		shims: map[string]func(any) any{
+			// v1 gave the bare list
+			"GET /announcements": unwrapItems,
+		},
+	},
+	{name: "v2"},
+}
+
+func newestAPIVersion() apiVersion {
+	return apiVersions[len(apiVersions)-1]
+}
+
+// parseAPIVersions reads -api-disable, refusing to switch off what doesn't
+// exist or the newest version.
+func parseAPIVersions(list string) (map[string]bool, error) {
+	off := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		known := false
+		for _, v := range apiVersions {
+			known = known || v.name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("no API version %q", name)
+		}
+		if name == newestAPIVersion().name {
+			return nil, fmt.Errorf("%s is the newest API version, it can't be switched off", name)
+		}
+		off[name] = true
+	}
+	return off, nil
+}
+
+// apiEndpoint is a route of the API as the newest version answers it. The
+// pattern has the path below /api/<version>.
+type apiEndpoint struct {
+	pattern string
+	role    string
+	content bool // the rest of the path is in the content tree, like /watch/
+	handler http.HandlerFunc
+}
+
+// apiRoutes mounts endpoints under every version of the API, the ones
+// switched off only answering that they are gone.
+func apiRoutes(endpoints []apiEndpoint, off map[string]bool) []route {
+	newest := newestAPIVersion()
+	var routes []route
+	for _, v := range apiVersions {
+		prefix := "/api/" + v.name
+		if off[v.name] {
+			routes = append(routes, route{pattern: prefix + "/", handler: apiVersionGone(v)})
+			continue
+		}
+		for _, ep := range endpoints {
+			method, p, _ := strings.Cut(ep.pattern, " ")
+			rt := route{pattern: method + " " + prefix + p, role: ep.role, handler: ep.handler}
+			if ep.content {
+				rt.path = below(prefix + p)
+			}
+			if v.name != newest.name {
+				rt.handler = apiShim(v, newest, v.shims[ep.pattern], ep.handler)
+			}
+			routes = append(routes, rt)
+		}
+	}
+	return routes
+}
+
+// apiShim answers a request to the older version v with the handler of newest,
+// turning its JSON back with convert if there is one.
+func apiShim(v, newest apiVersion, convert func(any) any, next http.HandlerFunc) http.HandlerFunc {
+	from, to := "/api/"+v.name+"/", "/api/"+newest.name+"/"
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = r.Clone(r.Context())
+		r.URL.Path = to + strings.TrimPrefix(r.URL.Path, from)
+		r.URL.RawPath = ""
+		if convert == nil {
+			next(w, r)
+			return
+		}
+
+		sw := &shimWriter{header: w.Header()}
+		next(sw, r)
+		body := sw.body.Bytes()
+		if sw.status == 0 || sw.status == http.StatusOK {
+			var out any
+			if err := json.Unmarshal(body, &out); err == nil {
+				if body, err = json.Marshal(convert(out)); err != nil {
+					log.Printf("%s", err.Error())
+				}
+				body = append(body, '\n')
+			}
+		}
+		w.Header().Del("Content-Length")
+		if sw.status != 0 {
+			w.WriteHeader(sw.status)
+		}
+		w.Write(body)
+	}
+}
+
+// shimWriter holds an answer back for apiShim to change.
+type shimWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (sw *shimWriter) Header() http.Header { return sw.header }
+
+func (sw *shimWriter) Write(p []byte) (int, error) { return sw.body.Write(p) }
+
+func (sw *shimWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+}
+
+// unwrapItems turns {"items": [...]} into the list.
+func unwrapItems(v any) any {
+	if m, ok := v.(map[string]any); ok {
+		if items, ok := m["items"]; ok {
+			return items
+		}
+	}
+	return v
+}
+
+// withAPIVersion tells clients of an old version that it is on its way out,
+// with Deprecation, Sunset and a Link to the newest one.
+func withAPIVersion(next http.Handler) http.Handler {
+	newest := newestAPIVersion()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, v := range apiVersions {
+			rest, ok := strings.CutPrefix(r.URL.Path, "/api/"+v.name+"/")
+			if !ok || v.deprecated.IsZero() {
+				continue
+			}
+			h := w.Header()
+			h.Set("Deprecation", "@"+strconv.FormatInt(v.deprecated.Unix(), 10))
+			if !v.sunset.IsZero() {
+				h.Set("Sunset", v.sunset.Format(http.TimeFormat))
+			}
+			h.Add("Link", fmt.Sprintf(`</api/%s/%s>; rel="successor-version"`, newest.name, rest))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiVersionGone answers every request to a version switched off with -api-disable.
+func apiVersionGone(v apiVersion) http.HandlerFunc {
+	newest := newestAPIVersion()
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, r, http.StatusGone, errCodeVersionGone,
+			fmt.Sprintf("API %s is switched off on this server, use %s", v.name, newest.name),
+			map[string]string{"version": v.name, "newest": newest.name})
+	}
+}
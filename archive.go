@@ -0,0 +1,347 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// archiveEntry is a file that goes into a folder download.
+type archiveEntry struct {
+	rel  string // in the content tree
+	name string // in the archive
+	info fs.FileInfo
+}
+
+// archiveFiles lists what a download of dir holds for email: what the listings
+// would show them, down every folder they may open. With picked only those
+// entries of dir go in, names that aren't there (anymore) are left out. Consus'
+// own folders in the content stay out, like for the content check. Nothing is
+// read yet, so the list is quick to make before the first byte goes out.
+func archiveFiles(db *sql.DB, content *contentFS, skip map[string]bool, email, dir string, picked []string) ([]archiveEntry, error) {
+	var files []archiveEntry
+	var walk func(rel, name string, depth int) error
+	// add puts the entry rel in the archive as name, a folder with all in it
+	add := func(rel, name string, info fs.FileInfo, depth int) error {
+		if full := content.abs(rel); full != "" {
+			if abs, _ := filepath.Abs(full); skip[abs] {
+				return nil
+			}
+		}
+		if content.ignore.hiddenEntry(rel, info.IsDir()) {
+			return nil
+		}
+		if ok, err := canAccessPath(db, email, rel); err != nil || !ok {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, archiveEntry{rel: rel, name: name, info: info})
+		} else if depth < scanMaxDepth {
+			// the limit also ends loops of symlinked folders
+			return walk(rel, name, depth+1)
+		}
+		return nil
+	}
+	walk = func(rel, name string, depth int) error {
+		entries, err := content.readDir(rel)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			entryRel := path.Join(rel, e.Name())
+			info, err := e.Info()
+			if e.Type()&fs.ModeSymlink != 0 {
+				if content.linkRefused(entryRel) {
+					continue
+				}
+				info, err = content.stat(entryRel)
+			}
+			if err != nil {
+				// broken links and files gone since the listing
+				continue
+			}
+			if err := add(entryRel, path.Join(name, e.Name()), info, depth); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	top, depth := archiveName(dir), folderDepth(dir)
+	if picked == nil {
+		return files, walk(dir, top, depth)
+	}
+	seen := map[string]bool{}
+	for _, name := range picked {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			continue
+		}
+		rel, err := content.resolve(path.Join(dir, name))
+		if err != nil || seen[rel] || content.linkRefused(rel) {
+			continue
+		}
+		seen[rel] = true
+		info, err := content.stat(rel)
+		if err != nil {
+			continue
+		}
+		if err := add(rel, path.Join(top, path.Base(rel)), info, depth); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// archiveName is what the archive of dir and the folder in it are called.
+func archiveName(dir string) string {
+	if dir = cleanRel(dir); dir != "" {
+		return path.Base(dir)
+	}
+	return "consus"
+}
+
+// folderEstimate is roughly what a download of a folder comes to, from what the
+// content check last saw. It counts what's hidden or restricted too, the
+// archive itself only holds what the one downloading it may see.
+type folderEstimate struct {
+	Files int
+	Bytes int64
+}
+
+func estimateFolder(db *sql.DB, dir string) (*folderEstimate, error) {
+	var est folderEstimate
+	dir = cleanRel(dir)
+	err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM content_index
+		WHERE is_dir = 0 AND (? = '' OR substr(path, 1, length(?) + 1) = ? || '/')`, dir, dir, dir).Scan(&est.Files, &est.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if est.Files == 0 {
+		// not scanned yet, or empty
+		return nil, nil
+	}
+	return &est, nil
+}
+
+// archiveWriter is a download being written, as zip or tar.gz.
+type archiveWriter interface {
+	// create starts the next file, size has to be right for tar
+	create(name string, info fs.FileInfo, size int64) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+// create stores files, not compresses them, media doesn't get smaller anyway.
+func (a zipArchive) create(name string, info fs.FileInfo, size int64) (io.Writer, error) {
+	h := &zip.FileHeader{Name: name, Method: zip.Store, Modified: info.ModTime()}
+	h.SetMode(info.Mode().Perm())
+	return a.CreateHeader(h)
+}
+
+// tarArchive keeps modes, and files of any size in any tar. It compresses
+// with the fastest level, what's worth compressing compresses well with it.
+type tarArchive struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func newTarArchive(w io.Writer) tarArchive {
+	gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	return tarArchive{tw: tar.NewWriter(gz), gz: gz}
+}
+
+func (a tarArchive) create(name string, info fs.FileInfo, size int64) (io.Writer, error) {
+	h := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: int64(info.Mode().Perm()), ModTime: info.ModTime()}
+	if err := a.tw.WriteHeader(h); err != nil {
+		return nil, err
+	}
+	return a.tw, nil
+}
+
+func (a tarArchive) Close() error {
+	err := a.tw.Close()
+	if gerr := a.gz.Close(); err == nil {
+		err = gerr
+	}
+	return err
+}
+
+// archiveFormats are the ?format= a folder download comes in, zip without.
+var archiveFormats = map[string]struct {
+	ext, ctype string
+	open       func(io.Writer) archiveWriter
+	// size is about how big the archive of files gets, before compression
+	size func([]archiveEntry) int64
+}{
+	"zip":   {".zip", "application/zip", func(w io.Writer) archiveWriter { return zipArchive{zip.NewWriter(w)} }, zipSize},
+	"targz": {".tar.gz", "application/gzip", func(w io.Writer) archiveWriter { return newTarArchive(w) }, tarSize},
+}
+
+// folderArchive is /zip/path/: the folder with everything below it as one
+// archive, written while it goes out. A POST with the names of some of its
+// entries, from the checkboxes of the listing, only gets those. The comments
+// of the files come along, unless comments=no. A HEAD tells the size to
+// expect in X-Estimated-Size.
+func folderArchive(db *sql.DB, content *contentFS, wmr *watermarker, scanner *contentScanner, commentPath string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel := cleanRel(strings.TrimPrefix(r.URL.Path, "/zip/"))
+		var picked []string
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+			if picked = r.PostForm["name"]; len(picked) == 0 {
+				http.Error(w, "tick the files to download first", http.StatusBadRequest)
+				return
+			}
+		}
+		format := r.FormValue("format")
+		if format == "" {
+			format = "zip"
+		}
+		kind, ok := archiveFormats[format]
+		if !ok {
+			http.Error(w, "format is zip or targz", http.StatusBadRequest)
+			return
+		}
+		info, err := content.stat(rel)
+		if err != nil || !info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		email := emailFromRequest(r)
+		files, err := archiveFiles(db, content, scanner.skipped(), email, rel, picked)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		withComments := commentPath != "" && r.FormValue("comments") != "no"
+		reviewCopies := wmr.defaults.Enabled() && !roleAtLeast(roleFromRequest(db, r), roleEditor)
+
+		w.Header().Set("Content-Type", kind.ctype)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName(rel) + kind.ext}))
+		w.Header().Set("X-Estimated-Size", strconv.FormatInt(kind.size(files), 10))
+		if r.Method == http.MethodHead {
+			return
+		}
+		detail := fmt.Sprintf("%d files as %s", len(files), format)
+		if picked != nil {
+			detail += ", picked"
+		}
+		audit(db, r, email, auditFolderZip, rel, detail)
+
+		aw := kind.open(downloads.writer(w, r))
+		for _, f := range files {
+			sched.yield(r.Context())
+			err := addArchiveFile(aw, content, wmr, f, reviewCopies && isWatermarkable(f.rel))
+			if err == nil && withComments {
+				err = addArchiveComments(aw, commentPath, f)
+			}
+			if err != nil {
+				// the status is long gone, a cut off archive is all the client notices
+				if r.Context().Err() == nil {
+					log.Printf("archive %s: %v", rel, err)
+				}
+				return
+			}
+		}
+		if err := aw.Close(); err != nil {
+			log.Printf("%s", err.Error())
+		}
+	}
+}
+
+// zipSize counts what is in the files and the headers of every one. Review
+// copies and comments make it off a bit.
+func zipSize(files []archiveEntry) int64 {
+	size := int64(22) // end of the central directory
+	for _, f := range files {
+		// local header, data descriptor and central directory entry, each
+		// with an extended timestamp
+		size += f.info.Size() + 30 + 16 + 46 + 2*(int64(len(f.name))+9)
+	}
+	return size
+}
+
+// tarSize is the same for a tar, long names and big files add a bit more.
+func tarSize(files []archiveEntry) int64 {
+	size := int64(1024) // two empty blocks at the end
+	for _, f := range files {
+		size += 512 + (f.info.Size()+511)/512*512
+	}
+	return size
+}
+
+func addArchiveFile(aw archiveWriter, content *contentFS, wmr *watermarker, f archiveEntry, reviewCopy bool) error {
+	if reviewCopy {
+		data, err := wmr.copy(content, f.rel, f.info, wmr.defaults)
+		if err != nil {
+			return err
+		}
+		out, err := aw.create(f.name, f.info, int64(len(data)))
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	}
+	chaosDisk()
+	in, err := content.open(f.rel)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := aw.create(f.name, f.info, f.info.Size())
+	if err != nil {
+		return err
+	}
+	// a file growing meanwhile is cut at the size it had, tar can't hold more
+	_, err = io.CopyN(out, in, f.info.Size())
+	return err
+}
+
+// addArchiveComments adds the comments on f, without the deleted ones, to a
+// .comments folder at the top of the archive laid out like the one on the
+// server.
+func addArchiveComments(aw archiveWriter, commentPath string, f archiveEntry) error {
+	comments, err := loadComments(filepath.Join(commentPath, filepath.FromSlash(f.rel)))
+	if err != nil || len(comments) == 0 {
+		return err
+	}
+	data, err := json.Marshal(CommentFilev1{Comments: comments})
+	if err != nil {
+		return err
+	}
+	top, rest, _ := strings.Cut(f.name, "/")
+	out, err := aw.create(path.Join(top, ".comments", rest), commentInfo{f.info}, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+// commentInfo is a comment file in an archive, readable rather than with the
+// mode of the file it is about.
+type commentInfo struct {
+	fs.FileInfo
+}
+
+func (commentInfo) Mode() fs.FileMode { return 0o644 }
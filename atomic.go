@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Everything Consus writes, uploads, comments, cached review copies and its own
+// files, goes through pendingFile: written to a temporary file next to the
+// real one, flushed to the disk and renamed over it. A crash or a full disk
+// leaves the old version or the new one, never half of one. What a crash
+// leaves behind is called .tmp-something and cleared away later.
+const tmpPrefix = ".tmp-"
+
+// tmpStale is how old a temporary file in the content has to be to count as
+// left behind, a younger one may be an upload of another instance.
+const tmpStale = time.Hour
+
+// pendingFile is the new version of a file being written. Close puts it in
+// place, abort throws it away.
+type pendingFile struct {
+	*os.File
+	dest   string
+	mode   fs.FileMode
+	broken bool // the upload broke off, Close aborts
+}
+
+func newPendingFile(dest string, mode fs.FileMode) (*pendingFile, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(dest), tmpPrefix+"*")
+	if err != nil {
+		return nil, disks.noticed(dest, err)
+	}
+	return &pendingFile{File: tmp, dest: dest, mode: mode}, nil
+}
+
+func (p *pendingFile) Close() error {
+	if p.broken {
+		p.abort()
+		return errors.New("upload broke off")
+	}
+	if err := p.flush(); err != nil {
+		return err
+	}
+	return p.place()
+}
+
+// flush gets what was written onto the disk, so the new name never points at
+// an empty file after a power cut. Only place is left to do after it.
+func (p *pendingFile) flush() error {
+	err := p.File.Sync()
+	if err == nil {
+		err = p.File.Chmod(p.mode)
+	}
+	if cerr := p.File.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(p.File.Name())
+		return disks.noticed(p.dest, err)
+	}
+	return nil
+}
+
+// place renames the flushed file over dest.
+func (p *pendingFile) place() error {
+	if err := os.Rename(p.File.Name(), p.dest); err != nil {
+		os.Remove(p.File.Name())
+		return disks.noticed(p.dest, err)
+	}
+	syncDir(filepath.Dir(p.dest))
+	return nil
+}
+
+// TransferError is how SFTP tells about a connection lost during an upload.
+func (p *pendingFile) TransferError(error) {
+	p.broken = true
+}
+
+func (p *pendingFile) abort() {
+	p.File.Close()
+	os.Remove(p.File.Name())
+}
+
+// syncDir makes a rename in dir stick. Not every system can sync a folder,
+// there the rename is as safe as it gets anyway.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// writeFile replaces name with data.
+func writeFile(name string, data []byte, perm os.FileMode) error {
+	p, err := newPendingFile(name, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := chaosWrite(p, data); err != nil {
+		p.abort()
+		return disks.noticed(name, err)
+	}
+	return p.Close()
+}
+
+// isLeftover tells whether name is a temporary file nobody is writing anymore.
+func isLeftover(name string, info fs.FileInfo, age time.Duration) bool {
+	return strings.HasPrefix(name, tmpPrefix) && info.Mode().IsRegular() && time.Since(info.ModTime()) >= age
+}
+
+// removeLeftovers deletes the temporary files below dir that a crash left.
+// Only call it for folders that are Consus' alone, before it writes there.
+func removeLeftovers(dir string) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), tmpPrefix) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && isLeftover(d.Name(), info, 0) {
+			if err := os.Remove(p); err == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
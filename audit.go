@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The audit log answers "who did what, when and from where". It is append-only,
+// the database refuses to change or delete rows, so an admin cannot tidy up
+// after themselves either.
+
+const (
+	auditLogin         = "login"
+	auditLoginFailed   = "login.failed"
+	auditLogoutAll     = "logout.all"
+	auditRegister      = "register"
+	auditResetRequest  = "password.reset.request"
+	auditReset         = "password.reset"
+	auditRoleChange    = "user.role"
+	auditStorageQuota  = "user.quota"
+	auditCommentAdd    = "comment.add"
+	auditCommentDelete = "comment.delete"
+	auditShareCreate   = "share.create"
+	auditShareRenew    = "share.renew"
+	auditShareRevoke   = "share.revoke"
+	auditShareAccept   = "share.accept"
+
+	auditAnnouncementPost   = "announcement.post"
+	auditAnnouncementDelete = "announcement.delete"
+	auditTermsAccept        = "terms.accept"
+	auditLicenseSet         = "license.set"
+	auditFilePut            = "file.put"
+	auditFileDelete         = "file.delete"
+	auditFileCopy           = "file.copy"
+	auditFileMove           = "file.move"
+	auditFolderCreate       = "folder.create"
+	auditFolderZip          = "folder.zip"
+	auditTrashRestore       = "trash.restore"
+	auditTrashPurge         = "trash.purge"
+)
+
+var auditActions = []string{
+	auditLogin, auditLoginFailed, auditLogoutAll, auditRegister, auditResetRequest, auditReset, auditRoleChange, auditStorageQuota, auditCommentAdd, auditCommentDelete,
+	auditShareCreate, auditShareRenew, auditShareRevoke, auditShareAccept, auditAnnouncementPost, auditAnnouncementDelete,
+	auditTermsAccept, auditLicenseSet, auditFilePut, auditFileDelete, auditFileCopy, auditFileMove, auditFolderCreate, auditFolderZip,
+	auditTrashRestore, auditTrashPurge,
+}
+
+type AuditEntry struct {
+	ID         int64     `json:"id"`
+	At         time.Time `json:"at"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target"`
+	Detail     string    `json:"detail,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// audit records an action taken by actor. Like notify it never fails the
+// request, a problem with the log only ends up in the server log.
+func audit(db *sql.DB, r *http.Request, actor, action, target, detail string) {
+	auditFrom(db, remoteIP(r), actor, action, target, detail)
+}
+
+// auditFrom is audit for what doesn't come in over HTTP, like SFTP.
+func auditFrom(db *sql.DB, ip, actor, action, target, detail string) {
+	_, err := db.Exec("INSERT INTO audit_log (at, actor, action, target, detail, remote_addr) VALUES (?, ?, ?, ?, ?, ?)",
+		time.Now(), actor, action, target, detail, ip)
+	if err != nil {
+		log.Printf("could not write audit log (%s %s %s): %v", actor, action, target, err)
+	}
+}
+
+// listAudit returns the newest entries first, optionally only those of one
+// actor or action. limit 0 means everything.
+func listAudit(db *sql.DB, actor, action string, limit int) ([]AuditEntry, error) {
+	query := "SELECT id, at, actor, action, target, detail, remote_addr FROM audit_log WHERE 1 = 1"
+	var args []any
+	if actor != "" {
+		query += " AND actor = ?"
+		args = append(args, actor)
+	}
+	if action != "" {
+		query += " AND action = ?"
+		args = append(args, action)
+	}
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.At, &e.Actor, &e.Action, &e.Target, &e.Detail, &e.RemoteAddr); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func renderAudit(tmpl *template.Template, db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, action := r.URL.Query().Get("actor"), r.URL.Query().Get("action")
+		entries, err := listAudit(db, actor, action, 500)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Version   string
+			UserEmail string
+			Entries   []AuditEntry
+			Actions   []string
+			Actor     string
+			Action    string
+		}{
+			Version:   GetVersion(),
+			UserEmail: emailFromRequest(r),
+			Entries:   entries,
+			Actions:   auditActions,
+			Actor:     actor,
+			Action:    action,
+		}
+		if err := tmpl.ExecuteTemplate(w, "audit.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// auditExport streams the whole log, oldest first, as one JSON object per line
+// for shipping it off to wherever logs are kept.
+func auditExport(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := listAudit(db, r.URL.Query().Get("actor"), r.URL.Query().Get("action"), 0)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="consus-audit.jsonl"`)
+		enc := json.NewEncoder(w)
+		for i := len(entries) - 1; i >= 0; i-- {
+			if err := enc.Encode(entries[i]); err != nil {
+				log.Printf("%s", err.Error())
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	connLimiterKey contextKey = "conn-limiter"
+	// throttleChunk is how much a throttled download writes between waits
+	throttleChunk = 32 << 10
+)
+
+// rateLimiter is a token bucket counting bytes. Writers reserve what they are
+// about to send and sleep off any debt, so the average stays at rate no matter
+// how many share it.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	burst := max(float64(rate)/4, throttleChunk)
+	return &rateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseRate reads rates like 10MB/s or 512KB, 0 or "" for no limit.
+func parseRate(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := parseSize(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q, use something like 10MB/s", s)
+	}
+	return n, nil
+}
+
+// bandwidth caps what file downloads send, over all of them and per connection.
+// Pages and everything else are never held back.
+type bandwidth struct {
+	total   *rateLimiter // nil for no cap
+	perConn int64        // bytes per second, 0 for no cap
+}
+
+// downloads is set up by NewMainServer.
+var downloads bandwidth
+
+// connContext gives every connection its own bucket, so several parallel
+// requests by a download manager still share one limit each.
+func (b *bandwidth) connContext(ctx context.Context, c net.Conn) context.Context {
+	if b.perConn == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, connLimiterKey, newRateLimiter(b.perConn))
+}
+
+// writer wraps w for sending a file, throttled as configured.
+func (b *bandwidth) writer(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	var limiters []*rateLimiter
+	if l, ok := r.Context().Value(connLimiterKey).(*rateLimiter); ok {
+		limiters = append(limiters, l)
+	}
+	if b.total != nil {
+		limiters = append(limiters, b.total)
+	}
+	if len(limiters) == 0 {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiters: limiters}
+}
+
+// throttledWriter hides io.ReaderFrom on purpose, sendfile would bypass Write.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rateLimiter
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		for _, l := range tw.limiters {
+			if err := l.wait(tw.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
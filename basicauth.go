@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// basicAuth puts the whole server behind a single user name and password.
+// spec is "user:passhash" with a hash as produced by -hash-password.
+func basicAuth(spec string, next http.Handler) (http.Handler, error) {
+	user, hash, ok := strings.Cut(spec, ":")
+	if !ok || user == "" || !strings.HasPrefix(hash, "pbkdf2-sha256$") {
+		return nil, fmt.Errorf("basic auth must be user:passhash, generate the hash with -hash-password")
+	}
+
+	// checking the hash is deliberately slow, remember credentials that passed
+	// so every asset the browser fetches does not pay for it again
+	var verified sync.Map
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 {
+			key := sha256.Sum256([]byte(u + "\x00" + p))
+			if _, hit := verified.Load(key); hit {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if checkPassword(hash, p) {
+				verified.Store(key, struct{}{})
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="Consus", charset="UTF-8"`)
+		failRequest(w, r, http.StatusUnauthorized, errCodeUnauthorized, "authentication required")
+	}), nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// BLAKE3, the plain 32 byte hash only, after the reference implementation.
+// Neither the standard library nor x/crypto have it, and checksums are all
+// Consus needs it for, so it doesn't pull in a module with assembly for it.
+
+const (
+	blake3ChunkLen = 1024
+	blake3BlockLen = 64
+
+	blake3ChunkStart = 1 << 0
+	blake3ChunkEnd   = 1 << 1
+	blake3Parent     = 1 << 2
+	blake3Root       = 1 << 3
+)
+
+var blake3IV = [8]uint32{0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3G(s *[16]uint32, a, b, c, d int, x, y uint32) {
+	s[a] += s[b] + x
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + y
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func blake3Compress(cv [8]uint32, m [16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	for round := 0; round < 7; round++ {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+		var permuted [16]uint32
+		for i, j := range blake3Permutation {
+			permuted[i] = m[j]
+		}
+		m = permuted
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+func blake3Words(block []byte) [16]uint32 {
+	var padded [blake3BlockLen]byte
+	copy(padded[:], block)
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(padded[i*4:])
+	}
+	return m
+}
+
+// blake3Output is a node of the tree before it is known whether it's the root.
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o blake3Output) chainingValue() [8]uint32 {
+	var cv [8]uint32
+	s := blake3Compress(o.cv, o.block, o.counter, o.blockLen, o.flags)
+	copy(cv[:], s[:8])
+	return cv
+}
+
+func blake3ParentOutput(left, right [8]uint32) blake3Output {
+	o := blake3Output{cv: blake3IV, blockLen: blake3BlockLen, flags: blake3Parent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+type blake3Chunk struct {
+	cv         [8]uint32
+	counter    uint64
+	block      [blake3BlockLen]byte
+	blockLen   int
+	compressed int // blocks
+}
+
+func (c *blake3Chunk) len() int {
+	return c.compressed*blake3BlockLen + c.blockLen
+}
+
+func (c *blake3Chunk) startFlag() uint32 {
+	if c.compressed == 0 {
+		return blake3ChunkStart
+	}
+	return 0
+}
+
+func (c *blake3Chunk) write(p []byte) {
+	for len(p) > 0 {
+		if c.blockLen == blake3BlockLen {
+			s := blake3Compress(c.cv, blake3Words(c.block[:]), c.counter, blake3BlockLen, c.startFlag())
+			copy(c.cv[:], s[:8])
+			c.compressed++
+			c.block = [blake3BlockLen]byte{}
+			c.blockLen = 0
+		}
+		n := copy(c.block[c.blockLen:], p)
+		c.blockLen += n
+		p = p[n:]
+	}
+}
+
+func (c *blake3Chunk) output() blake3Output {
+	return blake3Output{
+		cv:       c.cv,
+		block:    blake3Words(c.block[:c.blockLen]),
+		counter:  c.counter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.startFlag() | blake3ChunkEnd,
+	}
+}
+
+type blake3Hash struct {
+	chunk blake3Chunk
+	stack [][8]uint32 // chaining values of complete subtrees
+}
+
+func newBLAKE3() hash.Hash {
+	h := &blake3Hash{}
+	h.Reset()
+	return h
+}
+
+func (h *blake3Hash) Reset() {
+	h.chunk = blake3Chunk{cv: blake3IV}
+	h.stack = h.stack[:0]
+}
+
+func (h *blake3Hash) Size() int      { return 32 }
+func (h *blake3Hash) BlockSize() int { return blake3BlockLen }
+
+func (h *blake3Hash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if h.chunk.len() == blake3ChunkLen {
+			cv := h.chunk.output().chainingValue()
+			total := h.chunk.counter + 1
+			// every complete pair of subtrees folds into their parent
+			for total&1 == 0 {
+				cv = blake3ParentOutput(h.stack[len(h.stack)-1], cv).chainingValue()
+				h.stack = h.stack[:len(h.stack)-1]
+				total >>= 1
+			}
+			h.stack = append(h.stack, cv)
+			h.chunk = blake3Chunk{cv: blake3IV, counter: h.chunk.counter + 1}
+		}
+		take := min(blake3ChunkLen-h.chunk.len(), len(p))
+		h.chunk.write(p[:take])
+		p = p[take:]
+	}
+	return n, nil
+}
+
+func (h *blake3Hash) Sum(b []byte) []byte {
+	o := h.chunk.output()
+	for i := len(h.stack) - 1; i >= 0; i-- {
+		o = blake3ParentOutput(h.stack[i], o.chainingValue())
+	}
+	s := blake3Compress(o.cv, o.block, 0, o.blockLen, o.flags|blake3Root)
+	for _, w := range s[:8] {
+		b = binary.LittleEndian.AppendUint32(b, w)
+	}
+	return b
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	breakerFailures = 5 // failures in a row that open a breaker
+	breakerCooldown = 30 * time.Second
+)
+
+var errUnavailable = errors.New("not answering, try again later")
+
+// breaker guards calls to a service Consus doesn't control: the LDAP and SMTP
+// servers, login providers, Redis. Every call gets a deadline, and after
+// breakerFailures failures in a row the breaker opens: calls fail at once with
+// errUnavailable for breakerCooldown, then a single trial call decides whether
+// it closes again. A dead directory server then costs a log line instead of a
+// goroutine per login attempt waiting on it.
+type breaker struct {
+	name    string
+	timeout time.Duration
+	// answered tells errors that are a proper answer, like a wrong password,
+	// from the service failing. nil counts every error.
+	answered func(error) bool
+
+	mu       sync.Mutex
+	failures int
+	until    time.Time // open until then once failures reached breakerFailures
+	probing  bool
+}
+
+// breakers are all that were made, for /metrics.
+var breakers struct {
+	sync.Mutex
+	list []*breaker
+}
+
+func newBreaker(name string, timeout time.Duration, answered func(error) bool) *breaker {
+	b := &breaker{name: name, timeout: timeout, answered: answered}
+	breakers.Lock()
+	breakers.list = append(breakers.list, b)
+	breakers.Unlock()
+	return b
+}
+
+// call runs fn with a context that runs out after the timeout. fn has to give
+// up by then on its own, with the context or a deadline of its connection.
+func (b *breaker) call(ctx context.Context, fn func(context.Context) error) error {
+	b.mu.Lock()
+	if b.failures >= breakerFailures {
+		if b.probing || time.Now().Before(b.until) {
+			b.mu.Unlock()
+			return fmt.Errorf("%s: %w", b.name, errUnavailable)
+		}
+		b.probing = true
+	}
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	err := fn(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil || b.answered != nil && b.answered(err) {
+		if b.failures >= breakerFailures {
+			log.Printf("%s is answering again", b.name)
+		}
+		b.failures = 0
+		return err
+	}
+	b.failures++
+	if b.failures >= breakerFailures {
+		b.until = time.Now().Add(breakerCooldown)
+		log.Printf("%s failed %d times in a row, leaving it alone for %s: %v", b.name, b.failures, breakerCooldown, err)
+	}
+	return err
+}
+
+// open tells whether calls are being refused right now.
+func (b *breaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= breakerFailures && time.Now().Before(b.until)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache keeps generated bytes around, keyed by whatever identifies their input.
+// Caches are best effort: a failing backend is a miss, never an error.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+}
+
+// cacheConfig is parsed from a flag like "memory?size=8MB&ttl=10m", "disk",
+// "redis://:password@host:6379/0?ttl=1h" or "off".
+type cacheConfig struct {
+	Kind string
+	Size int64         // bytes, 0 for no limit
+	TTL  time.Duration // 0 for no expiry
+	URL  *url.URL      // redis only
+}
+
+func parseCacheConfig(spec string) (cacheConfig, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return cacheConfig{}, fmt.Errorf("invalid cache %q: %w", spec, err)
+	}
+	cfg := cacheConfig{Kind: u.Path}
+	if u.Scheme != "" {
+		cfg.Kind, cfg.URL = u.Scheme, u
+	}
+	switch cfg.Kind {
+	case "", "off", "memory", "disk", "redis":
+	default:
+		return cacheConfig{}, fmt.Errorf("unknown cache %q, use memory, disk, redis://host:port or off", spec)
+	}
+
+	q := u.Query()
+	if s := q.Get("size"); s != "" {
+		if cfg.Size, err = parseSize(s); err != nil {
+			return cacheConfig{}, fmt.Errorf("invalid cache size %q", s)
+		}
+	}
+	if s := q.Get("ttl"); s != "" {
+		if cfg.TTL, err = time.ParseDuration(s); err != nil {
+			return cacheConfig{}, fmt.Errorf("invalid cache ttl %q", s)
+		}
+	}
+	return cfg, nil
+}
+
+// parseSize reads sizes like 512KB, 64MB or 2GB, plain numbers are bytes.
+func parseSize(s string) (int64, error) {
+	unit := int64(1)
+	for _, u := range []struct {
+		suffix string
+		factor int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}} {
+		if strings.HasSuffix(strings.ToUpper(s), u.suffix) {
+			s, unit = s[:len(s)-len(u.suffix)], u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	return n * unit, err
+}
+
+// openCache builds the cache called name. dir is where a disk cache keeps its files.
+func openCache(name, spec, dir string) (*meteredCache, error) {
+	cfg, err := parseCacheConfig(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%s cache: %w", name, err)
+	}
+
+	mc := &meteredCache{name: name, spec: spec}
+	switch cfg.Kind {
+	case "memory":
+		mc.backend = newMemoryCache(cfg.Size, cfg.TTL)
+	case "disk":
+		mc.backend = &diskCache{dir: filepath.Join(dir, name), size: cfg.Size, ttl: cfg.TTL}
+	case "redis":
+		mc.backend = newRedisCache(cfg.URL, "consus:"+name+":", cfg.TTL)
+	}
+	return mc, nil
+}
+
+// meteredCache counts hits and misses for /metrics. A nil backend caches nothing.
+type meteredCache struct {
+	name      string
+	spec      string
+	backend   Cache
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	coalesced atomic.Uint64 // misses that waited for somebody else computing the same key
+
+	mu     sync.Mutex
+	flying map[string]*flight
+}
+
+// flight is one computation other callers can wait for.
+type flight struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+func (mc *meteredCache) Get(key string) ([]byte, bool) {
+	if mc.backend == nil {
+		return nil, false
+	}
+	value, ok := mc.backend.Get(key)
+	if ok {
+		mc.hits.Add(1)
+	} else {
+		mc.misses.Add(1)
+	}
+	return value, ok
+}
+
+func (mc *meteredCache) Set(key string, value []byte) {
+	if mc.backend != nil {
+		mc.backend.Set(key, value)
+	}
+}
+
+// fetch returns the value under key, computing and storing it on a miss. A
+// crowd asking for the same missing key at once gets one computation, the
+// others wait for its result, errors included.
+func (mc *meteredCache) fetch(key string, compute func() ([]byte, error)) ([]byte, error) {
+	if value, ok := mc.Get(key); ok {
+		return value, nil
+	}
+
+	mc.mu.Lock()
+	if f, ok := mc.flying[key]; ok {
+		mc.mu.Unlock()
+		mc.coalesced.Add(1)
+		<-f.done
+		return f.value, f.err
+	}
+	if mc.flying == nil {
+		mc.flying = map[string]*flight{}
+	}
+	f := &flight{done: make(chan struct{})}
+	mc.flying[key] = f
+	mc.mu.Unlock()
+
+	f.value, f.err = compute()
+	if f.err == nil {
+		mc.Set(key, f.value)
+	}
+	mc.mu.Lock()
+	delete(mc.flying, key)
+	mc.mu.Unlock()
+	close(f.done)
+	return f.value, f.err
+}
+
+// memoryCache is an LRU bounded by the bytes it holds.
+type memoryCache struct {
+	mu      sync.Mutex
+	size    int64
+	ttl     time.Duration
+	used    int64
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryCache(size int64, ttl time.Duration) *memoryCache {
+	return &memoryCache{size: size, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (mc *memoryCache) Get(key string) ([]byte, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	el, ok := mc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*memoryEntry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		mc.remove(el)
+		return nil, false
+	}
+	mc.order.MoveToFront(el)
+	return e.value, true
+}
+
+func (mc *memoryCache) Set(key string, value []byte) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if el, ok := mc.entries[key]; ok {
+		mc.remove(el)
+	}
+	cost := int64(len(key) + len(value))
+	if mc.size > 0 && cost > mc.size {
+		return
+	}
+
+	e := &memoryEntry{key: key, value: value}
+	if mc.ttl > 0 {
+		e.expires = time.Now().Add(mc.ttl)
+	}
+	mc.entries[key] = mc.order.PushFront(e)
+	mc.used += cost
+	for mc.size > 0 && mc.used > mc.size {
+		mc.remove(mc.order.Back())
+	}
+}
+
+func (mc *memoryCache) remove(el *list.Element) {
+	e := mc.order.Remove(el).(*memoryEntry)
+	delete(mc.entries, e.key)
+	mc.used -= int64(len(e.key) + len(e.value))
+}
+
+// diskCache keeps one file per key below dir. The size limit is enforced by
+// dropping the least recently written files after a write pushed it over.
+type diskCache struct {
+	dir  string
+	size int64
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	used    int64 // estimate between trims
+	counted bool  // used has been measured once
+}
+
+func (dc *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(dc.dir, name[:2], name)
+}
+
+func (dc *diskCache) Get(key string) ([]byte, bool) {
+	p := dc.path(key)
+	if dc.ttl > 0 {
+		info, err := os.Stat(p)
+		if err != nil || time.Since(info.ModTime()) > dc.ttl {
+			return nil, false
+		}
+	}
+	value, err := os.ReadFile(p)
+	return value, err == nil
+}
+
+func (dc *diskCache) Set(key string, value []byte) {
+	p := dc.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		log.Printf("cache: %v", err)
+		return
+	}
+	if disks.room(p) != nil {
+		// served without being kept until there is room again
+		return
+	}
+	// readers never see half a file
+	if err := writeFile(p, value, 0o600); err != nil {
+		log.Printf("cache: %v", err)
+		return
+	}
+
+	if dc.size > 0 {
+		dc.mu.Lock()
+		dc.used += int64(len(value))
+		if !dc.counted || dc.used > dc.size {
+			dc.used, dc.counted = dc.trim(), true
+		}
+		dc.mu.Unlock()
+	}
+}
+
+// trim deletes the oldest files until the cache fits in size again and returns
+// what is left.
+func (dc *diskCache) trim() int64 {
+	type file struct {
+		path string
+		size int64
+		mod  time.Time
+	}
+	var files []file
+	var used int64
+	filepath.WalkDir(dc.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, file{path, info.Size(), info.ModTime()})
+			used += info.Size()
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.Before(files[j].mod) })
+	for _, f := range files {
+		if used <= dc.size {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			used -= f.size
+		}
+	}
+	return used
+}
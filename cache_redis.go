@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisCache speaks just enough of the Redis protocol for GET and SET over a
+// single connection, which is plenty for a cache shared by a few instances.
+type redisCache struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	conn    net.Conn
+	rd      *bufio.Reader
+	breaker *breaker
+}
+
+func newRedisCache(u *url.URL, prefix string, ttl time.Duration) *redisCache {
+	rc := &redisCache{addr: u.Host, prefix: prefix, ttl: ttl}
+	if !strings.Contains(rc.addr, ":") {
+		rc.addr += ":6379"
+	}
+	if u.User != nil {
+		rc.password, _ = u.User.Password()
+	}
+	rc.db, _ = strconv.Atoi(strings.Trim(u.Path, "/"))
+	// a cache that is down is only a miss, so it gets no longer than a command takes
+	rc.breaker = newBreaker("redis "+strings.TrimSuffix(prefix, ":"), 2*time.Second, func(err error) bool {
+		var replyErr redisError
+		return errors.As(err, &replyErr)
+	})
+	return rc
+}
+
+func (rc *redisCache) Get(key string) ([]byte, bool) {
+	value, err := rc.do("GET", rc.prefix+key)
+	if err != nil {
+		if !errors.Is(err, errUnavailable) {
+			log.Printf("redis cache: %v", err)
+		}
+		return nil, false
+	}
+	return value, value != nil
+}
+
+func (rc *redisCache) Set(key string, value []byte) {
+	args := []string{"SET", rc.prefix + key, string(value)}
+	if rc.ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(rc.ttl.Milliseconds(), 10))
+	}
+	if _, err := rc.do(args...); err != nil && !errors.Is(err, errUnavailable) {
+		log.Printf("redis cache: %v", err)
+	}
+}
+
+// do sends one command and reads its reply, reconnecting once if the old
+// connection went away. A nil reply comes back as nil, nil.
+func (rc *redisCache) do(args ...string) (reply []byte, err error) {
+	err = rc.breaker.call(context.Background(), func(context.Context) error {
+		reply, err = rc.send(args...)
+		return err
+	})
+	return reply, err
+}
+
+func (rc *redisCache) send(args ...string) ([]byte, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if rc.conn == nil {
+			if err := rc.connect(); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := rc.roundTrip(args...)
+		var replyErr redisError
+		if err == nil || errors.As(err, &replyErr) || attempt == 1 {
+			return reply, err
+		}
+		rc.conn.Close()
+		rc.conn = nil
+	}
+}
+
+func (rc *redisCache) connect() error {
+	conn, err := net.DialTimeout("tcp", rc.addr, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	rc.conn, rc.rd = conn, bufio.NewReader(conn)
+	if rc.password != "" {
+		if _, err := rc.roundTrip("AUTH", rc.password); err != nil {
+			rc.conn.Close()
+			rc.conn = nil
+			return err
+		}
+	}
+	if rc.db != 0 {
+		if _, err := rc.roundTrip("SELECT", strconv.Itoa(rc.db)); err != nil {
+			rc.conn.Close()
+			rc.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func (rc *redisCache) roundTrip(args ...string) ([]byte, error) {
+	rc.conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	line, err := rc.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
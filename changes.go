@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// changePoll is how often a waiting client's folder is looked at when no
+	// watcher tells about changes, changePollWatched when one does
+	changePoll        = 2 * time.Second
+	changePollWatched = 30 * time.Second
+	changeWaitMax     = 60 * time.Second
+	// sseKeepAlive keeps proxies from closing an idle event stream
+	sseKeepAlive = 25 * time.Second
+)
+
+// changeFeed wakes up whoever waits for a folder when the watcher sees
+// something happen in it.
+type changeFeed struct {
+	mu      sync.Mutex
+	waiting map[string]chan struct{}
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{waiting: map[string]chan struct{}{}}
+}
+
+// wait returns a channel that is closed on the next change in dir.
+func (f *changeFeed) wait(dir string) <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch, ok := f.waiting[dir]
+	if !ok {
+		ch = make(chan struct{})
+		f.waiting[dir] = ch
+	}
+	return ch
+}
+
+func (f *changeFeed) publish(dir string) {
+	if f == nil {
+		return
+	}
+	dir = cleanRel(dir)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ch, ok := f.waiting[dir]; ok {
+		close(ch)
+		delete(f.waiting, dir)
+	}
+}
+
+// onFileAdded wakes up whoever waits for the folder of a file added or moved
+// through Consus, here or on another instance on the same storage, and puts
+// it in the index where no watcher does. Buckets tell nobody otherwise. A move
+// changes the folder it left too.
+func (f *changeFeed) onFileAdded(scanner *contentScanner) func(event) error {
+	return func(e event) error {
+		dirs := []string{cleanRel(path.Dir(e.Path))}
+		if from, ok := e.Data["from"]; ok {
+			dirs = append(dirs, cleanRel(path.Dir(from)))
+		}
+		for i, dir := range dirs {
+			f.publish(dir)
+			if dir == "" {
+				dirs[i] = "."
+			}
+		}
+		if !scanner.watched.Load() {
+			scanner.update(dirs, nil)
+		}
+		return nil
+	}
+}
+
+// folderVersion sums up what a listing of dir shows: names, sizes and mtimes
+// of what isn't hidden. It changes whenever the listing would.
+func folderVersion(content *contentFS, dir string) (string, error) {
+	entries, err := content.readDir(dir)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, e := range entries {
+		if content.ignore.hiddenEntry(path.Join(dir, e.Name()), e.IsDir()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00%t\x00%d\x00%d\n", e.Name(), e.IsDir(), info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8]), nil
+}
+
+type folderChange struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Changed bool   `json:"changed"`
+}
+
+// apiWatch is /api/v2/watch/path: it answers once the folder differs from
+// the version given as ?since=, or after ?timeout= seconds (30 by default) with
+// changed false. Clients asking for text/event-stream get an event for every
+// change instead, for as long as they stay, and "gone" when the folder is.
+func apiWatch(content *contentFS, feed *changeFeed, scanner *contentScanner) func(http.ResponseWriter, *http.Request) {
+	poll := func() time.Duration {
+		if scanner.watched.Load() {
+			return changePollWatched
+		}
+		return changePoll
+	}
+	// next waits for a change of dir away from version, false when the
+	// request is over first. The version of a folder that is gone is "".
+	next := func(r *http.Request, dir, version string, deadline <-chan time.Time) (string, bool) {
+		for {
+			woken := feed.wait(dir)
+			current, err := folderVersion(content, dir)
+			if err != nil || current != version {
+				return current, true
+			}
+			select {
+			case <-woken:
+			case <-time.After(poll()):
+			case <-deadline:
+				return version, false
+			case <-r.Context().Done():
+				return version, false
+			}
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel := cleanRel(strings.TrimPrefix(r.URL.Path, "/api/"+newestAPIVersion().name+"/watch/"))
+		info, err := content.stat(rel)
+		if err != nil || !info.IsDir() {
+			writeAPIError(w, r, http.StatusNotFound, errCodeNotFound, "no such folder", map[string]string{"path": rel})
+			return
+		}
+		version, err := folderVersion(content, rel)
+		if err != nil {
+			writeAPIError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error(), nil)
+			return
+		}
+
+		if r.Header.Get("Accept") == "text/event-stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("X-Accel-Buffering", "no")
+			rc := http.NewResponseController(w)
+			send := func(event string, c folderChange) bool {
+				data, _ := json.Marshal(c)
+				_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+				return err == nil && rc.Flush() == nil
+			}
+			if !send("version", folderChange{Path: rel, Version: version}) {
+				return
+			}
+			for {
+				current, ok := next(r, rel, version, time.After(sseKeepAlive))
+				if r.Context().Err() != nil {
+					return
+				}
+				if !ok {
+					if _, err := fmt.Fprint(w, ": still here\n\n"); err != nil || rc.Flush() != nil {
+						return
+					}
+					continue
+				}
+				version = current
+				if version == "" {
+					send("gone", folderChange{Path: rel, Changed: true})
+					return
+				}
+				if !send("change", folderChange{Path: rel, Version: version, Changed: true}) {
+					return
+				}
+			}
+		}
+
+		timeout := 30 * time.Second
+		if s, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && s >= 0 {
+			timeout = min(time.Duration(s)*time.Second, changeWaitMax)
+		}
+		since := r.URL.Query().Get("since")
+		changed := since != "" && since != version
+		if since == version {
+			version, changed = next(r, rel, version, time.After(timeout))
+			if r.Context().Err() != nil {
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(folderChange{Path: rel, Version: version, Changed: changed}); err != nil {
+			log.Printf("%s", err.Error())
+		}
+	}
+}
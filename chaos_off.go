@@ -0,0 +1,16 @@
+//go:build !chaos
+
+package main
+
+import "io"
+
+// Fault injection only exists in builds with -tags chaos, see chaos_on.go.
+// Here the hooks are what they stand in for.
+
+func chaosDisk() {}
+
+func chaosWrite(w io.Writer, data []byte) (int, error) { return w.Write(data) }
+
+func chaosDriver(name string) string { return name }
+
+func chaosRoutes() []route { return nil }
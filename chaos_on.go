@@ -0,0 +1,174 @@
+//go:build chaos
+
+package main
+
+// Built with -tags chaos, Consus can be told to misbehave: a slow disk, a
+// database that fails now and then, writes that stop halfway. It is there to
+// try retries, atomic writes and error pages against the real thing, and must
+// never go into a release build. Set CONSUS_CHAOS at start, or change it while
+// running with POST /chaos as an admin:
+//
+//	CONSUS_CHAOS=disk=300ms,db=0.05,write=0.2
+//
+// disk delays every listing, download and folder read by up to that long, db
+// fails that share of statements and write truncates that share of file writes
+// at a random spot and returns an error.
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errChaos = errors.New("chaos: injected failure")
+
+type chaosSpec struct {
+	disk  time.Duration
+	db    float64
+	write float64
+}
+
+func (s chaosSpec) String() string {
+	return fmt.Sprintf("disk=%s,db=%g,write=%g", s.disk, s.db, s.write)
+}
+
+func parseChaos(spec string) (chaosSpec, error) {
+	var s chaosSpec
+	for part := range strings.SplitSeq(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(part, "=")
+		var err error
+		switch key {
+		case "disk":
+			s.disk, err = time.ParseDuration(value)
+		case "db":
+			s.db, err = strconv.ParseFloat(value, 64)
+		case "write":
+			s.write, err = strconv.ParseFloat(value, 64)
+		default:
+			err = fmt.Errorf("unknown fault %q, want disk, db or write", key)
+		}
+		if err != nil {
+			return chaosSpec{}, fmt.Errorf("CONSUS_CHAOS %q: %w", part, err)
+		}
+	}
+	return s, nil
+}
+
+var chaos struct {
+	sync.Mutex
+	chaosSpec
+}
+
+func init() {
+	s, err := parseChaos(os.Getenv("CONSUS_CHAOS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	chaos.chaosSpec = s
+	log.Printf("warning: chaos build, faults: %s", s)
+}
+
+func currentChaos() chaosSpec {
+	chaos.Lock()
+	defer chaos.Unlock()
+	return chaos.chaosSpec
+}
+
+func chaosDisk() {
+	if d := currentChaos().disk; d > 0 {
+		time.Sleep(rand.N(d))
+	}
+}
+
+func chaosWrite(w io.Writer, data []byte) (int, error) {
+	if rand.Float64() < currentChaos().write {
+		n, _ := w.Write(data[:rand.N(len(data)+1)])
+		return n, errChaos
+	}
+	return w.Write(data)
+}
+
+var chaosDrivers sync.Map
+
+// chaosDriver registers a driver failing statements in front of name.
+func chaosDriver(name string) string {
+	wrapped := "chaos-" + name
+	if _, loaded := chaosDrivers.LoadOrStore(wrapped, true); !loaded {
+		db, err := sql.Open(name, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		sql.Register(wrapped, chaosSQL{db.Driver()})
+		db.Close()
+	}
+	return wrapped
+}
+
+type chaosSQL struct{ driver.Driver }
+
+func (d chaosSQL) Open(dsn string) (driver.Conn, error) {
+	c, err := d.Driver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return chaosConn{c}, nil
+}
+
+// chaosConn hides the fast paths of the real connection, so every statement
+// goes through Prepare and can be failed there.
+type chaosConn struct{ driver.Conn }
+
+func (c chaosConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c chaosConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if rand.Float64() < currentChaos().db {
+		return nil, errChaos
+	}
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c chaosConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func chaosRoutes() []route {
+	return []route{
+		{pattern: "GET /chaos", role: roleAdmin, handler: func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, currentChaos())
+		}},
+		{pattern: "POST /chaos", role: roleAdmin, handler: func(w http.ResponseWriter, r *http.Request) {
+			s, err := parseChaos(r.FormValue("spec"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			chaos.Lock()
+			chaos.chaosSpec = s
+			chaos.Unlock()
+			log.Printf("chaos: faults now %s", s)
+			fmt.Fprintln(w, s)
+		}},
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Checksums let whoever downloads a file check they got all of it. They are
+// worked out the first time somebody asks and kept in file_checksums along
+// with the size and mtime they were worked out for, a file changed since is
+// read again.
+type Checksums struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	BLAKE3 string `json:"blake3"`
+}
+
+func fileChecksums(ctx context.Context, db *sql.DB, content *contentFS, rel string) (Checksums, error) {
+	sums := Checksums{Path: cleanRel(rel)}
+	info, err := content.stat(rel)
+	if err != nil {
+		return sums, err
+	}
+	if info.IsDir() {
+		return sums, &fs.PathError{Op: "checksum", Path: rel, Err: fs.ErrNotExist}
+	}
+	sums.Size = info.Size()
+	mtime := info.ModTime().UnixNano()
+	err = db.QueryRow("SELECT sha256, blake3 FROM file_checksums WHERE path = ? AND size = ? AND mtime = ?", sums.Path, sums.Size, mtime).
+		Scan(&sums.SHA256, &sums.BLAKE3)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return sums, err
+	}
+
+	f, err := content.open(rel)
+	if err != nil {
+		return sums, err
+	}
+	defer f.Close()
+	sha, b3 := sha256.New(), newBLAKE3()
+	n, err := io.Copy(io.MultiWriter(sha, b3), ctxReader{ctx, f})
+	if err != nil {
+		return sums, err
+	}
+	if n != sums.Size {
+		// written to while being read, the next visit tries again
+		return sums, fmt.Errorf("%s changed while its checksums were worked out", rel)
+	}
+	sums.SHA256, sums.BLAKE3 = hex.EncodeToString(sha.Sum(nil)), hex.EncodeToString(b3.Sum(nil))
+	_, err = db.Exec(`INSERT INTO file_checksums (path, size, mtime, sha256, blake3) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET size = excluded.size, mtime = excluded.mtime, sha256 = excluded.sha256, blake3 = excluded.blake3`,
+		sums.Path, sums.Size, mtime, sums.SHA256, sums.BLAKE3)
+	return sums, err
+}
+
+// ctxReader stops reading once ctx is done, a visitor gone doesn't keep a
+// big file being read to the end.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// serveChecksums answers with the checksums of rel as JSON, or with
+// ?format=sha256 or ?format=blake3 as the one line sha256sum -c or b3sum -c
+// check a download with.
+func serveChecksums(w http.ResponseWriter, r *http.Request, db *sql.DB, content *contentFS, rel string) {
+	sums, err := fileChecksums(r.Context(), db, content, rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sums.Path = path.Base(sums.Path)
+
+	w.Header().Set("Cache-Control", "private, no-cache")
+	switch r.URL.Query().Get("format") {
+	case "sha256":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s  %s\n", sums.SHA256, sums.Path)
+	case "blake3":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s  %s\n", sums.BLAKE3, sums.Path)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sums)
+	}
+}
+
+// reviewCopyOnly tells whether visitors only ever download a review copy of
+// rel, whose checksums don't match the original's.
+func reviewCopyOnly(wm Watermark, rel string) bool {
+	return wm.Enabled() && isWatermarkable(rel)
+}
+
+// checksumFile is GET /checksum/{path}.
+func checksumFile(db *sql.DB, content *contentFS, wmr *watermarker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel := strings.TrimPrefix(r.URL.Path, "/checksum/")
+		if reviewCopyOnly(wmr.defaults, rel) && !roleAtLeast(roleFromRequest(db, r), roleEditor) {
+			http.Error(w, "you get a review copy of this file, it has no checksum", http.StatusNotFound)
+			return
+		}
+		serveChecksums(w, r, db, content, rel)
+	}
+}
+
+// shareChecksum is GET /s/{token}/checksum/{path...}, for shares that allow
+// downloading.
+func shareChecksum(db *sql.DB, secret []byte, content *contentFS, wmr *watermarker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := shareContent(w, r, db, secret)
+		if s == nil {
+			return
+		}
+		if !s.CanDownload {
+			http.Error(w, "this share does not allow downloading", http.StatusForbidden)
+			return
+		}
+		canon, err := s.resolve(content, r.PathValue("path"))
+		if errors.Is(err, errLinkRefused) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if reviewCopyOnly(s.watermark(wmr), canon) {
+			http.Error(w, "this share hands out review copies of this file, it has no checksum", http.StatusNotFound)
+			return
+		}
+		serveChecksums(w, r, db, content, canon)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const userUsage = `usage: consus user <command> [-db consus.db] [arguments]
+
+  add [-role editor] <name> <email>   create an account, the password is read from stdin
+  passwd <name>                       set a new password, read from stdin
+  del <name>                          delete an account
+  list                                show all accounts`
+
+// runUserCommand manages accounts from the shell, with the same code paths as
+// the web pages so the rules (first account is admin, one admin must remain)
+// hold either way.
+func runUserCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(userUsage)
+	}
+
+	fs := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	dbPath := fs.String("db", "consus.db", "SQLite database holding users and invites")
+	role := fs.String("role", roleEditor, "Role of the new account")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if !isValidRole(*role) {
+		return fmt.Errorf("unknown role %q", *role)
+	}
+
+	wantArgs := map[string]int{"add": 2, "passwd": 1, "del": 1, "list": 0}
+	n, ok := wantArgs[args[0]]
+	if !ok || fs.NArg() != n {
+		return errors.New(userUsage)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "add":
+		return cliUserAdd(db, fs.Arg(0), fs.Arg(1), *role)
+	case "passwd":
+		return cliUserPasswd(db, fs.Arg(0))
+	case "del":
+		return cliUserDel(db, fs.Arg(0))
+	default:
+		return cliUserList(db)
+	}
+}
+
+// readPassword reads one line from stdin, so it can also be piped in.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("could not read password: %w", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if len(password) < 8 {
+		return "", errors.New("password must be at least 8 characters")
+	}
+	return password, nil
+}
+
+func cliUserAdd(db *sql.DB, name, email, role string) error {
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("%q does not look like an email address", email)
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := createUser(tx, name, email, password, role); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	user, err := userByLogin(db, name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created %s <%s> as %s\n", user.Name, user.Email, user.Role)
+	return nil
+}
+
+func cliUserPasswd(db *sql.DB, name string) error {
+	user, err := userByLogin(db, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no user %q", name)
+	} else if err != nil {
+		return err
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET password_hash = ? WHERE name = ?", hash, name); err != nil {
+		return err
+	}
+	// a new password usually means the old one leaked, log out whoever used it
+	if err := endAllSessions(db, user.Email); err != nil {
+		return err
+	}
+	fmt.Printf("password of %s changed, sessions ended\n", name)
+	return nil
+}
+
+func cliUserDel(db *sql.DB, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email string
+	err = tx.QueryRow("DELETE FROM users WHERE name = ? RETURNING email", name).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no user %q", name)
+	} else if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE email = ?", email); err != nil {
+		return err
+	}
+
+	// same rule as the users page: never lock everybody out of the admin pages
+	var admins, total int
+	if err := tx.QueryRow("SELECT COUNT(*) FILTER (WHERE role = ?), COUNT(*) FROM users", roleAdmin).Scan(&admins, &total); err != nil {
+		return err
+	}
+	if admins == 0 && total > 0 {
+		return errors.New("at least one admin must remain")
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("deleted %s\n", name)
+	return nil
+}
+
+func cliUserList(db *sql.DB) error {
+	users, err := listUsers(db)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tEMAIL\tROLE\tCREATED")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.Name, u.Email, u.Role, u.CreatedAt.Format("2006-01-02"))
+	}
+	return tw.Flush()
+}
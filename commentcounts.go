@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Listings show how many comments each file has. Counting means reading every
+// comment file of the folder, so the counts live in the database instead. They
+// are written whenever a comment is added or deleted, and recounted from the
+// comment files once a day to catch files edited or restored behind our back.
+
+// setCommentCount records that the file at rel has n visible comments.
+func setCommentCount(db *sql.DB, rel string, n int) error {
+	rel = cleanRel(rel)
+	if n == 0 {
+		_, err := db.Exec("DELETE FROM comment_counts WHERE path = ?", rel)
+		return err
+	}
+	parent := cleanRel(path.Dir(rel))
+	_, err := db.Exec(`INSERT INTO comment_counts (path, parent, name, count) VALUES (?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET count = excluded.count`, rel, parent, path.Base(rel), n)
+	return err
+}
+
+// commentCounts returns the comment count of every file in the folder dir.
+func commentCounts(db *sql.DB, dir string) (map[string]uint16, error) {
+	rows, err := db.Query("SELECT name, count FROM comment_counts WHERE parent = ?", cleanRel(dir))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]uint16{}
+	for rows.Next() {
+		var name string
+		var n uint16
+		if err := rows.Scan(&name, &n); err != nil {
+			return nil, err
+		}
+		counts[name] = n
+	}
+	return counts, rows.Err()
+}
+
+// recountComments rebuilds all counts from the comment files below commentPath.
+func recountComments(db *sql.DB, commentPath string) error {
+	counts := map[string]int{}
+	err := filepath.WalkDir(commentPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		var cf CommentFilev1
+		if err := json.Unmarshal(data, &cf); err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(commentPath, p)
+		for _, c := range cf.Comments {
+			if !c.Deleted {
+				counts[filepath.ToSlash(rel)]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM comment_counts"); err != nil {
+		return err
+	}
+	for rel, n := range counts {
+		if _, err := tx.Exec("INSERT INTO comment_counts (path, parent, name, count) VALUES (?, ?, ?, ?)",
+			rel, cleanRel(path.Dir(rel)), path.Base(rel), n); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO settings (key, value) VALUES ('comment_counts.at', ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value",
+		time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// commentCountsBuilt tells whether the counts were ever put together, a fresh
+// database has to count once before the first listing.
+func commentCountsBuilt(db *sql.DB) bool {
+	var at string
+	return db.QueryRow("SELECT value FROM settings WHERE key = 'comment_counts.at'").Scan(&at) == nil
+}
+
+func watchCommentCounts(ctx context.Context, db *sql.DB, commentPath string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := recountComments(db, commentPath); err != nil {
+				log.Printf("could not recount comments: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Pages, listings, API answers and text files go out gzipped to clients
+// that take it, at the level -compress gives. Media, archives and anything
+// else already compressed goes out as it is, by its Content-Type, and so do
+// ranges, HEAD requests and event streams. ETags of gzipped answers are
+// weakened, they don't stand for the same bytes anymore.
+
+// compressMin is the smallest answer worth gzipping, when its length is known.
+const compressMin = 1 << 10
+
+// compressible tells whether answers of type ctype shrink with gzip.
+func compressible(ctype string) bool {
+	t, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	switch {
+	case t == "text/event-stream":
+		return false
+	case strings.HasPrefix(t, "text/"), strings.HasSuffix(t, "+json"), strings.HasSuffix(t, "+xml"):
+		return true
+	}
+	switch t {
+	case "application/json", "application/x-ndjson", "application/xml", "application/javascript",
+		"application/x-javascript", "application/x-subrip", "application/wasm", "image/svg+xml", "image/x-icon":
+		return true
+	}
+	return false
+}
+
+// acceptsGzip reads Accept-Encoding, gzip or * with a q above 0.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressResponses gzips what next answers, level being one of
+// compress/gzip's; 0 leaves answers alone.
+func compressResponses(level int, next http.Handler) http.Handler {
+	if level == 0 {
+		return next
+	}
+	pool := sync.Pool{New: func() any {
+		gz, _ := gzip.NewWriterLevel(io.Discard, level)
+		return gz
+	}}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, pool: &pool}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds the headers back until the first byte, when it is
+// known what the answer is and whether to gzip it.
+type compressWriter struct {
+	http.ResponseWriter
+	pool    *sync.Pool
+	status  int
+	decided bool
+	gz      *gzip.Writer // nil for answers going out as they are
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	if status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+}
+
+// decide settles the headers, sniffing the type from first like net/http
+// would if nobody set one.
+func (cw *compressWriter) decide(first []byte) {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(first) > 0 && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Type", http.DetectContentType(first))
+	}
+	if compressible(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	small := false
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		small = n < compressMin
+	}
+	switch {
+	case cw.status == http.StatusNotModified:
+		weakenETag(h)
+	case cw.status == http.StatusNoContent, cw.status == http.StatusPartialContent,
+		h.Get("Content-Encoding") != "", h.Get("Content-Range") != "", small,
+		!compressible(h.Get("Content-Type")):
+	default:
+		weakenETag(h)
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		cw.gz = cw.pool.Get().(*gzip.Writer)
+		cw.gz.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.decide(b)
+	}
+	if cw.gz == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return cw.gz.Write(b)
+}
+
+// ReadFrom keeps sendfile for files going out as they are.
+func (cw *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !cw.decided && cw.Header().Get("Content-Type") != "" {
+		cw.decide(nil)
+	}
+	if rf, ok := cw.ResponseWriter.(io.ReaderFrom); ok && cw.decided && cw.gz == nil {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(struct{ io.Writer }{cw}, src)
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(nil)
+	}
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 {
+			// the handler wrote nothing at all, net/http sends its 200
+			return
+		}
+		if cw.Header().Get("Content-Length") == "" && cw.status != http.StatusNoContent && cw.status != http.StatusNotModified {
+			cw.Header().Set("Content-Length", "0")
+		}
+		cw.decide(nil)
+	}
+	if cw.gz != nil {
+		cw.gz.Close()
+		cw.gz.Reset(io.Discard)
+		cw.pool.Put(cw.gz)
+		cw.gz = nil
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Running in a container mostly means: the image itself is read-only, state
+// lives in one mounted volume, logs go to stdout for the runtime to collect and
+// a healthcheck wants something cheap to look at.
+
+// setupLogging switches the standard logger to JSON lines on stdout. "auto"
+// does that unless a person is watching the terminal.
+func setupLogging(format string) {
+	if format == "auto" {
+		format = "json"
+		if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			format = "text"
+		}
+	}
+	if format == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	} else if format != "text" {
+		log.Fatalf("unknown log format %q, use auto, text or json", format)
+	}
+}
+
+// applyStateDir moves everything consus writes below dir, unless the flag for
+// it was given explicitly. dir is meant to be the one writable volume.
+func applyStateDir(dir string, paths map[string]*string) {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, p := range paths {
+		if !set[name] {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+}
+
+// writeHealthFile refreshes path every interval while the server is up, so a
+// healthcheck only has to look at its age.
+func writeHealthFile(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := writeFile(path, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0o644); err != nil {
+			log.Printf("could not write health file: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
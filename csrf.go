@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+const csrfTokenKey contextKey = "csrf-token"
+
+// csrfProtect hands every browser a random token in a cookie and expects it
+// back, as the csrf form field or X-CSRF-Token header, on anything that changes
+// state. Another site can make the browser send the cookie but cannot read it
+// to fill in the form. Requests authenticated by an API token carry no cookies
+// worth forging and are let through. So are WebDAV methods other than POST:
+// another site can only send those after a CORS preflight nobody answers.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if c, err := r.Cookie("csrf"); err == nil && len(c.Value) == 64 {
+			token = c.Value
+		} else {
+			token = newSessionToken()
+			http.SetCookie(w, &http.Cookie{
+				Name:     "csrf",
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		r = r.WithContext(context.WithValue(r.Context(), csrfTokenKey, token))
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if _, ok := r.Context().Value(tokenEmailKey).(string); ok {
+				break
+			}
+			if strings.HasPrefix(r.URL.Path, "/dav/") && r.Method != http.MethodPost {
+				break
+			}
+			sent := r.Header.Get("X-CSRF-Token")
+			if sent == "" && isMultipart(r) {
+				sent = multipartCSRF(r)
+			} else if sent == "" {
+				sent = r.PostFormValue("csrf")
+			}
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				http.Error(w, "invalid or missing CSRF token, reload the page and try again", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isMultipart(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// multipartCSRF reads the csrf field of an upload form without parsing the
+// whole form, which would put the files in temporary ones before the handler
+// gets to stream them. The field has to come first, before the files; what
+// was read is put back in front of the body.
+func multipartCSRF(r *http.Request) string {
+	_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(r.Body, head)
+	head = head[:n]
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+
+	part, err := multipart.NewReader(bytes.NewReader(head), params["boundary"]).NextPart()
+	if err != nil || part.FormName() != "csrf" {
+		return ""
+	}
+	value, _ := io.ReadAll(io.LimitReader(part, 128))
+	return string(value)
+}
+
+// csrfToken is the value templates put into the csrf field of their forms.
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfTokenKey).(string)
+	return token
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// davMethods are what /dav/ answers, those changing something only for editors.
+var davMethods = map[string]bool{
+	"GET": false, "OPTIONS": false, "PROPFIND": false,
+	"PUT": true, "DELETE": true, "MKCOL": true, "COPY": true, "MOVE": true, "PROPPATCH": true, "LOCK": true, "UNLOCK": true,
+}
+
+// davRoutes mounts the content tree at /dav/ for Finder, Explorer, rclone and
+// friends. Everybody reads what they could read under /files/, editors can
+// change things too.
+func davRoutes(db *sql.DB, content *contentFS, wmr *watermarker, commentPath string, rules uploadRules) []route {
+	h := davHandler(db, content, wmr, commentPath, rules)
+	var routes []route
+	for method, writes := range davMethods {
+		rt := route{pattern: method + " /dav/", path: below("/dav/"), writes: writes, lane: priorityBulk, handler: h}
+		if writes {
+			rt.role = roleEditor
+		}
+		routes = append(routes, rt)
+	}
+	return routes
+}
+
+func davHandler(db *sql.DB, content *contentFS, wmr *watermarker, commentPath string, rules uploadRules) func(http.ResponseWriter, *http.Request) {
+	dav := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: &davFS{db: db, content: content, comments: commentPath, rules: rules},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) {
+				log.Printf("dav %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel := strings.TrimPrefix(r.URL.Path, "/dav/")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			// downloads get what /files/ would hand out, review copies included
+			info, err := content.stat(rel)
+			if err != nil || info.IsDir() {
+				dav.ServeHTTP(w, r)
+			} else if wmr.defaults.Enabled() && isWatermarkable(rel) && !roleAtLeast(roleFromRequest(db, r), roleEditor) {
+				wmr.serve(w, r, content, rel, wmr.defaults)
+			} else {
+				serveContent(w, r, content, rel)
+			}
+			return
+		case http.MethodPut:
+			// the one of /files/, with If-Match and without half written files.
+			// It doesn't look at WebDAV locks, those only keep clients happy.
+			putContent(w, r, db, content, rules, rel)
+			return
+		}
+
+		rw := &receiptWriter{ResponseWriter: w}
+		dav.ServeHTTP(rw, r)
+		action := map[string]string{"DELETE": auditFileDelete, "MKCOL": auditFolderCreate, "COPY": auditFileCopy, "MOVE": auditFileMove}[r.Method]
+		if action != "" && rw.status >= 200 && rw.status < 300 {
+			audit(db, r, emailFromRequest(r), action, rel, r.Header.Get("Destination"))
+		}
+	}
+}
+
+// davFS is the content tree as webdav sees it. Every name goes through the
+// same resolve and access check as the routes, also the ones a request only
+// reaches by walking folders or as the destination of a COPY or MOVE.
+// Changes are for folders on disk, buckets and the top of the mounts refuse.
+// Comments and the rest kept about a path follow renames and deletes.
+type davFS struct {
+	db       *sql.DB
+	content  *contentFS
+	comments string // where the comments are, "" without
+	rules    uploadRules
+}
+
+func (d *davFS) resolve(ctx context.Context, name string) (string, error) {
+	rel, err := d.content.resolve(name)
+	if errors.Is(err, errLinkRefused) {
+		return "", fs.ErrPermission
+	} else if err != nil {
+		return "", fs.ErrNotExist
+	}
+	ok, err := canAccessPath(d.db, emailFromContext(ctx), rel)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fs.ErrPermission
+	}
+	return rel, nil
+}
+
+// writable returns rel and where it is on disk, if it can be changed.
+func (d *davFS) writable(ctx context.Context, name string) (string, string, error) {
+	rel, err := d.resolve(ctx, name)
+	if err != nil {
+		return "", "", err
+	}
+	full := d.content.abs(rel)
+	if m, rest := d.content.mountOf(rel); full == "" || rel == "" || m != nil && rest == "" {
+		return "", "", fs.ErrPermission
+	}
+	if d.content.linkRefused(path.Dir(rel)) {
+		return "", "", fs.ErrPermission
+	}
+	return rel, full, nil
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	_, full, err := d.writable(ctx, name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(full, perm)
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		rel, err := d.resolve(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		var f fs.File = davTop{}
+		if !d.content.virtual(rel) {
+			f, err = d.content.open(rel)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &davFile{File: f, fs: d, ctx: ctx, rel: rel}, nil
+	}
+
+	// files are only ever replaced whole, like PUT does
+	if flag&os.O_TRUNC == 0 {
+		return nil, fs.ErrPermission
+	}
+	rel, full, err := d.writable(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, problem := d.rules.check(d.content, path.Dir(rel), path.Base(rel), "replace"); problem != "" {
+		return nil, fmt.Errorf("%s: %w", problem, fs.ErrPermission)
+	}
+	old, err := os.Stat(full)
+	if err == nil && old.IsDir() {
+		return nil, fs.ErrPermission
+	}
+	if err := disks.room(full); err != nil {
+		return nil, err
+	}
+	// the size is only known at the end, writes past the limits break the
+	// upload off and a full quota refuses new files right away
+	email := emailFromContext(ctx)
+	allowance, err := d.rules.allowanceOf(d.db, email)
+	if err != nil {
+		return nil, err
+	}
+	left, err := d.rules.storageLeft(d.db, email)
+	if err != nil {
+		return nil, err
+	}
+	u := &davUpload{db: d.db, email: email, rel: rel, replaces: old != nil}
+	u.most, u.tooLarge = d.rules.most(allowance)
+	if left >= 0 && (u.most < 0 || left < u.most) {
+		u.most, u.tooLarge = left, errStorageQuota
+	}
+	if u.most == 0 {
+		return nil, u.tooLarge
+	}
+	if u.pendingFile, err = newPendingFile(full, perm&^0o022); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// RemoveAll sends name to the trash, also when a MOVE or COPY overwrites it.
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	rel, _, err := d.writable(ctx, name)
+	if err != nil {
+		return err
+	}
+	err = trashEntry(d.db, d.content, d.comments, rel, emailFromContext(ctx))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Rename never overwrites: a MOVE has sent what was there to the trash with
+// RemoveAll already, an SFTP rename onto a taken name fails.
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	fromRel, from, err := d.writable(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	toRel, _, err := d.writable(ctx, newName)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	if _, problem := destination(d.content, d.rules, cleanRel(path.Dir(toRel)), path.Base(toRel), info.IsDir()); problem != "" {
+		return fmt.Errorf("%s: %w", problem, fs.ErrPermission)
+	}
+	err = moveEntry(d.db, d.content, d.comments, fromRel, toRel)
+	if errors.Is(err, errTaken) {
+		return fmt.Errorf("%s: %w", toRel, fs.ErrExist)
+	}
+	if err != nil {
+		return err
+	}
+	events.publish(eventEntryMoved, emailFromContext(ctx), toRel, map[string]string{"from": fromRel})
+	return nil
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	rel, err := d.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := d.content.stat(rel)
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{info, path.Base("/" + rel)}, nil
+}
+
+// davFile is a file or folder being read.
+type davFile struct {
+	fs.File
+	fs  *davFS
+	ctx context.Context
+	rel string
+}
+
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{info, path.Base("/" + f.rel)}, nil
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(interface {
+		Seek(int64, int) (int64, error)
+	}); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, errors.New("cannot seek")
+}
+
+// Readdir lists what resolve lets through, a PROPFIND doesn't show more than
+// the listing under /files/.
+func (f *davFile) Readdir(int) ([]fs.FileInfo, error) {
+	entries, err := f.fs.content.readDir(f.rel)
+	if err != nil {
+		return nil, err
+	}
+	email := emailFromContext(f.ctx)
+	var infos []fs.FileInfo
+	for _, e := range entries {
+		rel := path.Join(f.rel, e.Name())
+		if f.fs.content.ignore.hiddenEntry(rel, e.IsDir()) {
+			continue
+		}
+		if ok, err := canAccessPath(f.fs.db, email, rel); err != nil || !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, davInfo{info, e.Name()})
+	}
+	return infos, nil
+}
+
+func (f *davFile) Write([]byte) (int, error) { return 0, fs.ErrPermission }
+
+// davTop is the top of a tree of mounts, which only has the mounts in it.
+type davTop struct{}
+
+func (davTop) Stat() (fs.FileInfo, error) { return virtualRoot{}, nil }
+func (davTop) Read([]byte) (int, error)   { return 0, errors.New("is a folder") }
+func (davTop) Close() error               { return nil }
+
+// davUpload is a file written by COPY, LOCK or SFTP.
+type davUpload struct {
+	*pendingFile
+	db       *sql.DB
+	email    string
+	rel      string
+	replaces bool  // a file that is there already
+	most     int64 // bytes the file may have, -1 for any
+	tooLarge error // what writing past most fails with
+}
+
+// fits breaks the upload off if writing up to end is more than it may be.
+func (u *davUpload) fits(end int64) error {
+	if u.most >= 0 && end > u.most {
+		u.pendingFile.broken = true
+		return u.tooLarge
+	}
+	return nil
+}
+
+func (u *davUpload) Write(p []byte) (int, error) {
+	at, err := u.pendingFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if err := u.fits(at + int64(len(p))); err != nil {
+		return 0, err
+	}
+	return u.pendingFile.Write(p)
+}
+
+// WriteAt is how SFTP writes.
+func (u *davUpload) WriteAt(p []byte, off int64) (int, error) {
+	if err := u.fits(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+	return u.pendingFile.WriteAt(p, off)
+}
+
+// Close puts the file in place and down as uploaded by whoever wrote it.
+func (u *davUpload) Close() error {
+	info, err := u.pendingFile.Stat()
+	if err != nil {
+		u.pendingFile.Close()
+		return err
+	}
+	if err := u.pendingFile.Close(); err != nil {
+		return err
+	}
+	countUpload(u.db, u.email, info.Size())
+	countStored(u.db, u.email, u.rel, info.Size())
+	if u.replaces {
+		events.publish(eventFileWritten, u.email, u.rel, nil)
+	} else {
+		events.publish(eventFileAdded, u.email, u.rel, nil)
+	}
+	return nil
+}
+
+func (u *davUpload) Readdir(int) ([]fs.FileInfo, error) { return nil, fs.ErrInvalid }
+
+func (u *davUpload) Stat() (fs.FileInfo, error) {
+	info, err := u.pendingFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{info, path.Base(u.dest)}, nil
+}
+
+// davInfo names mounts by their name rather than "." and has the ETag of the
+// rest of Consus.
+type davInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i davInfo) Name() string { return i.name }
+
+func (i davInfo) ETag(context.Context) (string, error) { return fileETag(i.FileInfo), nil }
+
+// ContentType saves opening every file of a PROPFIND, which hurts on buckets.
+func (i davInfo) ContentType(context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(i.name)); ctype != "" {
+		return ctype, nil
+	}
+	return "", webdav.ErrNotImplemented
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDavRenameNeverOverwrites(t *testing.T) {
+	c := testContent(t, "up/a.txt", "up/b.txt")
+	d := &davFS{db: testDB(t), content: c}
+	ctx := context.Background()
+
+	if err := d.Rename(ctx, "/up/a.txt", "/up/b.txt"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("rename onto up/b.txt = %v, want %v", err, fs.ErrExist)
+	}
+	for _, name := range []string{"up/a.txt", "up/b.txt"} {
+		if got, _ := os.ReadFile(filepath.Join(c.root, filepath.FromSlash(name))); string(got) != name {
+			t.Errorf("%s holds %q after the refused rename", name, got)
+		}
+	}
+	if err := d.Rename(ctx, "/up/a.txt", "/up/c.txt"); err != nil {
+		t.Errorf("rename to a free name: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(c.root, "up", "c.txt")); string(got) != "up/a.txt" {
+		t.Errorf("up/c.txt holds %q", got)
+	}
+}
+
+func TestDavRenameFollowsUploadRules(t *testing.T) {
+	c := testContent(t, "up/x.jpg", "up/album/")
+	d := &davFS{db: testDB(t), content: c, rules: uploadRules{extensions: map[string]bool{".jpg": true}}}
+	ctx := context.Background()
+
+	for _, to := range []string{"/up/x.exe", "/up/.x.jpg", "/up/x?.jpg"} {
+		if err := d.Rename(ctx, "/up/x.jpg", to); !errors.Is(err, fs.ErrPermission) && !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("rename of up/x.jpg to %s = %v, want it refused", to, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(c.root, "up", "x.jpg")); err != nil {
+		t.Errorf("up/x.jpg is gone after the refused renames: %v", err)
+	}
+	if err := d.Rename(ctx, "/up/x.jpg", "/up/y.JPG"); err != nil {
+		t.Errorf("rename to an allowed extension: %v", err)
+	}
+	if err := d.Rename(ctx, "/up/album", "/up/album 2"); err != nil {
+		t.Errorf("rename of a folder with no extension: %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order; the index of the last applied one is kept
+// in PRAGMA user_version. Only ever append to this list.
+var migrations = []string{
+	`CREATE TABLE users (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		name          TEXT NOT NULL UNIQUE,
+		email         TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL DEFAULT '',
+		created_at    TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE invites (
+		code       TEXT PRIMARY KEY,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		max_uses   INTEGER NOT NULL,
+		uses       INTEGER NOT NULL DEFAULT 0
+	)`,
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'viewer'`,
+	`ALTER TABLE invites ADD COLUMN role TEXT NOT NULL DEFAULT 'editor'`,
+	`CREATE TABLE shares (
+		token        TEXT PRIMARY KEY,
+		path         TEXT NOT NULL,
+		created_by   TEXT NOT NULL,
+		created_at   TIMESTAMP NOT NULL,
+		can_view     BOOLEAN NOT NULL,
+		can_download BOOLEAN NOT NULL,
+		can_comment  BOOLEAN NOT NULL,
+		watermark    TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE identities (
+		provider   TEXT NOT NULL,
+		subject    TEXT NOT NULL,
+		user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (provider, subject)
+	)`,
+	`CREATE TABLE settings (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+	`ALTER TABLE shares ADD COLUMN title TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE shares ADD COLUMN message TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE shares ADD COLUMN require_accept BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE share_acceptances (
+		token       TEXT NOT NULL REFERENCES shares(token) ON DELETE CASCADE,
+		accepted_at TIMESTAMP NOT NULL,
+		remote_addr TEXT NOT NULL,
+		user_agent  TEXT NOT NULL
+	)`,
+	`CREATE TABLE api_tokens (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name         TEXT NOT NULL,
+		hash         TEXT NOT NULL UNIQUE,
+		created_at   TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP
+	)`,
+	`ALTER TABLE shares ADD COLUMN expires_at TIMESTAMP`,
+	`ALTER TABLE shares ADD COLUMN lifetime_days INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE shares ADD COLUMN expiry_notified BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE shares ADD COLUMN renewal_requested_at TIMESTAMP`,
+	`CREATE TABLE notifications (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		email      TEXT NOT NULL,
+		message    TEXT NOT NULL,
+		link       TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		read_at    TIMESTAMP
+	)`,
+	`CREATE INDEX notifications_email ON notifications(email, created_at)`,
+	`CREATE TABLE folder_rules (
+		path     TEXT PRIMARY KEY,
+		min_role TEXT NOT NULL
+	)`,
+	`CREATE TABLE path_grants (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		path       TEXT NOT NULL,
+		email      TEXT NOT NULL,
+		granted_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE access_requests (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		email       TEXT NOT NULL,
+		path        TEXT NOT NULL,
+		message     TEXT NOT NULL,
+		created_at  TIMESTAMP NOT NULL,
+		resolved_at TIMESTAMP,
+		resolved_by TEXT,
+		resolution  TEXT
+	)`,
+	`ALTER TABLE folder_rules ADD COLUMN source TEXT NOT NULL DEFAULT 'db'`,
+	`ALTER TABLE path_grants ADD COLUMN group_name TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE path_grants ADD COLUMN source TEXT NOT NULL DEFAULT 'db'`,
+	`CREATE TABLE group_members (
+		group_name TEXT NOT NULL,
+		email      TEXT NOT NULL,
+		source     TEXT NOT NULL DEFAULT 'db',
+		PRIMARY KEY (group_name, email)
+	)`,
+	`ALTER TABLE folder_rules ADD COLUMN visibility TEXT NOT NULL DEFAULT 'restricted'`,
+	`ALTER TABLE shares ADD COLUMN revoked_at TIMESTAMP`,
+	`ALTER TABLE shares ADD COLUMN password_hash TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE login_failures (
+		login       TEXT NOT NULL,
+		remote_addr TEXT NOT NULL,
+		at          TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX login_failures_login ON login_failures(login, at)`,
+	`CREATE INDEX login_failures_remote_addr ON login_failures(remote_addr, at)`,
+	`CREATE TABLE audit_log (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		at          TIMESTAMP NOT NULL,
+		actor       TEXT NOT NULL,
+		action      TEXT NOT NULL,
+		target      TEXT NOT NULL,
+		detail      TEXT NOT NULL DEFAULT '',
+		remote_addr TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`,
+	`CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`,
+	`CREATE TABLE sessions (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash  TEXT NOT NULL UNIQUE,
+		email       TEXT NOT NULL,
+		created_at  TIMESTAMP NOT NULL,
+		last_seen   TIMESTAMP NOT NULL,
+		expires_at  TIMESTAMP NOT NULL,
+		remember    INTEGER NOT NULL DEFAULT 0,
+		user_agent  TEXT NOT NULL DEFAULT '',
+		remote_addr TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX sessions_email ON sessions(email)`,
+	`CREATE TABLE content_index (
+		path     TEXT PRIMARY KEY,
+		parent   TEXT NOT NULL,
+		name     TEXT NOT NULL,
+		is_dir   BOOLEAN NOT NULL,
+		size     INTEGER NOT NULL DEFAULT 0,
+		mod_time INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX content_index_parent ON content_index(parent)`,
+	`CREATE TABLE content_issues (
+		dir    TEXT NOT NULL,
+		path   TEXT NOT NULL,
+		kind   TEXT NOT NULL,
+		detail TEXT NOT NULL
+	)`,
+	`CREATE INDEX content_issues_dir ON content_issues(dir)`,
+	`CREATE TABLE password_resets (
+		token_hash TEXT PRIMARY KEY,
+		user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at    TIMESTAMP
+	)`,
+	`CREATE TABLE comment_counts (
+		path   TEXT PRIMARY KEY,
+		parent TEXT NOT NULL,
+		name   TEXT NOT NULL,
+		count  INTEGER NOT NULL
+	)`,
+	`CREATE INDEX comment_counts_parent ON comment_counts(parent)`,
+	`CREATE TABLE content_text_files (
+		id       INTEGER PRIMARY KEY,
+		path     TEXT NOT NULL UNIQUE,
+		size     INTEGER NOT NULL,
+		mod_time INTEGER NOT NULL
+	)`,
+	`CREATE TABLE announcements (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		message    TEXT NOT NULL,
+		severity   TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP
+	)`,
+	`CREATE TABLE terms_acceptances (
+		email       TEXT NOT NULL,
+		version     TEXT NOT NULL,
+		accepted_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (email, version)
+	)`,
+	`CREATE TABLE file_licenses (
+		path        TEXT PRIMARY KEY,
+		license     TEXT NOT NULL,
+		attribution TEXT NOT NULL,
+		set_by      TEXT NOT NULL,
+		set_at      TIMESTAMP NOT NULL
+	)`,
+	`ALTER TABLE shares ADD COLUMN notify_downloads BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE share_downloads (
+		token         TEXT NOT NULL REFERENCES shares(token) ON DELETE CASCADE,
+		path          TEXT NOT NULL,
+		bytes         INTEGER NOT NULL,
+		downloaded_at TIMESTAMP NOT NULL,
+		remote_addr   TEXT NOT NULL,
+		user_agent    TEXT NOT NULL
+	)`,
+	`CREATE INDEX share_downloads_token ON share_downloads(token, downloaded_at)`,
+	`CREATE TABLE api_usage (
+		day    TEXT NOT NULL,
+		client TEXT NOT NULL,
+		calls  INTEGER NOT NULL,
+		PRIMARY KEY (day, client)
+	)`,
+	`CREATE TABLE events (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind       TEXT NOT NULL,
+		data       TEXT NOT NULL,
+		origin     TEXT NOT NULL DEFAULT '',
+		origin_id  INTEGER,
+		created_at TIMESTAMP NOT NULL,
+		UNIQUE (origin, origin_id)
+	)`,
+	`CREATE TABLE event_cursors (
+		subscriber TEXT PRIMARY KEY,
+		last_id    INTEGER NOT NULL
+	)`,
+	`CREATE TABLE tus_uploads (
+		id         TEXT PRIMARY KEY,
+		email      TEXT NOT NULL,
+		dir        TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		collision  TEXT NOT NULL,
+		length     INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		done_path  TEXT NOT NULL DEFAULT ''
+	)`,
+	`ALTER TABLE content_index ADD COLUMN mtime INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE content_index ADD COLUMN mode INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE content_index ADD COLUMN generation INTEGER NOT NULL DEFAULT 0`,
+	// the new columns get filled when the folders are read again
+	`UPDATE content_index SET mod_time = 0 WHERE is_dir`,
+	`CREATE TABLE upload_usage (
+		day   TEXT NOT NULL,
+		email TEXT NOT NULL,
+		bytes INTEGER NOT NULL,
+		PRIMARY KEY (day, email)
+	)`,
+	`CREATE TABLE trash (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		path       TEXT NOT NULL,
+		is_dir     INTEGER NOT NULL,
+		size       INTEGER NOT NULL,
+		deleted_by TEXT NOT NULL,
+		deleted_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE stored_files (
+		path  TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		size  INTEGER NOT NULL
+	)`,
+	`CREATE INDEX stored_files_email ON stored_files (email)`,
+	`CREATE TABLE storage_quotas (
+		email TEXT PRIMARY KEY,
+		bytes INTEGER NOT NULL
+	)`,
+	`CREATE TABLE file_checksums (
+		path   TEXT PRIMARY KEY,
+		size   INTEGER NOT NULL,
+		mtime  INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		blake3 TEXT NOT NULL
+	)`,
+	`CREATE TABLE file_ids (
+		id   TEXT PRIMARY KEY,
+		path TEXT NOT NULL UNIQUE
+	)`,
+	`CREATE TABLE share_download_days (
+		token     TEXT NOT NULL REFERENCES shares(token) ON DELETE CASCADE,
+		day       TEXT NOT NULL,
+		downloads INTEGER NOT NULL,
+		bytes     INTEGER NOT NULL,
+		PRIMARY KEY (token, day)
+	)`,
+	`CREATE TABLE short_links (
+		code       TEXT PRIMARY KEY,
+		id         TEXT NOT NULL,
+		generated  BOOLEAN NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX short_links_id ON short_links (id)`,
+	`CREATE TABLE pipeline_jobs (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		pipeline   TEXT NOT NULL,
+		event_id   INTEGER NOT NULL,
+		path       TEXT NOT NULL,
+		actor      TEXT NOT NULL,
+		step       INTEGER NOT NULL,
+		status     TEXT NOT NULL,
+		output     TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		UNIQUE (pipeline, event_id)
+	)`,
+	`CREATE INDEX pipeline_jobs_path ON pipeline_jobs (path)`,
+}
+
+func openDB(path string) (*sql.DB, error) {
+	db, err := sql.Open(chaosDriver(sqliteDriver), sqliteDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows a single writer, serialising here avoids SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func migrate(db *sql.DB) error {
+	var current int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&current); err != nil {
+		return fmt.Errorf("could not read schema version: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+		// PRAGMA does not accept bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// freeSpace isn't known here, see diskfree_statfs.go. Only writes failing
+// for a full disk pause anything.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
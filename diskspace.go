@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errDiskFull is what writes get while the volume they go to is (nearly)
+// full. Reading, streaming and downloads carry on.
+var errDiskFull = errors.New("the disk is full, uploads are paused until an admin makes room")
+
+// diskGuard watches the free space of the volumes Consus writes to. One
+// falling below -min-free, or a write there running into a full disk, stops
+// uploads and new review copies from going there and tells the admins, until
+// a check finds room again.
+type diskGuard struct {
+	db      *sql.DB
+	notes   *notifier
+	minFree int64 // 0 only reacts to full disks
+
+	mu      sync.Mutex
+	volumes []*volume
+}
+
+type volume struct {
+	label string // what is kept there: content, comments, cache, database
+	dir   string // absolute
+	free  int64  // at the last check, -1 if unknown
+	full  bool
+}
+
+// disks is set up by NewMainServer, without it nothing is ever paused.
+var disks *diskGuard
+
+func newDiskGuard(db *sql.DB, notes *notifier, minFree int64) *diskGuard {
+	return &diskGuard{db: db, notes: notes, minFree: minFree}
+}
+
+// watch adds dir to what is checked, named label in the alerts.
+func (g *diskGuard) watch(label, dir string) {
+	if dir == "" {
+		return
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	g.volumes = append(g.volumes, &volume{label: label, dir: abs, free: -1})
+}
+
+// run checks every interval until ctx is done.
+func (g *diskGuard) run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		g.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// diskRoomAgain is the least a full volume needs free to count as having
+// room again, so it doesn't flip back and forth with a few bytes to spare.
+const diskRoomAgain = 100 << 20
+
+func (g *diskGuard) check() {
+	var filled, freed []string
+	for _, v := range g.volumes {
+		free, err := freeSpace(v.dir)
+		if err != nil {
+			// unknown, a write running into a full disk still pauses it
+			free = -1
+		}
+		g.mu.Lock()
+		v.free = free
+		g.mu.Unlock()
+		switch {
+		case free < 0:
+		case g.minFree > 0 && free < g.minFree:
+			if g.mark(v, fmt.Sprintf("only %s left", humanSize(free))) {
+				filled = append(filled, v.label)
+			}
+		case free >= max(g.minFree, diskRoomAgain):
+			if g.clear(v) {
+				freed = append(freed, v.label)
+			}
+		}
+	}
+	if len(filled) > 0 {
+		g.alert(fmt.Sprintf("The disk of the %s is nearly full, uploads to it are paused until there is room again", strings.Join(filled, ", ")))
+	}
+	if len(freed) > 0 {
+		g.alert(fmt.Sprintf("The disk of the %s has room again, uploads go on", strings.Join(freed, ", ")))
+	}
+}
+
+// mark has v count as full, true if it didn't before.
+func (g *diskGuard) mark(v *volume, why string) bool {
+	g.mu.Lock()
+	was := v.full
+	v.full = true
+	g.mu.Unlock()
+	if !was {
+		log.Printf("disk of the %s (%s): %s, uploads and new review copies there are paused", v.label, v.dir, why)
+	}
+	return !was
+}
+
+func (g *diskGuard) clear(v *volume) bool {
+	g.mu.Lock()
+	was := v.full
+	v.full = false
+	g.mu.Unlock()
+	if was {
+		log.Printf("disk of the %s (%s) has room again", v.label, v.dir)
+	}
+	return was
+}
+
+func (g *diskGuard) alert(message string) {
+	admins, err := adminEmails(g.db)
+	if err != nil {
+		// the database may well be on the full disk
+		log.Printf("could not tell the admins: %v", err)
+		return
+	}
+	for _, email := range admins {
+		g.notes.notify(email, message, "/scan")
+	}
+}
+
+// volumeOf finds the volume path is on, nil for one not watched.
+func (g *diskGuard) volumeOf(path string) *volume {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	var found *volume
+	for _, v := range g.volumes {
+		if (abs == v.dir || strings.HasPrefix(abs, v.dir+string(filepath.Separator))) && (found == nil || len(v.dir) > len(found.dir)) {
+			found = v
+		}
+	}
+	return found
+}
+
+// room returns errDiskFull if the volume of path is full.
+func (g *diskGuard) room(path string) error {
+	if g == nil {
+		return nil
+	}
+	v := g.volumeOf(path)
+	if v == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if v.full {
+		return errDiskFull
+	}
+	return nil
+}
+
+// noticed looks at the error of a write to path: one that ran out of space
+// pauses the volume and is returned as errDiskFull too.
+func (g *diskGuard) noticed(path string, err error) error {
+	if err == nil || !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	if g != nil {
+		if v := g.volumeOf(path); v != nil && g.mark(v, "a write ran out of space") {
+			g.alert(fmt.Sprintf("A write to the %s ran out of space, uploads to it are paused until there is room again", v.label))
+		}
+	}
+	return fmt.Errorf("%w: %w", errDiskFull, err)
+}
+
+// DiskStatus is a volume on the scan page.
+type DiskStatus struct {
+	Label string
+	Free  int64 // -1 if unknown
+	Full  bool
+}
+
+func (g *diskGuard) status() []DiskStatus {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var list []DiskStatus
+	for _, v := range g.volumes {
+		list = append(list, DiskStatus{Label: v.label, Free: v.free, Full: v.full})
+	}
+	return list
+}
+
+// writeMetrics adds the free space to /metrics.
+func (g *diskGuard) writeMetrics(w io.Writer) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "# HELP consus_disk_free_bytes Space left on the volumes written to, -1 if unknown.\n# TYPE consus_disk_free_bytes gauge\n")
+	for _, v := range g.volumes {
+		fmt.Fprintf(w, "consus_disk_free_bytes{volume=%q} %d\n", v.label, v.free)
+	}
+	fmt.Fprintf(w, "# HELP consus_disk_full Whether writes to a volume are paused for lack of space.\n# TYPE consus_disk_full gauge\n")
+	for _, v := range g.volumes {
+		full := 0
+		if v.full {
+			full = 1
+		}
+		fmt.Fprintf(w, "consus_disk_full{volume=%q} %d\n", v.label, full)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// The duplicate report at /duplicates groups the files with the same
+// checksum, from what file_checksums has. Only checksums still matching the
+// size and mtime the content check last saw count, and empty files are left
+// out, they are all the same. Files nobody asked the checksums of yet are
+// worked out in the background when an admin asks for it.
+
+// DuplicateGroup is files with the same content.
+type DuplicateGroup struct {
+	SHA256 string
+	Size   int64 // of each
+	Paths  []string
+}
+
+// Reclaimable is what deleting all but one of them frees.
+func (g DuplicateGroup) Reclaimable() int64 {
+	return g.Size * int64(len(g.Paths)-1)
+}
+
+// currentChecksum is the SQL condition for c's checksum being of what the
+// content index i has.
+const currentChecksum = "c.path = i.path AND c.size = i.size AND c.mtime = i.mtime"
+
+func findDuplicates(db *sql.DB) ([]DuplicateGroup, error) {
+	rows, err := db.Query(`SELECT c.sha256, c.size, c.path FROM file_checksums c
+		JOIN content_index i ON ` + currentChecksum + ` AND i.is_dir = 0
+		WHERE c.size > 0 AND c.sha256 IN (SELECT sha256 FROM file_checksums GROUP BY sha256 HAVING COUNT(*) > 1)
+		ORDER BY c.sha256, c.path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []DuplicateGroup
+	for rows.Next() {
+		var sum, rel string
+		var size int64
+		if err := rows.Scan(&sum, &size, &rel); err != nil {
+			return nil, err
+		}
+		if n := len(groups); n == 0 || groups[n-1].SHA256 != sum {
+			groups = append(groups, DuplicateGroup{SHA256: sum, Size: size})
+		}
+		groups[len(groups)-1].Paths = append(groups[len(groups)-1].Paths, rel)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// a copy changed since is no duplicate anymore
+	kept := groups[:0]
+	for _, g := range groups {
+		if len(g.Paths) > 1 {
+			kept = append(kept, g)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Reclaimable() > kept[j].Reclaimable() })
+	return kept, nil
+}
+
+// uncheckedFiles are the files in the content index without a current
+// checksum.
+func uncheckedFiles(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT i.path FROM content_index i
+		LEFT JOIN file_checksums c ON ` + currentChecksum + `
+		WHERE i.is_dir = 0 AND i.size > 0 AND c.path IS NULL ORDER BY i.path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []string
+	for rows.Next() {
+		var rel string
+		if err := rows.Scan(&rel); err != nil {
+			return nil, err
+		}
+		list = append(list, rel)
+	}
+	return list, rows.Err()
+}
+
+// checksummer works out the checksums of all files missing one, as bulk
+// work, one run at a time.
+type checksummer struct {
+	ctx     context.Context
+	db      *sql.DB
+	content *contentFS
+	running atomic.Bool
+	left    atomic.Int64 // files the running pass still has to read
+}
+
+func newChecksummer(ctx context.Context, db *sql.DB, content *contentFS) *checksummer {
+	return &checksummer{ctx: ctx, db: db, content: content}
+}
+
+// start begins a pass in the background unless one is going on.
+func (cs *checksummer) start() {
+	if !cs.running.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer cs.running.Store(false)
+		list, err := uncheckedFiles(cs.db)
+		if err != nil {
+			log.Printf("checksums: %v", err)
+			return
+		}
+		cs.left.Store(int64(len(list)))
+		failed := 0
+		for _, rel := range list {
+			sched.yield(cs.ctx)
+			if cs.ctx.Err() != nil {
+				return
+			}
+			if _, err := fileChecksums(cs.ctx, cs.db, cs.content, rel); err != nil {
+				failed++
+			}
+			cs.left.Add(-1)
+		}
+		log.Printf("checksums: worked out for %d files, %d could not be read", len(list)-failed, failed)
+	}()
+}
+
+func renderDuplicates(tmpl *template.Template, db *sql.DB, sums *checksummer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, err := findDuplicates(db)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		unchecked, err := uncheckedFiles(db)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data := struct {
+			Version     string
+			CSRF        string
+			UserEmail   string
+			Groups      []DuplicateGroup
+			Reclaimable int64
+			Unchecked   int   // files without a checksum yet
+			Left        int64 // of the pass running, -1 for none
+		}{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: emailFromRequest(r),
+			Groups:    groups,
+			Unchecked: len(unchecked),
+			Left:      -1,
+		}
+		for _, g := range groups {
+			data.Reclaimable += g.Reclaimable()
+		}
+		if sums.running.Load() {
+			data.Left = sums.left.Load()
+		}
+		if err := tmpl.ExecuteTemplate(w, "duplicates.html", data); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// duplicatesSubmit is POST /duplicates, which works out the checksums still
+// missing.
+func duplicatesSubmit(sums *checksummer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sums.start()
+		http.Redirect(w, r, "/duplicates", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The embed player at /embed/<path> is just the player, for an iframe on a
+// blog or wiki. Framing it is allowed from the origins -embed-origins lists,
+// sent as CSP frame-ancestors. Files need to be visible to whoever reads the
+// page, browsers don't send the login cookie into a frame on another site, a
+// share link's /s/<token>/embed/ works for everything else.
+
+// EmbedView is what the embed player is rendered from.
+type EmbedView struct {
+	Src      string // of the media
+	MimeType string
+	Name     string
+	Link     string // to the full view page
+	Start    float64
+	Autoplay bool
+}
+
+// frameAncestors turns -embed-origins into the frame-ancestors sources, only
+// Consus itself when it is empty.
+func frameAncestors(origins string) (string, error) {
+	sources := []string{"'self'"}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			return "*", nil
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return "", fmt.Errorf("-embed-origins: %q is not an origin like https://blog.example.com", origin)
+		}
+		sources = append(sources, u.Scheme+"://"+u.Host)
+	}
+	return strings.Join(sources, " "), nil
+}
+
+// embedStart reads ?t=, in seconds or like 1m30s.
+func embedStart(t string) float64 {
+	if secs, err := strconv.ParseFloat(t, 64); err == nil && secs > 0 {
+		return secs
+	}
+	if d, err := time.ParseDuration(t); err == nil && d > 0 {
+		return d.Seconds()
+	}
+	return 0
+}
+
+// serveEmbed sends the player for canon, which is rel below base.
+func serveEmbed(w http.ResponseWriter, r *http.Request, tmpl *template.Template, ancestors, base, rel, canon string) {
+	if !isMediaFile(canon) {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	data := EmbedView{
+		Src:      base + "files/" + rel,
+		MimeType: GetMimeTypeFromFilename(canon),
+		Name:     path.Base(canon),
+		Link:     base + "view/" + rel,
+		Start:    embedStart(q.Get("t")),
+		Autoplay: q.Get("autoplay") == "1" || q.Get("autoplay") == "true",
+	}
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+ancestors)
+	if err := tmpl.ExecuteTemplate(w, "embed.html", data); err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// renderEmbed is GET /embed/{path}.
+func renderEmbed(tmpl *template.Template, ancestors string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel := strings.TrimPrefix(r.URL.Path, "/embed/")
+		serveEmbed(w, r, tmpl, ancestors, "/", rel, rel)
+	}
+}
+
+// shareEmbed is GET /s/{token}/embed/{path...}, for shares that allow viewing.
+func shareEmbed(tmpl *template.Template, db *sql.DB, secret []byte, content *contentFS, ancestors string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := shareContent(w, r, db, secret)
+		if s == nil {
+			return
+		}
+		if !s.CanView {
+			http.Error(w, "this share does not allow viewing", http.StatusForbidden)
+			return
+		}
+		canon, err := s.resolve(content, r.PathValue("path"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		serveEmbed(w, r, tmpl, ancestors, s.base(), cleanRel(r.PathValue("path")), canon)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What happens in Consus that other parts care about. Whoever makes it happen
+// publishes an event, the parts interested subscribe to its kind rather than
+// being called from the handler.
+const (
+	eventFileAdded      = "file.added"      // a new file, uploaded through Consus
+	eventFileWritten    = "file.written"    // one there already, written over through Consus
+	eventEntryMoved     = "entry.moved"     // a file or folder renamed or moved through Consus, data: from
+	eventCommentPosted  = "comment.posted"  // data: id, share for guests
+	eventUserRegistered = "user.registered" // data: name, invite
+	eventFolderChanged  = "folder.changed"  // its entries, however that happened
+	eventAccessChanged  = "access.changed"  // the rule of a folder
+)
+
+const (
+	// eventMaxAttempts is how often a subscriber gets an event before it is
+	// given up, the waits in between doubling from a second to five minutes
+	eventMaxAttempts = 10
+	// eventsKeep is how long events stay after every subscriber had them
+	eventsKeep = 24 * time.Hour
+)
+
+type event struct {
+	ID     int64             `json:"id,omitempty"`
+	Kind   string            `json:"kind"`
+	Actor  string            `json:"actor,omitempty"` // email, or name of a guest
+	Path   string            `json:"path,omitempty"`
+	Data   map[string]string `json:"data,omitempty"`
+	At     time.Time         `json:"at"`
+	Origin string            `json:"origin,omitempty"` // the instance it came from, "" for this one
+}
+
+// eventBus hands events to the subscribers in the order they happened, at
+// least once: they are written to the database first and every subscriber
+// keeps a cursor there, moved on once it handled one. A restart picks up where
+// it stopped, a subscriber failing gets the event again later. Subscribers
+// have to cope with seeing an event twice.
+//
+// With a transport the events of this instance also go to NATS or Redis, and
+// those of the other instances on it come in, for the subscribers that want
+// them.
+type eventBus struct {
+	db        *sql.DB
+	instance  string
+	transport eventTransport // nil for this instance alone
+
+	mu        sync.Mutex
+	subs      []*eventSubscriber
+	published map[string]int64
+}
+
+type eventSubscriber struct {
+	name   string
+	kinds  map[string]bool // empty for all
+	remote bool            // also events of other instances
+	handle func(event) error
+	wake   chan struct{}
+
+	cursor    atomic.Int64
+	delivered atomic.Int64
+	failed    atomic.Int64
+}
+
+// events is set up by NewMainServer, publishing before does nothing.
+var events *eventBus
+
+func newEventBus(db *sql.DB, transport eventTransport) (*eventBus, error) {
+	instance, err := loadInstanceID(db)
+	if err != nil {
+		return nil, err
+	}
+	return &eventBus{db: db, instance: instance, transport: transport, published: map[string]int64{}}, nil
+}
+
+// loadInstanceID returns what this instance signs its events with, made up on
+// first start like the secret.
+func loadInstanceID(db *sql.DB) (string, error) {
+	var id string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = 'instance'").Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		id = hex.EncodeToString(b)
+		_, err = db.Exec("INSERT INTO settings (key, value) VALUES ('instance', ?)", id)
+	}
+	return id, err
+}
+
+// subscribe has handle called with every event of kinds, all of them without
+// any. name keeps the cursor across restarts; a new subscriber starts with
+// what is published from now on. Subscribe before run.
+func (b *eventBus) subscribe(name string, remote bool, handle func(event) error, kinds ...string) error {
+	s := &eventSubscriber{name: name, kinds: map[string]bool{}, remote: remote, handle: handle, wake: make(chan struct{}, 1)}
+	for _, k := range kinds {
+		s.kinds[k] = true
+	}
+	if _, err := b.db.Exec(`INSERT INTO event_cursors (subscriber, last_id)
+		SELECT ?, COALESCE(MAX(id), 0) FROM events WHERE true ON CONFLICT (subscriber) DO NOTHING`, name); err != nil {
+		return err
+	}
+	var cursor int64
+	if err := b.db.QueryRow("SELECT last_id FROM event_cursors WHERE subscriber = ?", name).Scan(&cursor); err != nil {
+		return err
+	}
+	s.cursor.Store(cursor)
+	b.mu.Lock()
+	b.subs = append(b.subs, s)
+	b.mu.Unlock()
+	return nil
+}
+
+// publish records that kind happened. Like audit it never fails the request,
+// an event that can't be stored is logged.
+func (b *eventBus) publish(kind, actor, rel string, data map[string]string) {
+	if b == nil {
+		return
+	}
+	e := event{Kind: kind, Actor: actor, Path: cleanRel(rel), Data: data, At: time.Now()}
+	if err := b.store(e, nil); err != nil {
+		log.Printf("could not publish %s event: %v", kind, err)
+		return
+	}
+	b.mu.Lock()
+	b.published[kind]++
+	b.mu.Unlock()
+}
+
+// store writes e, from another instance if originID is set, and wakes the
+// subscribers. An event from another instance that is here already is
+// dropped.
+func (b *eventBus) store(e event, originID *int64) error {
+	origin := e.Origin
+	e.ID, e.Origin = 0, ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := b.db.Exec("INSERT INTO events (kind, data, origin, origin_id, created_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		e.Kind, string(data), origin, originID, time.Now()); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.subs {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// run delivers to every subscriber until ctx is done.
+func (b *eventBus) run(ctx context.Context) {
+	if b.transport != nil {
+		go b.listen(ctx)
+	}
+	b.mu.Lock()
+	for _, s := range b.subs {
+		go b.deliver(ctx, s)
+	}
+	b.mu.Unlock()
+
+	tick := time.NewTicker(time.Hour)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			b.prune()
+		}
+	}
+}
+
+// prune drops what every subscriber had a while ago.
+func (b *eventBus) prune() {
+	b.mu.Lock()
+	var done int64 = -1
+	for _, s := range b.subs {
+		if c := s.cursor.Load(); done < 0 || c < done {
+			done = c
+		}
+	}
+	b.mu.Unlock()
+	if done <= 0 {
+		return
+	}
+	if _, err := b.db.Exec("DELETE FROM events WHERE id <= ? AND created_at < ?", done, time.Now().Add(-eventsKeep)); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+// deliver hands s the events after its cursor, one at a time.
+func (b *eventBus) deliver(ctx context.Context, s *eventSubscriber) {
+	for ctx.Err() == nil {
+		batch, err := b.after(s.cursor.Load(), 100)
+		if err != nil {
+			log.Printf("events for %s: %v", s.name, err)
+		}
+		if len(batch) == 0 {
+			select {
+			case <-ctx.Done():
+			case <-s.wake:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+		for _, e := range batch {
+			if s.wants(e) && !b.attempt(ctx, s, e) {
+				return
+			}
+			s.cursor.Store(e.ID)
+		}
+		if _, err := b.db.Exec("UPDATE event_cursors SET last_id = ? WHERE subscriber = ?", s.cursor.Load(), s.name); err != nil {
+			// the events come again after a restart, at least once is still kept
+			log.Printf("events for %s: %v", s.name, err)
+		}
+	}
+}
+
+func (s *eventSubscriber) wants(e event) bool {
+	if e.Kind == "" {
+		// could not be read
+		return false
+	}
+	return (e.Origin == "" || s.remote) && (len(s.kinds) == 0 || s.kinds[e.Kind])
+}
+
+// attempt has s handle e until it succeeds or eventMaxAttempts are used up.
+// It returns false when ctx ended first.
+func (b *eventBus) attempt(ctx context.Context, s *eventSubscriber, e event) bool {
+	wait := time.Second
+	for n := 1; ; n++ {
+		err := s.handle(e)
+		if err == nil {
+			s.delivered.Add(1)
+			return true
+		}
+		s.failed.Add(1)
+		if n == eventMaxAttempts {
+			log.Printf("events for %s: giving up on %s event %d: %v", s.name, e.Kind, e.ID, err)
+			return true
+		}
+		log.Printf("events for %s: %s event %d: %v, trying again in %s", s.name, e.Kind, e.ID, err, wait)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, 5*time.Minute)
+	}
+}
+
+// after reads the next events after the id cursor. The rows are closed before
+// any subscriber gets to query the database.
+func (b *eventBus) after(cursor int64, limit int) ([]event, error) {
+	rows, err := b.db.Query("SELECT id, data, origin FROM events WHERE id > ? ORDER BY id LIMIT ?", cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batch []event
+	for rows.Next() {
+		var e event
+		var id int64
+		var data, origin string
+		if err := rows.Scan(&id, &data, &origin); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			// a broken one is passed over, not handed out again and again
+			log.Printf("event %d: %v", id, err)
+		}
+		e.ID, e.Origin = id, origin
+		batch = append(batch, e)
+	}
+	return batch, rows.Err()
+}
+
+// forward is the subscriber sending the events of this instance to the
+// transport.
+func (b *eventBus) forward(e event) error {
+	id := e.ID
+	e.Origin = b.instance
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := b.transport.send(data); err != nil {
+		return fmt.Errorf("could not send event %d: %w", id, err)
+	}
+	return nil
+}
+
+// listen stores the events of the other instances on the transport, and
+// connects again when it loses the connection.
+func (b *eventBus) listen(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := b.transport.listen(ctx, func(data []byte) {
+			var e event
+			if err := json.Unmarshal(data, &e); err != nil || e.Origin == "" || e.ID == 0 {
+				log.Printf("events: ignoring a message on %s that isn't one", b.transport)
+				return
+			}
+			if e.Origin == b.instance {
+				return
+			}
+			id := e.ID
+			if err := b.store(e, &id); err != nil {
+				log.Printf("could not store event %d of %s: %v", id, e.Origin, err)
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("events: %s: %v", b.transport, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// writeMetrics adds the counts of the bus to /metrics.
+func (b *eventBus) writeMetrics(w io.Writer) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintf(w, "# HELP consus_events_published_total Events of this instance, by kind.\n# TYPE consus_events_published_total counter\n")
+	for _, kind := range slices.Sorted(maps.Keys(b.published)) {
+		fmt.Fprintf(w, "consus_events_published_total{kind=%q} %d\n", kind, b.published[kind])
+	}
+	fmt.Fprintf(w, "# HELP consus_events_delivered_total Events handled by a subscriber.\n# TYPE consus_events_delivered_total counter\n")
+	for _, s := range b.subs {
+		fmt.Fprintf(w, "consus_events_delivered_total{subscriber=%q} %d\n", s.name, s.delivered.Load())
+	}
+	fmt.Fprintf(w, "# HELP consus_events_failed_total Attempts of a subscriber that failed and are tried again.\n# TYPE consus_events_failed_total counter\n")
+	for _, s := range b.subs {
+		fmt.Fprintf(w, "consus_events_failed_total{subscriber=%q} %d\n", s.name, s.failed.Load())
+	}
+}
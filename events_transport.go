@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventTransport carries events between the instances of Consus, for
+// -events nats://host:4222 or redis://host:6379. Both only pass on what is
+// sent while the others listen; the bus keeps sending until the server took
+// it, an instance that is down misses what happens meanwhile.
+type eventTransport interface {
+	// send returns once the server has the message
+	send(data []byte) error
+	// listen hands every message to got until ctx ends or the connection
+	// breaks
+	listen(ctx context.Context, got func([]byte)) error
+	String() string
+}
+
+// openEventTransport reads -events. The subject or channel is consus.events,
+// or what ?topic= says.
+func openEventTransport(spec string) (eventTransport, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	topic := u.Query().Get("topic")
+	if topic == "" {
+		topic = "consus.events"
+	}
+	switch u.Scheme {
+	case "nats":
+		t := &natsTransport{addr: u.Host, topic: topic}
+		if !strings.Contains(t.addr, ":") {
+			t.addr += ":4222"
+		}
+		if u.User != nil {
+			t.user = u.User.Username()
+			t.password, _ = u.User.Password()
+		}
+		return t, nil
+	case "redis":
+		rc := newRedisCache(u, "events:", 0)
+		return &redisTransport{rc: rc, topic: topic}, nil
+	}
+	return nil, fmt.Errorf("events go to nats:// or redis://, not %q", u.Scheme)
+}
+
+// redisTransport publishes with the cache client, and listens on a connection
+// of its own: a subscribed one can't do anything else.
+type redisTransport struct {
+	rc    *redisCache
+	topic string
+}
+
+func (t *redisTransport) String() string { return "redis " + t.rc.addr + " " + t.topic }
+
+func (t *redisTransport) send(data []byte) error {
+	_, err := t.rc.do("PUBLISH", t.topic, string(data))
+	return err
+}
+
+func (t *redisTransport) listen(ctx context.Context, got func([]byte)) error {
+	conn, err := net.DialTimeout("tcp", t.rc.addr, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	sub := &redisCache{addr: t.rc.addr, conn: conn, rd: bufio.NewReader(conn)}
+	if t.rc.password != "" {
+		if _, err := sub.roundTrip("AUTH", t.rc.password); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(conn, fmt.Sprintf("*2\r\n$9\r\nSUBSCRIBE\r\n$%d\r\n%s\r\n", len(t.topic), t.topic)); err != nil {
+		return err
+	}
+	for {
+		// roundTrip put a deadline on it
+		conn.SetDeadline(time.Time{})
+		reply, err := readRedisArray(sub.rd)
+		if err != nil {
+			return err
+		}
+		if len(reply) == 3 && reply[0] == "message" {
+			got([]byte(reply[2]))
+		}
+	}
+}
+
+// readRedisArray reads an array of strings and numbers, which is what a
+// subscribed connection gets.
+func readRedisArray(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return nil, redisError(line[1:])
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected reply %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	items := make([]string, 0, n)
+	for range n {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, ":"):
+			items = append(items, line[1:])
+		case strings.HasPrefix(line, "$"):
+			size, err := strconv.Atoi(line[1:])
+			if err != nil {
+				return nil, err
+			}
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(rd, buf); err != nil {
+				return nil, err
+			}
+			items = append(items, string(buf[:size]))
+		default:
+			return nil, fmt.Errorf("unexpected reply %q", line)
+		}
+	}
+	return items, nil
+}
+
+// natsTransport speaks the text protocol of NATS, without JetStream. A PING
+// after every message tells when the server has it.
+type natsTransport struct {
+	addr, user, password string
+	topic                string
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func (t *natsTransport) String() string { return "nats " + t.addr + " " + t.topic }
+
+// dial connects and logs in, what the server says first is its INFO.
+func (t *natsTransport) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", t.addr, 2*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+	if line, err := rd.ReadString('\n'); err != nil {
+		conn.Close()
+		return nil, nil, err
+	} else if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, nil, fmt.Errorf("not a NATS server: %q", strings.TrimSpace(line))
+	}
+	opts, _ := json.Marshal(map[string]any{"verbose": false, "pedantic": false, "name": "consus", "user": t.user, "pass": t.password})
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", opts); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := natsPong(rd); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rd, nil
+}
+
+// natsPong waits for the PONG to a PING, failing on an -ERR before it.
+func natsPong(rd *bufio.Reader) error {
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (t *natsTransport) send(data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if t.conn == nil {
+			conn, rd, err := t.dial()
+			if err != nil {
+				return err
+			}
+			t.conn, t.rd = conn, rd
+		}
+		t.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err := fmt.Fprintf(t.conn, "PUB %s %d\r\n%s\r\nPING\r\n", t.topic, len(data), data)
+		if err == nil {
+			err = natsPong(t.rd)
+		}
+		if err == nil || attempt == 1 {
+			return err
+		}
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+func (t *natsTransport) listen(ctx context.Context, got func([]byte)) error {
+	conn, rd, err := t.dial()
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	if _, err := fmt.Fprintf(conn, "SUB %s 1\r\n", t.topic); err != nil {
+		return err
+	}
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			if _, err := io.WriteString(conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case "-ERR":
+			return errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case "MSG":
+			// MSG subject sid [reply-to] size
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return fmt.Errorf("unexpected %q", strings.TrimSpace(line))
+			}
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(rd, buf); err != nil {
+				return err
+			}
+			got(buf[:size])
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"path"
+	"sync"
+)
+
+// folderSizes keeps the total size of every folder, of all files below it,
+// for the listing. It is added up from the content index rather than by
+// walking the disk on every visit, after each content check and each change
+// the watcher puts in the index.
+type folderSizes struct {
+	db   *sql.DB
+	kick chan struct{}
+
+	mu    sync.RWMutex
+	sizes map[string]int64 // by the path of the folder, nil until first added up
+}
+
+func newFolderSizes(db *sql.DB) *folderSizes {
+	return &folderSizes{db: db, kick: make(chan struct{}, 1)}
+}
+
+// changed asks for the sizes to be added up again, it never blocks.
+func (sz *folderSizes) changed() {
+	if sz == nil {
+		return
+	}
+	select {
+	case sz.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run adds the sizes up once and then whenever changed was called.
+func (sz *folderSizes) run(ctx context.Context) {
+	sz.changed()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sz.kick:
+			if err := sz.update(); err != nil {
+				log.Printf("folder sizes: %v", err)
+			}
+		}
+	}
+}
+
+func (sz *folderSizes) update() error {
+	rows, err := sz.db.Query("SELECT path, size FROM content_index WHERE is_dir = 0")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var rel string
+		var size int64
+		if err := rows.Scan(&rel, &size); err != nil {
+			return err
+		}
+		for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+			sizes[dir] += size
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	sz.mu.Lock()
+	sz.sizes = sizes
+	sz.mu.Unlock()
+	return nil
+}
+
+// of is the sizes of the folders among files in dir, by their names. Folders
+// not in the index yet, or empty, are left out.
+func (sz *folderSizes) of(dir string, files []listEntry) map[string]int64 {
+	if sz == nil {
+		return nil
+	}
+	sz.mu.RLock()
+	defer sz.mu.RUnlock()
+	var sizes map[string]int64
+	for _, f := range files {
+		if !f.IsDir {
+			continue
+		}
+		if size, ok := sz.sizes[path.Join(cleanRel(dir), f.Name)]; ok {
+			if sizes == nil {
+				sizes = map[string]int64{}
+			}
+			sizes[f.Name] = size
+		}
+	}
+	return sizes
+}
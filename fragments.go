@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"time"
+)
+
+// fragments renders the parts of a page that don't depend on who is looking,
+// the rows of a listing and the comments of a file, through a cache. A fragment
+// is keyed by a hash of exactly the data it is rendered from, so a new file or
+// comment makes a new key and nothing ever needs invalidating; the old entry
+// just ages out. The menu and forms around them are rendered fresh every time.
+type fragments struct {
+	tmpl  *template.Template
+	cache *meteredCache
+}
+
+// render executes the template name with data, which has to marshal to JSON
+// and hold everything the template reads.
+func (f *fragments) render(name string, data any) (template.HTML, error) {
+	input, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(name+"\x00"), input...))
+	out, err := f.cache.fetch("fragment\x00"+hex.EncodeToString(sum[:]), func() ([]byte, error) {
+		var buf bytes.Buffer
+		if err := f.tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	})
+	return template.HTML(out), err
+}
+
+// listRows is what the rows of a listing are rendered from.
+type listRows struct {
+	Base         string
+	Path         string
+	Files        []listEntry
+	CommentCount map[string]uint16
+	FolderSizes  map[string]int64
+	CanDownload  bool
+	ShowPerms    bool
+	Selectable   bool // with checkboxes for downloading some of the files
+	Manageable   bool // with rename, move and delete, for editors
+	Pastes       bool // names open the paste page
+}
+
+func (v ListView) Rows() listRows {
+	return listRows{
+		Base:         v.Base,
+		Path:         v.Path,
+		Files:        v.Files,
+		CommentCount: v.CommentCount,
+		FolderSizes:  v.FolderSizes,
+		CanDownload:  v.Share == nil || v.Share.CanDownload,
+		ShowPerms:    v.ShowPerms,
+		Selectable:   v.Share == nil,
+		Manageable:   v.Share == nil && roleAtLeast(v.UserRole, roleEditor),
+		Pastes:       v.Share == nil && v.Paste,
+	}
+}
+
+// commentList is what the comments of a file are rendered from. Deletable
+// holds the IDs the viewer may still delete, for most viewers none, so they
+// all share one cached fragment.
+type commentList struct {
+	Path      string
+	Shared    bool
+	Comments  []Commentv1
+	Deletable map[string]bool
+}
+
+// commentDeletable tells whether a comment posted at t is still young enough
+// for its author to take back.
+func commentDeletable(t time.Time) bool {
+	return time.Since(t) < 5*time.Minute
+}
+
+// CommentList is called with whether the instance takes changes at all.
+func (v ItemView) CommentList(writable bool) commentList {
+	list := commentList{Path: v.Path, Shared: v.Share != nil, Comments: v.Comments}
+	if !writable || !roleAtLeast(v.UserRole, roleEditor) {
+		return list
+	}
+	for _, c := range v.Comments {
+		if c.User == v.UserEmail && commentDeletable(c.When) {
+			if list.Deletable == nil {
+				list.Deletable = map[string]bool{}
+			}
+			list.Deletable[c.ID] = true
+		}
+	}
+	return list
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+// URL paths and access rules are slash separated and match names exactly, the
+// disk underneath might not: NTFS and APFS find "Clients/Acme" when asked for
+// "clients/acme", Windows also takes "\" as a separator and quietly drops
+// trailing dots and spaces. Left alone, every one of those is a second spelling
+// of a restricted folder that its rule does not know about. contentFS maps each
+// incoming path onto the one spelling that is actually on disk, before it is
+// checked or served. It is also where paths that try to leave the content
+// folder are turned away, with .. or, if asked to, through a symlink.
+
+var (
+	errReservedName = errors.New("name cannot be used on this filesystem")
+	errEscape       = errors.New("path leads outside the content folder")
+	errLinkRefused  = errors.New("path goes through a symlink, which -follow-symlinks does not allow")
+)
+
+// symlinkPolicy is which symlinks get followed, set with -follow-symlinks.
+type symlinkPolicy string
+
+const (
+	followAlways     symlinkPolicy = "always"
+	followInsideRoot symlinkPolicy = "inside-root" // only ones staying in the content folder, or their mount
+	followNever      symlinkPolicy = "never"
+)
+
+func parseSymlinkPolicy(s string) (symlinkPolicy, error) {
+	switch p := symlinkPolicy(s); p {
+	case followAlways, followInsideRoot, followNever:
+		return p, nil
+	}
+	return "", fmt.Errorf("-follow-symlinks: unknown policy %q, pick one of always, inside-root, never", s)
+}
+
+type contentFS struct {
+	root     string
+	mounts   []mount      // instead of root, see mounts.go
+	foldCase bool         // names on disk are matched case-insensitively
+	ignore   *ignoreRules // paths that are not served, nil for none
+	// which symlinks are followed, "" for all
+	symlinks symlinkPolicy
+	realRoot string
+	store    contentStore // of root, see storage.go
+	ident    string       // id, computed once
+}
+
+func newContentFS(root string, mounts []mount) *contentFS {
+	c := &contentFS{root: root, mounts: mounts, realRoot: realPath(root), store: diskStore(root)}
+	c.foldCase = caseInsensitive(c.dirs()[0].dir)
+	c.ident = c.id()
+	return c
+}
+
+// caseInsensitive looks up a name from dir with its case flipped. Without a
+// suitable name to try it goes by what the platform usually ships with.
+func caseInsensitive(dir string) bool {
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		flipped := strings.Map(func(r rune) rune {
+			if unicode.IsUpper(r) {
+				return unicode.ToLower(r)
+			}
+			return unicode.ToUpper(r)
+		}, e.Name())
+		if flipped == e.Name() {
+			continue
+		}
+		a, err := os.Lstat(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		b, err := os.Lstat(filepath.Join(dir, flipped))
+		return err == nil && os.SameFile(a, b)
+	}
+	return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+}
+
+// resolve cleans rel and returns it spelled the way it is on disk. Parts that do
+// not exist are kept as they are and end up as a 404 further down, hidden ones
+// give errHidden, ones that lead out of the content folder errEscape and ones
+// through a symlink -follow-symlinks doesn't allow errLinkRefused. Every
+// handler serving something from the content folder has its path through here.
+func (c *contentFS) resolve(rel string) (string, error) {
+	if strings.ContainsRune(rel, 0) {
+		return "", errReservedName
+	}
+	// cleaning would quietly turn them into something else, refuse them instead
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if part == ".." {
+			return "", errEscape
+		}
+	}
+	rel = cleanRel(rel)
+	if rel == "" {
+		return "", nil
+	}
+
+	parts := strings.Split(rel, "/")
+	// whether the parts so far are folders that exist
+	found := true
+	for i, name := range parts {
+		if hostNameProblem(name) != "" {
+			return "", errReservedName
+		}
+		if len(c.mounts) > 0 && i == 0 {
+			// mount names are matched exactly, below them it's up to the disk
+			m, _ := c.mountOf(name)
+			found = m != nil
+			continue
+		}
+		if c.foldCase && found {
+			parts[i] = c.diskName(strings.Join(parts[:i], "/"), name)
+		}
+		if found {
+			info, err := c.stat(strings.Join(parts[:i+1], "/"))
+			found = err == nil && info.IsDir()
+		}
+	}
+	canon := strings.Join(parts, "/")
+	if c.ignore.hidden(canon) {
+		return "", errHidden
+	}
+	if c.linkRefused(canon) {
+		return "", errLinkRefused
+	}
+	return canon, nil
+}
+
+// linkRefused tells whether rel goes through a symlink the policy doesn't
+// follow: any with never, with inside-root one ending up outside the content
+// folder, or its mount. Paths that don't exist aren't refused.
+func (c *contentFS) linkRefused(rel string) bool {
+	if c.symlinks == "" || c.symlinks == followAlways || c.virtual(rel) {
+		return false
+	}
+	base, under := c.realRoot, rel
+	if m, rest := c.mountOf(rel); m != nil {
+		base, under = m.real, rest
+	}
+	real, err := filepath.EvalSymlinks(c.abs(rel))
+	if err != nil {
+		return false
+	}
+	real, _ = filepath.Abs(real)
+	if c.symlinks == followNever {
+		return real != filepath.Join(base, filepath.FromSlash(under))
+	}
+	rel, err = filepath.Rel(base, real)
+	return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// diskName returns the entry of the folder dir that name refers to on a
+// case-insensitive disk, preferring an exact match.
+func (c *contentFS) diskName(dir, name string) string {
+	entries, err := c.readDir(dir)
+	if err != nil {
+		return name
+	}
+	found := name
+	for _, e := range entries {
+		if e.Name() == name {
+			return name
+		}
+		if found == name && strings.EqualFold(e.Name(), name) {
+			found = e.Name()
+		}
+	}
+	return found
+}
+
+// windowsNameProblem explains why name cannot exist on Windows, or aliases
+// another name there.
+func windowsNameProblem(name string) string {
+	if strings.TrimRight(name, ". ") != name {
+		return "name ends with a dot or space, Windows drops those"
+	}
+	if i := strings.IndexAny(name, `<>:"|?*\`); i >= 0 {
+		return "name contains " + name[i:i+1] + ", which Windows does not allow"
+	}
+	base, _, _ := strings.Cut(name, ".")
+	switch strings.ToUpper(strings.TrimRight(base, " ")) {
+	case "CON", "PRN", "AUX", "NUL",
+		"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+		"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9":
+		return "name is reserved for a device on Windows"
+	}
+	return ""
+}
+
+// hostNameProblem is windowsNameProblem where it matters, on Windows.
+func hostNameProblem(name string) string {
+	if runtime.GOOS != "windows" {
+		return ""
+	}
+	return windowsNameProblem(name)
+}
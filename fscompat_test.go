@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// makeTree creates the files under root, folders for names ending in /.
+func makeTree(t *testing.T, root string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		full := filepath.Join(root, filepath.FromSlash(name))
+		if name[len(name)-1] == '/' {
+			if err := os.MkdirAll(full, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// symlink links name below root to target, skipping the test where the
+// system doesn't let it.
+func symlink(t *testing.T, root, name, target string) {
+	t.Helper()
+	if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(name))); err != nil {
+		t.Skipf("no symlinks here: %v", err)
+	}
+}
+
+// testContent is a content tree of the files given, with the ignore rules of
+// the server and case folding off, like on Linux.
+func testContent(t *testing.T, names ...string) *contentFS {
+	t.Helper()
+	root := t.TempDir()
+	makeTree(t, root, names...)
+	c := newContentFS(root, nil)
+	c.foldCase = false
+	c.ignore = newIgnoreRules(c, false)
+	return c
+}
+
+type resolveCase struct {
+	rel, want string
+	err       error
+}
+
+func checkResolve(t *testing.T, c *contentFS, cases []resolveCase) {
+	t.Helper()
+	for _, tc := range cases {
+		got, err := c.resolve(tc.rel)
+		switch {
+		case tc.err != nil && !errors.Is(err, tc.err):
+			t.Errorf("resolve(%q) = %q, %v; want error %v", tc.rel, got, err, tc.err)
+		case tc.err == nil && (err != nil || got != tc.want):
+			t.Errorf("resolve(%q) = %q, %v; want %q", tc.rel, got, err, tc.want)
+		}
+	}
+}
+
+func TestResolveCleans(t *testing.T) {
+	c := testContent(t, "music/album/01.mp3")
+	checkResolve(t, c, []resolveCase{
+		{rel: "", want: ""},
+		{rel: "/", want: ""},
+		{rel: ".", want: ""},
+		{rel: "music", want: "music"},
+		{rel: "/music/album/", want: "music/album"},
+		{rel: "music//album/./01.mp3", want: "music/album/01.mp3"},
+		// what isn't there is kept as it is, the handler answers 404
+		{rel: "music/missing/x.mp3", want: "music/missing/x.mp3"},
+	})
+}
+
+func TestResolveRefusesEscapes(t *testing.T) {
+	c := testContent(t, "music/album/01.mp3")
+	checkResolve(t, c, []resolveCase{
+		{rel: "..", err: errEscape},
+		{rel: "../etc/passwd", err: errEscape},
+		{rel: "/../etc/passwd", err: errEscape},
+		{rel: "music/../../etc/passwd", err: errEscape},
+		// even the ones that would stay inside, cleaning them changes what was asked for
+		{rel: "music/album/../album/01.mp3", err: errEscape},
+		{rel: "music/..", err: errEscape},
+		{rel: "music/\x00/01.mp3", err: errReservedName},
+	})
+	// dots in a name are just part of the name
+	makeTree(t, c.root, "music/v1..v2/")
+	checkResolve(t, c, []resolveCase{{rel: "music/v1..v2", want: "music/v1..v2"}})
+}
+
+func TestResolveFoldsCase(t *testing.T) {
+	c := testContent(t, "Music/Album/Song.mp3", "Docs/readme.txt")
+	c.foldCase = true
+	checkResolve(t, c, []resolveCase{
+		{rel: "music/album/song.mp3", want: "Music/Album/Song.mp3"},
+		{rel: "MUSIC/ALBUM/SONG.MP3", want: "Music/Album/Song.mp3"},
+		{rel: "docs", want: "Docs"},
+		// below a part that isn't there, nothing is looked up
+		{rel: "music/new/song.mp3", want: "Music/new/song.mp3"},
+	})
+
+	// an exact match wins over one differing in case
+	makeTree(t, c.root, "Docs/README.txt")
+	checkResolve(t, c, []resolveCase{
+		{rel: "Docs/README.txt", want: "Docs/README.txt"},
+		{rel: "Docs/readme.txt", want: "Docs/readme.txt"},
+	})
+
+	c.foldCase = false
+	checkResolve(t, c, []resolveCase{{rel: "music/album/song.mp3", want: "music/album/song.mp3"}})
+}
+
+func TestResolveSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	makeTree(t, outside, "secret.txt")
+	c := testContent(t, "inside/file.txt")
+	symlink(t, c.root, "to-inside", filepath.Join(c.root, "inside"))
+	symlink(t, c.root, "to-outside", outside)
+	symlink(t, c.root, "inside/up", "..")
+
+	for _, tc := range []struct {
+		policy               symlinkPolicy
+		toInside, toOutside  error
+		throughRelativeAbove error
+	}{
+		{policy: ""},
+		{policy: followAlways},
+		{policy: followInsideRoot, toOutside: errLinkRefused},
+		{policy: followNever, toInside: errLinkRefused, toOutside: errLinkRefused, throughRelativeAbove: errLinkRefused},
+	} {
+		name := string(tc.policy)
+		if name == "" {
+			name = "unset"
+		}
+		t.Run(name, func(t *testing.T) {
+			c.symlinks = tc.policy
+			checkResolve(t, c, []resolveCase{
+				{rel: "inside/file.txt", want: "inside/file.txt"},
+				{rel: "to-inside/file.txt", want: "to-inside/file.txt", err: tc.toInside},
+				{rel: "to-outside/secret.txt", want: "to-outside/secret.txt", err: tc.toOutside},
+				{rel: "inside/up/inside/file.txt", want: "inside/up/inside/file.txt", err: tc.throughRelativeAbove},
+				// paths that don't exist aren't refused, they end up a 404
+				{rel: "to-outside/missing.txt", want: "to-outside/missing.txt"},
+			})
+		})
+	}
+}
+
+// The content folder itself may be reached through a symlink, what is inside
+// it still counts as inside.
+func TestResolveSymlinkedRoot(t *testing.T) {
+	real := t.TempDir()
+	makeTree(t, real, "inside/file.txt")
+	link := filepath.Join(t.TempDir(), "content")
+	if err := os.Symlink(real, link); err != nil {
+		t.Skipf("no symlinks here: %v", err)
+	}
+	c := newContentFS(link, nil)
+	c.foldCase = false
+	c.symlinks = followInsideRoot
+	checkResolve(t, c, []resolveCase{{rel: "inside/file.txt", want: "inside/file.txt"}})
+}
+
+func TestResolveHidden(t *testing.T) {
+	c := testContent(t,
+		"public/song.mp3", "public/take.tmp", "public/secret/plan.txt", "public/deep/secret/keep.txt",
+		"public/.env", ".trash/x", "consus.db",
+	)
+	if err := os.WriteFile(filepath.Join(c.root, "public", ignoreFile), []byte("*.tmp\n/secret/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c.ignore.keepPrivate(filepath.Join(c.root, "consus.db"), filepath.Join(c.root, "consus.db-wal"))
+	checkResolve(t, c, []resolveCase{
+		{rel: "public/song.mp3", want: "public/song.mp3"},
+		{rel: "public/take.tmp", err: errHidden},
+		{rel: "public/secret/plan.txt", err: errHidden},
+		{rel: "public/secret", err: errHidden},
+		// /secret/ is anchored to the folder of the .consusignore
+		{rel: "public/deep/secret/keep.txt", want: "public/deep/secret/keep.txt"},
+		{rel: "public/.env", err: errHidden},
+		{rel: "public/" + ignoreFile, err: errHidden},
+		{rel: ".trash/x", err: errHidden},
+		{rel: "consus.db", err: errHidden},
+		// before the database has written one
+		{rel: "consus.db-wal", err: errHidden},
+	})
+
+	c.ignore = newIgnoreRules(c, true)
+	c.ignore.keepPrivate(filepath.Join(c.root, "consus.db"))
+	checkResolve(t, c, []resolveCase{
+		{rel: "public/.env", want: "public/.env"},
+		{rel: "public/" + ignoreFile, err: errHidden},
+		{rel: ".trash/x", err: errHidden},
+		{rel: "consus.db", err: errHidden},
+	})
+}
+
+func TestResolveMounts(t *testing.T) {
+	music, docs := t.TempDir(), t.TempDir()
+	makeTree(t, music, "Album/01.mp3")
+	makeTree(t, docs, "readme.txt", ".env")
+	var mounts mountList
+	for _, spec := range []string{"music=" + music, "docs=" + docs} {
+		if err := mounts.Set(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newContentFS("", mounts)
+	c.foldCase = true
+	c.ignore = newIgnoreRules(c, false)
+	symlink(t, music, "to-docs", docs)
+	checkResolve(t, c, []resolveCase{
+		{rel: "", want: ""},
+		{rel: "music/Album/01.mp3", want: "music/Album/01.mp3"},
+		// below a mount it's up to the disk, its name is matched exactly
+		{rel: "music/album/01.mp3", want: "music/Album/01.mp3"},
+		{rel: "Music/album/01.mp3", want: "Music/album/01.mp3"},
+		{rel: "nothing/x", want: "nothing/x"},
+		{rel: "docs/.env", err: errHidden},
+		{rel: "music/../docs/readme.txt", err: errEscape},
+		{rel: "music/to-docs/readme.txt", want: "music/to-docs/readme.txt"},
+	})
+	// another mount is outside this one
+	c.symlinks = followInsideRoot
+	checkResolve(t, c, []resolveCase{
+		{rel: "docs/readme.txt", want: "docs/readme.txt"},
+		{rel: "music/to-docs/readme.txt", err: errLinkRefused},
+	})
+}
+
+func TestWindowsNameProblem(t *testing.T) {
+	for _, name := range []string{"song.mp3", "CONSOLE.txt", "com10", "Con Air.mkv", "a.b.c", "résumé.pdf"} {
+		if problem := windowsNameProblem(name); problem != "" {
+			t.Errorf("windowsNameProblem(%q) = %q, want none", name, problem)
+		}
+	}
+	for _, name := range []string{
+		"trailing.", "trailing ", "a<b", "a>b", "a:b", `a"b`, "a|b", "a?b", "a*b", `a\b`,
+		"CON", "con", "con.txt", "NUL.tar.gz", "COM1", "lpt9.log", "AUX .txt",
+	} {
+		if windowsNameProblem(name) == "" {
+			t.Errorf("windowsNameProblem(%q) = none, want a problem", name)
+		}
+	}
+}
+
+// On Windows those names are refused before they reach the disk, anywhere
+// else they are just names.
+func TestResolveReservedNames(t *testing.T) {
+	c := testContent(t, "music/album/01.mp3")
+	for _, rel := range []string{"music/con", "music/album./01.mp3", "music/a:b"} {
+		_, err := c.resolve(rel)
+		if refused := errors.Is(err, errReservedName); refused != (runtime.GOOS == "windows") {
+			t.Errorf("resolve(%q) = %v on %s", rel, err, runtime.GOOS)
+		}
+	}
+}
+
+// Windows takes \ as a separator, so there it has to be one for the checks
+// too, or music\..\secret would slip past them.
+func TestResolveBackslashes(t *testing.T) {
+	c := testContent(t, "music/album/01.mp3", "secret/plan.txt")
+	got, err := c.resolve(`music\album\01.mp3`)
+	if runtime.GOOS == "windows" {
+		if err != nil || got != "music/album/01.mp3" {
+			t.Errorf(`resolve(music\album\01.mp3) = %q, %v`, got, err)
+		}
+		if _, err := c.resolve(`music\..\secret\plan.txt`); !errors.Is(err, errEscape) {
+			t.Errorf(`resolve(music\..\secret\plan.txt) = %v, want %v`, err, errEscape)
+		}
+		return
+	}
+	if err != nil || got != `music\album\01.mp3` {
+		t.Errorf(`resolve(music\album\01.mp3) = %q, %v; want it as one name`, got, err)
+	}
+}
+
+func TestCaseInsensitiveProbe(t *testing.T) {
+	// nothing with a case to flip, it goes by the platform
+	dir := t.TempDir()
+	makeTree(t, dir, "123", "_-_")
+	if got, want := caseInsensitive(dir), runtime.GOOS == "windows" || runtime.GOOS == "darwin"; got != want {
+		t.Errorf("caseInsensitive without letters = %v, want %v on %s", got, want, runtime.GOOS)
+	}
+
+	// with a name to flip it asks the disk
+	dir = t.TempDir()
+	makeTree(t, dir, "Music/")
+	_, err := os.Stat(filepath.Join(dir, "mUSIC"))
+	if got := caseInsensitive(dir); got != (err == nil) {
+		t.Errorf("caseInsensitive = %v, but looking up mUSIC gave %v", got, err)
+	}
+}
+
+func TestDiskName(t *testing.T) {
+	c := testContent(t, "Music/", "Docs/Readme.txt", "Docs/readme.md")
+	for _, tc := range []struct{ dir, name, want string }{
+		{"", "music", "Music"},
+		{"", "Music", "Music"},
+		{"Docs", "README.TXT", "Readme.txt"},
+		{"Docs", "readme.md", "readme.md"},
+		{"Docs", "missing", "missing"},
+		{"missing", "x", "x"},
+	} {
+		if got := c.diskName(tc.dir, tc.name); got != tc.want {
+			t.Errorf("diskName(%q, %q) = %q, want %q", tc.dir, tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	textMaxFile = 32 << 20 // bigger files are not read for their text
+	textMaxBody = 1 << 20  // text kept per file
+)
+
+// textExtractors turn a file into the text the full-text index keeps.
+var textExtractors = map[string]func([]byte) string{
+	".txt": plainText,
+	".md":  plainText,
+	".srt": subtitleText,
+	".vtt": subtitleText,
+	".pdf": pdfText,
+}
+
+// textIndex keeps the text of lyrics, notes, scores and subtitles in an FTS5
+// table. It works off the content index, so it only reads files that are new
+// or changed since it last looked, and follows every content check.
+type textIndex struct {
+	db      *sql.DB
+	content *contentFS
+	kick    chan struct{}
+}
+
+// newTextIndex sets up the FTS5 table. That is not a migration since mattn's
+// driver only has FTS5 when built with the sqlite_fts5 tag, and a database
+// should keep working with a binary built without it.
+func newTextIndex(db *sql.DB, content *contentFS) (*textIndex, error) {
+	if _, err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS content_text
+		USING fts5(path UNINDEXED, body, tokenize = 'unicode61 remove_diacritics 2')`); err != nil {
+		return nil, fmt.Errorf("full-text search needs SQLite with FTS5, add the sqlite_fts5 tag to cgo_sqlite builds: %w", err)
+	}
+	return &textIndex{db: db, content: content, kick: make(chan struct{}, 1)}, nil
+}
+
+// changed asks for an update, it never blocks.
+func (ti *textIndex) changed() {
+	select {
+	case ti.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (ti *textIndex) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ti.kick:
+			if err := ti.update(ctx); err != nil {
+				log.Printf("full-text index: %v", err)
+			}
+		}
+	}
+}
+
+type textFile struct {
+	id        int64
+	size, mod int64
+}
+
+// update brings the text index in line with the content index.
+func (ti *textIndex) update(ctx context.Context) error {
+	started := time.Now()
+	want := map[string]textFile{}
+	rows, err := ti.db.Query("SELECT path, size, mod_time FROM content_index WHERE is_dir = 0")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var p string
+		var f textFile
+		if err := rows.Scan(&p, &f.size, &f.mod); err != nil {
+			rows.Close()
+			return err
+		}
+		if textExtractors[strings.ToLower(path.Ext(p))] != nil {
+			want[p] = f
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	have := map[string]textFile{}
+	rows, err = ti.db.Query("SELECT id, path, size, mod_time FROM content_text_files")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var p string
+		var f textFile
+		if err := rows.Scan(&f.id, &p, &f.size, &f.mod); err != nil {
+			rows.Close()
+			return err
+		}
+		have[p] = f
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	read, dropped := 0, 0
+	for p, f := range have {
+		if _, ok := want[p]; !ok {
+			if err := ti.drop(f.id); err != nil {
+				return err
+			}
+			dropped++
+		}
+	}
+	for p, f := range want {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if old, ok := have[p]; ok && old.size == f.size && old.mod == f.mod {
+			continue
+		}
+		text := ""
+		if !ti.content.linkRefused(p) {
+			text = extractText(ti.content, p, f.size)
+		}
+		if err := ti.store(p, f, text); err != nil {
+			return err
+		}
+		read++
+	}
+	if read > 0 || dropped > 0 {
+		log.Printf("full-text index: %d files read, %d dropped in %s", read, dropped, time.Since(started).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// extractText reads the file rel, "" when it can't be read. A file that gives
+// no text is still stored, so it isn't read again until it changes.
+func extractText(content *contentFS, rel string, size int64) string {
+	if size > textMaxFile {
+		return ""
+	}
+	data, err := content.readFile(rel)
+	if err != nil {
+		return ""
+	}
+	text := textExtractors[strings.ToLower(path.Ext(rel))](data)
+	if len(text) > textMaxBody {
+		text = text[:textMaxBody]
+	}
+	return strings.ToValidUTF8(text, "")
+}
+
+func (ti *textIndex) store(p string, f textFile, body string) error {
+	tx, err := ti.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var id int64
+	if err := tx.QueryRow(`INSERT INTO content_text_files (path, size, mod_time) VALUES (?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET size = excluded.size, mod_time = excluded.mod_time RETURNING id`,
+		p, f.size, f.mod).Scan(&id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM content_text WHERE rowid = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO content_text (rowid, path, body) VALUES (?, ?, ?)", id, p, body); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ti *textIndex) drop(id int64) error {
+	tx, err := ti.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM content_text WHERE rowid = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM content_text_files WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// search finds files below in whose text has every word of q, best first,
+// with a snippet around the match.
+func (ti *textIndex) search(in, q string) ([]SearchHit, error) {
+	var terms []string
+	for _, word := range strings.Fields(q) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	query := `SELECT path, snippet(content_text, 1, char(2), char(3), '…', 16) FROM content_text WHERE content_text MATCH ?`
+	args := []any{strings.Join(terms, " ")}
+	if in != "" {
+		query += " AND substr(path, 1, length(?) + 1) = ? || '/'"
+		args = append(args, in, in)
+	}
+	rows, err := ti.db.Query(query+" ORDER BY rank LIMIT 1000", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []SearchHit
+	for rows.Next() {
+		var h SearchHit
+		var snippet string
+		if err := rows.Scan(&h.Path, &snippet); err != nil {
+			return nil, err
+		}
+		h.Name = path.Base(h.Path)
+		h.Snippet = highlight(snippet)
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// highlight escapes a snippet and marks the matches, which FTS5 put between
+// \x02 and \x03.
+func highlight(snippet string) template.HTML {
+	s := html.EscapeString(snippet)
+	s = strings.ReplaceAll(s, "\x02", "<mark>")
+	s = strings.ReplaceAll(s, "\x03", "</mark>")
+	return template.HTML(s)
+}
+
+func plainText(data []byte) string {
+	return strings.TrimPrefix(string(data), "\ufeff")
+}
+
+// subtitleText keeps the spoken lines of SRT and WebVTT files, without cue
+// numbers, timings and styling.
+func subtitleText(data []byte) string {
+	var out strings.Builder
+	for line := range strings.Lines(plainText(data)) {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "WEBVTT" || strings.HasPrefix(line, "NOTE") || strings.Contains(line, "-->") ||
+			strings.Trim(line, "0123456789") == "" {
+			continue
+		}
+		out.WriteString(stripMarkup(line))
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
+
+// stripMarkup drops <i>-style tags and {\an8}-style overrides.
+func stripMarkup(line string) string {
+	var out strings.Builder
+	closing := rune(0)
+	for _, r := range line {
+		switch {
+		case closing != 0:
+			if r == closing {
+				closing = 0
+			}
+		case r == '<':
+			closing = '>'
+		case r == '{':
+			closing = '}'
+		default:
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Files and folders get an ID the first time somebody asks for one, kept in
+// file_ids. It stays with them when they are renamed, moved, trashed and
+// restored from the listing, WebDAV or SFTP, so a link to /id/<id> or an app
+// keeping IDs instead of paths doesn't break. Something moved on the disk
+// behind Consus's back is new to it and gets a new ID. Comments have had IDs
+// of their own all along, and shares their token.
+
+// idFormats are the generators -id-format picks from. IDs of any of them
+// can be mixed, only new ones are made with the one picked.
+var idFormats = map[string]func() string{
+	// sorts by when it was made, 26 characters
+	"ulid": newULID,
+	// 16 hex digits, like comments had before
+	"hex": newCommentID,
+}
+
+// newID makes the IDs of new files and comments, set from -id-format.
+var newID = newULID
+
+func idFormatNames() string {
+	var names []string
+	for name := range idFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID is a ULID: the milliseconds since 1970 in 48 bits, then 80 random
+// ones, in Crockford's base 32.
+func newULID() string {
+	var b [16]byte
+	ms := uint64(time.Now().UnixMilli())
+	binary.BigEndian.PutUint16(b[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:], uint32(ms))
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err)
+	}
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	out := make([]byte, 26)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+var errUnknownID = errors.New("no file or folder has that ID")
+
+// entryID is the ID of rel, made now if it has none yet.
+func entryID(db *sql.DB, rel string) (string, error) {
+	rel = cleanRel(rel)
+	if _, err := db.Exec("INSERT INTO file_ids (id, path) VALUES (?, ?) ON CONFLICT (path) DO NOTHING", newID(), rel); err != nil {
+		return "", err
+	}
+	var id string
+	err := db.QueryRow("SELECT id FROM file_ids WHERE path = ?", rel).Scan(&id)
+	return id, err
+}
+
+// entryPath is where the file or folder id is now.
+func entryPath(db *sql.DB, id string) (string, error) {
+	var rel string
+	err := db.QueryRow("SELECT path FROM file_ids WHERE id = ?", id).Scan(&rel)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errUnknownID
+	}
+	return rel, err
+}
+
+// visibleEntry is the path of id if it is there for whoever asks in r.
+func visibleEntry(db *sql.DB, content *contentFS, r *http.Request, id string) (string, bool, error) {
+	rel, err := entryPath(db, id)
+	if err != nil {
+		return "", false, err
+	}
+	canon, err := content.resolve(rel)
+	if err != nil {
+		// gone, or hidden: the same to the one asking
+		return "", false, errUnknownID
+	}
+	info, err := content.stat(canon)
+	if err != nil {
+		return "", false, errUnknownID
+	}
+	ok, err := canAccessPath(db, emailFromRequest(r), canon)
+	if err != nil {
+		return "", false, err
+	} else if !ok {
+		return "", false, errUnknownID
+	}
+	return canon, info.IsDir(), nil
+}
+
+// idRedirect is GET /id/{id}, which sends the browser to wherever the file
+// or folder is now.
+func idRedirect(db *sql.DB, content *contentFS) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		redirectToEntry(w, r, db, content, r.PathValue("id"))
+	}
+}
+
+// redirectToEntry sends the browser to the listing or player of id.
+func redirectToEntry(w http.ResponseWriter, r *http.Request, db *sql.DB, content *contentFS, id string) {
+	rel, isDir, err := visibleEntry(db, content, r, id)
+	if errors.Is(err, errUnknownID) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	to := "/files/" + (&url.URL{Path: rel}).EscapedPath()
+	if isDir && rel != "" {
+		to += "/"
+	} else if isMediaFile(rel) {
+		to = "/view/" + (&url.URL{Path: rel}).EscapedPath()
+	}
+	http.Redirect(w, r, to, http.StatusSeeOther)
+}
+
+// entryRef is what the API tells about an ID.
+type entryRef struct {
+	ID    string `json:"id"`
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir"`
+}
+
+// apiEntryID is GET /ids/{path}, the ID of a file or folder.
+func apiEntryID(db *sql.DB, content *contentFS) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel := cleanRel(strings.TrimPrefix(r.URL.Path, "/api/"+newestAPIVersion().name+"/ids/"))
+		info, err := content.stat(rel)
+		if err != nil {
+			writeAPIError(w, r, http.StatusNotFound, errCodeNotFound, "no such file or folder", map[string]string{"path": rel})
+			return
+		}
+		id, err := entryID(db, rel)
+		if err != nil {
+			writeAPIError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error(), nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entryRef{ID: id, Path: rel, IsDir: info.IsDir()})
+	}
+}
+
+// apiEntryPath is GET /paths/{id}, where a file or folder is now.
+func apiEntryPath(db *sql.DB, content *contentFS) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		rel, isDir, err := visibleEntry(db, content, r, id)
+		if errors.Is(err, errUnknownID) {
+			writeAPIError(w, r, http.StatusNotFound, errCodeNotFound, err.Error(), map[string]string{"id": id})
+			return
+		} else if err != nil {
+			writeAPIError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error(), nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entryRef{ID: id, Path: rel, IsDir: isDir})
+	}
+}
+
+// checkIDFormat sets newID from -id-format.
+func checkIDFormat(name string) error {
+	gen, ok := idFormats[name]
+	if !ok {
+		return fmt.Errorf("-id-format: unknown format %q, pick one of %s", name, idFormatNames())
+	}
+	newID = gen
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ignoreFile = ".consusignore"
+	// ignoreRecheck is how long the rules of a folder are used before the
+	// file is looked at again
+	ignoreRecheck = 2 * time.Second
+)
+
+var errHidden = errors.New("hidden by " + ignoreFile)
+
+// ignorePattern is one line of a .consusignore file.
+type ignorePattern struct {
+	glob     string // without the leading ! and / and the trailing /
+	negate   bool   // ! brings back what an earlier pattern hid
+	dirOnly  bool   // a trailing / only matches folders
+	anchored bool   // a / before the end matches from the folder of the file only
+}
+
+// ignoreRules hides files and folders from listings, search and direct links.
+// Any folder can have a .consusignore with gitignore patterns: *, ?, [a-z],
+// ** for any number of folders, ! to bring something back, a leading / to
+// only match next to the file and a trailing / to only match folders. The
+// patterns apply to the folder they are in and everything below it, later
+// lines win over earlier ones, and nothing inside a hidden folder comes back.
+// Dotfiles are hidden too unless showDot is set; the .consusignore files, the
+// trash and Consus' own files that happen to sit in the tree always are.
+type ignoreRules struct {
+	content *contentFS
+	showDot bool
+	private map[string]bool // see keepPrivate
+
+	mu    sync.Mutex
+	files map[string]*ignoreList // by folder below the root
+}
+
+type ignoreList struct {
+	checked  time.Time
+	mod      time.Time
+	size     int64
+	patterns []ignorePattern
+}
+
+func newIgnoreRules(content *contentFS, showDot bool) *ignoreRules {
+	return &ignoreRules{content: content, showDot: showDot, files: map[string]*ignoreList{}}
+}
+
+// keepPrivate hides the files and folders at the paths on disk given, the
+// database, keys and comment files of Consus, wherever they are in the content
+// tree. With the defaults the database is right in the content folder, and
+// with it the instance secret and every password hash.
+func (ig *ignoreRules) keepPrivate(files ...string) {
+	if ig.private == nil {
+		ig.private = map[string]bool{}
+	}
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if file == "" || err != nil {
+			continue
+		}
+		if rel, ok := ig.content.rel(abs); ok {
+			ig.private[ig.privateKey(rel)] = true
+		}
+	}
+}
+
+func (ig *ignoreRules) privateKey(rel string) string {
+	if ig.content.foldCase {
+		return strings.ToLower(rel)
+	}
+	return rel
+}
+
+// hidden tells whether rel, slash separated below the root, is hidden. It
+// looks at the disk to tell folders from files.
+func (ig *ignoreRules) hidden(rel string) bool {
+	rel = cleanRel(rel)
+	if ig == nil || rel == "" {
+		return false
+	}
+	info, err := ig.content.stat(rel)
+	return ig.hiddenEntry(rel, err == nil && info.IsDir())
+}
+
+// hiddenEntry is hidden for when the caller knows whether rel is a folder.
+func (ig *ignoreRules) hiddenEntry(rel string, isDir bool) bool {
+	if ig == nil {
+		return false
+	}
+	parts := strings.Split(cleanRel(rel), "/")
+	for i, name := range parts {
+		if name == "" {
+			continue
+		}
+		if ig.private[ig.privateKey(strings.Join(parts[:i+1], "/"))] {
+			return true
+		}
+		if name == ignoreFile || name == trashName || !ig.showDot && strings.HasPrefix(name, ".") {
+			return true
+		}
+		dir := i < len(parts)-1 || isDir
+		hide := false
+		for j := 0; j <= i; j++ {
+			for _, p := range ig.patterns(strings.Join(parts[:j], "/")) {
+				if p.dirOnly && !dir {
+					continue
+				}
+				target := name
+				if p.anchored {
+					target = strings.Join(parts[j:i+1], "/")
+				}
+				if globMatch(p.glob, target) {
+					hide = !p.negate
+				}
+			}
+		}
+		if hide {
+			return true
+		}
+	}
+	return false
+}
+
+// filter drops the hidden entries of the folder dir.
+func (ig *ignoreRules) filter(dir string, entries []listEntry) []listEntry {
+	if ig == nil {
+		return entries
+	}
+	kept := make([]listEntry, 0, len(entries))
+	for _, e := range entries {
+		if !ig.hiddenEntry(path.Join(cleanRel(dir), e.Name), e.IsDir) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// patterns returns the rules of the .consusignore in dir, reading it again
+// when it changed.
+func (ig *ignoreRules) patterns(dir string) []ignorePattern {
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	list := ig.files[dir]
+	if list != nil && time.Since(list.checked) < ignoreRecheck {
+		return list.patterns
+	}
+	if list == nil {
+		list = &ignoreList{}
+		ig.files[dir] = list
+	}
+	list.checked = time.Now()
+
+	name := path.Join(dir, ignoreFile)
+	info, err := ig.content.stat(name)
+	if err != nil {
+		list.patterns, list.mod, list.size = nil, time.Time{}, 0
+		return nil
+	}
+	if info.ModTime().Equal(list.mod) && info.Size() == list.size {
+		return list.patterns
+	}
+	data, err := ig.content.readFile(name)
+	if err != nil {
+		return list.patterns
+	}
+	list.patterns, list.mod, list.size = parseIgnore(data), info.ModTime(), info.Size()
+	return list.patterns
+}
+
+func parseIgnore(data []byte) []ignorePattern {
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			// \# and \! for names that start with those
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored, line = true, strings.TrimPrefix(line, "/")
+		}
+		if line != "" {
+			p.glob = line
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// globMatch matches a slash separated name against a pattern in which **
+// stands for any number of folders.
+func globMatch(pattern, name string) bool {
+	return matchParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for k := 0; k <= len(name); k++ {
+				if matchParts(pattern[1:], name[k:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
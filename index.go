@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+)
+
+// The content index keeps every file and folder the content check has seen,
+// with size and mtime, plus the problems it found. Adding, removing or renaming
+// an entry changes the mtime of its folder, so a folder whose mtime matches the
+// index has the same entries as last time and is not read again. That way a
+// restart only looks at the folders that changed.
+//
+// Listings come from the index too. A folder's entries are replaced in one
+// transaction and read in one, so a listing is what the folder held at one
+// moment, never half of an update. Every change of the entries counts up the
+// folder's generation, which clients compare to tell whether what they have
+// is still current.
+
+type indexEntry struct {
+	Name  string
+	IsDir bool
+	Size  int64
+	Mod   int64 // UnixNano, for folders the mtime they had when last read, 0 if never
+	MTime int64 // UnixNano as listed, for folders too
+	Mode  fs.FileMode
+}
+
+// folderSnapshot is what the index holds about a folder at one moment.
+type folderSnapshot struct {
+	Mod        int64 // the mtime it was read at
+	Generation int64
+	Entries    []indexEntry
+}
+
+// snapshotFolder reads rel and its entries from the index. ok is false for
+// folders the index doesn't know.
+func snapshotFolder(db *sql.DB, rel string) (snap folderSnapshot, ok bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return snap, false, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow("SELECT mod_time, generation FROM content_index WHERE path = ?", rel).Scan(&snap.Mod, &snap.Generation)
+	if errors.Is(err, sql.ErrNoRows) {
+		return snap, false, nil
+	} else if err != nil {
+		return snap, false, err
+	}
+
+	rows, err := tx.Query("SELECT name, is_dir, size, mod_time, mtime, mode FROM content_index WHERE parent = ? ORDER BY name", rel)
+	if err != nil {
+		return snap, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e indexEntry
+		if err := rows.Scan(&e.Name, &e.IsDir, &e.Size, &e.Mod, &e.MTime, &e.Mode); err != nil {
+			return snap, false, err
+		}
+		snap.Entries = append(snap.Entries, e)
+	}
+	return snap, true, rows.Err()
+}
+
+// indexedFolder returns the mtime rel was read at and its entries. ok is false
+// for folders the index doesn't know.
+func indexedFolder(db *sql.DB, rel string) (mod int64, children []indexEntry, ok bool, err error) {
+	snap, ok, err := snapshotFolder(db, rel)
+	return snap.Mod, snap.Entries, ok, err
+}
+
+// sameEntries tells whether a listing of old and children looks the same.
+func sameEntries(old, children []indexEntry) bool {
+	if len(old) != len(children) {
+		return false
+	}
+	byName := map[string]indexEntry{}
+	for _, e := range old {
+		byName[e.Name] = e
+	}
+	for _, e := range children {
+		o, ok := byName[e.Name]
+		if !ok || o.IsDir != e.IsDir || o.Size != e.Size || o.MTime != e.MTime || o.Mode != e.Mode {
+			return false
+		}
+	}
+	return true
+}
+
+// storeFolder replaces what the index knows about the entries of rel. old is
+// what it knew before, folders missing from children are dropped with
+// everything below them. It tells whether a folder the index already had
+// changed.
+func storeFolder(db *sql.DB, rel string, mod int64, old, children []indexEntry, issues []scanIssue) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	kept := map[string]bool{}
+	for _, e := range children {
+		kept[e.Name] = e.IsDir
+	}
+	for _, e := range old {
+		if e.IsDir && !kept[e.Name] {
+			sub := path.Join(rel, e.Name)
+			if _, err := tx.Exec("DELETE FROM content_index WHERE path = ? OR substr(path, 1, length(?) + 1) = ? || '/'", sub, sub, sub); err != nil {
+				return false, err
+			}
+			if _, err := tx.Exec("DELETE FROM content_issues WHERE dir = ? OR substr(dir, 1, length(?) + 1) = ? || '/'", sub, sub, sub); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	// the rows of subfolders are also theirs, updated in place they keep
+	// their generation
+	rows, err := tx.Query("SELECT name FROM content_index WHERE parent = ?", rel)
+	if err != nil {
+		return false, err
+	}
+	var gone []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if _, ok := kept[name]; !ok {
+			gone = append(gone, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	for _, name := range gone {
+		if _, err := tx.Exec("DELETE FROM content_index WHERE path = ?", path.Join(rel, name)); err != nil {
+			return false, err
+		}
+	}
+	for _, e := range children {
+		if _, err := tx.Exec(`INSERT INTO content_index (path, parent, name, is_dir, size, mod_time, mtime, mode) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (path) DO UPDATE SET parent = excluded.parent, is_dir = excluded.is_dir, size = excluded.size,
+				mod_time = excluded.mod_time, mtime = excluded.mtime, mode = excluded.mode`,
+			path.Join(rel, e.Name), rel, e.Name, e.IsDir, e.Size, e.Mod, e.MTime, e.Mode); err != nil {
+			return false, err
+		}
+	}
+	parent := path.Dir(rel)
+	if rel == "." {
+		parent = ""
+	}
+	bump := 0
+	if !sameEntries(old, children) {
+		bump = 1
+	}
+	// a folder read before has its mtime, one only seen in its parent not yet
+	var before int64
+	if err := tx.QueryRow("SELECT mod_time FROM content_index WHERE path = ?", rel).Scan(&before); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	if _, err := tx.Exec(`INSERT INTO content_index (path, parent, name, is_dir, size, mod_time, generation) VALUES (?, ?, ?, 1, 0, ?, 1)
+		ON CONFLICT (path) DO UPDATE SET mod_time = excluded.mod_time, generation = generation + ?`, rel, parent, path.Base(rel), mod, bump); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM content_issues WHERE dir = ?", rel); err != nil {
+		return false, err
+	}
+	for _, issue := range issues {
+		if _, err := tx.Exec("INSERT INTO content_issues (dir, path, kind, detail) VALUES (?, ?, ?, ?)",
+			rel, issue.Path, issue.Kind, issue.Detail); err != nil {
+			return false, err
+		}
+	}
+	return bump == 1 && before != 0, tx.Commit()
+}
+
+func clearIndex(db *sql.DB) error {
+	if _, err := db.Exec("DELETE FROM content_index"); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM content_issues")
+	return err
+}
+
+// indexIssues returns the problems recorded anywhere in the index, up to
+// scanMaxIssues, and whether there were more.
+func indexIssues(db *sql.DB) ([]scanIssue, bool, error) {
+	rows, err := db.Query("SELECT path, kind, detail FROM content_issues ORDER BY path LIMIT ?", scanMaxIssues+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var issues []scanIssue
+	for rows.Next() {
+		var issue scanIssue
+		if err := rows.Scan(&issue.Path, &issue.Kind, &issue.Detail); err != nil {
+			return nil, false, err
+		}
+		issues = append(issues, issue)
+	}
+	if len(issues) > scanMaxIssues {
+		return issues[:scanMaxIssues], true, rows.Err()
+	}
+	return issues, false, rows.Err()
+}
+
+// saveScanReport remembers the outcome of the last check, and for which content
+// root it was, so the page has something to show right after a restart.
+func saveScanReport(db *sql.DB, root string, rep *scanReport) error {
+	data, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	for key, value := range map[string]string{"index.root": root, "index.report": string(data)} {
+		if _, err := db.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadScanReport returns the last saved check of root, nil if there is none.
+func loadScanReport(db *sql.DB, root string) (*scanReport, error) {
+	var savedRoot, data string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = 'index.root'").Scan(&savedRoot)
+	if errors.Is(err, sql.ErrNoRows) || savedRoot != root {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := db.QueryRow("SELECT value FROM settings WHERE key = 'index.report'").Scan(&data); err != nil {
+		return nil, err
+	}
+
+	rep := &scanReport{}
+	if err := json.Unmarshal([]byte(data), rep); err != nil {
+		return nil, err
+	}
+	rep.Issues, rep.Truncated, err = indexIssues(db)
+	return rep, err
+}
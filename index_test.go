@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// benchIndex fills a content index the way the content check does, with
+// top*subs folders of files each below the root. The defaults give a little
+// over a million entries.
+func benchIndex(b *testing.B, top, subs, files int) *sql.DB {
+	b.Helper()
+	db, err := openDB(filepath.Join(b.TempDir(), "consus.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	folders := func(prefix string, n int) []indexEntry {
+		entries := make([]indexEntry, n)
+		for i := range entries {
+			entries[i] = indexEntry{Name: fmt.Sprintf("%s %02d", prefix, i), IsDir: true, Mode: 0o755}
+		}
+		return entries
+	}
+	if _, err := storeFolder(db, ".", 1, nil, folders("archive", top), nil); err != nil {
+		b.Fatal(err)
+	}
+	n := 0
+	for t := 0; t < top; t++ {
+		dir := fmt.Sprintf("archive %02d", t)
+		if _, err := storeFolder(db, dir, 1, nil, folders("roll", subs), nil); err != nil {
+			b.Fatal(err)
+		}
+		for s := 0; s < subs; s++ {
+			entries := make([]indexEntry, files)
+			for i := range entries {
+				entries[i] = indexEntry{Name: fmt.Sprintf("photo %07d.jpg", n), Size: 3 << 20, MTime: int64(n), Mode: 0o644}
+				n++
+			}
+			if _, err := storeFolder(db, path.Join(dir, fmt.Sprintf("roll %02d", s)), 1, nil, entries, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return db
+}
+
+// BenchmarkContentIndex lists one folder and searches names in an index of a
+// million files, the whole tree and one top folder of it.
+func BenchmarkContentIndex(b *testing.B) {
+	db := benchIndex(b, 100, 10, 1000)
+
+	b.Run("list", func(b *testing.B) {
+		for i := 0; b.Loop(); i++ {
+			snap, _, err := snapshotFolder(db, fmt.Sprintf("archive %02d/roll %02d", i%100, i%10))
+			if err != nil || len(snap.Entries) != 1000 {
+				b.Fatalf("%d entries, %v", len(snap.Entries), err)
+			}
+		}
+	})
+	b.Run("list parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if _, _, err := snapshotFolder(db, fmt.Sprintf("archive %02d/roll %02d", i%100, i%10)); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+	b.Run("search", func(b *testing.B) {
+		for b.Loop() {
+			hits, err := searchIndex(db, "", "0424242")
+			if err != nil || len(hits) == 0 || hits[0].Name != "photo 0424242.jpg" {
+				b.Fatalf("%d hits, %v", len(hits), err)
+			}
+		}
+	})
+	b.Run("search in", func(b *testing.B) {
+		for b.Loop() {
+			hits, err := searchIndex(db, "archive 42", "0424242")
+			if err != nil || len(hits) == 0 || hits[0].Name != "photo 0424242.jpg" {
+				b.Fatalf("%d hits, %v", len(hits), err)
+			}
+		}
+	})
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Zip and tar files, comic book archives among them, can be browsed like
+// folders at /inside/<archive>/: their entries are listed from the archive
+// itself and each one is streamed out of it on its own, nothing is extracted
+// to the disk. Members stored without compression, the usual for comics and
+// videos, are served with ranges.
+
+// browsableFormats are the archives that can be browsed, by extension.
+var browsableFormats = map[string]string{
+	".zip": "zip",
+	".cbz": "zip",
+	".tar": "tar",
+	".cbt": "tar",
+}
+
+func isArchive(name string) bool {
+	_, ok := browsableFormats[strings.ToLower(path.Ext(name))]
+	return ok
+}
+
+// splitArchive cuts rel into the archive in it and the path inside that.
+func splitArchive(rel string) (archive, member string, ok bool) {
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		if isArchive(part) {
+			return strings.Join(parts[:i+1], "/"), strings.Join(parts[i+1:], "/"), true
+		}
+	}
+	return "", "", false
+}
+
+// archiveMember is a file or folder in an archive.
+type archiveMember struct {
+	name  string // full path inside the archive
+	isDir bool
+	size  int64
+	mod   time.Time
+	zf    *zip.File // nil for tar
+}
+
+type openArchive struct {
+	f       fs.File
+	ra      io.ReaderAt // zip only
+	format  string
+	entries []archiveMember
+}
+
+// memberName cleans a name from an archive, "" for ones that are no use.
+func memberName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, "\\", "/")), "/")
+}
+
+// readArchive opens the archive rel and reads its table of entries.
+func readArchive(content *contentFS, rel string) (*openArchive, error) {
+	f, err := content.open(rel)
+	if err != nil {
+		return nil, err
+	}
+	a := &openArchive{f: f, format: browsableFormats[strings.ToLower(path.Ext(rel))]}
+	if err := a.read(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *openArchive) read() error {
+	info, err := a.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &fs.PathError{Op: "open", Path: info.Name(), Err: fs.ErrNotExist}
+	}
+	switch a.format {
+	case "zip":
+		if ra, ok := a.f.(io.ReaderAt); ok {
+			a.ra = ra
+		} else if rs, ok := a.f.(io.ReadSeekCloser); ok {
+			a.ra = &seekReaderAt{f: rs}
+		} else {
+			return fmt.Errorf("%s can't be read from at random", info.Name())
+		}
+		zr, err := zip.NewReader(a.ra, info.Size())
+		if err != nil {
+			return err
+		}
+		for _, zf := range zr.File {
+			if name := memberName(zf.Name); name != "" {
+				isDir := zf.FileInfo().IsDir()
+				a.entries = append(a.entries, archiveMember{name: name, isDir: isDir, size: int64(zf.UncompressedSize64), mod: zf.Modified, zf: zf})
+			}
+		}
+	case "tar":
+		tr := tar.NewReader(a.f)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			name := memberName(h.Name)
+			// links in a tar are left out, they point who knows where
+			if name == "" || h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeDir {
+				continue
+			}
+			a.entries = append(a.entries, archiveMember{name: name, isDir: h.Typeflag == tar.TypeDir, size: h.Size, mod: h.ModTime})
+		}
+	}
+	return nil
+}
+
+func (a *openArchive) Close() error {
+	return a.f.Close()
+}
+
+// file is the file called name in the archive.
+func (a *openArchive) file(name string) (archiveMember, bool) {
+	for _, e := range a.entries {
+		if e.name == name && !e.isDir {
+			return e, true
+		}
+	}
+	return archiveMember{}, false
+}
+
+// list is what the folder dir of the archive holds, folders first. Folders
+// that are only there as part of the names of files below them count as well.
+func (a *openArchive) list(dir string) ([]listEntry, bool) {
+	found := dir == ""
+	at := map[string]int{}
+	var list []listEntry
+	for _, e := range a.entries {
+		rest := e.name
+		if dir != "" {
+			var ok bool
+			if rest, ok = strings.CutPrefix(e.name, dir+"/"); !ok {
+				found = found || e.name == dir && e.isDir
+				continue
+			}
+		}
+		found = true
+		name, _, below := strings.Cut(rest, "/")
+		if i, ok := at[name]; ok {
+			list[i].IsDir = list[i].IsDir || below || e.isDir
+			continue
+		}
+		entry := listEntry{Name: name, IsDir: below || e.isDir, ModTime: e.mod}
+		if !entry.IsDir {
+			entry.Size = e.size
+		}
+		at[name] = len(list)
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].IsDir != list[j].IsDir {
+			return list[i].IsDir
+		}
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+	return list, found
+}
+
+// open reads the file e from the archive.
+func (a *openArchive) open(e archiveMember) (io.ReadCloser, error) {
+	if e.zf != nil {
+		return e.zf.Open()
+	}
+	rs, ok := a.f.(io.Seeker)
+	if !ok {
+		return nil, errors.New("the archive can't be read again from the start")
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(a.f)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if memberName(h.Name) == e.name && h.Typeflag == tar.TypeReg {
+			return io.NopCloser(tr), nil
+		}
+	}
+}
+
+// serve sends the file e, with ranges if it is stored uncompressed in a zip.
+func (a *openArchive) serve(w http.ResponseWriter, r *http.Request, e archiveMember) {
+	if e.zf != nil && e.zf.Method == zip.Store {
+		if off, err := e.zf.DataOffset(); err == nil {
+			http.ServeContent(w, r, path.Base(e.name), e.mod, io.NewSectionReader(a.ra, off, e.size))
+			return
+		}
+	}
+	rc, err := a.open(e)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	if ctype := mime.TypeByExtension(path.Ext(e.name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(e.size, 10))
+	w.Header().Set("Last-Modified", e.mod.UTC().Format(http.TimeFormat))
+	if r.Method != http.MethodHead {
+		io.Copy(w, ctxReader{r.Context(), rc})
+	}
+}
+
+// ArchiveView is the listing of a folder in an archive.
+type ArchiveView struct {
+	Base        string
+	Archive     string // below Base + "files/"
+	Dir         string // in the archive, "" for the top
+	Breadcrumbs []Breadcrumb
+	Files       []listEntry
+	Version     string
+	UserEmail   string
+	Share       *Share
+}
+
+// browseArchive answers a request for member, a folder or file in the
+// archive canon. rel is the archive as the visitor sees it, below base.
+// It tells whether a file was sent.
+func browseArchive(w http.ResponseWriter, r *http.Request, tmpl *template.Template, content *contentFS, canon, rel, member, base string, share *Share) bool {
+	a, err := readArchive(content, canon)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return false
+	} else if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, fmt.Sprintf("%s can't be read as an archive: %v", path.Base(rel), err), http.StatusUnprocessableEntity)
+		return false
+	}
+	defer a.Close()
+
+	dir := strings.TrimSuffix(member, "/")
+	if member != "" && !strings.HasSuffix(member, "/") {
+		if e, ok := a.file(dir); ok {
+			if r.URL.Query().Has("download") {
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(e.name)))
+			}
+			a.serve(downloads.writer(w, r), r, e)
+			return true
+		}
+	}
+	files, found := a.list(dir)
+	if !found {
+		http.NotFound(w, r)
+		return false
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return false
+	}
+
+	// the crumbs up to the archive lead back to the listing it is in
+	crumbs := GenerateBreadcrumbs(base+"inside/", path.Join(rel, dir))
+	for i := 0; i < strings.Count(rel, "/"); i++ {
+		crumbs[i].URL = base + "files/" + strings.TrimPrefix(crumbs[i].URL, base+"inside/")
+	}
+	data := ArchiveView{
+		Base:        base,
+		Archive:     rel,
+		Dir:         dir,
+		Breadcrumbs: crumbs,
+		Files:       files,
+		Version:     GetVersion(),
+		UserEmail:   emailFromRequest(r),
+		Share:       share,
+	}
+	if err := tmpl.ExecuteTemplate(w, "archive.html", data); err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
+
+// archiveInside is GET /inside/{archive}/{path}.
+func archiveInside(tmpl *template.Template, content *contentFS) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel, member, ok := splitArchive(strings.TrimPrefix(r.URL.Path, "/inside/"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		// the route only checked the whole path, which a link can't be part of
+		if _, err := content.resolve(rel); errors.Is(err, errLinkRefused) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		browseArchive(w, r, tmpl, content, rel, rel, member, "/", nil)
+	}
+}
+
+// shareInside is GET /s/{token}/inside/{path...}, for shares that allow
+// downloading.
+func shareInside(tmpl *template.Template, db *sql.DB, secret []byte, content *contentFS, notes *notifier) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := shareContent(w, r, db, secret)
+		if s == nil {
+			return
+		}
+		if !s.CanDownload {
+			http.Error(w, "this share does not allow downloading", http.StatusForbidden)
+			return
+		}
+		rel, member, ok := splitArchive(cleanRel(r.PathValue("path")))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.PathValue("path"), "/") {
+			member += "/"
+		}
+		canon, err := s.resolve(content, rel)
+		if errors.Is(err, errLinkRefused) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		rw := &receiptWriter{ResponseWriter: w}
+		if browseArchive(rw, r, tmpl, content, canon, rel, member, s.base(), s) && rw.complete(r) {
+			recordDownload(db, notes, s, path.Join(rel, member), r, rw.written)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Invite struct {
+	Code      string
+	CreatedBy string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	MaxUses   int
+	Uses      int
+	Role      string
+}
+
+var errInvalidInvite = errors.New("invite code is invalid, expired or used up")
+
+func createInvite(db *sql.DB, createdBy, role string, maxUses int, ttl time.Duration) (*Invite, error) {
+	now := time.Now()
+	invite := &Invite{
+		Code:      newCommentID(),
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		MaxUses:   maxUses,
+		Role:      role,
+	}
+	_, err := db.Exec("INSERT INTO invites (code, created_by, created_at, expires_at, max_uses, role) VALUES (?, ?, ?, ?, ?, ?)",
+		invite.Code, invite.CreatedBy, invite.CreatedAt, invite.ExpiresAt, invite.MaxUses, invite.Role)
+	if err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+func listInvites(db *sql.DB) ([]Invite, error) {
+	rows, err := db.Query("SELECT code, created_by, created_at, expires_at, max_uses, uses, role FROM invites ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []Invite
+	for rows.Next() {
+		var i Invite
+		if err := rows.Scan(&i.Code, &i.CreatedBy, &i.CreatedAt, &i.ExpiresAt, &i.MaxUses, &i.Uses, &i.Role); err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+// redeemInvite consumes one use of the code and creates the account in the same transaction,
+// so a failed registration does not burn an invite. While no account exists yet the code
+// is not checked at all, which is how the first admin gets in.
+func redeemInvite(db *sql.DB, code, name, email, password string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var total int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users").Scan(&total); err != nil {
+		return err
+	}
+
+	role := roleAdmin
+	if total > 0 {
+		err := tx.QueryRow("UPDATE invites SET uses = uses + 1 WHERE code = ? AND uses < max_uses AND expires_at > ? RETURNING role",
+			code, time.Now()).Scan(&role)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errInvalidInvite
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if err := createUser(tx, name, email, password, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type registerView struct {
+	Version   string
+	CSRF      string
+	UserEmail string
+	Bootstrap bool
+	Code      string
+	Name      string
+	Email     string
+	Error     string
+}
+
+func renderRegister(tmpl *template.Template, db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		total, err := countUsers(db)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := registerView{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: emailFromRequest(r),
+			Bootstrap: total == 0,
+			Code:      r.URL.Query().Get("code"),
+		}
+		if err := tmpl.ExecuteTemplate(w, "register.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func registerSubmit(tmpl *template.Template, db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		data := registerView{
+			Version: GetVersion(),
+			CSRF:    csrfToken(r),
+			Code:    strings.TrimSpace(r.FormValue("code")),
+			Name:    strings.TrimSpace(r.FormValue("name")),
+			Email:   strings.TrimSpace(r.FormValue("email")),
+		}
+		password := r.FormValue("password")
+
+		switch {
+		case data.Name == "" || data.Email == "":
+			data.Error = "User name and email are required."
+		case !strings.Contains(data.Email, "@"):
+			data.Error = "That does not look like an email address."
+		case len(password) < 8:
+			data.Error = "Password must be at least 8 characters."
+		case password != r.FormValue("password_confirm"):
+			data.Error = "Passwords do not match."
+		}
+
+		if data.Error == "" {
+			err := redeemInvite(db, data.Code, data.Name, data.Email, password)
+			switch {
+			case err == nil:
+				audit(db, r, data.Email, auditRegister, data.Email, data.Name)
+				events.publish(eventUserRegistered, data.Email, "", map[string]string{"name": data.Name, "invite": data.Code})
+				if !startSession(w, r, data.Email, false) {
+					return
+				}
+				http.Redirect(w, r, "/files/", http.StatusSeeOther)
+				return
+			case errors.Is(err, errInvalidInvite), errors.Is(err, errUserExists):
+				data.Error = err.Error()
+			default:
+				log.Printf("register error: %v", err)
+				http.Error(w, "could not create account", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		if err := tmpl.ExecuteTemplate(w, "register.html", data); err != nil {
+			log.Printf("%s", err.Error())
+		}
+	}
+}
+
+func renderInvites(tmpl *template.Template, db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		invites, err := listInvites(db)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Version   string
+			CSRF      string
+			UserEmail string
+			Invites   []Invite
+			Roles     []string
+			Now       time.Time
+		}{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: emailFromRequest(r),
+			Invites:   invites,
+			Roles:     roles,
+			Now:       time.Now(),
+		}
+		if err := tmpl.ExecuteTemplate(w, "invites.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func inviteCreate(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		maxUses, err := strconv.Atoi(r.FormValue("max_uses"))
+		if err != nil || maxUses < 1 {
+			http.Error(w, "max uses must be a positive number", http.StatusBadRequest)
+			return
+		}
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil || days < 1 {
+			http.Error(w, "validity must be a positive number of days", http.StatusBadRequest)
+			return
+		}
+
+		role := r.FormValue("role")
+		if !isValidRole(role) {
+			http.Error(w, "unknown role", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := createInvite(db, emailFromRequest(r), role, maxUses, time.Duration(days)*24*time.Hour); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not create invite", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/invites", http.StatusSeeOther)
+	}
+}
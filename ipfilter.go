@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const clientIPKey contextKey = "client-ip"
+
+// parseNets reads a comma separated list of CIDRs, plain addresses count as a
+// single host.
+func parseNets(spec string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for field := range strings.SplitSeq(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", field)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			field = fmt.Sprintf("%s/%d", field, bits)
+		}
+		_, n, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", field)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr finds who is really on the other end. X-Forwarded-For is only
+// believed as far as the hops are trusted proxies, read from the right, since
+// anybody can put anything in front.
+func clientAddr(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trusted, ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// ipFilter only lets addresses through that match allow (when given) and
+// don't match deny. It runs before anything else, a refused client never gets
+// to see a login page. The address it settled on is what remoteIP reports
+// further in, for the audit log and login throttling.
+func ipFilter(allow, deny, trusted string, next http.Handler) (http.Handler, error) {
+	allowed, err := parseNets(allow)
+	if err != nil {
+		return nil, fmt.Errorf("-allow: %w", err)
+	}
+	denied, err := parseNets(deny)
+	if err != nil {
+		return nil, fmt.Errorf("-deny: %w", err)
+	}
+	proxies, err := parseNets(trusted)
+	if err != nil {
+		return nil, fmt.Errorf("-trusted-proxies: %w", err)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientAddr(r, proxies)
+		if ip == nil || containsIP(denied, ip) || (len(allowed) > 0 && !containsIP(allowed, ip)) {
+			log.Printf("refused %s %s from %s", r.Method, r.URL.Path, ip)
+			failRequest(w, r, http.StatusForbidden, errCodeForbidden, "forbidden")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey, ip.String())))
+	}), nil
+}
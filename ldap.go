@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	errLDAPNoUser      = errors.New("no such user in the directory")
+	errLDAPBadPassword = errors.New("wrong password")
+	errLDAPNotInGroup  = errors.New("user is not a member of the required group")
+)
+
+// ldapAuth checks passwords against a directory server instead of the users table.
+type ldapAuth struct {
+	URL          string
+	StartTLS     bool
+	BindDN       string // service account used to look users up, empty for anonymous search
+	BindPassword string
+	BaseDN       string
+	Filter       string // {login} is replaced with the escaped login name
+	EmailAttr    string
+	Group        string // DN of a group the user must be a member of, optional
+	breaker      *breaker
+}
+
+// loadLDAP reads the LDAP_* environment, returning nil when no server is configured.
+func loadLDAP(timeout time.Duration) *ldapAuth {
+	url := os.Getenv("LDAP_URL")
+	if url == "" {
+		return nil
+	}
+	l := &ldapAuth{
+		URL:          url,
+		StartTLS:     os.Getenv("LDAP_START_TLS") == "true",
+		BindDN:       os.Getenv("LDAP_BIND_DN"),
+		BindPassword: os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:       os.Getenv("LDAP_BASE_DN"),
+		Filter:       os.Getenv("LDAP_FILTER"),
+		EmailAttr:    os.Getenv("LDAP_EMAIL_ATTRIBUTE"),
+		Group:        os.Getenv("LDAP_GROUP"),
+	}
+	if l.Filter == "" {
+		l.Filter = "(|(uid={login})(sAMAccountName={login})(mail={login}))"
+	}
+	if l.EmailAttr == "" {
+		l.EmailAttr = "mail"
+	}
+	l.breaker = newBreaker("ldap", timeout, func(err error) bool {
+		return errors.Is(err, errLDAPBadPassword) || errors.Is(err, errLDAPNoUser) || errors.Is(err, errLDAPNotInGroup)
+	})
+	return l
+}
+
+// authenticate binds as the user behind login and returns their DN and email.
+func (l *ldapAuth) authenticate(ctx context.Context, login, password string) (dn, email string, err error) {
+	// an empty password would be an unauthenticated bind, which most servers accept
+	if password == "" {
+		return "", "", errLDAPBadPassword
+	}
+	err = l.breaker.call(ctx, func(ctx context.Context) error {
+		dn, email, err = l.bind(ctx, login, password)
+		return err
+	})
+	return dn, email, err
+}
+
+func (l *ldapAuth) bind(ctx context.Context, login, password string) (string, string, error) {
+	timeout := l.breaker.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return "", "", fmt.Errorf("could not reach LDAP server: %w", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(timeout)
+
+	if l.StartTLS {
+		host := strings.TrimPrefix(strings.TrimPrefix(l.URL, "ldap://"), "ldaps://")
+		host, _, _ = strings.Cut(host, ":")
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return "", "", fmt.Errorf("StartTLS failed: %w", err)
+		}
+	}
+
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return "", "", fmt.Errorf("service account bind failed: %w", err)
+		}
+	}
+
+	filter := strings.ReplaceAll(l.Filter, "{login}", ldap.EscapeFilter(login))
+	res, err := conn.Search(ldap.NewSearchRequest(l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 10, false, filter, []string{l.EmailAttr, "memberOf"}, nil))
+	if err != nil {
+		return "", "", fmt.Errorf("user search failed: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return "", "", errLDAPNoUser
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", "", errLDAPBadPassword
+		}
+		return "", "", fmt.Errorf("user bind failed: %w", err)
+	}
+
+	if l.Group != "" && !l.inGroup(conn, entry) {
+		return "", "", errLDAPNotInGroup
+	}
+
+	email := entry.GetAttributeValue(l.EmailAttr)
+	if email == "" {
+		return "", "", fmt.Errorf("directory entry %s has no %s attribute", entry.DN, l.EmailAttr)
+	}
+	return entry.DN, email, nil
+}
+
+// inGroup checks memberOf first (AD, OpenLDAP with the overlay) and falls back
+// to looking for the user in the group's member attributes.
+func (l *ldapAuth) inGroup(conn *ldap.Conn, entry *ldap.Entry) bool {
+	for _, g := range entry.GetAttributeValues("memberOf") {
+		if strings.EqualFold(g, l.Group) {
+			return true
+		}
+	}
+
+	filter := fmt.Sprintf("(|(member=%s)(uniqueMember=%s))", ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(entry.DN))
+	res, err := conn.Search(ldap.NewSearchRequest(l.Group, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+		1, 10, false, filter, []string{"dn"}, nil))
+	return err == nil && len(res.Entries) == 1
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// licenseURLs are the licenses a file can be marked with, by SPDX id. The
+// empty URL is for ones without a canonical text.
+var licenseURLs = map[string]string{
+	"CC0-1.0":             "https://creativecommons.org/publicdomain/zero/1.0/",
+	"CC-BY-4.0":           "https://creativecommons.org/licenses/by/4.0/",
+	"CC-BY-SA-4.0":        "https://creativecommons.org/licenses/by-sa/4.0/",
+	"CC-BY-NC-4.0":        "https://creativecommons.org/licenses/by-nc/4.0/",
+	"CC-BY-NC-SA-4.0":     "https://creativecommons.org/licenses/by-nc-sa/4.0/",
+	"CC-BY-ND-4.0":        "https://creativecommons.org/licenses/by-nd/4.0/",
+	"all-rights-reserved": "",
+}
+
+// licenseNames is licenseURLs in the order the form offers them.
+var licenseNames = []string{"CC0-1.0", "CC-BY-4.0", "CC-BY-SA-4.0", "CC-BY-NC-4.0", "CC-BY-NC-SA-4.0", "CC-BY-ND-4.0", "all-rights-reserved"}
+
+// License is what editors say about the rights to a file: under which terms
+// it can be used and who to credit.
+type License struct {
+	Path        string
+	License     string
+	Attribution string
+	SetBy       string
+	SetAt       time.Time
+}
+
+func (l License) URL() string {
+	return licenseURLs[l.License]
+}
+
+// fileLicense returns the license of rel, nil if none was set.
+func fileLicense(db *sql.DB, rel string) (*License, error) {
+	l := License{Path: rel}
+	err := db.QueryRow("SELECT license, attribution, set_by, set_at FROM file_licenses WHERE path = ?", rel).
+		Scan(&l.License, &l.Attribution, &l.SetBy, &l.SetAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// licenseSubmit sets the license and attribution of a file, an empty license
+// takes both away.
+func licenseSubmit(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+		rel := strings.TrimPrefix(r.URL.Path, "/license/")
+		license := r.FormValue("license")
+		attribution := strings.TrimSpace(r.FormValue("attribution"))
+		if _, ok := licenseURLs[license]; license != "" && !ok {
+			http.Error(w, "unknown license", http.StatusBadRequest)
+			return
+		}
+
+		email := emailFromRequest(r)
+		var err error
+		if license == "" {
+			_, err = db.Exec("DELETE FROM file_licenses WHERE path = ?", rel)
+		} else {
+			_, err = db.Exec(`INSERT INTO file_licenses (path, license, attribution, set_by, set_at) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT(path) DO UPDATE SET license = excluded.license, attribution = excluded.attribution, set_by = excluded.set_by, set_at = excluded.set_at`,
+				rel, license, attribution, email, time.Now())
+		}
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not set the license", http.StatusInternalServerError)
+			return
+		}
+		audit(db, r, email, auditLicenseSet, rel, license)
+		http.Redirect(w, r, "/view/"+rel, http.StatusSeeOther)
+	}
+}
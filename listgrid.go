@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A listing is shown as a table or as a grid of tiles, images and videos with
+// a small picture of themselves and everything else with an icon of its kind.
+// ?view=grid or ?view=list switches and is kept in a cookie, so the visitor's
+// next folders come up the same way, logged in or not.
+
+var listLayouts = []string{"list", "grid"}
+
+var (
+	gridImageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp"}
+	gridVideoExtensions = []string{".mp4", ".webm"}
+)
+
+// listLayout is the layout r asks for, by ?view= or else the cookie.
+func listLayout(r *http.Request) string {
+	if v := r.URL.Query().Get("view"); v != "" {
+		for _, l := range listLayouts {
+			if v == l {
+				return l
+			}
+		}
+	}
+	if c, err := r.Cookie("layout"); err == nil && c.Value == "grid" {
+		return "grid"
+	}
+	return "list"
+}
+
+// chooseLayout sets the layout of the listing, and the cookie if ?view=
+// changed it.
+func (v *ListView) chooseLayout(w http.ResponseWriter, r *http.Request) {
+	v.Layout = listLayout(r)
+	if !r.URL.Query().Has("view") {
+		return
+	}
+	if c, err := r.Cookie("layout"); err == nil && c.Value == v.Layout {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "layout",
+		Value:    v.Layout,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   365 * 86400,
+	})
+}
+
+// LayoutLink is the query switching to layout l, keeping sort and page.
+func (v ListView) LayoutLink(l string) string {
+	q := url.Values{"sort": {v.Sort}, "order": {v.Order}, "view": {l}}
+	if v.Page > 1 {
+		q.Set("page", strconv.Itoa(v.Page))
+	}
+	return "?" + q.Encode()
+}
+
+// gridKind is what a tile shows for a file: "image" and "video" get a
+// picture, the rest an icon by kind, "audio", "archive" or "file".
+func gridKind(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range gridImageExtensions {
+		if ext == e {
+			return "image"
+		}
+	}
+	for _, e := range gridVideoExtensions {
+		if ext == e {
+			return "video"
+		}
+	}
+	switch {
+	case isMediaFile(name):
+		return "audio"
+	case isArchive(name):
+		return "archive"
+	}
+	return "file"
+}
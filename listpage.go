@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// listPageSize is how many entries a listing shows at once. Folders with tens
+// of thousands of files would otherwise make a page the browser chokes on.
+const listPageSize = 500
+
+// paginate cuts the sorted listing down to the page asked for in q (?page=N,
+// counted from 1). Pages past the end show the last one.
+func (v *ListView) paginate(q url.Values) {
+	v.Total = len(v.Files)
+	v.Pages = max(1, (v.Total+listPageSize-1)/listPageSize)
+	v.Page, _ = strconv.Atoi(q.Get("page"))
+	v.Page = min(max(v.Page, 1), v.Pages)
+
+	start := (v.Page - 1) * listPageSize
+	v.Files = v.Files[start:min(start+listPageSize, v.Total)]
+}
+
+// pageLink is the query of page n, keeping the sort order.
+func (v ListView) pageLink(n int) string {
+	q := url.Values{"sort": {v.Sort}, "order": {v.Order}}
+	if n > 1 {
+		q.Set("page", strconv.Itoa(n))
+	}
+	return "?" + q.Encode()
+}
+
+// PrevLink and NextLink are empty on the first and last page.
+func (v ListView) PrevLink() string {
+	if v.Page <= 1 {
+		return ""
+	}
+	return v.pageLink(v.Page - 1)
+}
+
+func (v ListView) NextLink() string {
+	if v.Page >= v.Pages {
+		return ""
+	}
+	return v.pageLink(v.Page + 1)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var listSorts = []string{"name", "size", "mtime"}
+
+// sortFiles orders the listing as asked for in q (?sort=name|size|mtime and
+// ?order=asc|desc). Folders always come first, names break ties.
+func (v *ListView) sortFiles(q url.Values) {
+	v.Sort, v.Order = "name", "asc"
+	for _, s := range listSorts {
+		if q.Get("sort") == s {
+			v.Sort = s
+		}
+	}
+	if q.Get("order") == "desc" {
+		v.Order = "desc"
+	}
+
+	sort.SliceStable(v.Files, func(i, j int) bool {
+		a, b := v.Files[i], v.Files[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if v.Order == "desc" {
+			a, b = b, a
+		}
+		switch {
+		case v.Sort == "size" && a.IsDir && v.FolderSizes[a.Name] != v.FolderSizes[b.Name]:
+			return v.FolderSizes[a.Name] < v.FolderSizes[b.Name]
+		case v.Sort == "size" && a.Size != b.Size:
+			return a.Size < b.Size
+		case v.Sort == "mtime" && !a.ModTime.Equal(b.ModTime):
+			return a.ModTime.Before(b.ModTime)
+		}
+		if naturalLess(a.Name, b.Name) != naturalLess(b.Name, a.Name) {
+			return naturalLess(a.Name, b.Name)
+		}
+		return a.Name < b.Name
+	})
+}
+
+// SortLink is the query a column header links to: sort by col, or flip the
+// order if the listing is sorted by it already.
+func (v ListView) SortLink(col string) string {
+	order := "asc"
+	if v.Sort == col && v.Order == "asc" {
+		order = "desc"
+	}
+	return "?" + url.Values{"sort": {col}, "order": {order}}.Encode()
+}
+
+// SortMark is the arrow next to the column the listing is sorted by.
+func (v ListView) SortMark(col string) string {
+	switch {
+	case v.Sort != col:
+		return ""
+	case v.Order == "desc":
+		return "▾"
+	default:
+		return "▴"
+	}
+}
+
+// naturalLess compares names the way people count, "track2" before "track10",
+// ignoring case.
+func naturalLess(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			na, nb := digitPrefix(a), digitPrefix(b)
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) < len(tb)
+			}
+			if ta != tb {
+				return ta < tb
+			}
+			a, b = a[len(na):], b[len(nb):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func digitPrefix(s string) string {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i]
+}
+
+// humanSize formats n bytes for the listing, 1.5 MB rather than 1572864.
+func humanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, unit := float64(n), 0
+	for size >= 1024 && unit < 4 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", size, []string{"B", "KB", "MB", "GB", "TB"}[unit])
+}
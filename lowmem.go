@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// memoryProfile is the set of knobs trading speed for footprint. -low-memory
+// picks the small one, meant for a Raspberry Pi or a NAS with 512MB to share.
+type memoryProfile struct {
+	Name           string
+	RenderWorkers  int   // images watermarked at the same time, each holds the decoded picture
+	ScanWorkers    int   // top level folders the content check walks at the same time
+	BulkSlots      int   // folder downloads, syncs and exports running at the same time
+	MemoryLimit    int64 // soft limit for the Go heap, 0 leaves the runtime default
+	GCPercent      int   // 0 leaves the runtime default
+	MaxHeaderBytes int   // 0 is net/http's 1MB
+	ListingCache   string
+	FragmentCache  string
+}
+
+var (
+	defaultProfile = memoryProfile{
+		Name:          "default",
+		RenderWorkers: runtime.NumCPU(),
+		ScanWorkers:   8,
+		BulkSlots:     4,
+		ListingCache:  "memory?size=8MB",
+		FragmentCache: "memory?size=4MB",
+	}
+	lowMemoryProfile = memoryProfile{
+		Name:           "low-memory",
+		RenderWorkers:  1,
+		ScanWorkers:    1,
+		BulkSlots:      1,
+		MemoryLimit:    96 << 20,
+		GCPercent:      50,
+		MaxHeaderBytes: 64 << 10,
+		ListingCache:   "memory?size=1MB",
+		FragmentCache:  "memory?size=512KB",
+	}
+)
+
+// apply hands the limits to the runtime. GOGC and GOMEMLIMIT still win, so an
+// operator who tuned them by hand keeps their settings.
+func (p memoryProfile) apply() {
+	if p.GCPercent > 0 && os.Getenv("GOGC") == "" {
+		debug.SetGCPercent(p.GCPercent)
+	}
+	if p.MemoryLimit > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(p.MemoryLimit)
+	}
+}
+
+// renderMetrics reports memory use and cache hit rates in the Prometheus text
+// format, to check a profile actually keeps the process small.
+func renderMetrics(profile memoryProfile, review *qualityGovernor, caches ...*meteredCache) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(w, "# consus memory profile: %s\n", profile.Name)
+		for _, metric := range []struct {
+			name, kind, help string
+			value            uint64
+		}{
+			{"consus_heap_alloc_bytes", "gauge", "Bytes of allocated heap objects.", m.HeapAlloc},
+			{"consus_heap_inuse_bytes", "gauge", "Bytes in in-use heap spans.", m.HeapInuse},
+			{"consus_sys_bytes", "gauge", "Bytes obtained from the OS.", m.Sys},
+			{"consus_gc_total", "counter", "Completed GC cycles.", uint64(m.NumGC)},
+			{"consus_goroutines", "gauge", "Goroutines that currently exist.", uint64(runtime.NumGoroutine())},
+		} {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+		}
+		fmt.Fprintf(w, "# HELP consus_cache_hits_total Cache lookups that found an entry.\n# TYPE consus_cache_hits_total counter\n")
+		for _, c := range caches {
+			fmt.Fprintf(w, "consus_cache_hits_total{cache=%q} %d\n", c.name, c.hits.Load())
+		}
+		fmt.Fprintf(w, "# HELP consus_cache_misses_total Cache lookups that did not.\n# TYPE consus_cache_misses_total counter\n")
+		for _, c := range caches {
+			fmt.Fprintf(w, "consus_cache_misses_total{cache=%q} %d\n", c.name, c.misses.Load())
+		}
+		fmt.Fprintf(w, "# HELP consus_cache_coalesced_total Misses that waited for the same value being computed already.\n# TYPE consus_cache_coalesced_total counter\n")
+		for _, c := range caches {
+			fmt.Fprintf(w, "consus_cache_coalesced_total{cache=%q} %d\n", c.name, c.coalesced.Load())
+		}
+		events.writeMetrics(w)
+		disks.writeMetrics(w)
+		sched.writeMetrics(w)
+		review.writeMetrics(w)
+		fmt.Fprintf(w, "# HELP consus_breaker_open Whether calls to an outside service are refused after it kept failing.\n# TYPE consus_breaker_open gauge\n")
+		breakers.Lock()
+		for _, b := range breakers.list {
+			open := 0
+			if b.open() {
+				open = 1
+			}
+			fmt.Fprintf(w, "consus_breaker_open{service=%q} %d\n", b.name, open)
+		}
+		breakers.Unlock()
+	}
+}
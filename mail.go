@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// mailer sends plain text mail through the SMTP_* server. A nil mailer drops
+// everything, notifications are still visible in the web UI then.
+type mailer struct {
+	Addr     string
+	User     string
+	Password string
+	From     string
+	breaker  *breaker
+}
+
+func loadMailer(timeout time.Duration) *mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "consus@" + host
+	}
+	return &mailer{
+		Addr:     net.JoinHostPort(host, port),
+		User:     os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+		breaker:  newBreaker("smtp", timeout, nil),
+	}
+}
+
+func (m *mailer) send(to, subject, body string) error {
+	if m == nil {
+		return nil
+	}
+
+	var auth smtp.Auth
+	if m.User != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.User, m.Password, host)
+	}
+
+	// header injection through user supplied subjects is not a thing we want
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		m.From, to, subject, time.Now().Format(time.RFC1123Z), body)
+	return m.breaker.call(context.Background(), func(ctx context.Context) error {
+		return m.deliver(ctx, auth, to, msg)
+	})
+}
+
+// deliver does what smtp.SendMail does, but gives up once ctx runs out instead
+// of waiting on a server that stopped talking.
+func (m *mailer) deliver(ctx context.Context, auth smtp.Auth, to, msg string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(m.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
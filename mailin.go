@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mail in: -mail-in-listen takes mail over SMTP, meant to be handed it by the
+// mail server of the domain, and saves the attachments of what is sent to
+// -mail-in-to into a folder, with the text of the mail as a comment on each.
+// The folder goes by the plus address, uploads+field@example.com going to the
+// folder -mail-in-folders gives for "field", or else by the sender. Senders
+// need to be editors allowed into the folder, like for any upload; the
+// sender of a mail is easy to fake though, so only the mail server checking
+// SPF and DKIM should be let in, with -allow or by listening on 127.0.0.1.
+
+const (
+	mailInMaxSize    = 100 << 20 // of a whole mail
+	mailInMaxRcpts   = 20
+	mailInCommentMax = 10000 // characters of the text kept as the comment
+	mailInIdle       = 5 * time.Minute
+)
+
+type mailInServer struct {
+	db         *sql.DB
+	content    *contentFS
+	rules      uploadRules
+	comments   string
+	houseRules *terms
+	readOnly   bool
+	local      string // of -mail-in-to, before the @
+	domain     string
+	byTag      map[string]string // plus address to folder
+	bySender   map[string]string
+	allowed    []*net.IPNet
+	denied     []*net.IPNet
+}
+
+// parseMailInFolders reads -mail-in-folders, tag=folder and
+// sender@example.com=folder separated by commas.
+func parseMailInFolders(spec string) (byTag, bySender map[string]string, err error) {
+	byTag, bySender = map[string]string{}, map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, folder, ok := strings.Cut(pair, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || key == "" {
+			return nil, nil, fmt.Errorf("%q is not tag=folder or sender=folder", pair)
+		}
+		if strings.Contains(key, "@") {
+			bySender[key] = cleanRel(folder)
+		} else {
+			byTag[key] = cleanRel(folder)
+		}
+	}
+	return byTag, bySender, nil
+}
+
+func newMailInServer(db *sql.DB, content *contentFS, rules uploadRules, houseRules *terms, config ServerConfig) (*mailInServer, error) {
+	local, domain, ok := strings.Cut(strings.ToLower(strings.TrimSpace(config.MailInTo)), "@")
+	if !ok || local == "" || domain == "" || strings.Contains(local, "+") {
+		return nil, fmt.Errorf("-mail-in-to: %q is not an address like uploads@example.com", config.MailInTo)
+	}
+	s := &mailInServer{db: db, content: content, rules: rules, comments: config.Comments, houseRules: houseRules,
+		readOnly: config.ReadOnly, local: local, domain: domain}
+	var err error
+	if s.byTag, s.bySender, err = parseMailInFolders(config.MailInFolders); err != nil {
+		return nil, fmt.Errorf("-mail-in-folders: %w", err)
+	}
+	if s.allowed, err = parseNets(config.Allow); err != nil {
+		return nil, fmt.Errorf("-allow: %w", err)
+	}
+	if s.denied, err = parseNets(config.Deny); err != nil {
+		return nil, fmt.Errorf("-deny: %w", err)
+	}
+	return s, nil
+}
+
+func (s *mailInServer) serve(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Mail in: %s for %s@%s", addr, s.local, s.domain)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// tag is the plus address of a recipient, "" for plain -mail-in-to; ok is
+// false for anybody else.
+func (s *mailInServer) tag(rcpt string) (string, bool) {
+	local, domain, ok := strings.Cut(strings.ToLower(rcpt), "@")
+	if !ok || domain != s.domain {
+		return "", false
+	}
+	local, tag, _ := strings.Cut(local, "+")
+	return tag, local == s.local
+}
+
+// handle speaks just enough SMTP for a mail server handing over mail.
+func (s *mailInServer) handle(conn net.Conn) {
+	defer conn.Close()
+	ip := net.ParseIP(addrIP(conn.RemoteAddr()))
+	if ip == nil || containsIP(s.denied, ip) || (len(s.allowed) > 0 && !containsIP(s.allowed, ip)) {
+		log.Printf("refused mail from %s", ip)
+		return
+	}
+	tc := textproto.NewConn(conn)
+	reply := func(code int, text string) bool {
+		return tc.PrintfLine("%d %s", code, text) == nil
+	}
+	if !reply(220, "consus ESMTP") {
+		return
+	}
+	var from string
+	var tags []string
+	started := false // MAIL FROM was given
+	for {
+		conn.SetDeadline(time.Now().Add(mailInIdle))
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			if tc.PrintfLine("250-consus") != nil || tc.PrintfLine("250-8BITMIME") != nil || !reply(250, "SIZE "+strconv.Itoa(mailInMaxSize)) {
+				return
+			}
+		case "HELO", "NOOP":
+			reply(250, "OK")
+		case "RSET":
+			from, tags, started = "", nil, false
+			reply(250, "OK")
+		case "MAIL":
+			addr, ok := smtpPath(arg, "FROM:")
+			if !ok {
+				reply(501, "MAIL FROM:<address>")
+				continue
+			}
+			from, tags, started = strings.ToLower(addr), nil, true
+			reply(250, "OK")
+		case "RCPT":
+			addr, ok := smtpPath(arg, "TO:")
+			switch {
+			case !started:
+				reply(503, "MAIL FROM first")
+			case !ok:
+				reply(501, "RCPT TO:<address>")
+			case len(tags) == mailInMaxRcpts:
+				reply(452, "too many recipients")
+			default:
+				if tag, ok := s.tag(addr); ok {
+					tags = append(tags, tag)
+					reply(250, "OK")
+				} else {
+					reply(550, "no such mailbox here")
+				}
+			}
+		case "DATA":
+			if len(tags) == 0 {
+				reply(503, "RCPT TO first")
+				continue
+			}
+			if !reply(354, "go ahead, end with a line with just a dot") {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(mailInIdle))
+			dr := tc.DotReader()
+			data, err := io.ReadAll(io.LimitReader(dr, mailInMaxSize+1))
+			if err != nil {
+				return
+			}
+			if len(data) > mailInMaxSize {
+				io.Copy(io.Discard, dr)
+				reply(552, "mail too large")
+			} else {
+				code, text := s.deliver(ip.String(), from, tags, data)
+				reply(code, text)
+			}
+			from, tags, started = "", nil, false
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "not supported")
+		}
+	}
+}
+
+// smtpPath is the address of "FROM:<someone@example.com> SIZE=123".
+func smtpPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", false
+	}
+	addr, _, ok := strings.Cut(rest[1:], ">")
+	return addr, ok
+}
+
+// folder is where a mail from sender to tags goes, the first tag with a
+// folder winning over the sender.
+func (s *mailInServer) folder(sender string, tags []string) (string, bool) {
+	for _, tag := range tags {
+		if dir, ok := s.byTag[tag]; ok && tag != "" {
+			return dir, true
+		}
+	}
+	dir, ok := s.bySender[sender]
+	return dir, ok
+}
+
+// deliver saves the attachments of a mail, answering with the SMTP reply.
+func (s *mailInServer) deliver(ip, envelope string, tags []string, data []byte) (int, string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return 554, "could not read the mail"
+	}
+	email := envelope
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		email = strings.ToLower(from.Address)
+	}
+	if s.readOnly {
+		return 554, "this server is read-only"
+	}
+	dir, ok := s.folder(email, tags)
+	if !ok {
+		return 550, "no folder for mail from " + email
+	}
+	if !roleAtLeast(userRole(s.db, email), roleEditor) {
+		return 550, email + " may not upload"
+	}
+	if s.houseRules != nil {
+		if ok, err := s.houseRules.accepted(s.db, email); err != nil {
+			log.Printf("%s", err.Error())
+			return 451, "try again later"
+		} else if !ok {
+			return 550, email + " needs to accept the terms first"
+		}
+	}
+	canon, err := s.content.resolve(dir)
+	if err == nil {
+		err = isFolder(s.content, canon)
+	}
+	if err != nil {
+		log.Printf("mail in: folder /%s: %v", dir, err)
+		return 550, "no folder for mail from " + email
+	}
+	if ok, err := canAccessPath(s.db, email, canon); err != nil {
+		log.Printf("%s", err.Error())
+		return 451, "try again later"
+	} else if !ok {
+		return 550, email + " may not upload there"
+	}
+
+	var text string
+	var saved, problems []string
+	err = walkMail(msg.Header, msg.Body, func(ctype, name string, body io.Reader) error {
+		if name == "" {
+			if text == "" && strings.HasPrefix(ctype, "text/plain") {
+				b, err := io.ReadAll(io.LimitReader(body, mailInCommentMax*4))
+				text = strings.TrimSpace(string(b))
+				return err
+			}
+			return nil
+		}
+		rel, err := s.save(ip, email, canon, name, body)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			return nil
+		}
+		saved = append(saved, rel)
+		return nil
+	})
+	if err != nil {
+		return 554, "could not read the mail: " + err.Error()
+	}
+	if len(saved) == 0 {
+		if len(problems) > 0 {
+			return 554, strings.Join(problems, "; ")
+		}
+		return 554, "the mail has no attachments"
+	}
+
+	note := text
+	if subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err == nil && subject != "" {
+		note = strings.TrimSpace(subject + "\n\n" + text)
+	}
+	if r := []rune(note); len(r) > mailInCommentMax {
+		note = string(r[:mailInCommentMax]) + "..."
+	}
+	if note != "" && s.comments != "" {
+		for _, rel := range saved {
+			comment := Commentv1{ID: newID(), User: email, Content: note, When: time.Now()}
+			if err := addComment(s.db, s.comments, rel, comment); err != nil {
+				log.Printf("mail in: %v", err)
+				continue
+			}
+			auditFrom(s.db, ip, email, auditCommentAdd, rel, comment.ID)
+			events.publish(eventCommentPosted, email, rel, map[string]string{"id": comment.ID})
+		}
+	}
+	log.Printf("mail in: %d files from %s into /%s", len(saved), email, canon)
+	answer := fmt.Sprintf("saved %d files in /%s", len(saved), canon)
+	if len(problems) > 0 {
+		answer += ", not " + strings.Join(problems, "; ")
+	}
+	return 250, answer
+}
+
+func isFolder(content *contentFS, rel string) error {
+	info, err := content.stat(rel)
+	if err == nil && !info.IsDir() {
+		err = errors.New("not a folder")
+	}
+	return err
+}
+
+// save writes an attachment into dir like an upload from the listing, a name
+// that is taken getting a number.
+func (s *mailInServer) save(ip, email, dir, sent string, body io.Reader) (string, error) {
+	name, _, problem := s.rules.check(s.content, dir, sent, "rename")
+	if problem != "" {
+		return "", errors.New(problem)
+	}
+	allowance, err := s.rules.allowanceOf(s.db, email)
+	if err != nil {
+		return "", err
+	}
+	left, err := s.rules.storageLeft(s.db, email)
+	if err != nil {
+		return "", err
+	}
+	rel, info, created, err := saveUpload(s.content, dir, name, "rename", s.rules.limit(storageLimit(body, left), allowance))
+	if err != nil {
+		return "", err
+	}
+	auditFrom(s.db, ip, email, auditFilePut, rel, strconv.FormatInt(info.Size(), 10)+", mail")
+	countUpload(s.db, email, info.Size())
+	countStored(s.db, email, rel, info.Size())
+	if created {
+		events.publish(eventFileAdded, email, rel, nil)
+	}
+	return rel, nil
+}
+
+type mimeHeader interface{ Get(string) string }
+
+// walkMail calls visit with every part of a mail that isn't made of other
+// parts, decoded, with its type and its file name if it is an attachment.
+func walkMail(h mimeHeader, body io.Reader, visit func(ctype, name string, body io.Reader) error) error {
+	ctype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		ctype, params = "text/plain", nil
+	}
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	if strings.HasPrefix(ctype, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := walkMail(part.Header, part, visit); err != nil {
+				return err
+			}
+		}
+	}
+	var dec mime.WordDecoder
+	name := params["name"]
+	if _, dparams, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && dparams["filename"] != "" {
+		name = dparams["filename"]
+	}
+	if decoded, err := dec.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	if name != "" {
+		name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	}
+	return visit(ctype, name, body)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/rand"
+	"database/sql"
 	"embed"
 	"encoding/hex"
 	"encoding/json"
@@ -11,17 +13,19 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
-
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
 // Embed files/directories
@@ -37,12 +41,6 @@ var version string
 
 var mediaExtensions = []string{".mp4", ".mp3", ".ogg", ".webm", ".m4a"}
 
-// sessions stores active session tokens mapped to user emails.
-var sessions = struct {
-	mu sync.Mutex
-	m  map[string]string
-}{m: make(map[string]string)}
-
 func newSessionToken() string {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
@@ -52,13 +50,17 @@ func newSessionToken() string {
 }
 
 func emailFromRequest(r *http.Request) string {
-	c, err := r.Cookie("session")
-	if err != nil {
-		return ""
+	return emailFromContext(r.Context())
+}
+
+// emailFromContext is emailFromRequest for code that only gets the context of
+// the request, like the WebDAV file system.
+func emailFromContext(ctx context.Context) string {
+	if email, ok := ctx.Value(tokenEmailKey).(string); ok {
+		return email
 	}
-	sessions.mu.Lock()
-	defer sessions.mu.Unlock()
-	return sessions.m[c.Value]
+	email, _ := ctx.Value(sessionEmailKey).(string)
+	return email
 }
 
 func isAllowedEmail(email string) bool {
@@ -74,108 +76,9 @@ func isAllowedEmail(email string) bool {
 	return false
 }
 
-func newOAuthConfig() *oauth2.Config {
-	return &oauth2.Config{
-		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
-		RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
-		Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email"},
-		Endpoint:     google.Endpoint,
-	}
-}
-
-func handleLogin(w http.ResponseWriter, r *http.Request) {
-	state := newSessionToken()
-	http.SetCookie(w, &http.Cookie{
-		Name:     "oauth_state",
-		Value:    state,
-		Path:     "/",
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		MaxAge:   300,
-	})
-	if redirect := r.URL.Query().Get("redirect"); redirect != "" {
-		http.SetCookie(w, &http.Cookie{
-			Name:     "oauth_redirect",
-			Value:    redirect,
-			Path:     "/",
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			MaxAge:   300,
-		})
-	}
-	http.Redirect(w, r, newOAuthConfig().AuthCodeURL(state), http.StatusTemporaryRedirect)
-}
-
-func handleCallback(w http.ResponseWriter, r *http.Request) {
-	stateCookie, err := r.Cookie("oauth_state")
-	if err != nil || r.URL.Query().Get("state") != stateCookie.Value {
-		http.Error(w, "invalid state", http.StatusBadRequest)
-		return
-	}
-	// Clear state cookie
-	http.SetCookie(w, &http.Cookie{Name: "oauth_state", Path: "/", MaxAge: -1})
-
-	token, err := newOAuthConfig().Exchange(r.Context(), r.URL.Query().Get("code"))
-	if err != nil {
-		log.Printf("oauth exchange error: %v", err)
-		http.Error(w, "oauth exchange failed", http.StatusInternalServerError)
-		return
-	}
-
-	client := newOAuthConfig().Client(r.Context(), token)
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
-	if err != nil {
-		log.Printf("userinfo fetch error: %v", err)
-		http.Error(w, "could not fetch user info", http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	var userInfo struct {
-		Email string `json:"email"`
-	}
-	if err := json.Unmarshal(body, &userInfo); err != nil {
-		http.Error(w, "could not parse user info", http.StatusInternalServerError)
-		return
-	}
-
-	if !isAllowedEmail(userInfo.Email) {
-		http.Error(w, "access denied: email not in allowlist", http.StatusForbidden)
-		return
-	}
-
-	sessionToken := newSessionToken()
-	sessions.mu.Lock()
-	sessions.m[sessionToken] = userInfo.Email
-	sessions.mu.Unlock()
-
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    sessionToken,
-		Path:     "/",
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		MaxAge:   86400, // 24 hours
-	})
-
-	redirectTo := "/files/"
-	if c, err := r.Cookie("oauth_redirect"); err == nil && c.Value != "" {
-		// Only allow relative paths to prevent open redirect
-		if strings.HasPrefix(c.Value, "/") {
-			redirectTo = c.Value
-		}
-		http.SetCookie(w, &http.Cookie{Name: "oauth_redirect", Path: "/", MaxAge: -1})
-	}
-	http.Redirect(w, r, redirectTo, http.StatusTemporaryRedirect)
-}
-
 func handleLogout(w http.ResponseWriter, r *http.Request) {
-	if c, err := r.Cookie("session"); err == nil {
-		sessions.mu.Lock()
-		delete(sessions.m, c.Value)
-		sessions.mu.Unlock()
+	if err := sessions.end(r); err != nil {
+		log.Printf("%s", err.Error())
 	}
 	http.SetCookie(w, &http.Cookie{Name: "session", Path: "/", MaxAge: -1})
 	http.Redirect(w, r, "/files/", http.StatusTemporaryRedirect)
@@ -188,12 +91,27 @@ type BaseView struct {
 
 type ListView struct {
 	Breadcrumbs  []Breadcrumb
+	Base         string
 	Path         string
-	Files        []os.DirEntry
+	Files        []listEntry
+	Sort         string // name, size or mtime
+	Order        string // asc or desc
+	Layout       string // list or grid, see listgrid.go
+	Page         int    // from 1
+	Pages        int
+	Total        int   // entries in the folder, Files only holds the page
+	Generation   int64 // of the folder in the index, counts up with every change
 	Version      string
 	CommentCount map[string]uint16
 	IsMediaFile  func(string) bool
 	UserEmail    string
+	UserRole     string
+	ShowPerms    bool // permission column, for admins
+	Share        *Share
+	Estimate     *folderEstimate // of the folder as an archive, nil if unknown
+	FolderSizes  map[string]int64
+	CSRF         string
+	Paste        bool // a paste folder, see paste.go
 }
 
 type Breadcrumb struct {
@@ -244,10 +162,12 @@ func GetVersion() string {
 	return version
 }
 
-func renderList(tmpl *template.Template, contentPath, commentPath string) func(http.ResponseWriter, *http.Request) {
+// renderList shows folders and serves files. With showPerms admins also see
+// the permission bits of every entry.
+func renderList(tmpl *template.Template, db *sql.DB, content *contentFS, wmr *watermarker, listings *meteredCache, scanner *contentScanner, board *announcements, showPerms bool, pastes pasteFolders) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		contentLocation := filepath.Join(contentPath, strings.TrimPrefix(r.URL.Path, "/files"))
-		info, err := os.Stat(contentLocation)
+		rel := strings.TrimPrefix(r.URL.Path, "/files/")
+		info, err := content.stat(rel)
 		if os.IsNotExist(err) {
 			log.Printf("%s", err.Error())
 			http.NotFound(w, r)
@@ -260,86 +180,124 @@ func renderList(tmpl *template.Template, contentPath, commentPath string) func(h
 
 		// the single most important cond. deciding if there is a anything to render or just return a file
 		if info.IsDir() {
-			files, err := os.ReadDir(contentLocation)
+			data, err := newListView(db, listings, scanner, rel, "/", rel)
 			if err != nil {
 				log.Printf("%s", err.Error())
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-
-			var fileInfos []os.DirEntry
-			for _, file := range files {
-				fileInfos = append(fileInfos, file)
-			}
-
-			commentCount, err := getCommentCountPerItem(filepath.Join(commentPath, r.URL.Path))
-			if err != nil {
+			data.sortFiles(r.URL.Query())
+			data.paginate(r.URL.Query())
+			data.chooseLayout(w, r)
+			data.UserEmail = emailFromRequest(r)
+			data.UserRole = roleFromRequest(db, r)
+			data.ShowPerms = showPerms && roleAtLeast(data.UserRole, roleAdmin)
+			data.CSRF = csrfToken(r)
+			data.Paste = pastes.holds(rel)
+			if data.Estimate, err = estimateFolder(db, rel); err != nil {
 				log.Printf("%s", err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
 			}
 
-			data := ListView{
-				Breadcrumbs:  GenerateBreadcrumbs(r.URL.Path),
-				Path:         strings.TrimPrefix(r.URL.Path, "/files/"),
-				Files:        fileInfos,
-				Version:      GetVersion(),
-				CommentCount: commentCount,
-				UserEmail:    emailFromRequest(r),
-			}
-
-			if err := tmpl.ExecuteTemplate(w, "list.html", data); err != nil {
-				log.Printf("%s", err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			w.Header().Set("X-Folder-Generation", strconv.FormatInt(data.Generation, 10))
+			etag := pageETag(r, board, data.Generation, data.Files, data.Total, data.CommentCount, data.FolderSizes, data.UserRole, data.ShowPerms, data.Estimate, data.Paste, data.Layout)
+			if notModified(w, r, etag, info.ModTime()) {
+				return
 			}
+			streamTemplate(w, tmpl, "list.html", data)
+		} else if wmr.defaults.Enabled() && isWatermarkable(rel) && !roleAtLeast(roleFromRequest(db, r), roleEditor) {
+			// viewers and anonymous visitors only ever get the review copy
+			wmr.serve(w, r, content, rel, wmr.defaults)
+		} else if link := content.passthrough(rel, info); link != "" {
+			http.Redirect(w, r, link, http.StatusTemporaryRedirect)
 		} else {
-			http.ServeFile(w, r, contentLocation)
+			serveContent(w, r, content, rel)
 		}
 	}
 }
 
-func getCommentCountPerItem(commentsLocation string) (map[string]uint16, error) {
-	counts := map[string]uint16{}
-
-	dir, err := os.Open(commentsLocation)
-	if errors.Is(err, os.ErrNotExist) {
-		return counts, os.MkdirAll(commentsLocation, 0o755)
-	} else if err != nil {
-		return nil, err
+// newListView reads the directory dir, relative to the top of the content
+// tree. base is the URL prefix the listing is mounted under and rel the slash
+// separated path below it.
+func newListView(db *sql.DB, listings *meteredCache, scanner *contentScanner, dir, base, rel string) (ListView, error) {
+	files, generation, err := readListing(listings, scanner, dir)
+	if err != nil {
+		return ListView{}, err
 	}
-	defer dir.Close()
+	// after the cache, a changed .consusignore doesn't change the folder's mtime
+	files = scanner.content.ignore.filter(dir, files)
 
-	files, err := dir.Readdir(-1)
+	commentCount, err := commentCounts(db, dir)
 	if err != nil {
-		return nil, err
+		return ListView{}, err
 	}
 
-	for _, f := range files {
-		if f.IsDir() {
-			continue
-		}
-		data, err := os.ReadFile(filepath.Join(commentsLocation, f.Name()))
+	return ListView{
+		Breadcrumbs:  GenerateBreadcrumbs(base+"files/", rel),
+		Base:         base,
+		Path:         rel,
+		Files:        files,
+		Generation:   generation,
+		Version:      GetVersion(),
+		CommentCount: commentCount,
+		FolderSizes:  scanner.sizes.of(dir, files),
+	}, nil
+}
+
+// listEntry is one row of a folder listing.
+type listEntry struct {
+	Name    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+	Mode    fs.FileMode // permission bits
+}
+
+// Perms is the permission bits in octal, as chmod takes them.
+func (e listEntry) Perms() string {
+	return fmt.Sprintf("%04o", e.Mode)
+}
+
+// folderListing is what the listings cache holds for a folder.
+type folderListing struct {
+	Generation int64
+	Files      []listEntry
+}
+
+// readListing returns the entries of the folder dir and its generation, as
+// the index has them. They are cached under the folder's mtime, which changes
+// whenever an entry is added, removed or renamed.
+func readListing(listings *meteredCache, scanner *contentScanner, dir string) ([]listEntry, int64, error) {
+	info, err := scanner.content.stat(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	key := fmt.Sprintf("listing4\x00%s\x00%d\x00%d", scanner.content.key(dir), info.ModTime().UnixNano(), scanner.stamp(dir))
+	data, err := listings.fetch(key, func() ([]byte, error) {
+		chaosDisk()
+		snap, err := scanner.current(cleanRel(dir))
 		if err != nil {
-			continue
-		}
-		var cf CommentFilev1
-		if err := json.Unmarshal(data, &cf); err != nil {
-			continue
+			return nil, err
 		}
-		var count uint16
-		for _, c := range cf.Comments {
-			if !c.Deleted {
-				count++
-			}
+		list := folderListing{Generation: snap.Generation, Files: make([]listEntry, 0, len(snap.Entries))}
+		for _, e := range snap.Entries {
+			list.Files = append(list.Files, listEntry{Name: e.Name, IsDir: e.IsDir, Size: e.Size, ModTime: time.Unix(0, e.MTime), Mode: e.Mode})
 		}
-		counts[f.Name()] = count
+		return json.Marshal(list)
+	})
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return counts, nil
+	var list folderListing
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, 0, err
+	}
+	return list.Files, list.Generation, nil
 }
 
-func GenerateBreadcrumbs(path string) []Breadcrumb {
-	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(path, "/files"), "/"), "/")
+// GenerateBreadcrumbs returns one crumb per directory of rel, linking below prefix.
+func GenerateBreadcrumbs(prefix, rel string) []Breadcrumb {
+	parts := strings.Split(strings.Trim(rel, "/"), "/")
 	breadcrumbs := []Breadcrumb{}
 
 	for i, part := range parts {
@@ -348,65 +306,175 @@ func GenerateBreadcrumbs(path string) []Breadcrumb {
 		}
 		breadcrumbs = append(breadcrumbs, Breadcrumb{
 			Name:   part,
-			URL:    strings.Join(parts[:i+1], "/"),
+			URL:    prefix + strings.Join(parts[:i+1], "/") + "/",
 			IsLast: i == len(parts)-1,
 		})
 	}
 	return breadcrumbs
 }
 
-func renderItem(tmpl *template.Template, commentPath string) func(http.ResponseWriter, *http.Request) {
+type ItemView struct {
+	Base            string
+	Path            string
+	MimeType        string
+	Version         string
+	CommentsEnabled bool
+	Comments        []Commentv1
+	License         *License
+	Licenses        []string // for the form editors set it with
+	Checksums       bool     // of what a download gets, not shown for review copies
+	UserEmail       string
+	UserRole        string
+	Share           *Share
+	GuestName       string
+	GuestRename     bool
+	CSRF            string
+	Jobs            []PipelineJob // pipelines the file went through, for editors
+}
+
+func renderItem(tmpl *template.Template, db *sql.DB, commentPath string, wmr *watermarker, board *announcements, runner *pipelineRunner) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		filePath := strings.TrimPrefix(r.URL.Path, "/view/")
-		fileCommentPath := filepath.Join(commentPath, filePath)
-
-		commentBytes, err := os.ReadFile(fileCommentPath)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				http.Error(w, fmt.Sprintf("error while reading %s", err.Error()), http.StatusInternalServerError)
-				return
-			}
-		}
-
-		commentsFile := CommentFilev1{}
-		if len(commentBytes) > 0 {
-			err := json.Unmarshal(commentBytes, &commentsFile)
-			if err != nil {
-				http.Error(w, "", http.StatusInternalServerError)
-				return
-			}
-		}
-
-		var visibleComments []Commentv1
-		for _, c := range commentsFile.Comments {
-			if !c.Deleted {
-				visibleComments = append(visibleComments, c)
-			}
-		}
 
-		data := struct {
-			Path            string
-			MimeType        string
-			Version         string
-			CommentsEnabled bool
-			Comments        []Commentv1
-			UserEmail       string
-		}{
+		data := ItemView{
+			Base:            "/",
 			Path:            filePath,
 			MimeType:        GetMimeTypeFromFilename(filePath),
 			Version:         GetVersion(),
 			CommentsEnabled: commentPath != "",
-			Comments:        visibleComments,
 			UserEmail:       emailFromRequest(r),
+			UserRole:        roleFromRequest(db, r),
+			CSRF:            csrfToken(r),
 		}
 
+		if r.URL.Query().Has("comments") {
+			renderComments(w, r, tmpl, data, filepath.Join(commentPath, filePath))
+			return
+		}
+		var err error
+		if data.License, err = fileLicense(db, filePath); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if roleAtLeast(data.UserRole, roleEditor) {
+			data.Licenses = licenseNames
+		}
+		data.Checksums = !reviewCopyOnly(wmr.defaults, filePath) || roleAtLeast(data.UserRole, roleEditor)
+		if roleAtLeast(data.UserRole, roleEditor) {
+			if data.Jobs, err = runner.jobs(filePath, 10); err != nil {
+				log.Printf("%s", err.Error())
+			}
+		}
+		if notModified(w, r, pageETag(r, board, data.License, data.Licenses != nil, data.Checksums, data.UserRole, data.Jobs), time.Time{}) {
+			return
+		}
 		if err := tmpl.ExecuteTemplate(w, "view.html", data); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	}
 }
 
-func commentSubmit(commentPath string) func(http.ResponseWriter, *http.Request) {
+// renderComments answers ?comments on a view page with just the comments. The
+// page itself goes out without them, so the player can start while a long
+// thread is still being read.
+func renderComments(w http.ResponseWriter, r *http.Request, tmpl *template.Template, data ItemView, fileCommentPath string) {
+	if !data.CommentsEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	// the comment file is written anew with every comment
+	var version struct {
+		Size  int64
+		MTime int64
+	}
+	if info, err := os.Stat(fileCommentPath); err == nil {
+		version.Size, version.MTime = info.Size(), info.ModTime().UnixNano()
+	}
+	if notModified(w, r, pageETag(r, nil, version, data.UserRole, data.Share, data.GuestName, data.GuestRename), time.Time{}) {
+		return
+	}
+	comments, err := loadComments(fileCommentPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Comments = comments
+	if err := tmpl.ExecuteTemplate(w, "comments", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// loadComments returns the comments of a file that have not been deleted.
+func loadComments(fileCommentPath string) ([]Commentv1, error) {
+	commentBytes, err := os.ReadFile(fileCommentPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error while reading %s", err.Error())
+	}
+
+	commentsFile := CommentFilev1{}
+	if len(commentBytes) > 0 {
+		if err := json.Unmarshal(commentBytes, &commentsFile); err != nil {
+			return nil, fmt.Errorf("could not load comment data: %w", err)
+		}
+	}
+
+	var visibleComments []Commentv1
+	for _, c := range commentsFile.Comments {
+		if !c.Deleted {
+			visibleComments = append(visibleComments, c)
+		}
+	}
+	return visibleComments, nil
+}
+
+// addComment prepends comment to the comment file of rel, creating it if needed.
+func addComment(db *sql.DB, commentPath, rel string, comment Commentv1) error {
+	fileCommentPath := filepath.Join(commentPath, filepath.FromSlash(rel))
+	// Ensure parent directory exists
+	if err := os.MkdirAll(filepath.Dir(fileCommentPath), 0o755); err != nil {
+		return fmt.Errorf("could not create comment directory: %w", err)
+	}
+
+	unlock := lockCommentFile(fileCommentPath)
+	defer unlock()
+
+	// Load existing comments (if any)
+	commentsFile := CommentFilev1{}
+	commentBytes, err := os.ReadFile(fileCommentPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unexpected file error: %w", err)
+	}
+	if len(commentBytes) > 0 {
+		if err := json.Unmarshal(commentBytes, &commentsFile); err != nil {
+			return fmt.Errorf("could not load comment data: %w", err)
+		}
+	}
+
+	// Prepend new comment and persist
+	commentsFile.Comments = append([]Commentv1{comment}, commentsFile.Comments...)
+	commentBytes, err = json.Marshal(commentsFile)
+	if err != nil {
+		return fmt.Errorf("could not persist comment data: %w", err)
+	}
+
+	if err := writeFile(fileCommentPath, commentBytes, 0o644); err != nil {
+		return fmt.Errorf("could not write comment file: %w", err)
+	}
+	// still under the lock, so counts of racing comments land in order
+	var visible int
+	for _, c := range commentsFile.Comments {
+		if !c.Deleted {
+			visible++
+		}
+	}
+	if err := setCommentCount(db, rel, visible); err != nil {
+		log.Printf("could not update comment count: %v", err)
+	}
+	return nil
+}
+
+func commentSubmit(db *sql.DB, commentPath string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		email := emailFromRequest(r)
 		if email == "" {
@@ -420,56 +488,25 @@ func commentSubmit(commentPath string) func(http.ResponseWriter, *http.Request)
 		}
 
 		comment := Commentv1{
-			ID:      newCommentID(),
+			ID:      newID(),
 			User:    email,
 			Content: r.FormValue("content"),
 			When:    time.Now(),
 		}
 
 		filePath := strings.TrimPrefix(r.URL.Path, "/comment/")
-		fileCommentPath := filepath.Join(commentPath, filePath)
-
-		// Ensure parent directory exists
-		if err := os.MkdirAll(filepath.Dir(fileCommentPath), 0o755); err != nil {
-			http.Error(w, fmt.Errorf("could not create comment directory: %w", err).Error(), http.StatusInternalServerError)
-			return
-		}
-
-		unlock := lockCommentFile(fileCommentPath)
-		defer unlock()
-
-		// Load existing comments (if any)
-		commentsFile := CommentFilev1{}
-		commentBytes, err := os.ReadFile(fileCommentPath)
-		if err != nil && !os.IsNotExist(err) {
-			http.Error(w, fmt.Errorf("unexpected file error: %w", err).Error(), http.StatusInternalServerError)
-			return
-		}
-		if len(commentBytes) > 0 {
-			if err := json.Unmarshal(commentBytes, &commentsFile); err != nil {
-				http.Error(w, fmt.Errorf("could not load comment data: %w", err).Error(), http.StatusInternalServerError)
-				return
-			}
-		}
-
-		// Prepend new comment and persist
-		commentsFile.Comments = append([]Commentv1{comment}, commentsFile.Comments...)
-		commentBytes, err = json.Marshal(commentsFile)
-		if err != nil {
-			http.Error(w, fmt.Errorf("could not persist comment data: %w", err).Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if err := os.WriteFile(fileCommentPath, commentBytes, 0o644); err != nil {
-			http.Error(w, fmt.Errorf("could not write comment file: %w", err).Error(), http.StatusInternalServerError)
+		if err := addComment(db, commentPath, filePath, comment); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		audit(db, r, email, auditCommentAdd, filePath, comment.ID)
+		events.publish(eventCommentPosted, email, filePath, map[string]string{"id": comment.ID})
 
 		http.Redirect(w, r, fmt.Sprintf("/view/%s", filePath), http.StatusSeeOther)
 	}
 }
 
-func commentDelete(commentPath string) func(http.ResponseWriter, *http.Request) {
+func commentDelete(db *sql.DB, commentPath string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		email := emailFromRequest(r)
 		if email == "" {
@@ -500,20 +537,22 @@ func commentDelete(commentPath string) func(http.ResponseWriter, *http.Request)
 			return
 		}
 
-		found := false
+		found, visible := false, 0
 		for i := range commentsFile.Comments {
 			if commentsFile.Comments[i].ID == commentID {
 				if commentsFile.Comments[i].User != email {
 					http.Error(w, "forbidden", http.StatusForbidden)
 					return
 				}
-				if time.Since(commentsFile.Comments[i].When) >= 5*time.Minute {
+				if !commentDeletable(commentsFile.Comments[i].When) {
 					http.Error(w, "delete window expired", http.StatusForbidden)
 					return
 				}
 				commentsFile.Comments[i].Deleted = true
 				found = true
-				break
+			}
+			if !commentsFile.Comments[i].Deleted {
+				visible++
 			}
 		}
 
@@ -528,19 +567,97 @@ func commentDelete(commentPath string) func(http.ResponseWriter, *http.Request)
 			return
 		}
 
-		if err := os.WriteFile(fileCommentPath, commentBytes, 0o644); err != nil {
+		if err := writeFile(fileCommentPath, commentBytes, 0o644); err != nil {
 			http.Error(w, "could not write comment file", http.StatusInternalServerError)
 			return
 		}
+		if err := setCommentCount(db, filePath, visible); err != nil {
+			log.Printf("could not update comment count: %v", err)
+		}
+		audit(db, r, email, auditCommentDelete, filePath, commentID)
 
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
 type ServerConfig struct {
-	Port     int
-	data     string
-	Comments string
+	Port      int
+	data      string
+	Mounts    []mount // -directory, instead of data
+	Comments  string
+	DB        string
+	Cache     string
+	Watermark Watermark
+	BasicAuth string
+	PublicURL string
+	ACL       string
+	Memory    memoryProfile
+	Health    string
+	ReadOnly  bool
+	Warm      bool
+	FullText  bool
+	Watch     bool
+	ShowPerms bool
+
+	ReviewMinQuality int // JPEG quality review copies may drop to under load, 90 for none
+	ReviewMinSize    int // longest edge they may shrink to, 0 for never
+
+	Terms        string // house rules to accept before commenting, empty for none
+	TermsVersion string
+
+	SFTPPort    int // 0 for no SFTP
+	SFTPHostKey string
+
+	MailInListen  string // SMTP address taking mail, empty for none
+	MailInTo      string // uploads@example.com, with plus addresses
+	MailInFolders string // tag=folder and sender=folder, comma separated
+
+	APIDisabled map[string]bool // old API versions switched off
+	APIQuota    int64           // calls per client and day, 0 for no limit
+
+	ShowDotfiles   bool
+	FollowSymlinks string // always, inside-root or never
+
+	ExternalTimeout time.Duration // for LDAP, SMTP and login providers
+
+	SessionIdle     time.Duration
+	SessionRemember time.Duration // 0 turns "remember me" off
+
+	Allow          string // comma separated CIDRs, empty lets everybody in
+	Deny           string
+	TrustedProxies string // whose X-Forwarded-For is believed
+
+	EmbedOrigins string // sites that may frame /embed/, comma separated, * for any
+
+	Pipelines string // JSON file with the jobs run on new files, per folder
+
+	PasteFolders string // comma separated, taking text pasted into their listing
+
+	ImageCache    string
+	ListingCache  string // empty for the memory profile's default
+	FragmentCache string // same
+	PageCache     string // only with ReadOnly
+
+	MaxRate        string // for all downloads together, e.g. 10MB/s
+	MaxRatePerConn string
+
+	Compress int // gzip level of pages and text, 0 for none
+
+	UploadMaxSize    string        // per file, e.g. 1GB, empty for any size
+	UploadExtensions string        // comma separated, empty for any
+	UploadExpiry     time.Duration // of resumable uploads nobody goes on with
+	UploadQuota      string        // per user and day, e.g. 5GB, empty for none
+	StorageQuota     string        // what a user may keep uploaded, e.g. 50GB, empty for no limit
+	MinFree          string        // below that uploads pause, e.g. 1GB, 0 for only a full disk
+	TrashKeep        time.Duration // how long deleted files can be restored, 0 for until purged
+	ReceiptsKeep     time.Duration // how long single downloads of shares are kept, 0 for ever
+
+	Events string // nats:// or redis:// URL the events also go to, empty for none
+
+	IDFormat string // of new file and comment IDs, see idFormats
+
+	routed  func([]route) []route // lets tests wrap the handlers of the routing table
+	serving func(http.Handler)    // hands tests what is about to serve
 }
 
 func migrateComments(commentPath string) error {
@@ -569,7 +686,7 @@ func migrateComments(commentPath string) error {
 		modified := false
 		for i := range cf.Comments {
 			if cf.Comments[i].ID == "" {
-				cf.Comments[i].ID = newCommentID()
+				cf.Comments[i].ID = newID()
 				modified = true
 			}
 		}
@@ -583,63 +700,520 @@ func migrateComments(commentPath string) error {
 			return err
 		}
 		log.Printf("migrate: assigned IDs to comments in %s", path)
-		return os.WriteFile(path, out, 0o644)
+		return writeFile(path, out, 0o644)
 	})
 }
 
 func NewMainServer(ctx context.Context, config ServerConfig) error {
-	if config.Comments != "" {
+	if err := checkIDFormat(config.IDFormat); err != nil {
+		return err
+	}
+	db, err := openDB(config.DB)
+	if err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+	defer db.Close()
+	sessions = &sessionStore{db: db, idle: config.SessionIdle, remember: config.SessionRemember}
+
+	secret, err := loadSecret(db)
+	if err != nil {
+		return fmt.Errorf("could not load instance secret: %w", err)
+	}
+
+	if config.ACL != "" {
+		if err := applyACLFile(db, config.ACL); err != nil {
+			return fmt.Errorf("could not load access rules: %w", err)
+		}
+	}
+
+	// nothing writes there yet, so every temporary file is one a crash left
+	for _, dir := range []string{config.Comments, config.Cache} {
+		if dir == "" {
+			continue
+		}
+		if n, err := removeLeftovers(dir); err != nil {
+			log.Printf("could not clear %s: %v", dir, err)
+		} else if n > 0 {
+			log.Printf("Removed %d half written files from %s", n, dir)
+		}
+	}
+
+	if config.Comments != "" && !config.ReadOnly {
 		if err := migrateComments(config.Comments); err != nil {
 			log.Printf("warning: comment migration failed: %v", err)
 		}
 	}
 
+	notes := &notifier{db: db, mail: loadMailer(config.ExternalTimeout), publicURL: strings.TrimSuffix(config.PublicURL, "/")}
+
+	assets, err := loadStaticAssets(staticDir)
+	if err != nil {
+		return fmt.Errorf("could not load static files: %w", err)
+	}
+	frags := &fragments{}
+	board := &announcements{db: db}
 	templates := template.Must(template.New("").Funcs(template.FuncMap{
-		"isMediaFile": isMediaFile,
-		"isLast":      func(i, size int) bool { return i == size-1 },
-		"split":       strings.Split,
-		"year":        time.Now().Year,
-		"canDelete":   func(t time.Time) bool { return time.Since(t) < 5*time.Minute },
+		"fragment":         frags.render,
+		"announcements":    board.current,
+		"isMediaFile":      isMediaFile,
+		"isArchive":        isArchive,
+		"gridKind":         gridKind,
+		"isLast":           func(i, size int) bool { return i == size-1 },
+		"split":            strings.Split,
+		"year":             time.Now().Year,
+		"humanSize":        humanSize,
+		"roleAtLeast":      roleAtLeast,
+		"readOnly":         func() bool { return config.ReadOnly },
+		"canRemember":      func() bool { return config.SessionRemember > 0 },
+		"canResetPassword": func() bool { return resetsEnabled(notes) },
+		"asset":            assets.url,
 	}).ParseFS(viewDir, "views/*.html", "views/partials/*"))
 
-	mux := http.NewServeMux()
+	config.Memory.apply()
+	images, err := openCache("images", config.ImageCache, config.Cache)
+	if err != nil {
+		return err
+	}
+	if config.ListingCache == "" {
+		config.ListingCache = config.Memory.ListingCache
+	}
+	listings, err := openCache("listings", config.ListingCache, config.Cache)
+	if err != nil {
+		return err
+	}
+	if config.FragmentCache == "" {
+		config.FragmentCache = config.Memory.FragmentCache
+	}
+	frags.tmpl = templates
+	if frags.cache, err = openCache("fragments", config.FragmentCache, config.Cache); err != nil {
+		return err
+	}
+	pageStore, err := openCache("pages", config.PageCache, config.Cache)
+	if err != nil {
+		return err
+	}
+	if pageStore.backend != nil && !config.ReadOnly {
+		return errors.New("-page-cache only works with -read-only, elsewhere pages change with every comment")
+	}
+	total, err := parseRate(config.MaxRate)
+	if err != nil {
+		return fmt.Errorf("-max-rate: %w", err)
+	}
+	perConn, err := parseRate(config.MaxRatePerConn)
+	if err != nil {
+		return fmt.Errorf("-max-rate-per-conn: %w", err)
+	}
+	uploadRules, err := parseUploadRules(config.UploadMaxSize, config.UploadExtensions, config.UploadQuota, config.StorageQuota)
+	if err != nil {
+		return err
+	}
+	downloads = bandwidth{perConn: perConn}
+	sched = newScheduler(config.Memory.BulkSlots)
+	if total > 0 {
+		downloads.total = newRateLimiter(total)
+	}
+	wmr := &watermarker{cache: images, defaults: config.Watermark, renders: make(chan struct{}, config.Memory.RenderWorkers)}
+	if config.ReviewMinQuality < 1 || config.ReviewMinQuality > reviewQuality {
+		return fmt.Errorf("-review-min-quality: %d is not between 1 and %d", config.ReviewMinQuality, reviewQuality)
+	}
+	if config.ReviewMinSize < 0 {
+		return fmt.Errorf("-review-min-size: %d is not a size", config.ReviewMinSize)
+	}
+	if config.Watermark.Enabled() && (config.ReviewMinQuality < reviewQuality || config.ReviewMinSize > 0) {
+		wmr.quality = newQualityGovernor(wmr, config.ReviewMinQuality, config.ReviewMinSize)
+		go wmr.quality.run(ctx, 5*time.Second)
+	}
+	providers := loadProviders(config.ExternalTimeout)
+	directory := loadLDAP(config.ExternalTimeout)
+	// logins can end up asking a directory and then the local table
+	loginTimeout := 2 * config.ExternalTimeout
+
+	content := newContentFS(config.data, config.Mounts)
+	content.ignore = newIgnoreRules(content, config.ShowDotfiles)
+	content.ignore.keepPrivate(config.DB, config.DB+"-wal", config.DB+"-shm", config.DB+"-journal", config.SFTPHostKey,
+		config.Comments, config.Cache)
+	if content.symlinks, err = parseSymlinkPolicy(config.FollowSymlinks); err != nil {
+		return err
+	}
+
+	if config.Compress < 0 || config.Compress > 9 {
+		return fmt.Errorf("-compress: %d is not a gzip level from 1 to 9, or 0", config.Compress)
+	}
+
+	var minFree int64
+	if config.MinFree != "" && config.MinFree != "0" {
+		if minFree, err = parseSize(config.MinFree); err != nil || minFree <= 0 {
+			return fmt.Errorf("-min-free: invalid size %q", config.MinFree)
+		}
+	}
+	disks = newDiskGuard(db, notes, minFree)
+	if !config.ReadOnly {
+		for _, d := range content.dirs() {
+			if d.name == "" {
+				disks.watch("content", d.dir)
+			} else {
+				disks.watch("content of /"+d.name, d.dir)
+			}
+		}
+	}
+	disks.watch("comments", config.Comments)
+	disks.watch("cache", config.Cache)
+	disks.watch("database", filepath.Dir(config.DB))
+	go disks.run(ctx, 30*time.Second)
 
-	mux.Handle("/", http.RedirectHandler("/files/", http.StatusTemporaryRedirect))
-	mux.Handle("/static/", http.FileServer(http.FS(staticDir)))
+	go watchShareExpiry(ctx, db, notes, time.Hour)
+	go keepReceipts(ctx, db, config.ReceiptsKeep, time.Hour)
+	if config.Comments != "" {
+		if !commentCountsBuilt(db) {
+			if err := recountComments(db, config.Comments); err != nil {
+				log.Printf("warning: could not count comments: %v", err)
+			}
+		}
+		go watchCommentCounts(ctx, db, config.Comments, 24*time.Hour)
+	}
+
+	scanner := newContentScanner(db, content, append([]string{config.Comments, config.Cache}, trashDirs(content)...), config.Memory.ScanWorkers)
+	scanner.tidy = !config.ReadOnly
+	scanner.sizes = newFolderSizes(db)
+	go scanner.sizes.run(ctx)
+	var texts *textIndex
+	if config.FullText {
+		if texts, err = newTextIndex(db, content); err != nil {
+			return err
+		}
+		scanner.done = texts.changed
+		go texts.run(ctx)
+	}
+	feed := newChangeFeed()
+	meter, err := newAPIMeter(db, config.APIQuota)
+	if err != nil {
+		return err
+	}
+	go meter.run(ctx)
+	transport, err := openEventTransport(config.Events)
+	if err != nil {
+		return fmt.Errorf("-events: %w", err)
+	}
+	bus, err := newEventBus(db, transport)
+	if err != nil {
+		return err
+	}
+	pages := newPageCache(pageStore, board, content.foldCase)
+	for _, sub := range []struct {
+		name   string
+		remote bool
+		handle func(event) error
+		kinds  []string
+	}{
+		{"notifications", false, notifyOnEvent(db, notes, config.Comments), []string{eventCommentPosted, eventUserRegistered}},
+		{"changes", true, feed.onFileAdded(scanner), []string{eventFileAdded, eventEntryMoved}},
+		{"pages", true, pages.onEvent, []string{eventFileAdded, eventFileWritten, eventEntryMoved, eventFolderChanged, eventCommentPosted, eventAccessChanged}},
+		{"listings", true, scanner.onFileWritten, []string{eventFileWritten}},
+	} {
+		if err := bus.subscribe(sub.name, sub.remote, sub.handle, sub.kinds...); err != nil {
+			return err
+		}
+	}
+	if transport != nil {
+		if err := bus.subscribe("transport", false, bus.forward); err != nil {
+			return err
+		}
+	}
+	var pipelines *pipelineRunner
+	if config.Pipelines != "" {
+		list, err := loadPipelines(config.Pipelines)
+		if err != nil {
+			return fmt.Errorf("-pipelines: %w", err)
+		}
+		pipelines = newPipelineRunner(db, content, list, notes.publicURL)
+		if err := bus.subscribe("pipelines", false, pipelines.onFileAdded, eventFileAdded); err != nil {
+			return err
+		}
+		go pipelines.run(ctx)
+	}
+	events = bus
+	go bus.run(ctx)
+	resumable, err := newTusStore(db, content, uploadRules, filepath.Join(config.Cache, "uploads"), config.UploadExpiry)
+	if err != nil {
+		return err
+	}
+	go resumable.run(ctx, time.Hour)
+	if !config.ReadOnly {
+		go keepTrash(ctx, db, content, config.Comments, config.TrashKeep, time.Hour)
+		go watchStorage(ctx, db, content, 24*time.Hour)
+	}
+	tracker := newUploadTracker()
+	checksums := newChecksummer(ctx, db, content)
+	if config.Watch {
+		if err := watchContent(ctx, scanner, feed); err != nil {
+			log.Printf("warning: could not watch the content folder, searches check it again instead: %v", err)
+		}
+	}
+	scanner.start(false)
 
-	mux.HandleFunc("GET /login", handleLogin)
-	mux.HandleFunc("GET /callback", handleCallback)
-	mux.HandleFunc("GET /logout", handleLogout)
+	pastes := parsePasteFolders(config.PasteFolders)
+	ancestors, err := frameAncestors(config.EmbedOrigins)
+	if err != nil {
+		return err
+	}
+	routes := []route{
+		{pattern: "/", handler: http.RedirectHandler("/files/", http.StatusTemporaryRedirect).ServeHTTP},
+		{pattern: "/static/", handler: assets.serve},
+
+		{pattern: "GET /login", handler: renderLogin(templates, providers)},
+		{pattern: "POST /login", timeout: loginTimeout, handler: loginSubmit(templates, db, providers, directory)},
+		{pattern: "GET /login/{provider}", handler: handleLogin(providers)},
+		{pattern: "GET /callback", timeout: loginTimeout, handler: handleCallback(db, providers)},
+		{pattern: "GET /callback/{provider}", timeout: loginTimeout, handler: handleCallback(db, providers)},
+		{pattern: "GET /logout", handler: handleLogout},
+		{pattern: "POST /logout/all", role: roleViewer, handler: logoutEverywhere(db)},
+		{pattern: "GET /sessions", role: roleViewer, handler: renderSessions(templates, db)},
+		{pattern: "POST /sessions/{id}/revoke", role: roleViewer, handler: sessionRevoke(db)},
+		{pattern: "GET /reset", handler: renderReset(templates, db, notes)},
+		{pattern: "POST /reset", handler: resetRequest(templates, db, notes)},
+		{pattern: "GET /reset/{token}", handler: renderReset(templates, db, notes)},
+		{pattern: "POST /reset/{token}", handler: resetSubmit(templates, db, notes)},
+		{pattern: "GET /register", handler: renderRegister(templates, db)},
+		{pattern: "POST /register", handler: registerSubmit(templates, db)},
+		{pattern: "GET /invites", role: roleAdmin, handler: renderInvites(templates, db)},
+		{pattern: "POST /invites", role: roleAdmin, handler: inviteCreate(db)},
+		{pattern: "GET /users", role: roleAdmin, handler: renderUsers(templates, db)},
+		{pattern: "GET /users/{name}", role: roleViewer, handler: renderProfile(templates, db, config.Comments, uploadRules)},
+		{pattern: "POST /users/{name}/role", role: roleAdmin, handler: userRoleSubmit(db)},
+		{pattern: "POST /users/{name}/quota", role: roleAdmin, handler: userQuotaSubmit(db)},
+		{pattern: "GET /access", role: roleAdmin, handler: renderAccess(templates, db)},
+		{pattern: "POST /access/rules", role: roleAdmin, handler: folderRuleSubmit(db)},
+		{pattern: "POST /access/requests", role: roleViewer, handler: accessRequestSubmit(db, notes)},
+		{pattern: "POST /access/requests/{id}", role: roleAdmin, handler: accessRequestResolve(db, notes)},
+		{pattern: "POST /access/grants", role: roleAdmin, handler: pathGrantSubmit(db)},
+		{pattern: "POST /access/grants/{id}/revoke", role: roleAdmin, handler: pathGrantRevoke(db)},
+		{pattern: "POST /access/groups", role: roleAdmin, handler: groupMemberSubmit(db)},
+		{pattern: "POST /access/groups/{group}/remove", role: roleAdmin, handler: groupMemberRemove(db)},
+		{pattern: "GET /scan", role: roleAdmin, handler: renderScan(templates, scanner)},
+		{pattern: "POST /scan", role: roleAdmin, handler: scanSubmit(scanner)},
+		{pattern: "GET /audit", role: roleAdmin, handler: renderAudit(templates, db)},
+		{pattern: "GET /trash", role: roleAdmin, handler: renderTrash(templates, db, config.TrashKeep)},
+		{pattern: "POST /trash/{id}/restore", role: roleAdmin, writes: true, handler: trashAction(db, content, config.Comments, true)},
+		{pattern: "POST /trash/{id}/purge", role: roleAdmin, writes: true, handler: trashAction(db, content, config.Comments, false)},
+		{pattern: "POST /trash/empty", role: roleAdmin, writes: true, handler: trashEmpty(db, content, config.Comments)},
+		{pattern: "GET /duplicates", role: roleAdmin, handler: renderDuplicates(templates, db, checksums)},
+		{pattern: "POST /duplicates", role: roleAdmin, handler: duplicatesSubmit(checksums)},
+		{pattern: "GET /pipelines", role: roleAdmin, handler: renderPipelines(templates, pipelines)},
+		{pattern: "POST /pipelines/{id}/retry", role: roleAdmin, writes: true, handler: pipelineRetry(db, pipelines)},
+		{pattern: "GET /id/{id}", handler: idRedirect(db, content)},
+		{pattern: "GET /l/{code}", handler: shortLinkRedirect(db, content)},
+		{pattern: "POST /links", role: roleViewer, handler: shortLinkCreate(db, content)},
+		{pattern: "GET /audit.jsonl", role: roleAdmin, lane: priorityBulk, handler: auditExport(db)},
+		{pattern: "GET /usage", role: roleAdmin, handler: renderUsage(templates, meter)},
+		{pattern: "GET /announcements", role: roleAdmin, handler: renderAnnouncements(templates, db)},
+		{pattern: "POST /announcements", role: roleAdmin, handler: announcementCreate(db, board)},
+		{pattern: "POST /announcements/{id}/delete", role: roleAdmin, handler: announcementDelete(db, board)},
+		{pattern: "/api/", handler: apiNotFound},
+		{pattern: "GET /metrics", role: roleAdmin, handler: renderMetrics(config.Memory, wmr.quality, images, listings, frags.cache, pageStore)},
+
+		// would be nice to separate file and rendering this early
+		{pattern: "/files/", path: below("/files/"), lane: priorityInteractive, handler: renderList(templates, db, content, wmr, listings, scanner, board, config.ShowPerms, pastes)},
+		{pattern: "PUT /files/", role: roleEditor, path: below("/files/"), writes: true, handler: filePut(db, content, uploadRules)},
+		{pattern: "POST /upload/", role: roleEditor, path: below("/upload/"), writes: true, handler: fileUpload(db, content, uploadRules, resumable, tracker)},
+		{pattern: "POST /mkdir/", role: roleEditor, path: below("/mkdir/"), writes: true, handler: folderCreate(db, content)},
+		{pattern: "GET /paste/", path: below("/paste/"), lane: priorityInteractive, handler: pasteView(templates, content, pastes)},
+		{pattern: "POST /paste/", role: roleEditor, path: below("/paste/"), writes: true, handler: pasteSubmit(db, content, uploadRules, pastes)},
+		{pattern: "PUT /paste/", role: roleEditor, path: below("/paste/"), writes: true, handler: pasteSubmit(db, content, uploadRules, pastes)},
+		{pattern: "POST /rename/", role: roleEditor, path: below("/rename/"), writes: true, handler: entryRename(db, content, config.Comments, uploadRules)},
+		{pattern: "POST /move/", role: roleEditor, path: below("/move/"), writes: true, handler: entryMove(db, content, config.Comments, uploadRules)},
+		{pattern: "POST /delete/", role: roleEditor, path: below("/delete/"), writes: true, handler: entryDelete(db, content, config.Comments)},
+		{pattern: "GET /uploads/progress/{id}", role: roleEditor, handler: uploadProgress(tracker)},
+		{pattern: "OPTIONS /uploads/", role: roleEditor, handler: resumable.options},
+		{pattern: "HEAD /uploads/{id}", role: roleEditor, handler: resumable.upload(db)},
+		{pattern: "PATCH /uploads/{id}", role: roleEditor, writes: true, handler: resumable.upload(db)},
+		{pattern: "DELETE /uploads/{id}", role: roleEditor, writes: true, handler: resumable.upload(db)},
+		{pattern: "GET /view/", path: below("/view/"), lane: priorityInteractive, handler: renderItem(templates, db, config.Comments, wmr, board, pipelines)},
+		{pattern: "GET /checksum/", path: below("/checksum/"), lane: priorityBulk, handler: checksumFile(db, content, wmr)},
+		{pattern: "GET /inside/", path: below("/inside/"), lane: priorityInteractive, handler: archiveInside(templates, content)},
+		{pattern: "GET /embed/", path: below("/embed/"), lane: priorityInteractive, handler: renderEmbed(templates, ancestors)},
+		{pattern: "GET /zip/", path: below("/zip/"), lane: priorityBulk, handler: folderArchive(db, content, wmr, scanner, config.Comments)},
+		{pattern: "POST /zip/", path: below("/zip/"), lane: priorityBulk, handler: folderArchive(db, content, wmr, scanner, config.Comments)},
+
+		// doubt: maybe having it on a different route has no benefits now
+		{pattern: "POST /comment/", path: below("/comment/"), writes: true, handler: commentSubmit(db, config.Comments)},
+		{pattern: "DELETE /comment/", role: roleEditor, path: below("/comment/"), writes: true, handler: commentDelete(db, config.Comments)},
+		{pattern: "POST /license/", role: roleEditor, path: below("/license/"), writes: true, handler: licenseSubmit(db)},
+
+		{pattern: "GET /search", handler: renderSearch(templates, db, scanner, texts, content.ignore)},
+
+		{pattern: "GET /tokens", role: roleViewer, handler: renderTokens(templates, db)},
+		{pattern: "POST /tokens", role: roleViewer, handler: tokenCreate(db)},
+		{pattern: "POST /tokens/{id}/revoke", role: roleViewer, handler: tokenRevoke(db)},
+
+		{pattern: "GET /notifications", role: roleViewer, handler: renderNotifications(templates, db)},
+
+		{pattern: "GET /shares", role: roleEditor, handler: renderShares(templates, db)},
+		{pattern: "POST /shares", role: roleEditor, handler: shareCreate(db, secret, content)},
+		{pattern: "POST /shares/{token}/renew", role: roleEditor, handler: shareRenew(db, secret)},
+		{pattern: "POST /shares/{token}/revoke", role: roleEditor, handler: shareRevoke(db, secret)},
+		{pattern: "GET /s/{token}", handler: shareRoot(templates, db, secret)},
+		{pattern: "GET /s/{token}/{$}", handler: shareRoot(templates, db, secret)},
+		{pattern: "POST /s/{token}/enter", handler: shareEnter(templates, db, secret)},
+		{pattern: "POST /s/{token}/renewal", handler: shareRequestRenewal(db, secret, notes)},
+		{pattern: "GET /s/{token}/files/{path...}", lane: priorityInteractive, handler: shareFiles(templates, db, secret, content, wmr, listings, scanner, board, notes)},
+		{pattern: "GET /s/{token}/view/{path...}", lane: priorityInteractive, handler: shareView(templates, db, secret, config.Comments, content, wmr, board)},
+		{pattern: "GET /s/{token}/checksum/{path...}", lane: priorityBulk, handler: shareChecksum(db, secret, content, wmr)},
+		{pattern: "GET /s/{token}/inside/{path...}", lane: priorityInteractive, handler: shareInside(templates, db, secret, content, notes)},
+		{pattern: "GET /s/{token}/embed/{path...}", lane: priorityInteractive, handler: shareEmbed(templates, db, secret, content, ancestors)},
+		{pattern: "POST /s/{token}/guest", handler: shareGuest(db, secret)},
+		{pattern: "POST /s/{token}/comment/{path...}", writes: true, handler: shareComment(db, secret, config.Comments, content)},
+	}
+	routes = append(routes, apiRoutes([]apiEndpoint{
+		{pattern: "GET /openapi.yaml", handler: renderOpenAPI},
+		{pattern: "GET /announcements", handler: apiAnnouncements(board)},
+		{pattern: "GET /watch/", content: true, handler: apiWatch(content, feed, scanner)},
+		{pattern: "GET /ids/", content: true, handler: apiEntryID(db, content)},
+		{pattern: "GET /paths/{id}", handler: apiEntryPath(db, content)},
+		{pattern: "GET /version", role: roleAdmin, handler: renderVersion(newBuildInfo(enabledFeatures(config, providers, directory, notes.mail)))},
+	}, config.APIDisabled)...)
+	routes = append(routes, davRoutes(db, content, wmr, config.Comments, uploadRules)...)
+	routes = append(routes, chaosRoutes()...)
+	var houseRules *terms
+	if config.Terms != "" {
+		if houseRules, err = loadTerms(config.Terms, config.TermsVersion); err != nil {
+			return err
+		}
+		routes = append(routes,
+			route{pattern: "GET /terms", handler: renderTerms(templates, db, houseRules)},
+			route{pattern: "POST /terms", role: roleViewer, handler: termsAccept(db, houseRules)},
+		)
+	}
 
-	// would be nice to separate file and rendering this early
-	mux.HandleFunc("/files/", renderList(templates, config.data, config.Comments))
+	if config.SFTPPort != 0 {
+		sftpd, err := newSFTPServer(db, directory, content, wmr, houseRules, uploadRules, config)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := sftpd.serve(ctx, config.SFTPPort); err != nil {
+				log.Printf("sftp: %v", err)
+			}
+		}()
+	}
+	if config.MailInListen != "" {
+		mailIn, err := newMailInServer(db, content, uploadRules, houseRules, config)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := mailIn.serve(ctx, config.MailInListen); err != nil {
+				log.Printf("mail in: %v", err)
+			}
+		}()
+	}
 
-	mux.HandleFunc("GET /view/", renderItem(templates, config.Comments))
+	if config.routed != nil {
+		routes = config.routed(routes)
+	}
+	mux := http.NewServeMux()
+	if err := registerRoutes(mux, templates, db, content, houseRules, routes, config.ReadOnly); err != nil {
+		return err
+	}
 
-	// doubt: maybe having it on a different route has no benefits now
-	mux.HandleFunc("POST /comment/", commentSubmit(config.Comments))
-	mux.HandleFunc("DELETE /comment/", commentDelete(config.Comments))
 	log.Printf("Starting Consus media/file server on port %d...", config.Port)
-	log.Printf("DataPath: %s", config.data)
+	if len(config.Mounts) == 0 {
+		log.Printf("DataPath: %s", config.data)
+	}
+	for _, m := range config.Mounts {
+		log.Printf("Directory: /%s from %s", m.name, m.source)
+	}
 	log.Printf("CommentsPath: %s", config.Comments)
-	log.Printf("OAuth: ClientID=%s ClientSecret=%s RedirectURL=%s AllowedEmails=%s",
-		redact(os.Getenv("GOOGLE_CLIENT_ID")), redact(os.Getenv("GOOGLE_CLIENT_SECRET")),
-		os.Getenv("GOOGLE_REDIRECT_URL"),
-		os.Getenv("ALLOWED_EMAILS"),
-	)
+	log.Printf("Database: %s", config.DB)
+	log.Printf("CachePath: %s", config.Cache)
+	if config.ReadOnly {
+		log.Printf("Read-only: comments and changes are refused")
+	}
+	log.Printf("Memory: %s profile, %d watermark renders and %d bulk requests at once", config.Memory.Name, config.Memory.RenderWorkers, config.Memory.BulkSlots)
+	log.Printf("Caches: images=%s listings=%s fragments=%s pages=%s", redactURL(images.spec), redactURL(listings.spec), redactURL(frags.cache.spec), redactURL(pageStore.spec))
+	if transport != nil {
+		log.Printf("Events: %s", transport)
+	}
+	if config.MaxRate != "" || config.MaxRatePerConn != "" {
+		log.Printf("Download limits: total=%s per connection=%s", config.MaxRate, config.MaxRatePerConn)
+	}
+	if content.foldCase {
+		log.Printf("Content is on a case-insensitive filesystem, matching names accordingly")
+	}
+	if config.ACL != "" {
+		log.Printf("ACL: %s", config.ACL)
+	}
+	if houseRules != nil {
+		log.Printf("Terms: %s, version %s", config.Terms, houseRules.Version)
+	}
+	for _, p := range providers {
+		log.Printf("OAuth %s: ClientID=%s ClientSecret=%s RedirectURL=%s",
+			p.Name, redact(p.config.ClientID), redact(p.config.ClientSecret), p.config.RedirectURL)
+	}
+	if directory != nil {
+		log.Printf("LDAP: URL=%s BaseDN=%s Filter=%s Group=%s", directory.URL, directory.BaseDN, directory.Filter, directory.Group)
+	}
+	if notes.mail != nil {
+		log.Printf("SMTP: Addr=%s From=%s User=%s", notes.mail.Addr, notes.mail.From, notes.mail.User)
+	}
+	log.Printf("AllowedEmails: %s", os.Getenv("ALLOWED_EMAILS"))
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
 	if err != nil {
 		log.Fatal("could not start listening: ", err)
 	}
+	if config.Health != "" {
+		go writeHealthFile(ctx, config.Health, 30*time.Second)
+		defer os.Remove(config.Health)
+	}
+	if config.Warm {
+		// leave half the render slots to the visitors arriving meanwhile
+		wr := &warmer{content: content, skip: append([]string{config.Comments, config.Cache}, trashDirs(content)...),
+			wmr: wmr, listings: listings, scanner: scanner, workers: config.Memory.RenderWorkers / 2}
+		go wr.run(ctx)
+	}
+
+	var handler http.Handler = bearerAuth(db, sessionAuth(sessions, meter.limit(csrfProtect(pages.serve(mux)))))
+	if config.BasicAuth != "" {
+		handler, err = basicAuth(config.BasicAuth, handler)
+		if err != nil {
+			return err
+		}
+		log.Printf("BasicAuth: enabled for the whole server")
+	}
+	handler, err = ipFilter(config.Allow, config.Deny, config.TrustedProxies, handler)
+	if err != nil {
+		return err
+	}
+	handler = withRequestID(withAPIVersion(compressResponses(config.Compress, handler)))
+	if config.Allow != "" || config.Deny != "" {
+		log.Printf("IP filter: allow=%s deny=%s", config.Allow, config.Deny)
+	}
+	if config.TrustedProxies != "" {
+		log.Printf("Trusted proxies: %s", config.TrustedProxies)
+	}
 
 	svr := http.Server{
-		Handler: mux,
+		Handler:        handler,
+		MaxHeaderBytes: config.Memory.MaxHeaderBytes,
+		ConnContext:    downloads.connContext,
+	}
+	if config.serving != nil {
+		config.serving(handler)
 	}
 
-	defer svr.Shutdown(ctx)
+	// docker stop sends SIGTERM and waits, finish the running requests instead
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		svr.Shutdown(shutdownCtx)
+	}()
 
-	return svr.Serve(listener)
+	if err := svr.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Printf("Shut down")
+	return nil
 }
 
 type mainServer struct {
@@ -650,24 +1224,213 @@ type mainServer struct {
 //
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		if err := runUserCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	port := flag.Int("port", 7001, "Port to serve on (overridden by PORT env var)")
 	data := flag.String("data", ".", "Directory to serve files from")
+	var mounts mountList
+	flag.Var(&mounts, "directory", "Serve a folder as a top level folder, name=/path, repeatable (instead of -data)")
 	comments := flag.String("comments", ".comments", "A shadow directory to store comments of files")
+	dbPath := flag.String("db", "consus.db", "SQLite database holding users and invites")
+	cache := flag.String("cache", ".cache", "Directory for generated files such as watermarked images")
+	watermarkText := flag.String("watermark-text", "", "Text stamped on images served to viewers and anonymous visitors")
+	watermarkImage := flag.String("watermark-image", "", "PNG overlay stamped on images served to viewers and anonymous visitors")
+	reviewMinQuality := flag.Int("review-min-quality", 70, "Lowest JPEG quality review copies drop to under sustained load, 90 keeps it")
+	reviewMinSize := flag.Int("review-min-size", 1600, "Smallest longest edge in pixels review copies shrink to under sustained load, 0 keeps their size")
+	basicAuthSpec := flag.String("basic-auth", "", "Protect the whole server with HTTP Basic Auth, given as user:passhash")
+	aclPath := flag.String("acl", "", "File with folder restrictions, grants and groups, applied on start")
+	termsPath := flag.String("terms", "", "Text file with terms users have to accept before commenting")
+	termsVersion := flag.String("terms-version", "", "Version of -terms, bump it to ask everybody again (default: a hash of the text)")
+	sftpPort := flag.Int("sftp-port", 0, "Also serve the content over SFTP on this port, e.g. 2022")
+	sftpHostKey := flag.String("sftp-host-key", "sftp_host_key", "Private key the SFTP server identifies with, made on first start")
+	mailInListen := flag.String("mail-in-listen", "", "Take mail over SMTP on this address, e.g. 127.0.0.1:2525, and save its attachments into folders")
+	mailInTo := flag.String("mail-in-to", "", "Address the mail in is for, e.g. uploads@example.com; uploads+tag@example.com works too")
+	mailInFolders := flag.String("mail-in-folders", "", "Where mail in goes, comma separated tag=folder for plus addresses and sender@example.com=folder")
+	apiDisable := flag.String("api-disable", "", "Switch off these comma separated old API versions, e.g. v1")
+	apiQuota := flag.Int64("api-quota", 0, "API calls a token, user or address may make per day, 0 for no limit")
+	publicURL := flag.String("public-url", "", "Externally visible base URL, used for links in notification emails")
+	stateDir := flag.String("state-dir", "", "Put the database, comments and cache below this directory unless given explicitly (overridden by STATE_DIR env var)")
+	logFormat := flag.String("log-format", "auto", "Log as text or json, auto uses json unless stderr is a terminal")
+	healthFile := flag.String("health-file", "", "File refreshed every 30s while the server is up, for container healthchecks")
+	allow := flag.String("allow", "", "Only serve these comma separated networks, e.g. 10.8.0.0/24,192.168.1.0/24 (overridden by ALLOW env var)")
+	deny := flag.String("deny", "", "Never serve these comma separated networks, checked before -allow (overridden by DENY env var)")
+	trustedProxies := flag.String("trusted-proxies", "", "Reverse proxies whose X-Forwarded-For header tells the client address (overridden by TRUSTED_PROXIES env var)")
+	embedOrigins := flag.String("embed-origins", "", "Comma separated origins allowed to put the /embed/ player in a frame, like https://blog.example.com, * for any")
+	pasteFolders := flag.String("paste-folders", "", "Comma separated folders that take text pasted into their listing or PUT to /paste/<folder>/, like a pastebin")
+	pipelinesFile := flag.String("pipelines", "", "JSON file with the pipelines, jobs run one after the other on files uploaded into a folder")
+	readOnly := flag.Bool("read-only", false, "Refuse comments and anything else that would change content, for a public archive")
+	imageCache := flag.String("image-cache", "disk", "Cache for watermarked images: memory, disk, redis://host:port or off, with ?size=64MB&ttl=24h")
+	listingCache := flag.String("listing-cache", "", "Cache for folder listings, same syntax as -image-cache (default memory?size=8MB)")
+	fragmentCache := flag.String("fragment-cache", "", "Cache for rendered listing rows and comments, same syntax as -image-cache (default memory?size=4MB)")
+	pageCache := flag.String("page-cache", "off", "Cache for whole pages of visitors who aren't logged in, with -read-only, same syntax as -image-cache")
+	sessionIdle := flag.Duration("session-idle", 24*time.Hour, "Log out sessions that were not used for this long")
+	sessionRemember := flag.Duration("session-remember", 30*24*time.Hour, "How long \"remember me\" keeps a device logged in, 0 hides the option")
+	externalTimeout := flag.Duration("external-timeout", 10*time.Second, "How long LDAP, SMTP and login providers get to answer before a call is given up")
+	fullText := flag.Bool("fulltext", false, "Index the text of txt, md, pdf and subtitle files in the background for searching their contents")
+	followSymlinks := flag.String("follow-symlinks", "always", "Which symlinks listings and downloads follow: always, inside-root (only ones staying in the content folder) or never")
+	noOutsideLinks := flag.Bool("no-outside-links", false, "The same as -follow-symlinks=inside-root")
+	showDotfiles := flag.Bool("show-dotfiles", false, "List files and folders whose names start with a dot, which are hidden otherwise")
+	showPerms := flag.Bool("show-perms", false, "Show admins the permission bits of files and folders in listings")
+	watch := flag.Bool("watch", false, "Follow changes to the content folder as they happen, for searches that are always up to date")
+	warm := flag.Bool("warm", false, "Fill the caches with comment counts and watermarked images in the background after starting")
+	maxRate := flag.String("max-rate", "", "Cap the bandwidth of all file downloads together, e.g. 10MB/s")
+	compress := flag.Int("compress", 5, "gzip level, 1 to 9, of pages, listings, API answers and text files for clients that take it; 0 turns it off")
+	maxRatePerConn := flag.String("max-rate-per-conn", "", "Cap the bandwidth of downloads per connection, e.g. 2MB/s")
+	uploadMaxSize := flag.String("upload-max-size", "", "Refuse uploads from the listing larger than this per file, e.g. 1GB")
+	uploadExtensions := flag.String("upload-extensions", "", "Comma separated extensions the listing takes uploads of, e.g. jpg,png,pdf; empty for any")
+	uploadExpiry := flag.Duration("upload-expiry", 24*time.Hour, "Throw away resumable uploads that got nothing new for this long")
+	trashKeep := flag.Duration("trash-keep", 30*24*time.Hour, "Purge deleted files from the trash after this long, 0 keeps them until an admin does")
+	receiptsKeep := flag.Duration("receipts-keep", 90*24*time.Hour, "Sum the download receipts of share links up per day after this long, 0 keeps every one")
+	minFree := flag.String("min-free", "1GB", "Pause uploads and new review copies on a disk with less free space than this; 0 only once one is full")
+	uploadQuota := flag.String("upload-quota", "", "How much every user but admins may upload from the listing a day, e.g. 5GB; empty for no limit")
+	storageQuota := flag.String("storage-quota", "", "How much every user but admins may keep uploaded, e.g. 50GB; admins set others per user, empty for no limit")
+	idFormat := flag.String("id-format", "ulid", "How new IDs of files and comments are made: "+idFormatNames())
+	eventsTo := flag.String("events", "", "Also send events to NATS or Redis and take those of other instances, e.g. nats://localhost:4222 or redis://localhost:6379")
+	lowMemory := flag.Bool("low-memory", false, "Keep memory use small for a Raspberry Pi or NAS, at the cost of speed")
+	hashPasswordFlag := flag.Bool("hash-password", false, "Read a password from stdin, print its hash for -basic-auth and exit")
 	flag.Parse()
 
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "data" && len(mounts) > 0 {
+			log.Fatal("-data and -directory don't go together")
+		}
+	})
+	if *noOutsideLinks && *followSymlinks == string(followAlways) {
+		*followSymlinks = string(followInsideRoot)
+	}
+
+	if *hashPasswordFlag {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal("could not read password: ", err)
+		}
+		hash, err := hashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatal("could not hash password: ", err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	setupLogging(*logFormat)
+
+	for env, value := range map[string]*string{"ALLOW": allow, "DENY": deny, "TRUSTED_PROXIES": trustedProxies} {
+		if v := os.Getenv(env); v != "" {
+			*value = v
+		}
+	}
+	if env := os.Getenv("STATE_DIR"); env != "" {
+		*stateDir = env
+	}
+	if *stateDir != "" {
+		applyStateDir(*stateDir, map[string]*string{"db": dbPath, "comments": comments, "cache": cache, "sftp-host-key": sftpHostKey})
+	}
+	if err := dropPrivileges(*stateDir, *dbPath, *comments, *cache); err != nil {
+		log.Fatal("could not switch user: ", err)
+	}
+
+	memory := defaultProfile
+	if *lowMemory {
+		memory = lowMemoryProfile
+	}
+
 	if envPort := os.Getenv("PORT"); envPort != "" {
 		if p, err := fmt.Sscanf(envPort, "%d", port); p != 1 || err != nil {
 			log.Fatalf("invalid PORT env var: %q", envPort)
 		}
 	}
+	apiDisabled, err := parseAPIVersions(*apiDisable)
+	if err != nil {
+		log.Fatal("-api-disable: ", err)
+	}
 
-	err := NewMainServer(ctx, ServerConfig{
+	err = NewMainServer(ctx, ServerConfig{
 		Port:     *port,
 		data:     *data,
+		Mounts:   mounts,
 		Comments: *comments,
+		DB:       *dbPath,
+		Cache:    *cache,
+		Watermark: Watermark{
+			Text:  *watermarkText,
+			Image: *watermarkImage,
+		},
+		BasicAuth: *basicAuthSpec,
+		PublicURL: *publicURL,
+		ACL:       *aclPath,
+		Memory:    memory,
+		Health:    *healthFile,
+		ReadOnly:  *readOnly,
+		Warm:      *warm,
+		FullText:  *fullText,
+		Watch:     *watch,
+		ShowPerms: *showPerms,
+
+		ReviewMinQuality: *reviewMinQuality,
+		ReviewMinSize:    *reviewMinSize,
+
+		Terms:        *termsPath,
+		TermsVersion: *termsVersion,
+
+		SFTPPort:    *sftpPort,
+		SFTPHostKey: *sftpHostKey,
+
+		MailInListen:  *mailInListen,
+		MailInTo:      *mailInTo,
+		MailInFolders: *mailInFolders,
+
+		APIDisabled: apiDisabled,
+		APIQuota:    *apiQuota,
+
+		ShowDotfiles:   *showDotfiles,
+		FollowSymlinks: *followSymlinks,
+
+		ExternalTimeout: *externalTimeout,
+
+		SessionIdle:     *sessionIdle,
+		SessionRemember: *sessionRemember,
+
+		Allow:          *allow,
+		Deny:           *deny,
+		TrustedProxies: *trustedProxies,
+
+		EmbedOrigins: *embedOrigins,
+
+		Pipelines: *pipelinesFile,
+
+		PasteFolders: *pasteFolders,
+
+		ImageCache:    *imageCache,
+		ListingCache:  *listingCache,
+		FragmentCache: *fragmentCache,
+		PageCache:     *pageCache,
+
+		MaxRate:        *maxRate,
+		MaxRatePerConn: *maxRatePerConn,
+
+		Compress: *compress,
+
+		UploadMaxSize:    *uploadMaxSize,
+		UploadExtensions: *uploadExtensions,
+		UploadExpiry:     *uploadExpiry,
+		UploadQuota:      *uploadQuota,
+		StorageQuota:     *storageQuota,
+		MinFree:          *minFree,
+		TrashKeep:        *trashKeep,
+		ReceiptsKeep:     *receiptsKeep,
+
+		Events: *eventsTo,
+
+		IDFormat: *idFormat,
 	})
 	if err != nil {
 		log.Fatal("serve error ", err)
@@ -686,6 +1449,14 @@ func GetMimeTypeFromFilename(name string) string {
 	return "application/octet-stream"
 }
 
+// redactURL hides the password of a redis:// cache address.
+func redactURL(s string) string {
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return s
+}
+
 func redact(s string) string {
 	if len(s) <= 8 {
 		return "***"
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGenerateBreadcrumbs(t *testing.T) {
+	for _, tc := range []struct {
+		name, prefix, rel string
+		want              []Breadcrumb
+	}{
+		{"root", "/files/", "", []Breadcrumb{}},
+		{"root with slash", "/files/", "/", []Breadcrumb{}},
+		{"one folder", "/files/", "music", []Breadcrumb{
+			{Name: "music", URL: "/files/music/", IsLast: true},
+		}},
+		{"nested", "/files/", "music/album/disc 1", []Breadcrumb{
+			{Name: "music", URL: "/files/music/"},
+			{Name: "album", URL: "/files/music/album/"},
+			{Name: "disc 1", URL: "/files/music/album/disc 1/", IsLast: true},
+		}},
+		{"trailing slash", "/files/", "music/album/", []Breadcrumb{
+			{Name: "music", URL: "/files/music/"},
+			{Name: "album", URL: "/files/music/album/", IsLast: true},
+		}},
+		// what resolve made of music/album on a case-insensitive disk
+		{"case folded", "/files/", "Music/Album", []Breadcrumb{
+			{Name: "Music", URL: "/files/Music/"},
+			{Name: "Album", URL: "/files/Music/Album/", IsLast: true},
+		}},
+		{"mount", "/files/", "archive/2019/Take 3", []Breadcrumb{
+			{Name: "archive", URL: "/files/archive/"},
+			{Name: "2019", URL: "/files/archive/2019/"},
+			{Name: "Take 3", URL: "/files/archive/2019/Take 3/", IsLast: true},
+		}},
+		{"share", "/s/abc123/files/", "album", []Breadcrumb{
+			{Name: "album", URL: "/s/abc123/files/album/", IsLast: true},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := GenerateBreadcrumbs(tc.prefix, tc.rel); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("GenerateBreadcrumbs(%q, %q) = %+v, want %+v", tc.prefix, tc.rel, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Organizing the library from the browser: new folders, renames, moves and
+// deletes, the last ones into the trash (trash.go). Whatever hangs off a path
+// in Consus goes along with the file: its comments, comment count, license,
+// the access rules of a folder and the share links to it. WebDAV and SFTP do
+// the same through moveMetadata and trashEntry.
+
+var (
+	errTaken      = errors.New("there is something of that name there already")
+	errIntoItself = errors.New("a folder can't go into itself")
+	errAcrossTops = errors.New("moving between the top level folders isn't supported")
+)
+
+// changeablePath returns where rel is on disk if it may be renamed, moved or
+// deleted: on disk, not a bucket, not the top of the tree or of a mount.
+func changeablePath(content *contentFS, rel string) (string, error) {
+	full := content.abs(rel)
+	if m, rest := content.mountOf(rel); full == "" || rel == "" || m != nil && rest == "" {
+		return "", errNotWritable
+	}
+	if content.linkRefused(path.Dir(rel)) {
+		return "", errLinkRefused
+	}
+	return full, nil
+}
+
+// entryName checks a name for a new folder or a rename in dir, and returns
+// why it can't be one if so.
+func entryName(content *contentFS, dir, name string) string {
+	name = strings.TrimSpace(name)
+	if strings.ContainsAny(name, "/\\") {
+		return "a name can't have / in it"
+	}
+	if _, problem := uploadName(content, dir, name); problem != "" {
+		return problem
+	}
+	return hostNameProblem(name)
+}
+
+// destination tells why an entry can't be renamed or moved to name in dir,
+// naming it, with the status to answer. A file there follows the upload rules like one
+// uploaded, x.jpg renamed to x.exe is no way around them.
+func destination(content *contentFS, rules uploadRules, dir, name string, isDir bool) (int, string) {
+	if problem := entryName(content, dir, name); problem != "" {
+		return http.StatusBadRequest, fmt.Sprintf("%q: %s", name, problem)
+	}
+	if !isDir {
+		if _, status, problem := rules.check(content, dir, name, "replace"); problem != "" {
+			return status, problem
+		}
+	}
+	return 0, ""
+}
+
+// makeFolder creates the folder rel, its parent has to be there.
+func makeFolder(content *contentFS, rel string) error {
+	full := content.abs(rel)
+	if full == "" || content.virtual(path.Dir(rel)) && len(content.mounts) > 0 {
+		return errNotWritable
+	}
+	if content.linkRefused(path.Dir(rel)) {
+		return errLinkRefused
+	}
+	if err := disks.room(full); err != nil {
+		return err
+	}
+	err := os.Mkdir(full, 0o755)
+	switch {
+	case errors.Is(err, fs.ErrExist):
+		return errTaken
+	case errors.Is(err, fs.ErrNotExist):
+		return errNoParent
+	}
+	return disks.noticed(full, err)
+}
+
+// moveEntry renames from to to, which may be in another folder, and takes
+// everything Consus keeps about it along. Nothing there is overwritten.
+func moveEntry(db *sql.DB, content *contentFS, commentPath, from, to string) error {
+	src, err := changeablePath(content, from)
+	if err != nil {
+		return err
+	}
+	dst, err := changeablePath(content, to)
+	if err != nil {
+		return err
+	}
+	if to == from || strings.HasPrefix(to, from+"/") {
+		return errIntoItself
+	}
+	if m, _ := content.mountOf(from); m != nil {
+		if n, _ := content.mountOf(to); n != m {
+			return errAcrossTops
+		}
+	}
+	if _, err := os.Lstat(src); err != nil {
+		return err
+	}
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	if _, err := os.Lstat(dst); err == nil {
+		return errTaken
+	}
+	if info, err := os.Stat(filepath.Dir(dst)); err != nil || !info.IsDir() {
+		return errNoParent
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	return moveMetadata(db, commentPath, from, to)
+}
+
+// belowPath is the SQL condition for path being rel or inside it.
+const belowPath = "(path = ? OR substr(path, 1, length(?) + 1) = ? || '/')"
+
+// entryTables are the tables keyed by path whose rows follow a move.
+var entryTables = []string{"folder_rules", "path_grants", "file_licenses", "shares", "stored_files", "file_checksums", "file_ids"}
+
+// moveMetadata moves the comments and the database rows of from and below
+// to to.
+func moveMetadata(db *sql.DB, commentPath, from, to string) error {
+	return relocateMetadata(db, commentPath, from, to, entryTables)
+}
+
+// relocateMetadata is moveMetadata for the comments, their counts and the
+// rows of tables only.
+func relocateMetadata(db *sql.DB, commentPath, from, to string, tables []string) error {
+	from, to = cleanRel(from), cleanRel(to)
+	if commentPath != "" {
+		src := filepath.Join(commentPath, filepath.FromSlash(from))
+		dst := filepath.Join(commentPath, filepath.FromSlash(to))
+		if _, err := os.Stat(src); err == nil {
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+				return err
+			}
+			os.RemoveAll(dst)
+			if err := os.Rename(src, dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	moved := "? || substr(path, length(?) + 1)"
+	for _, table := range tables {
+		if _, err := tx.Exec("UPDATE OR REPLACE "+table+" SET path = "+moved+" WHERE "+belowPath,
+			to, from, from, from, from); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	// the counts also know their folder and name
+	if _, err := tx.Exec(`UPDATE OR REPLACE comment_counts SET
+			path = `+moved+`,
+			parent = CASE WHEN path = ? THEN ? ELSE ? || substr(parent, length(?) + 1) END,
+			name = CASE WHEN path = ? THEN ? ELSE name END
+		WHERE `+belowPath,
+		to, from, from, cleanRel(path.Dir(to)), to, from, from, path.Base(to), from, from, from); err != nil {
+		return fmt.Errorf("comment_counts: %w", err)
+	}
+	return tx.Commit()
+}
+
+// dropMetadata forgets the comments, counts, licenses and uploaders of rel
+// and below.
+func dropMetadata(db *sql.DB, commentPath, rel string) error {
+	rel = cleanRel(rel)
+	if commentPath != "" {
+		if err := os.RemoveAll(filepath.Join(commentPath, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"comment_counts", "file_licenses", "stored_files", "file_checksums", "file_ids"} {
+		if _, err := db.Exec("DELETE FROM "+table+" WHERE "+belowPath, rel, rel, rel); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// manageStatus is the response to a failed file operation.
+func manageStatus(err error) int {
+	switch {
+	case errors.Is(err, errTaken), errors.Is(err, errIntoItself), errors.Is(err, errAcrossTops):
+		return http.StatusConflict
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	}
+	status := writeStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("%s", err.Error())
+	}
+	return status
+}
+
+// manageDone answers a file operation: browsers go back to the listing of
+// dir, scripts get where the entry is now.
+func manageDone(w http.ResponseWriter, r *http.Request, dir, rel string, status int) {
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		back := "/files/"
+		if dir = cleanRel(dir); dir != "" {
+			back += dir + "/"
+		}
+		http.Redirect(w, r, (&url.URL{Path: back}).String(), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"path": rel})
+}
+
+// manageTarget is the entry a file operation is about, from the URL below
+// prefix.
+func manageTarget(content *contentFS, r *http.Request, prefix string) (string, error) {
+	rel, err := content.resolve(strings.TrimPrefix(r.URL.Path, prefix))
+	if err != nil {
+		return "", err
+	}
+	if _, err := content.stat(rel); err != nil {
+		return "", err
+	}
+	return rel, nil
+}
+
+// folderCreate is POST /mkdir/dir/ with name=: a new folder in dir.
+func folderCreate(db *sql.DB, content *contentFS) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dir, err := manageTarget(content, r, "/mkdir/")
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		if problem := entryName(content, dir, name); problem != "" {
+			http.Error(w, fmt.Sprintf("%q: %s", name, problem), http.StatusBadRequest)
+			return
+		}
+		rel := path.Join(dir, name)
+		if err := makeFolder(content, rel); err != nil {
+			http.Error(w, err.Error(), manageStatus(err))
+			return
+		}
+		audit(db, r, emailFromRequest(r), auditFolderCreate, rel, "")
+		manageDone(w, r, dir, rel, http.StatusCreated)
+	}
+}
+
+// entryRename is POST /rename/path with name=: the entry gets that name in
+// the same folder.
+func entryRename(db *sql.DB, content *contentFS, commentPath string, rules uploadRules) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel, err := manageTarget(content, r, "/rename/")
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		info, err := content.stat(rel)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		dir := cleanRel(path.Dir(rel))
+		name := strings.TrimSpace(r.FormValue("name"))
+		if status, problem := destination(content, rules, dir, name, info.IsDir()); problem != "" {
+			http.Error(w, problem, status)
+			return
+		}
+		to := path.Join(dir, name)
+		if err := moveEntry(db, content, commentPath, rel, to); err != nil {
+			http.Error(w, err.Error(), manageStatus(err))
+			return
+		}
+		email := emailFromRequest(r)
+		audit(db, r, email, auditFileMove, rel, to)
+		events.publish(eventEntryMoved, email, to, map[string]string{"from": rel})
+		manageDone(w, r, dir, to, http.StatusOK)
+	}
+}
+
+// entryMove is POST /move/path with to=: the entry goes into the folder to,
+// which whoever moves it has to be able to open.
+func entryMove(db *sql.DB, content *contentFS, commentPath string, rules uploadRules) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel, err := manageTarget(content, r, "/move/")
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		folder, err := content.resolve(strings.Trim(r.FormValue("to"), "/"))
+		if err != nil {
+			http.Error(w, "to is the folder to move it into", http.StatusBadRequest)
+			return
+		}
+		email := emailFromRequest(r)
+		if ok, err := canAccessPath(db, email, folder); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, "you can't open the folder to move it into", http.StatusForbidden)
+			return
+		}
+		if info, err := content.stat(folder); err != nil || !info.IsDir() {
+			http.Error(w, errNoParent.Error(), http.StatusConflict)
+			return
+		}
+		info, err := content.stat(rel)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		// what is fine in one folder can be hidden or refused in another
+		if status, problem := destination(content, rules, folder, path.Base(rel), info.IsDir()); problem != "" {
+			http.Error(w, problem, status)
+			return
+		}
+		to := path.Join(folder, path.Base(rel))
+		if err := moveEntry(db, content, commentPath, rel, to); err != nil {
+			http.Error(w, err.Error(), manageStatus(err))
+			return
+		}
+		audit(db, r, email, auditFileMove, rel, to)
+		events.publish(eventEntryMoved, email, to, map[string]string{"from": rel})
+		manageDone(w, r, path.Dir(rel), to, http.StatusOK)
+	}
+}
+
+// entryDelete is POST /delete/path: the file, or the folder with everything
+// in it, goes to the trash.
+func entryDelete(db *sql.DB, content *contentFS, commentPath string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel, err := manageTarget(content, r, "/delete/")
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		email := emailFromRequest(r)
+		if err := trashEntry(db, content, commentPath, rel, email); err != nil {
+			http.Error(w, err.Error(), manageStatus(err))
+			return
+		}
+		audit(db, r, email, auditFileDelete, rel, "")
+		manageDone(w, r, path.Dir(rel), rel, http.StatusOK)
+	}
+}
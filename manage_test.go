@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenameAndMoveFollowUploadRules(t *testing.T) {
+	c := testContent(t, "up/x.jpg", "up/album/", "other/")
+	db := testDB(t)
+	rules := uploadRules{extensions: map[string]bool{".jpg": true}}
+	rename := entryRename(db, c, "", rules)
+	move := entryMove(db, c, "", rules)
+
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		url     string
+		form    url.Values
+		status  int
+	}{
+		{rename, "/rename/up/x.jpg", url.Values{"name": {"x.exe"}}, http.StatusUnsupportedMediaType},
+		{rename, "/rename/up/x.jpg", url.Values{"name": {".x.jpg"}}, http.StatusBadRequest},
+		{rename, "/rename/up/album", url.Values{"name": {"album 2"}}, http.StatusOK},
+		{rename, "/rename/up/x.jpg", url.Values{"name": {"y.jpg"}}, http.StatusOK},
+		{move, "/move/up/y.jpg", url.Values{"to": {"other"}}, http.StatusOK},
+	} {
+		r := httptest.NewRequest("POST", tc.url, strings.NewReader(tc.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		tc.handler(w, r)
+		if w.Code != tc.status {
+			t.Errorf("POST %s %s: %d %s, want %d", tc.url, tc.form.Encode(), w.Code, strings.TrimSpace(w.Body.String()), tc.status)
+		}
+	}
+	for _, name := range []string{"up/album 2", "other/y.jpg"} {
+		if _, err := os.Stat(filepath.Join(c.root, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s isn't there: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mount is a folder shown as a top level folder of the content tree, from
+// -directory name=/path. With mounts the top of the tree is made up: it holds
+// just the mounts, and /files/music/... is served from the music mount's
+// folder, wherever that lives. Comments of a mount end up below its name in the
+// comment folder, like they would if it was a real folder. A mount can also be
+// a bucket, name=s3://bucket/prefix, see s3store.go.
+type mount struct {
+	name   string
+	source string // what -directory said
+	dir    string // on disk, "" for a bucket
+	real   string // dir with its symlinks followed, to tell what leads out of it
+	store  contentStore
+}
+
+func parseMount(spec string) (mount, error) {
+	name, dir, ok := strings.Cut(spec, "=")
+	if !ok || dir == "" {
+		return mount{}, fmt.Errorf("-directory %q: want name=/path", spec)
+	}
+	if name == "" || name != cleanRel(name) || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		return mount{}, fmt.Errorf("-directory %q: the name has to be a plain folder name", spec)
+	}
+	if strings.HasPrefix(dir, "s3://") {
+		store, err := newS3Store(dir)
+		if err != nil {
+			return mount{}, fmt.Errorf("-directory %s: %w", name, err)
+		}
+		return mount{name: name, source: dir, store: store}, nil
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return mount{}, fmt.Errorf("-directory %q: %w", spec, err)
+	} else if !info.IsDir() {
+		return mount{}, fmt.Errorf("-directory %q: not a folder", spec)
+	}
+	return mount{name: name, source: dir, dir: dir, real: realPath(dir), store: diskStore(dir)}, nil
+}
+
+// mountList collects repeated -directory flags.
+type mountList []mount
+
+func (l *mountList) String() string {
+	var specs []string
+	for _, m := range *l {
+		specs = append(specs, m.name+"="+m.source)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (l *mountList) Set(spec string) error {
+	m, err := parseMount(spec)
+	if err != nil {
+		return err
+	}
+	for _, other := range *l {
+		if other.name == m.name {
+			return fmt.Errorf("-directory %q: %s is mounted already", spec, m.name)
+		}
+	}
+	*l = append(*l, m)
+	return nil
+}
+
+// realPath is the absolute path of dir with its symlinks followed, as far as
+// they can be.
+func realPath(dir string) string {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		real = dir
+	}
+	real, _ = filepath.Abs(real)
+	return real
+}
+
+// mountOf splits rel into its mount and the rest below it.
+func (c *contentFS) mountOf(rel string) (*mount, string) {
+	first, rest, _ := strings.Cut(cleanRel(rel), "/")
+	for i := range c.mounts {
+		if c.mounts[i].name == first {
+			return &c.mounts[i], rest
+		}
+	}
+	return nil, ""
+}
+
+// virtual tells whether rel is the made-up top of a tree of mounts.
+func (c *contentFS) virtual(rel string) bool {
+	return len(c.mounts) > 0 && cleanRel(rel) == ""
+}
+
+// abs is the path on disk of rel, a slash separated path below the top of the
+// content tree. It is "" for the top of a tree of mounts and for paths in no
+// mount at all, and for buckets.
+func (c *contentFS) abs(rel string) string {
+	if len(c.mounts) == 0 {
+		return filepath.Join(c.root, filepath.FromSlash(cleanRel(rel)))
+	}
+	m, rest := c.mountOf(rel)
+	if m == nil || m.dir == "" {
+		return ""
+	}
+	return filepath.Join(m.dir, filepath.FromSlash(rest))
+}
+
+// rel is abs the other way around; ok is false for paths outside the tree.
+func (c *contentFS) rel(name string) (string, bool) {
+	for _, d := range c.dirs() {
+		if d.dir == "" {
+			continue
+		}
+		prefix, _ := filepath.Abs(d.dir)
+		r, err := filepath.Rel(prefix, name)
+		if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return cleanRel(path.Join(d.name, filepath.ToSlash(r))), true
+	}
+	return "", false
+}
+
+// dirs are the folders that make up the content tree, the content root or
+// every mount, by the name they have in the tree.
+func (c *contentFS) dirs() []mount {
+	if len(c.mounts) == 0 {
+		return []mount{{name: "", dir: c.root, real: c.realRoot, store: c.store}}
+	}
+	return c.mounts
+}
+
+// id tells one content tree from another, for the content index and the
+// cache keys.
+func (c *contentFS) id() string {
+	if len(c.mounts) == 0 {
+		abs, _ := filepath.Abs(c.root)
+		return abs
+	}
+	var specs []string
+	for _, m := range c.mounts {
+		source := m.source
+		if m.dir != "" {
+			source, _ = filepath.Abs(m.dir)
+		}
+		specs = append(specs, m.name+"="+source)
+	}
+	return strings.Join(specs, "\n")
+}
+
+// mountEntry is a mount's folder under the mount's name.
+type mountEntry struct {
+	fs.DirEntry
+	name string
+}
+
+func (e mountEntry) Name() string { return e.name }
+
+// virtualRoot stands in for the top of a tree of mounts. Its mtime never
+// changes, a different set of mounts makes a different content index anyway.
+type virtualRoot struct{}
+
+func (virtualRoot) Name() string       { return "." }
+func (virtualRoot) Size() int64        { return 0 }
+func (virtualRoot) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (virtualRoot) ModTime() time.Time { return time.Unix(0, 1) }
+func (virtualRoot) IsDir() bool        { return true }
+func (virtualRoot) Sys() any           { return nil }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Notification struct {
+	ID        int64
+	Message   string
+	Link      string
+	CreatedAt time.Time
+	Read      bool
+}
+
+// notifier stores notifications for the web UI and mails them when SMTP is set up.
+type notifier struct {
+	db        *sql.DB
+	mail      *mailer
+	publicURL string
+}
+
+// notify is fire and forget, a broken mail server must never fail the request
+// that triggered it.
+func (n *notifier) notify(email, message, link string) {
+	if _, err := n.db.Exec("INSERT INTO notifications (email, message, link, created_at) VALUES (?, ?, ?, ?)",
+		email, message, link, time.Now()); err != nil {
+		log.Printf("could not store notification for %s: %v", email, err)
+	}
+
+	go func() {
+		body := message
+		if link != "" {
+			body += "\n\n" + n.publicURL + link
+		}
+		if err := n.mail.send(email, "[Consus] "+message, body); err != nil {
+			log.Printf("could not mail notification to %s: %v", email, err)
+		}
+	}()
+}
+
+func listNotifications(db *sql.DB, email string) ([]Notification, error) {
+	rows, err := db.Query(`SELECT id, message, link, created_at, read_at IS NOT NULL FROM notifications
+		WHERE email = ? ORDER BY created_at DESC LIMIT 100`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Message, &n.Link, &n.CreatedAt, &n.Read); err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// renderNotifications shows the latest notifications and marks them as read.
+func renderNotifications(tmpl *template.Template, db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := emailFromRequest(r)
+		list, err := listNotifications(db, email)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := db.Exec("UPDATE notifications SET read_at = ? WHERE email = ? AND read_at IS NULL", time.Now(), email); err != nil {
+			log.Printf("%s", err.Error())
+		}
+
+		data := struct {
+			Version       string
+			UserEmail     string
+			Notifications []Notification
+		}{
+			Version:       GetVersion(),
+			UserEmail:     email,
+			Notifications: list,
+		}
+		if err := tmpl.ExecuteTemplate(w, "notifications.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// notifyOnEvent tells the people who took part when something happens: the
+// others who commented on a file when a comment is added, whoever made the
+// invite when somebody signs up with it.
+func notifyOnEvent(db *sql.DB, n *notifier, commentPath string) func(event) error {
+	return func(e event) error {
+		switch e.Kind {
+		case eventCommentPosted:
+			if commentPath == "" {
+				return nil
+			}
+			comments, err := loadComments(filepath.Join(commentPath, filepath.FromSlash(e.Path)))
+			if err != nil {
+				return err
+			}
+			told := map[string]bool{e.Actor: true}
+			for _, c := range comments {
+				// guests commenting through share links have no email
+				if told[c.User] || !strings.Contains(c.User, "@") {
+					continue
+				}
+				told[c.User] = true
+				// the access of who commented may be gone since
+				if ok, err := canAccessPath(db, c.User, e.Path); err != nil {
+					return err
+				} else if ok {
+					n.notify(c.User, fmt.Sprintf("%s commented on /%s", e.Actor, e.Path), "/view/"+e.Path)
+				}
+			}
+		case eventUserRegistered:
+			var inviter string
+			err := db.QueryRow("SELECT created_by FROM invites WHERE code = ?", e.Data["invite"]).Scan(&inviter)
+			if errors.Is(err, sql.ErrNoRows) {
+				// the first account needs none
+				return nil
+			} else if err != nil {
+				return err
+			}
+			n.notify(inviter, fmt.Sprintf("%s (%s) signed up with your invite", e.Data["name"], e.Actor), "/users")
+		}
+		return nil
+	}
+}
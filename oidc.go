@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+	"golang.org/x/oauth2/google"
+)
+
+// loginProvider is an external identity provider speaking the OAuth2 code flow.
+type loginProvider struct {
+	Name   string // used in /login/{name} and /callback/{name}
+	Title  string // shown on the login page
+	config *oauth2.Config
+	// identify fetches the stable subject and the email of the logged-in user.
+	identify func(ctx context.Context, client *http.Client) (subject, email string, err error)
+	breaker  *breaker
+}
+
+// loadProviders configures every provider that has its client ID set in the environment.
+func loadProviders(timeout time.Duration) map[string]*loginProvider {
+	providers := map[string]*loginProvider{}
+
+	if id := os.Getenv("GOOGLE_CLIENT_ID"); id != "" {
+		providers["google"] = &loginProvider{
+			Name:  "google",
+			Title: "Google",
+			config: &oauth2.Config{
+				ClientID:     id,
+				ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+				RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
+				Scopes:       []string{"openid", "https://www.googleapis.com/auth/userinfo.email"},
+				Endpoint:     google.Endpoint,
+			},
+			identify: oidcUserInfo("https://openidconnect.googleapis.com/v1/userinfo"),
+		}
+	}
+
+	if id := os.Getenv("GITHUB_CLIENT_ID"); id != "" {
+		providers["github"] = &loginProvider{
+			Name:  "github",
+			Title: "GitHub",
+			config: &oauth2.Config{
+				ClientID:     id,
+				ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
+				RedirectURL:  os.Getenv("GITHUB_REDIRECT_URL"),
+				Scopes:       []string{"read:user", "user:email"},
+				Endpoint:     endpoints.GitHub,
+			},
+			identify: githubUserInfo,
+		}
+	}
+
+	if id := os.Getenv("OIDC_CLIENT_ID"); id != "" {
+		issuer := strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+		discovery, err := discoverOIDC(issuer)
+		if err != nil {
+			log.Printf("warning: OIDC provider disabled: %v", err)
+		} else {
+			title := os.Getenv("OIDC_NAME")
+			if title == "" {
+				title = "SSO"
+			}
+			providers["oidc"] = &loginProvider{
+				Name:  "oidc",
+				Title: title,
+				config: &oauth2.Config{
+					ClientID:     id,
+					ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+					RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+					Scopes:       []string{"openid", "email", "profile"},
+					Endpoint: oauth2.Endpoint{
+						AuthURL:  discovery.AuthorizationEndpoint,
+						TokenURL: discovery.TokenEndpoint,
+					},
+				},
+				identify: oidcUserInfo(discovery.UserinfoEndpoint),
+			}
+		}
+	}
+
+	for _, p := range providers {
+		// the token endpoint refusing a code is an answer, not an outage
+		p.breaker = newBreaker("login provider "+p.Name, timeout, func(err error) bool {
+			var refused *oauth2.RetrieveError
+			return errors.As(err, &refused)
+		})
+	}
+	return providers
+}
+
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+func discoverOIDC(issuer string) (*oidcDiscovery, error) {
+	if issuer == "" {
+		return nil, errors.New("OIDC_ISSUER is not set")
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("discovery failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery failed: %s", resp.Status)
+	}
+
+	var d oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, fmt.Errorf("could not parse discovery document: %w", err)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.UserinfoEndpoint == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	return &d, nil
+}
+
+func oidcUserInfo(url string) func(context.Context, *http.Client) (string, string, error) {
+	return func(ctx context.Context, client *http.Client) (string, string, error) {
+		var info struct {
+			Subject       string `json:"sub"`
+			Email         string `json:"email"`
+			EmailVerified *bool  `json:"email_verified"`
+		}
+		if err := getJSON(ctx, client, url, &info); err != nil {
+			return "", "", err
+		}
+		if info.EmailVerified != nil && !*info.EmailVerified {
+			return "", "", errors.New("email address is not verified")
+		}
+		return info.Subject, info.Email, nil
+	}
+}
+
+// githubUserInfo asks for the primary verified address separately, the profile
+// email is empty when the user keeps it private.
+func githubUserInfo(ctx context.Context, client *http.Client) (string, string, error) {
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &user); err != nil {
+		return "", "", err
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return "", "", err
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return strconv.FormatInt(user.ID, 10), e.Email, nil
+		}
+	}
+	return "", "", errors.New("no verified primary email on the GitHub account")
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// userForIdentity maps a provider subject onto a local user, linking or creating
+// the row on first login. Unless the provider is trusted to decide who gets in,
+// unknown people are only let in when their email is on ALLOWED_EMAILS.
+func userForIdentity(db *sql.DB, provider, subject, email string, trusted bool) (*User, error) {
+	user, err := scanUser(db.QueryRow("SELECT "+prefixColumns("u.", userColumns)+
+		" FROM identities i JOIN users u ON u.id = i.user_id WHERE i.provider = ? AND i.subject = ?", provider, subject))
+	if err == nil {
+		return user, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	err = tx.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		if !trusted && !isAllowedEmail(email) {
+			return nil, errNotAllowed
+		}
+		if err := createUser(tx, uniqueUserName(tx, email), email, "", roleEditor); err != nil {
+			return nil, err
+		}
+		if err := tx.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("INSERT INTO identities (provider, subject, user_id, created_at) VALUES (?, ?, ?, ?)",
+		provider, subject, userID, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userID))
+}
+
+var errNotAllowed = errors.New("access denied: email not in allowlist")
+
+// uniqueUserName derives a user name from the local part of email.
+func uniqueUserName(tx *sql.Tx, email string) string {
+	base, _, _ := strings.Cut(email, "@")
+	name := base
+	for i := 2; ; i++ {
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE name = ?", name).Scan(&n); err != nil || n == 0 {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+func prefixColumns(prefix, columns string) string {
+	cols := strings.Split(columns, ", ")
+	for i := range cols {
+		cols[i] = prefix + cols[i]
+	}
+	return strings.Join(cols, ", ")
+}
+
+func handleLogin(providers map[string]*loginProvider) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := providers[r.PathValue("provider")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		state := newSessionToken()
+		http.SetCookie(w, &http.Cookie{
+			Name:     "oauth_state",
+			Value:    state,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   300,
+		})
+		if redirect := r.URL.Query().Get("redirect"); redirect != "" {
+			http.SetCookie(w, &http.Cookie{
+				Name:     "oauth_redirect",
+				Value:    redirect,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+				MaxAge:   300,
+			})
+		}
+		http.Redirect(w, r, provider.config.AuthCodeURL(state), http.StatusTemporaryRedirect)
+	}
+}
+
+func handleCallback(db *sql.DB, providers map[string]*loginProvider) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("provider")
+		if name == "" {
+			// the original Google redirect URL had no provider segment
+			name = "google"
+		}
+		provider, ok := providers[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		stateCookie, err := r.Cookie("oauth_state")
+		if err != nil || r.URL.Query().Get("state") != stateCookie.Value {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		}
+		// Clear state cookie
+		http.SetCookie(w, &http.Cookie{Name: "oauth_state", Path: "/", MaxAge: -1})
+
+		var subject, email string
+		err = provider.breaker.call(r.Context(), func(ctx context.Context) error {
+			token, err := provider.config.Exchange(ctx, r.URL.Query().Get("code"))
+			if err != nil {
+				return fmt.Errorf("oauth exchange error: %w", err)
+			}
+			subject, email, err = provider.identify(ctx, provider.config.Client(ctx, token))
+			if err != nil {
+				return fmt.Errorf("userinfo error: %w", err)
+			}
+			return nil
+		})
+		if errors.Is(err, errUnavailable) {
+			http.Error(w, provider.Title+" is not answering right now, try again in a minute.", http.StatusServiceUnavailable)
+			return
+		} else if err != nil || subject == "" || email == "" {
+			log.Printf("%s login error: %v", provider.Name, err)
+			http.Error(w, "could not fetch user info", http.StatusInternalServerError)
+			return
+		}
+
+		user, err := userForIdentity(db, provider.Name, subject, email, false)
+		if errors.Is(err, errNotAllowed) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			log.Printf("identity mapping error: %v", err)
+			http.Error(w, "could not log in", http.StatusInternalServerError)
+			return
+		}
+
+		audit(db, r, user.Email, auditLogin, user.Email, provider.Name)
+		if !startSession(w, r, user.Email, false) {
+			return
+		}
+
+		redirectTo := "/files/"
+		if c, err := r.Cookie("oauth_redirect"); err == nil && c.Value != "" {
+			redirectTo = safeRedirect(c.Value)
+			http.SetCookie(w, &http.Cookie{Name: "oauth_redirect", Path: "/", MaxAge: -1})
+		}
+		http.Redirect(w, r, redirectTo, http.StatusTemporaryRedirect)
+	}
+}
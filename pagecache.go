@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// pageCache keeps the whole pages of listings and players as visitors who
+// aren't logged in get them, so a link going around doesn't read the folder
+// and the database for every one of them. It is for public -read-only
+// instances, where nothing a visitor does changes a page. Pages are keyed by
+// path, sort, page, layout and language; the events about a folder purge its pages,
+// a changed access rule all of them.
+type pageCache struct {
+	cache    *meteredCache
+	board    *announcements
+	foldCase bool
+	run      string // in the keys, what a shared cache has from an earlier run predates its purges
+
+	mu      sync.Mutex
+	epoch   int64
+	folders map[string]int64 // how often the pages of a folder were purged
+}
+
+// pageQuery are the parameters a cached page may have, anything else goes to
+// the handler.
+var pageQuery = []string{"sort", "order", "page", "view"}
+
+func newPageCache(cache *meteredCache, board *announcements, foldCase bool) *pageCache {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &pageCache{cache: cache, board: board, foldCase: foldCase, run: hex.EncodeToString(b), folders: map[string]int64{}}
+}
+
+// onEvent purges what an event changed.
+func (p *pageCache) onEvent(e event) error {
+	switch e.Kind {
+	case eventAccessChanged:
+		p.purgeAll()
+	case eventFolderChanged:
+		p.purge(e.Path)
+	case eventEntryMoved:
+		p.purge(path.Dir(e.Data["from"]))
+		p.purge(path.Dir(e.Path))
+	default:
+		// a file, its folder lists it
+		p.purge(path.Dir(e.Path))
+	}
+	return nil
+}
+
+// purge purges the pages of dir and of the folders above it, which list the
+// size of everything below them.
+func (p *pageCache) purge(dir string) {
+	dir = p.fold(cleanRel(dir))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		p.folders[dir]++
+		if dir == "" {
+			return
+		}
+		if dir = path.Dir(dir); dir == "." {
+			dir = ""
+		}
+	}
+}
+
+func (p *pageCache) purgeAll() {
+	p.mu.Lock()
+	p.epoch++
+	clear(p.folders)
+	p.mu.Unlock()
+}
+
+func (p *pageCache) fold(rel string) string {
+	if p.foldCase {
+		return strings.ToLower(rel)
+	}
+	return rel
+}
+
+// key is where the page for r is kept, "" for a request that isn't cached.
+// A page counts as one of its own folder and the one above, the listing of a
+// folder also shows what its parent knows and a player what its folder does.
+func (p *pageCache) key(r *http.Request) string {
+	if r.Method != http.MethodGet || emailFromRequest(r) != "" {
+		return ""
+	}
+	var rel string
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/files/"); ok {
+		if rest != "" && !strings.HasSuffix(rest, "/") {
+			// a file, with ranges and ETags of its own
+			return ""
+		}
+		rel = rest
+	} else if rest, ok := strings.CutPrefix(r.URL.Path, "/view/"); ok {
+		rel = rest
+	} else {
+		return ""
+	}
+	q := r.URL.Query()
+	kept := url.Values{}
+	for _, name := range pageQuery {
+		if v, ok := q[name]; ok {
+			kept[name] = v
+		}
+	}
+	if len(kept) != len(q) {
+		return ""
+	}
+
+	rel = p.fold(cleanRel(rel))
+	var b strings.Builder
+	p.mu.Lock()
+	fmt.Fprintf(&b, "%s/%d/%d/%d", p.run, p.epoch, p.folders[rel], p.folders[cleanRel(path.Dir(rel))])
+	p.mu.Unlock()
+	// the banner is on every page, and changes or runs out on its own
+	for _, a := range p.board.current() {
+		fmt.Fprintf(&b, ",%d", a.ID)
+	}
+	fmt.Fprintf(&b, " %s %s %s?%s", pageLanguage(r), listLayout(r), r.URL.Path, kept.Encode())
+	return b.String()
+}
+
+// pageLanguage is the language a visitor wants most, as in en or de.
+func pageLanguage(r *http.Request) string {
+	first, _, _ := strings.Cut(r.Header.Get("Accept-Language"), ",")
+	first, _, _ = strings.Cut(first, ";")
+	first, _, _ = strings.Cut(strings.TrimSpace(first), "-")
+	first = strings.ToLower(first)
+	if len(first) > 8 || strings.Trim(first, "abcdefghijklmnopqrstuvwxyz") != "" {
+		return ""
+	}
+	return first
+}
+
+// serve answers what is cached and keeps what the handler renders for the next
+// visitor. It goes inside csrfProtect: the form token of whoever rendered a
+// page is swapped for that of whoever gets it.
+func (p *pageCache) serve(next http.Handler) http.Handler {
+	if p == nil || p.cache.backend == nil {
+		return next
+	}
+	placeholder := []byte("csrf-" + p.run)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := p.key(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cached, ok := p.cache.Get(key); ok {
+			if header, body, err := splitPage(cached); err == nil {
+				for name, values := range header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("X-Page-Cache", "hit")
+				w.Write(bytes.ReplaceAll(body, placeholder, []byte(csrfToken(r))))
+				return
+			}
+		}
+
+		pw := &pageWriter{ResponseWriter: w, before: w.Header().Clone()}
+		next.ServeHTTP(pw, r)
+		// a page setting a cookie is somebody's own
+		if pw.status != http.StatusOK || len(w.Header().Values("Set-Cookie")) != len(pw.before.Values("Set-Cookie")) ||
+			!strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			return
+		}
+		header := http.Header{}
+		for name, values := range w.Header() {
+			// the ETag hashes in the form token of whoever rendered it
+			if _, ok := pw.before[name]; !ok && name != "Etag" {
+				header[name] = values
+			}
+		}
+		var page bytes.Buffer
+		header.Write(&page)
+		page.WriteString("\r\n")
+		if token := csrfToken(r); token != "" {
+			page.Write(bytes.ReplaceAll(pw.body.Bytes(), []byte(token), placeholder))
+		} else {
+			page.Write(pw.body.Bytes())
+		}
+		p.cache.Set(key, page.Bytes())
+	})
+}
+
+// splitPage takes a cached page apart into its headers and body.
+func splitPage(page []byte) (http.Header, []byte, error) {
+	br := bufio.NewReader(bytes.NewReader(page))
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := io.ReadAll(br)
+	return http.Header(header), body, err
+}
+
+// pageWriter copies a page on its way out.
+type pageWriter struct {
+	http.ResponseWriter
+	before http.Header // what was set before the handler
+	status int
+	body   bytes.Buffer
+}
+
+func (pw *pageWriter) WriteHeader(status int) {
+	if pw.status == 0 {
+		pw.status = status
+	}
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *pageWriter) Write(b []byte) (int, error) {
+	if pw.status == 0 {
+		pw.status = http.StatusOK
+	}
+	pw.body.Write(b)
+	return pw.ResponseWriter.Write(b)
+}
+
+func (pw *pageWriter) Flush() {
+	if f, ok := pw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
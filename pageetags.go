@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Listings and view pages carry an ETag made from what they are rendered
+// from: the folder's generation and mtime or the comment file's, the comment
+// counts, who is asking, the banner. A browser coming back with it in
+// If-None-Match gets a 304 before anything is rendered. Pages have the
+// visitor's form token in them, so they are private, and no-cache so they
+// are asked about every time.
+
+// pageETag is the ETag of the page r asks for, rendered from parts.
+func pageETag(r *http.Request, board *announcements, parts ...any) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	enc.Encode([]string{GetVersion(), emailFromRequest(r), csrfToken(r), r.URL.RawQuery})
+	if board != nil {
+		enc.Encode(board.current())
+	}
+	for _, p := range parts {
+		enc.Encode(p)
+	}
+	// weak, a page is the same whichever way it was compressed
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// notModified sends the validators of a page and answers a request that
+// already has it with a 304. If-Modified-Since alone isn't enough for one, a
+// page changes with comments and rights that leave mtimes alone.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" && etagListed(h, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Paste folders, the ones -paste-folders lists and everything below them,
+// take text as it is: pasted into the form of their listing, or PUT to
+// /paste/<folder>/ by a script. The file gets a made up name unless one is
+// given, with an extension going by what the text looks like, and is shown
+// at /paste/<path> with line numbers and the language it was taken for.
+
+const (
+	pasteMaxSize    = 1 << 20 // what a paste may be
+	pastePreviewMax = 1 << 20 // of a file shown at /paste/, the rest is cut off
+)
+
+// pasteFolders are the folders of -paste-folders.
+type pasteFolders []string
+
+func parsePasteFolders(spec string) pasteFolders {
+	var folders pasteFolders
+	for _, dir := range strings.Split(spec, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			folders = append(folders, cleanRel(dir))
+		}
+	}
+	return folders
+}
+
+// holds tells whether rel is a paste folder or in one.
+func (p pasteFolders) holds(rel string) bool {
+	rel = cleanRel(rel)
+	for _, dir := range p {
+		if dir == "" || rel == dir || strings.HasPrefix(rel, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// syntaxes are what a paste is taken for, by its first lines, the first
+// match winning.
+var syntaxes = []struct {
+	lang, ext string
+	re        *regexp.Regexp
+}{
+	{"Shell", ".sh", regexp.MustCompile(`\A#!\s*/\S*(ba|z|da)?sh\b|\A#!\s*/usr/bin/env\s+(ba|z)?sh\b`)},
+	{"Python", ".py", regexp.MustCompile(`\A#!\S*python|(?m)^(def \w+\(.*\):|from [\w.]+ import |import \w+$|if __name__ == )`)},
+	{"Diff", ".diff", regexp.MustCompile(`(?m)\A(diff --git |--- \S.*\n\+\+\+ |Index: )`)},
+	{"Go", ".go", regexp.MustCompile(`(?m)^package \w+$|^func (\(\w+ \*?\w+\) )?\w+\(`)},
+	{"HTML", ".html", regexp.MustCompile(`(?i)\A\s*(<!doctype html|<html)`)},
+	{"XML", ".xml", regexp.MustCompile(`\A\s*<\?xml `)},
+	{"PHP", ".php", regexp.MustCompile(`\A\s*<\?php`)},
+	{"SQL", ".sql", regexp.MustCompile(`(?im)^\s*(select .+ from |insert into |create (table|index|view) |update \w+ set )`)},
+	{"JavaScript", ".js", regexp.MustCompile(`(?m)^\s*(const|let|var) \w+ = |\bfunction\s*\w*\(.*\)\s*\{|=> \{|console\.log\(`)},
+	{"CSS", ".css", regexp.MustCompile(`(?m)^[.#]?[\w-]+(\s*[,>]\s*[.#]?[\w-]+)*\s*\{\s*$`)},
+	{"YAML", ".yaml", regexp.MustCompile(`(?m)\A(---\n)?[\w-]+:( .+)?\n([\w-]+:|  )`)},
+	{"Markdown", ".md", regexp.MustCompile(`(?m)^#{1,6} \S|^\s*[-*] \[[ x]\] |^` + "```")},
+	{"INI", ".ini", regexp.MustCompile(`(?m)\A\s*\[[\w .-]+\]\s*$`)},
+}
+
+// syntaxByExt names the language of a file by its extension, for pastes
+// given a name and files pasted some other way.
+func syntaxByExt(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	switch ext {
+	case ".json":
+		return "JSON"
+	case ".txt", ".log", "":
+		return ""
+	case ".yml":
+		return "YAML"
+	}
+	for _, s := range syntaxes {
+		if s.ext == ext {
+			return s.lang
+		}
+	}
+	return ""
+}
+
+// detectSyntax tells what text looks like and the extension going with it,
+// plain text if nothing fits.
+func detectSyntax(text string) (string, string) {
+	head := text
+	if len(head) > 4<<10 {
+		head = head[:4<<10]
+	}
+	if t := strings.TrimSpace(text); (strings.HasPrefix(t, "{") || strings.HasPrefix(t, "[")) && json.Valid([]byte(t)) {
+		return "JSON", ".json"
+	}
+	for _, s := range syntaxes {
+		if s.re.MatchString(head) {
+			return s.lang, s.ext
+		}
+	}
+	return "", ".txt"
+}
+
+// pasteName is what a paste is saved as: the name given, with the extension
+// of its language if it has none, or a made up one.
+func pasteName(given, text string) string {
+	_, ext := detectSyntax(text)
+	if given = strings.TrimSpace(given); given != "" {
+		if path.Ext(given) == "" {
+			given += ext
+		}
+		return given
+	}
+	return time.Now().UTC().Format("20060102-150405") + "-" + newShortCode()[:4] + ext
+}
+
+// pasteSubmit is POST /paste/<folder>/ with content= and name=, sending the
+// browser to the new file, and PUT /paste/<folder>/ with the text as the body
+// and ?name=, answering with where it went as JSON.
+func pasteSubmit(db *sql.DB, content *contentFS, rules uploadRules, pastes pasteFolders) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dir, err := manageTarget(content, r, "/paste/")
+		if err == nil {
+			err = isFolder(content, dir)
+		}
+		if err != nil || !pastes.holds(dir) {
+			http.NotFound(w, r)
+			return
+		}
+		var text, given string
+		if r.Method == http.MethodPut {
+			body, err := io.ReadAll(io.LimitReader(r.Body, pasteMaxSize+1))
+			if err != nil {
+				http.Error(w, fmt.Errorf("could not read paste: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+			text, given = string(body), r.URL.Query().Get("name")
+		} else {
+			text, given = r.FormValue("content"), r.FormValue("name")
+			// browsers send the lines of a textarea with \r\n
+			text = strings.ReplaceAll(text, "\r\n", "\n")
+		}
+		switch {
+		case len(text) > pasteMaxSize:
+			http.Error(w, "a paste is up to "+humanSize(pasteMaxSize), http.StatusRequestEntityTooLarge)
+			return
+		case strings.TrimSpace(text) == "":
+			http.Error(w, "nothing to paste", http.StatusBadRequest)
+			return
+		case !utf8.ValidString(text):
+			http.Error(w, "a paste is text, upload anything else", http.StatusUnsupportedMediaType)
+			return
+		}
+		if given != "" {
+			if problem := entryName(content, dir, given); problem != "" {
+				http.Error(w, fmt.Sprintf("%q: %s", given, problem), http.StatusBadRequest)
+				return
+			}
+		}
+
+		email := emailFromRequest(r)
+		name, status, problem := rules.check(content, dir, pasteName(given, text), "rename")
+		if problem != "" {
+			http.Error(w, problem, status)
+			return
+		}
+		allowance, err := rules.allowance(db, r)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		left, err := rules.storageLeft(db, email)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rel, info, created, err := saveUpload(content, dir, name, "rename", rules.limit(storageLimit(strings.NewReader(text), left), allowance))
+		if err != nil {
+			http.Error(w, err.Error(), uploadStatus(err))
+			return
+		}
+		audit(db, r, email, auditFilePut, rel, strconv.FormatInt(info.Size(), 10)+", paste")
+		countUpload(db, email, info.Size())
+		countStored(db, email, rel, info.Size())
+		if created {
+			events.publish(eventFileAdded, email, rel, nil)
+		}
+
+		link := (&url.URL{Path: "/paste/" + rel}).String()
+		if r.Method != http.MethodPut {
+			http.Redirect(w, r, link, http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", link)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"path": rel, "link": link, "raw": (&url.URL{Path: "/files/" + rel}).String()})
+	}
+}
+
+// PasteView is the page of a file in a paste folder.
+type PasteView struct {
+	Version     string
+	CSRF        string
+	UserEmail   string
+	Breadcrumbs []Breadcrumb
+	Path        string
+	Language    string // "" for plain text
+	Size        int64
+	Lines       []string
+	Cut         bool // longer than pastePreviewMax, only the start is shown
+}
+
+// pasteView is GET /paste/<path>: a file with line numbers, a folder is
+// sent to its listing.
+func pasteView(tmpl *template.Template, content *contentFS, pastes pasteFolders) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel, err := manageTarget(content, r, "/paste/")
+		if err != nil || !pastes.holds(rel) {
+			http.NotFound(w, r)
+			return
+		}
+		info, err := content.stat(rel)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if info.IsDir() {
+			http.Redirect(w, r, (&url.URL{Path: "/files/" + rel + "/"}).String(), http.StatusSeeOther)
+			return
+		}
+		f, err := content.open(rel)
+		if err != nil {
+			http.Error(w, err.Error(), writeStatus(err))
+			return
+		}
+		defer f.Close()
+		data, err := io.ReadAll(io.LimitReader(f, pastePreviewMax+1))
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		view := PasteView{
+			Version:     GetVersion(),
+			CSRF:        csrfToken(r),
+			UserEmail:   emailFromRequest(r),
+			Breadcrumbs: GenerateBreadcrumbs("/files/", rel),
+			Path:        rel,
+			Size:        info.Size(),
+			Cut:         len(data) > pastePreviewMax,
+		}
+		if view.Cut {
+			data = data[:pastePreviewMax]
+		}
+		if !utf8.Valid(data) && !view.Cut {
+			// not text, the raw file is all there is to show
+			http.Redirect(w, r, (&url.URL{Path: "/files/" + rel}).String(), http.StatusSeeOther)
+			return
+		}
+		text := strings.TrimSuffix(string(data), "\n")
+		if view.Language = syntaxByExt(rel); view.Language == "" && path.Ext(rel) == "" {
+			view.Language, _ = detectSyntax(text)
+		}
+		view.Lines = strings.Split(text, "\n")
+		if err := tmpl.ExecuteTemplate(w, "paste.html", view); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
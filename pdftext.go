@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// pdfText pulls the text out of a PDF for the full-text index. It is no PDF
+// reader: it inflates the content streams and collects the strings shown by
+// Tj, TJ, ' and ". That covers what word processors and score editors export;
+// text drawn with embedded CID fonts comes out as noise or not at all, and
+// scanned pages have no text to find.
+func pdfText(data []byte) string {
+	var out strings.Builder
+	for rest := data; ; {
+		start := bytes.Index(rest, []byte("stream"))
+		if start < 0 {
+			break
+		}
+		dict := rest[max(0, bytes.LastIndex(rest[:start], []byte("<<"))):start]
+		body := rest[start+len("stream"):]
+		body = bytes.TrimPrefix(bytes.TrimPrefix(body, []byte("\r")), []byte("\n"))
+		end := bytes.Index(body, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := body[:end]
+		rest = body[end+len("endstream"):]
+
+		if bytes.Contains(dict, []byte("/Image")) || bytes.Contains(dict, []byte("/Length1")) {
+			continue
+		}
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			r, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			// a truncated stream still gives what came before the damage
+			stream, _ = io.ReadAll(io.LimitReader(r, 16<<20))
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			continue
+		}
+		if bytes.Contains(stream, []byte("BT")) {
+			pdfShownText(stream, &out)
+		}
+	}
+	return out.String()
+}
+
+// pdfShownText appends the strings a content stream shows to out, a space for
+// every move to another spot on the page and for wide gaps within a TJ array,
+// which is how most generators set the space between words.
+func pdfShownText(content []byte, out *strings.Builder) {
+	var pending []string
+	inArray := false
+	for i := 0; i < len(content); {
+		switch c := content[i]; {
+		case c == '[' || c == ']':
+			inArray = c == '['
+			i++
+		case c == '-' || c == '.' || '0' <= c && c <= '9':
+			j := i + 1
+			for j < len(content) && (content[j] == '.' || '0' <= content[j] && content[j] <= '9') {
+				j++
+			}
+			if n, err := strconv.ParseFloat(string(content[i:j]), 64); err == nil && inArray && n < -200 {
+				pending = append(pending, " ")
+			}
+			i = j
+		case c == '(':
+			s, n := pdfLiteral(content[i:])
+			pending = append(pending, s)
+			i += n
+		case c == '<' && i+1 < len(content) && content[i+1] == '<':
+			// dictionaries of marked content, nothing shown
+			i += 2
+		case c == '<':
+			s, n := pdfHex(content[i:])
+			pending = append(pending, s)
+			i += n
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case isPDFLetter(c) || c == '\'' || c == '"' || c == '*':
+			j := i
+			for j < len(content) && (isPDFLetter(content[j]) || content[j] == '\'' || content[j] == '"' || content[j] == '*') {
+				j++
+			}
+			switch string(content[i:j]) {
+			case "Tj", "TJ", "'", "\"":
+				for _, s := range pending {
+					out.WriteString(s)
+				}
+			case "Td", "TD", "T*", "Tm", "ET":
+				out.WriteByte(' ')
+			}
+			pending = pending[:0]
+			i = j
+		default:
+			i++
+		}
+	}
+}
+
+func isPDFLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// pdfLiteral decodes the (string) at the start of b and says how many bytes
+// it took.
+func pdfLiteral(b []byte) (string, int) {
+	var s []byte
+	depth := 0
+	i := 0
+	for ; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c == '\\' && i+1 < len(b):
+			i++
+			switch e := b[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r', 't', 'b', 'f':
+				s = append(s, ' ')
+			case '\r', '\n':
+			default:
+				if '0' <= e && e <= '7' {
+					v := 0
+					for k := 0; k < 3 && i < len(b) && '0' <= b[i] && b[i] <= '7'; k++ {
+						v = v*8 + int(b[i]-'0')
+						i++
+					}
+					i--
+					s = append(s, byte(v))
+				} else {
+					s = append(s, e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				s = append(s, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return pdfString(s), i + 1
+			}
+			s = append(s, c)
+		default:
+			s = append(s, c)
+		}
+	}
+	return pdfString(s), i
+}
+
+// pdfHex decodes the <hex string> at the start of b.
+func pdfHex(b []byte) (string, int) {
+	end := bytes.IndexByte(b, '>')
+	if end < 0 {
+		return "", len(b)
+	}
+	var s []byte
+	var digits []byte
+	for _, c := range b[1:end] {
+		if v, ok := hexValue(c); ok {
+			digits = append(digits, v)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, 0)
+	}
+	for k := 0; k < len(digits); k += 2 {
+		s = append(s, digits[k]<<4|digits[k+1])
+	}
+	return pdfString(s), end + 1
+}
+
+func hexValue(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// pdfString turns the bytes of a PDF string into text, UTF-16 when it starts
+// with a byte order mark and Latin-1, close enough to WinAnsi, otherwise.
+func pdfString(s []byte) string {
+	if len(s) >= 2 && s[0] == 0xfe && s[1] == 0xff {
+		units := make([]uint16, 0, len(s)/2)
+		for k := 2; k+1 < len(s); k += 2 {
+			units = append(units, uint16(s[k])<<8|uint16(s[k+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	runes := make([]rune, 0, len(s))
+	for _, c := range s {
+		if c < 0x20 && c != '\n' {
+			c = ' '
+		}
+		runes = append(runes, rune(c))
+	}
+	return string(runes)
+}
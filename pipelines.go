@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pipelines are chains of jobs run on every file uploaded into a folder, in
+// order: a command, say one that normalizes a recording or transcribes it,
+// then a webhook telling a chat channel. They are declared in the JSON file
+// -pipelines names. Each upload is a row in pipeline_jobs, worked through one
+// at a time in the background, so a restart goes on with the step it was at;
+// a step can run twice, not never. Admins see the jobs at /pipelines, where a
+// failed one can be tried again, and the player page shows those of its file.
+
+const (
+	pipelineStepTimeout = 10 * time.Minute
+	pipelineOutputKeep  = 2000 // last bytes of what a step printed
+)
+
+// pipelineStep is one job of a pipeline, a command or a webhook.
+type pipelineStep struct {
+	Name    string   `json:"name"`
+	Run     []string `json:"run,omitempty"`     // {file} is the path on disk, {path} the one in Consus
+	Webhook string   `json:"webhook,omitempty"` // POSTed the job as JSON
+	Timeout string   `json:"timeout,omitempty"` // like 30m, 10m if not set
+
+	timeout time.Duration
+}
+
+type pipeline struct {
+	Name   string         `json:"name"`   // the folder if not set
+	Folder string         `json:"folder"` // files in it and below
+	Match  string         `json:"match"`  // pattern of file names, like *.wav, all if not set
+	Steps  []pipelineStep `json:"steps"`
+}
+
+func (p pipeline) matches(rel string) bool {
+	rel = cleanRel(rel)
+	if p.Folder != "" && !strings.HasPrefix(rel, p.Folder+"/") {
+		return false
+	}
+	ok, _ := path.Match(p.Match, path.Base(rel))
+	return p.Match == "" || ok
+}
+
+func (p pipeline) stepNames() []string {
+	names := make([]string, len(p.Steps))
+	for i, s := range p.Steps {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// loadPipelines reads and checks the pipelines file.
+func loadPipelines(file string) ([]pipeline, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var list []pipeline
+	if err := dec.Decode(&list); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	names := map[string]bool{}
+	for i := range list {
+		p := &list[i]
+		p.Folder = cleanRel(p.Folder)
+		if p.Name == "" {
+			p.Name = "/" + p.Folder
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("%s: two pipelines are called %q", file, p.Name)
+		}
+		names[p.Name] = true
+		if _, err := path.Match(p.Match, ""); err != nil {
+			return nil, fmt.Errorf("%s: pipeline %q: match: %w", file, p.Name, err)
+		}
+		if len(p.Steps) == 0 {
+			return nil, fmt.Errorf("%s: pipeline %q has no steps", file, p.Name)
+		}
+		for j := range p.Steps {
+			s := &p.Steps[j]
+			if s.Name == "" {
+				s.Name = "step " + strconv.Itoa(j+1)
+			}
+			if (len(s.Run) > 0) == (s.Webhook != "") {
+				return nil, fmt.Errorf("%s: pipeline %q, %s: give either run or webhook", file, p.Name, s.Name)
+			}
+			s.timeout = pipelineStepTimeout
+			if s.Timeout != "" {
+				if s.timeout, err = time.ParseDuration(s.Timeout); err != nil || s.timeout <= 0 {
+					return nil, fmt.Errorf("%s: pipeline %q, %s: timeout %q is not a duration like 30m", file, p.Name, s.Name, s.Timeout)
+				}
+			}
+		}
+	}
+	return list, nil
+}
+
+// PipelineJob is a file going through a pipeline.
+type PipelineJob struct {
+	ID       int64
+	Pipeline string
+	Path     string
+	Actor    string // who uploaded the file
+	Step     int    // the one running, or that failed, or next
+	Steps    []string
+	Status   string // queued, running, done or failed
+	Output   string // of the last step that ran
+	Updated  time.Time
+}
+
+// StepState is how far step i got: done, the status of the job for the one
+// it is at, "" for the later ones.
+func (j PipelineJob) StepState(i int) string {
+	switch {
+	case i < j.Step || j.Status == "done":
+		return "done"
+	case i == j.Step:
+		return j.Status
+	}
+	return ""
+}
+
+type pipelineRunner struct {
+	db        *sql.DB
+	content   *contentFS
+	pipelines []pipeline
+	publicURL string
+	kick      chan struct{}
+}
+
+func newPipelineRunner(db *sql.DB, content *contentFS, pipelines []pipeline, publicURL string) *pipelineRunner {
+	return &pipelineRunner{db: db, content: content, pipelines: pipelines, publicURL: publicURL, kick: make(chan struct{}, 1)}
+}
+
+func (pr *pipelineRunner) wake() {
+	select {
+	case pr.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (pr *pipelineRunner) find(name string) (pipeline, bool) {
+	for _, p := range pr.pipelines {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return pipeline{}, false
+}
+
+// onFileAdded queues the file of e for every pipeline it matches, once per
+// event however often that comes.
+func (pr *pipelineRunner) onFileAdded(e event) error {
+	queued := false
+	for _, p := range pr.pipelines {
+		if !p.matches(e.Path) {
+			continue
+		}
+		now := time.Now()
+		if _, err := pr.db.Exec(`INSERT INTO pipeline_jobs (pipeline, event_id, path, actor, step, status, output, created_at, updated_at)
+			VALUES (?, ?, ?, ?, 0, 'queued', '', ?, ?) ON CONFLICT (pipeline, event_id) DO NOTHING`,
+			p.Name, e.ID, e.Path, e.Actor, now, now); err != nil {
+			return err
+		}
+		queued = true
+	}
+	if queued {
+		pr.wake()
+	}
+	return nil
+}
+
+// run works through the queue until ctx is done. A job running when the
+// server stopped goes on with its step.
+func (pr *pipelineRunner) run(ctx context.Context) {
+	pr.wake()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pr.kick:
+		}
+		for ctx.Err() == nil {
+			job, err := pr.next()
+			if errors.Is(err, sql.ErrNoRows) {
+				break
+			} else if err != nil {
+				log.Printf("pipelines: %v", err)
+				break
+			}
+			pr.work(ctx, job)
+		}
+	}
+}
+
+func (pr *pipelineRunner) next() (PipelineJob, error) {
+	var j PipelineJob
+	err := pr.db.QueryRow(`SELECT id, pipeline, path, actor, step FROM pipeline_jobs
+		WHERE status IN ('queued', 'running') ORDER BY id LIMIT 1`).Scan(&j.ID, &j.Pipeline, &j.Path, &j.Actor, &j.Step)
+	return j, err
+}
+
+func (pr *pipelineRunner) set(j PipelineJob, status, output string) {
+	if len(output) > pipelineOutputKeep {
+		output = "..." + output[len(output)-pipelineOutputKeep:]
+	}
+	if _, err := pr.db.Exec("UPDATE pipeline_jobs SET step = ?, status = ?, output = ?, updated_at = ? WHERE id = ?",
+		j.Step, status, output, time.Now(), j.ID); err != nil {
+		log.Printf("pipelines: %v", err)
+	}
+}
+
+// work runs the steps of j from where it is.
+func (pr *pipelineRunner) work(ctx context.Context, j PipelineJob) {
+	p, ok := pr.find(j.Pipeline)
+	if !ok {
+		pr.set(j, "failed", "there is no pipeline called "+j.Pipeline+" anymore")
+		return
+	}
+	for ; j.Step < len(p.Steps); j.Step++ {
+		pr.set(j, "running", "")
+		sched.yield(ctx)
+		out, err := pr.runStep(ctx, p, p.Steps[j.Step], j)
+		if ctx.Err() != nil {
+			// shutting down, the step runs again after the restart
+			return
+		}
+		if err != nil {
+			log.Printf("pipelines: %s, %s of %s: %v", p.Name, p.Steps[j.Step].Name, j.Path, err)
+			pr.set(j, "failed", strings.TrimSpace(out+"\n"+err.Error()))
+			return
+		}
+		if j.Step == len(p.Steps)-1 {
+			pr.set(j, "done", out)
+			return
+		}
+	}
+}
+
+func (pr *pipelineRunner) runStep(ctx context.Context, p pipeline, s pipelineStep, j PipelineJob) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if s.Webhook != "" {
+		payload := map[string]string{"pipeline": p.Name, "step": s.Name, "path": j.Path, "actor": j.Actor}
+		if pr.publicURL != "" {
+			payload["url"] = pr.publicURL + "/files/" + (&url.URL{Path: j.Path}).EscapedPath()
+		}
+		body, _ := json.Marshal(payload)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Webhook, bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		if res.StatusCode >= 300 {
+			return "", fmt.Errorf("webhook answered %s", res.Status)
+		}
+		return res.Status, nil
+	}
+
+	full := pr.content.abs(j.Path)
+	if full == "" {
+		return "", errors.New("commands only run on files on a disk")
+	}
+	if _, err := os.Stat(full); err != nil {
+		return "", err
+	}
+	args := make([]string, len(s.Run))
+	for i, a := range s.Run {
+		args[i] = strings.NewReplacer("{file}", full, "{path}", j.Path).Replace(a)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = filepath.Dir(full)
+	cmd.Env = append(os.Environ(), "CONSUS_FILE="+full, "CONSUS_PATH="+j.Path, "CONSUS_ACTOR="+j.Actor, "CONSUS_PIPELINE="+p.Name)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// jobs are the latest jobs, of rel only unless it is "".
+func (pr *pipelineRunner) jobs(rel string, limit int) ([]PipelineJob, error) {
+	if pr == nil {
+		return nil, nil
+	}
+	query := "SELECT id, pipeline, path, actor, step, status, output, updated_at FROM pipeline_jobs"
+	var args []any
+	if rel != "" {
+		query += " WHERE path = ?"
+		args = append(args, cleanRel(rel))
+	}
+	rows, err := pr.db.Query(query+" ORDER BY id DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []PipelineJob
+	for rows.Next() {
+		var j PipelineJob
+		if err := rows.Scan(&j.ID, &j.Pipeline, &j.Path, &j.Actor, &j.Step, &j.Status, &j.Output, &j.Updated); err != nil {
+			return nil, err
+		}
+		if p, ok := pr.find(j.Pipeline); ok {
+			j.Steps = p.stepNames()
+		}
+		list = append(list, j)
+	}
+	return list, rows.Err()
+}
+
+func renderPipelines(tmpl *template.Template, runner *pipelineRunner) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobs, err := runner.jobs("", 200)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data := struct {
+			Version    string
+			CSRF       string
+			UserEmail  string
+			Configured bool
+			Jobs       []PipelineJob
+		}{
+			Version:    GetVersion(),
+			CSRF:       csrfToken(r),
+			UserEmail:  emailFromRequest(r),
+			Configured: runner != nil,
+			Jobs:       jobs,
+		}
+		if err := tmpl.ExecuteTemplate(w, "pipelines.html", data); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// pipelineRetry is POST /pipelines/{id}/retry, which queues a failed job
+// again at the step that failed.
+func pipelineRetry(db *sql.DB, runner *pipelineRunner) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if runner == nil {
+			http.NotFound(w, r)
+			return
+		}
+		res, err := db.Exec("UPDATE pipeline_jobs SET status = 'queued', updated_at = ? WHERE id = ? AND status = 'failed'", time.Now(), r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "no failed job with that id", http.StatusNotFound)
+			return
+		}
+		runner.wake()
+		http.Redirect(w, r, "/pipelines", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// priority is which lane a route runs in.
+type priority int
+
+const (
+	priorityNormal      priority = iota // neither held back nor holding anything back
+	priorityInteractive                 // somebody is waiting for it: listings, players, the start of a stream
+	priorityBulk                        // nobody watches it byte by byte: folder downloads, syncs, exports
+)
+
+// bulkPatience is the longest bulk work waits for interactive requests at a
+// time, so it is slowed down under load but never stopped.
+const bulkPatience = 250 * time.Millisecond
+
+// scheduler keeps the UI snappy while a server is busy with bulk work. Only
+// so many bulk requests run at once (BulkSlots of the memory profile), and
+// those, the warm-up too, pause between files while interactive requests
+// haven't answered yet. A script with an API token on an interactive route
+// is bulk, fetching files it is syncing them.
+type scheduler struct {
+	slots chan struct{} // one per bulk request running
+
+	mu      sync.Mutex
+	pending int           // interactive requests that haven't sent their first byte
+	quiet   chan struct{} // closed while pending is 0
+
+	waiting atomic.Int64 // bulk requests waiting for a slot
+	yields  atomic.Int64
+}
+
+// sched is set up by NewMainServer, without it nothing waits.
+var sched *scheduler
+
+func newScheduler(slots int) *scheduler {
+	quiet := make(chan struct{})
+	close(quiet)
+	return &scheduler{slots: make(chan struct{}, max(slots, 1)), quiet: quiet}
+}
+
+// begin counts an interactive request until end is called, once or more.
+func (s *scheduler) begin() (end func()) {
+	s.mu.Lock()
+	if s.pending == 0 {
+		s.quiet = make(chan struct{})
+	}
+	s.pending++
+	s.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			if s.pending--; s.pending == 0 {
+				close(s.quiet)
+			}
+			s.mu.Unlock()
+		})
+	}
+}
+
+// yield lets interactive requests go first, for at most bulkPatience.
+func (s *scheduler) yield(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	quiet, busy := s.quiet, s.pending > 0
+	s.mu.Unlock()
+	if !busy {
+		return
+	}
+	s.yields.Add(1)
+	t := time.NewTimer(bulkPatience)
+	defer t.Stop()
+	select {
+	case <-quiet:
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// serve runs h in the lane p of a route.
+func (s *scheduler) serve(p priority, h http.HandlerFunc) http.HandlerFunc {
+	if s == nil || p == priorityNormal {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p == priorityBulk || r.Context().Value(tokenIDKey) != nil {
+			s.yield(r.Context())
+			s.waiting.Add(1)
+			select {
+			case s.slots <- struct{}{}:
+				s.waiting.Add(-1)
+			case <-r.Context().Done():
+				s.waiting.Add(-1)
+				return
+			}
+			defer func() { <-s.slots }()
+			h(w, r)
+			return
+		}
+		end := s.begin()
+		defer end()
+		h(&firstByteWriter{ResponseWriter: w, sent: end}, r)
+	}
+}
+
+// firstByteWriter tells when the answer starts going out, what an
+// interactive request waits for is done by then.
+type firstByteWriter struct {
+	http.ResponseWriter
+	sent func()
+}
+
+func (f *firstByteWriter) WriteHeader(status int) {
+	f.sent()
+	f.ResponseWriter.WriteHeader(status)
+}
+
+func (f *firstByteWriter) Write(b []byte) (int, error) {
+	f.sent()
+	return f.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps sendfile for the files served.
+func (f *firstByteWriter) ReadFrom(src io.Reader) (int64, error) {
+	f.sent()
+	return io.Copy(f.ResponseWriter, src)
+}
+
+func (f *firstByteWriter) Flush() {
+	f.sent()
+	if fl, ok := f.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+func (f *firstByteWriter) Unwrap() http.ResponseWriter { return f.ResponseWriter }
+
+// writeMetrics adds the lanes to /metrics.
+func (s *scheduler) writeMetrics(w io.Writer) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	pending := s.pending
+	s.mu.Unlock()
+	fmt.Fprintf(w, "# HELP consus_interactive_pending Interactive requests that haven't answered yet.\n# TYPE consus_interactive_pending gauge\nconsus_interactive_pending %d\n", pending)
+	fmt.Fprintf(w, "# HELP consus_bulk_running Bulk requests running.\n# TYPE consus_bulk_running gauge\nconsus_bulk_running %d\n", len(s.slots))
+	fmt.Fprintf(w, "# HELP consus_bulk_waiting Bulk requests waiting for a slot.\n# TYPE consus_bulk_waiting gauge\nconsus_bulk_waiting %d\n", s.waiting.Load())
+	fmt.Fprintf(w, "# HELP consus_bulk_yields_total Times bulk work paused for interactive requests.\n# TYPE consus_bulk_yields_total counter\nconsus_bulk_yields_total %d\n", s.yields.Load())
+}
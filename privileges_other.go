@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// dropPrivileges only exists on unix, see privileges_unix.go.
+func dropPrivileges(paths ...string) error {
+	if os.Getenv("PUID") != "" || os.Getenv("PGID") != "" || os.Getenv("UMASK") != "" {
+		return errors.New("PUID, PGID and UMASK are only supported on unix")
+	}
+	return nil
+}
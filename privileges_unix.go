@@ -0,0 +1,82 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges honours the PUID, PGID and UMASK variables container images
+// commonly take. Started as root, it hands the state paths to that user first
+// and then becomes them, so files on the volume belong to the host user.
+func dropPrivileges(paths ...string) error {
+	if mask := os.Getenv("UMASK"); mask != "" {
+		m, err := strconv.ParseUint(mask, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid UMASK %q", mask)
+		}
+		syscall.Umask(int(m))
+	}
+
+	uid, gid, err := envIDs()
+	if err != nil || uid < 0 {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		if uid != os.Geteuid() {
+			return fmt.Errorf("PUID=%d needs consus to be started as root", uid)
+		}
+		return nil
+	}
+
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		err := filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // not created yet
+			}
+			return os.Lchown(path, uid, gid)
+		})
+		if err != nil {
+			return fmt.Errorf("could not hand %s to %d:%d: %w", p, uid, gid, err)
+		}
+	}
+
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+// envIDs reads PUID and PGID, -1 when PUID is not set. PGID defaults to PUID.
+func envIDs() (int, int, error) {
+	puid, pgid := os.Getenv("PUID"), os.Getenv("PGID")
+	if puid == "" {
+		if pgid != "" {
+			return -1, -1, fmt.Errorf("PGID is set without PUID")
+		}
+		return -1, -1, nil
+	}
+	if pgid == "" {
+		pgid = puid
+	}
+	uid, err := strconv.Atoi(puid)
+	if err != nil {
+		return -1, -1, fmt.Errorf("invalid PUID %q", puid)
+	}
+	gid, err := strconv.Atoi(pgid)
+	if err != nil {
+		return -1, -1, fmt.Errorf("invalid PGID %q", pgid)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const profileComments = 50
+
+// UserComment is a comment together with the file it was left on.
+type UserComment struct {
+	Path string
+	Commentv1
+}
+
+// userComments collects what email wrote across all comment files, newest first.
+// Comment files only exist per media file, so this walks the shadow tree.
+func userComments(commentPath, email string) ([]UserComment, error) {
+	var list []UserComment
+	err := filepath.WalkDir(commentPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var cf CommentFilev1
+		if err := json.Unmarshal(data, &cf); err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(commentPath, path)
+		for _, c := range cf.Comments {
+			if c.User == email && !c.Deleted {
+				list = append(list, UserComment{Path: filepath.ToSlash(rel), Commentv1: c})
+			}
+		}
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].When.After(list[j].When) })
+	return list, err
+}
+
+// renderProfile shows a user and their latest comments. Comments on files the
+// visitor cannot see themselves are left out. The storage used is for the
+// user and admins only, who can also change the quota here.
+func renderProfile(tmpl *template.Template, db *sql.DB, commentPath string, rules uploadRules) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		user, err := userByLogin(db, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Google logins from ALLOWED_EMAILS comment without a local account
+			if !isAllowedEmail(name) {
+				http.NotFound(w, r)
+				return
+			}
+			user = &User{Name: name, Email: name}
+		} else if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var comments []UserComment
+		if commentPath != "" {
+			all, err := userComments(commentPath, user.Email)
+			if err != nil {
+				log.Printf("%s", err.Error())
+			}
+			email := emailFromRequest(r)
+			for _, c := range all {
+				if len(comments) == profileComments {
+					break
+				}
+				if ok, err := canAccessPath(db, email, c.Path); err == nil && ok {
+					comments = append(comments, c)
+				}
+			}
+		}
+
+		var storage *StorageUsage
+		email := emailFromRequest(r)
+		admin := roleAtLeast(userRole(db, email), roleAdmin)
+		if email == user.Email || admin {
+			usage, err := rules.storageUsage(db, user.Email)
+			if err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			storage = &usage
+		}
+
+		data := struct {
+			Version   string
+			CSRF      string
+			UserEmail string
+			Profile   *User
+			Comments  []UserComment
+			Storage   *StorageUsage // nil for somebody else's profile
+			Admin     bool
+		}{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: email,
+			Profile:   user,
+			Comments:  comments,
+			Storage:   storage,
+			Admin:     admin,
+		}
+		if err := tmpl.ExecuteTemplate(w, "profile.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
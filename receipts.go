@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shareDownloadsShown is how many of the latest receipts the shares page lists
+// per link.
+const shareDownloadsShown = 5
+
+// ShareDownload is a receipt: a file of a share link went out complete, proof
+// that the client got the delivery.
+type ShareDownload struct {
+	Path         string
+	Bytes        int64
+	DownloadedAt time.Time
+	RemoteAddr   string
+}
+
+// receiptWriter counts what a download really sent.
+type receiptWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rw *receiptWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *receiptWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.written += int64(n)
+	return n, err
+}
+
+// complete tells whether the whole file went out in this one response: all of
+// it, or a range from the first to the last byte. A download resumed from the
+// middle doesn't count, its first part can't be told apart from one that broke.
+func (rw *receiptWriter) complete(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	h := rw.Header()
+	switch rw.status {
+	case http.StatusOK:
+		size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		return err == nil && rw.written == size
+	case http.StatusPartialContent:
+		var first, last, size int64
+		if _, err := fmt.Sscanf(h.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &size); err != nil {
+			return false
+		}
+		return first == 0 && last == size-1 && rw.written == size
+	}
+	return false
+}
+
+// recordDownload keeps the receipt of rel, a file below the share root, and
+// tells the creator if they asked for it.
+func recordDownload(db *sql.DB, notes *notifier, s *Share, rel string, r *http.Request, bytes int64) {
+	if _, err := db.Exec("INSERT INTO share_downloads (token, path, bytes, downloaded_at, remote_addr, user_agent) VALUES (?, ?, ?, ?, ?, ?)",
+		s.Token, rel, bytes, time.Now(), remoteIP(r), r.UserAgent()); err != nil {
+		log.Printf("could not record download: %v", err)
+		return
+	}
+	if s.NotifyDownloads {
+		notes.notify(s.CreatedBy, fmt.Sprintf("%s was downloaded through your share link for /%s", rel, s.Path), "/shares#share-"+s.Token)
+	}
+}
+
+// attachDownloads fills in the latest receipts of every share and how many
+// downloads it had in all, the rolled up days included.
+func attachDownloads(db *sql.DB, shares []Share) error {
+	if len(shares) == 0 {
+		return nil
+	}
+	byToken := map[string]*Share{}
+	args := make([]any, 0, len(shares))
+	for i := range shares {
+		byToken[shares[i].Token] = &shares[i]
+		args = append(args, shares[i].Token)
+	}
+	in := "token IN (?" + strings.Repeat(", ?", len(args)-1) + ")"
+	rows, err := db.Query(`SELECT token, path, bytes, downloaded_at, remote_addr FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY token ORDER BY downloaded_at DESC) AS n FROM share_downloads WHERE `+in+`
+		) WHERE n <= ? ORDER BY downloaded_at DESC`, append(args, shareDownloadsShown)...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var token string
+		var d ShareDownload
+		if err := rows.Scan(&token, &d.Path, &d.Bytes, &d.DownloadedAt, &d.RemoteAddr); err != nil {
+			rows.Close()
+			return err
+		}
+		byToken[token].Downloads = append(byToken[token].Downloads, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(`SELECT token, SUM(n) FROM (
+			SELECT token, COUNT(*) AS n FROM share_downloads WHERE `+in+` GROUP BY token
+			UNION ALL SELECT token, SUM(downloads) FROM share_download_days WHERE `+in+` GROUP BY token
+		) GROUP BY token`, append(args, args...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var token string
+		var count int
+		if err := rows.Scan(&token, &count); err != nil {
+			return err
+		}
+		byToken[token].DownloadCount = count
+	}
+	return rows.Err()
+}
+
+// rollUpDownloads sums the receipts from before then up per share and day in
+// share_download_days and drops them, so the shares page doesn't read years
+// of them. It tells how many went.
+func rollUpDownloads(db *sql.DB, before time.Time) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// the day as it was written, in the zone of the server
+	if _, err := tx.Exec(`INSERT INTO share_download_days (token, day, downloads, bytes)
+		SELECT token, substr(downloaded_at, 1, 10), COUNT(*), SUM(bytes) FROM share_downloads WHERE downloaded_at < ? GROUP BY 1, 2
+		ON CONFLICT (token, day) DO UPDATE SET downloads = downloads + excluded.downloads, bytes = bytes + excluded.bytes`, before); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM share_downloads WHERE downloaded_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// keepReceipts rolls up the receipts older than keep every interval, unless
+// keep is 0.
+func keepReceipts(ctx context.Context, db *sql.DB, keep, interval time.Duration) {
+	if keep <= 0 {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		if n, err := rollUpDownloads(db, time.Now().Add(-keep)); err != nil {
+			log.Printf("receipts: %v", err)
+		} else if n > 0 {
+			log.Printf("receipts: rolled up %d downloads older than %s", n, keep)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
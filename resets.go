@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Forgotten passwords are reset through a link mailed to the account's address.
+// The token in it works once and for resetTTL, only its hash is stored. Links
+// always point at -public-url, never at whatever Host the request claimed.
+
+const (
+	resetTTL = time.Hour
+	// resetEvery keeps the form from being used to flood somebody's inbox
+	resetEvery = 5 * time.Minute
+)
+
+type resetView struct {
+	Version   string
+	CSRF      string
+	UserEmail string
+	Token     string
+	Sent      bool
+	Error     string
+}
+
+// resetsEnabled needs a way to mail the link and a trustworthy address for it.
+func resetsEnabled(notes *notifier) bool {
+	return notes.mail != nil && notes.publicURL != ""
+}
+
+// createReset returns a new token for user, or "" if one was handed out recently.
+func createReset(db *sql.DB, user *User) (string, error) {
+	var recent int
+	if err := db.QueryRow("SELECT COUNT(*) FROM password_resets WHERE user_id = ? AND created_at > ?",
+		user.ID, time.Now().Add(-resetEvery)).Scan(&recent); err != nil {
+		return "", err
+	}
+	if recent > 0 {
+		return "", nil
+	}
+
+	token := newSessionToken()
+	now := time.Now()
+	if _, err := db.Exec("DELETE FROM password_resets WHERE expires_at < ?", now); err != nil {
+		return "", err
+	}
+	_, err := db.Exec("INSERT INTO password_resets (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), user.ID, now, now.Add(resetTTL))
+	return token, err
+}
+
+// resetUser returns the account an unused, unexpired token belongs to.
+func resetUser(db *sql.DB, token string) (*User, error) {
+	return scanUser(db.QueryRow("SELECT "+userColumns+` FROM users WHERE id = (
+		SELECT user_id FROM password_resets WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?)`,
+		hashToken(token), time.Now()))
+}
+
+func renderReset(tmpl *template.Template, db *sql.DB, notes *notifier) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !resetsEnabled(notes) {
+			http.NotFound(w, r)
+			return
+		}
+		data := resetView{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: emailFromRequest(r),
+			Token:     r.PathValue("token"),
+		}
+		if data.Token != "" {
+			if _, err := resetUser(db, data.Token); errors.Is(err, sql.ErrNoRows) {
+				data.Token, data.Error = "", "That link was used already or has expired, ask for a new one."
+			} else if err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tmpl.ExecuteTemplate(w, "reset.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// resetRequest mails a reset link. The answer is the same whether the account
+// exists or not, so the form can't be used to find out who has one.
+func resetRequest(tmpl *template.Template, db *sql.DB, notes *notifier) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !resetsEnabled(notes) {
+			http.NotFound(w, r)
+			return
+		}
+		login := strings.TrimSpace(r.FormValue("login"))
+
+		user, err := userByLogin(db, login)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			log.Printf("%s", err.Error())
+		case user.PasswordHash == "":
+			// accounts of identity providers reset their password over there
+		default:
+			token, err := createReset(db, user)
+			if err != nil {
+				log.Printf("%s", err.Error())
+			} else if token != "" {
+				audit(db, r, "", auditResetRequest, user.Email, "")
+				body := fmt.Sprintf("Somebody, hopefully you, asked to reset the password of %s.\n\n"+
+					"Set a new one here within the next hour:\n\n%s/reset/%s\n\nIf it wasn't you, ignore this mail.",
+					user.Name, notes.publicURL, token)
+				go func() {
+					if err := notes.mail.send(user.Email, "[Consus] Reset your password", body); err != nil {
+						log.Printf("could not mail password reset to %s: %v", user.Email, err)
+					}
+				}()
+			}
+		}
+
+		data := resetView{Version: GetVersion(), CSRF: csrfToken(r), Sent: true}
+		if err := tmpl.ExecuteTemplate(w, "reset.html", data); err != nil {
+			log.Printf("%s", err.Error())
+		}
+	}
+}
+
+// resetSubmit sets the new password, uses the token up and ends every old
+// session of the account.
+func resetSubmit(tmpl *template.Template, db *sql.DB, notes *notifier) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !resetsEnabled(notes) {
+			http.NotFound(w, r)
+			return
+		}
+		data := resetView{Version: GetVersion(), CSRF: csrfToken(r), Token: r.PathValue("token")}
+		password := r.FormValue("password")
+
+		user, err := resetUser(db, data.Token)
+		if errors.Is(err, sql.ErrNoRows) {
+			data.Token, data.Error = "", "That link was used already or has expired, ask for a new one."
+		} else if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if len(password) < 8 {
+			data.Error = "Password must be at least 8 characters."
+		} else if password != r.FormValue("password_confirm") {
+			data.Error = "Passwords do not match."
+		}
+
+		if data.Error == "" {
+			if err := applyReset(db, user, data.Token, password); err != nil {
+				log.Printf("password reset error: %v", err)
+				http.Error(w, "could not reset password", http.StatusInternalServerError)
+				return
+			}
+			audit(db, r, user.Email, auditReset, user.Email, "")
+			if !startSession(w, r, user.Email, false) {
+				return
+			}
+			http.Redirect(w, r, "/files/", http.StatusSeeOther)
+			return
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		if err := tmpl.ExecuteTemplate(w, "reset.html", data); err != nil {
+			log.Printf("%s", err.Error())
+		}
+	}
+}
+
+func applyReset(db *sql.DB, user *User, token, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// marking it used first means two submits racing can't both get through
+	res, err := tx.Exec("UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND used_at IS NULL", time.Now(), hashToken(token))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("reset token already used")
+	}
+	if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE email = ?", user.Email); err != nil {
+		return err
+	}
+	for _, login := range []string{user.Name, user.Email} {
+		if _, err := tx.Exec("DELETE FROM login_failures WHERE login = ?", login); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Review copies are the one thing Consus re-encodes, there are no thumbnails
+// or transcodes. Under sustained load qualityGovernor renders them smaller and
+// with a lower JPEG quality, down to -review-min-quality and -review-min-size,
+// and goes back up a step at a time once the load drops. Copies of every
+// level are cached under their own key, so a recovered server renders full
+// copies again.
+
+const (
+	reviewQuality      = 90 // JPEG quality of review copies at full quality
+	reviewLevels       = 3  // steps from full quality down to the bounds
+	reviewSustained    = 6  // samples in a row above or below the marks before changing level
+	reviewHighLoad     = 0.8
+	reviewLowLoad      = 0.3
+	reviewSampleWeight = 0.3 // of a new sample in the average
+)
+
+// renderQuality is how a review copy is encoded.
+type renderQuality struct {
+	jpeg int // JPEG quality
+	edge int // longest edge in pixels, 0 for the size of the original
+}
+
+func (q renderQuality) key() string {
+	return fmt.Sprintf("q%d-%d", q.jpeg, q.edge)
+}
+
+type qualityGovernor struct {
+	minQuality int // JPEG quality at the lowest level
+	minEdge    int // longest edge at the lowest level, 0 never scales
+	load       func() float64
+
+	level   atomic.Int32
+	average float64 // of the load, only touched by run
+	streak  int     // samples in a row past a mark, negative below the low one
+}
+
+// newQualityGovernor adapts review copies to how busy the render slots of wmr
+// are and whether bulk requests queue for a slot.
+func newQualityGovernor(wmr *watermarker, minQuality, minEdge int) *qualityGovernor {
+	return &qualityGovernor{minQuality: minQuality, minEdge: minEdge, load: func() float64 {
+		if sched != nil && sched.waiting.Load() > 0 {
+			return 1
+		}
+		return float64(len(wmr.renders)) / float64(max(cap(wmr.renders), 1))
+	}}
+}
+
+// quality is how review copies are encoded right now, full quality without
+// a governor.
+func (g *qualityGovernor) quality() renderQuality {
+	if g == nil {
+		return renderQuality{jpeg: reviewQuality}
+	}
+	level := int(g.level.Load())
+	q := renderQuality{jpeg: reviewQuality - (reviewQuality-g.minQuality)*level/reviewLevels}
+	if level > 0 && g.minEdge > 0 {
+		// twice the bound at the first step, the bound itself at the last
+		q.edge = g.minEdge + g.minEdge*(reviewLevels-level)/(reviewLevels-1)
+	}
+	return q
+}
+
+// run samples the load every interval until ctx is done.
+func (g *qualityGovernor) run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			g.sample(g.load())
+		}
+	}
+}
+
+func (g *qualityGovernor) sample(load float64) {
+	g.average += (load - g.average) * reviewSampleWeight
+	switch {
+	case g.average > reviewHighLoad:
+		g.streak = max(g.streak, 0) + 1
+	case g.average < reviewLowLoad:
+		g.streak = min(g.streak, 0) - 1
+	default:
+		g.streak = 0
+	}
+	level := int(g.level.Load())
+	switch {
+	case g.streak >= reviewSustained && level < reviewLevels:
+		level++
+	case g.streak <= -reviewSustained && level > 0:
+		level--
+	default:
+		return
+	}
+	g.streak = 0
+	g.level.Store(int32(level))
+	q := g.quality()
+	size := "the size of the original"
+	if q.edge > 0 {
+		size = fmt.Sprintf("at most %dpx", q.edge)
+	}
+	log.Printf("review copies: load at %.0f%%, now JPEG quality %d and %s (level %d of %d)", g.average*100, q.jpeg, size, level, reviewLevels)
+}
+
+// writeMetrics adds the level to /metrics.
+func (g *qualityGovernor) writeMetrics(w io.Writer) {
+	if g == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP consus_review_quality_level How far review copies are reduced for load, 0 is full quality.\n# TYPE consus_review_quality_level gauge\nconsus_review_quality_level %d\n", g.level.Load())
+}
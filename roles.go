@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+)
+
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+// roles in ascending order of privilege
+var roles = []string{roleViewer, roleEditor, roleAdmin}
+
+func isValidRole(role string) bool {
+	return slices.Contains(roles, role)
+}
+
+// roleAtLeast reports whether role grants at least the privileges of min.
+func roleAtLeast(role, min string) bool {
+	have := slices.Index(roles, role)
+	return have >= 0 && have >= slices.Index(roles, min)
+}
+
+// userRole returns the role for a logged-in email. Allowlisted Google users
+// without a local account are treated as editors; anonymous requests get no role.
+func userRole(db *sql.DB, email string) string {
+	if email == "" {
+		return ""
+	}
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE email = ?", email).Scan(&role)
+	if err == nil {
+		return role
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("role lookup error: %v", err)
+		return ""
+	}
+	if isAllowedEmail(email) {
+		return roleEditor
+	}
+	return ""
+}
+
+func roleFromRequest(db *sql.DB, r *http.Request) string {
+	return userRole(db, emailFromRequest(r))
+}
+
+// requireRole wraps a handler so it only runs for users holding at least min.
+func requireRole(db *sql.DB, min string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := emailFromRequest(r)
+		if email == "" {
+			failRequest(w, r, http.StatusUnauthorized, errCodeUnauthorized, "login required")
+			return
+		}
+		if !roleAtLeast(userRole(db, email), min) {
+			failRequest(w, r, http.StatusForbidden, errCodeForbidden, "forbidden")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func listUsers(db *sql.DB) ([]User, error) {
+	rows, err := db.Query("SELECT " + userColumns + " FROM users ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+func renderUsers(tmpl *template.Template, db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, err := listUsers(db)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		failures, err := listLoginFailures(db)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Version   string
+			CSRF      string
+			UserEmail string
+			Users     []User
+			Roles     []string
+			Failures  []LoginFailure
+		}{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: emailFromRequest(r),
+			Users:     users,
+			Roles:     roles,
+			Failures:  failures,
+		}
+		if err := tmpl.ExecuteTemplate(w, "users.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func userRoleSubmit(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		role := r.FormValue("role")
+		if !isValidRole(role) {
+			http.Error(w, "unknown role", http.StatusBadRequest)
+			return
+		}
+
+		name := r.PathValue("name")
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "could not update role", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		res, err := tx.Exec("UPDATE users SET role = ? WHERE name = ?", role, name)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not update role", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+
+		// never lock everybody out of the admin pages
+		var admins int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE role = ?", roleAdmin).Scan(&admins); err != nil || admins == 0 {
+			http.Error(w, "at least one admin must remain", http.StatusConflict)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "could not update role", http.StatusInternalServerError)
+			return
+		}
+		audit(db, r, emailFromRequest(r), auditRoleChange, name, role)
+		http.Redirect(w, r, "/users", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// route is one line of the routing table. authorize turns it into a handler,
+// so roles and folder visibility are enforced in exactly one place instead of
+// in every handler.
+type route struct {
+	pattern string
+	role    string                     // minimum role, empty for everybody
+	path    func(*http.Request) string // content path the request touches, nil if none
+	writes  bool                       // adds to or changes content or comments, refused with -read-only
+	timeout time.Duration              // deadline of the request context, 0 for none
+	lane    priority                   // interactive requests go before bulk ones
+	handler http.HandlerFunc
+}
+
+// contentPrefixes are the URL spaces mirroring the content tree with the rights
+// of whoever is logged in. Share links under /s/ are scoped by their token instead.
+var contentPrefixes = []string{"/files/", "/view/", "/embed/", "/zip/", "/checksum/", "/inside/", "/upload/", "/comment/", "/license/", "/mkdir/", "/rename/", "/move/", "/delete/", "/paste/"}
+
+// below extracts the content path from routes mirroring the tree under prefix.
+func below(prefix string) func(*http.Request) string {
+	return func(r *http.Request) string {
+		return strings.TrimPrefix(r.URL.Path, prefix)
+	}
+}
+
+// checkRoutes refuses to start with a content route that would skip the
+// visibility check, so a new endpoint cannot leak restricted folders by accident.
+func checkRoutes(routes []route) error {
+	for _, rt := range routes {
+		pattern := rt.pattern
+		if _, p, ok := strings.Cut(pattern, " "); ok {
+			pattern = p
+		}
+		for _, prefix := range contentPrefixes {
+			if strings.HasPrefix(pattern, prefix) && rt.path == nil {
+				return fmt.Errorf("route %q serves content but has no path to check access with", rt.pattern)
+			}
+		}
+		if rt.role != "" && !isValidRole(rt.role) {
+			return fmt.Errorf("route %q requires unknown role %q", rt.pattern, rt.role)
+		}
+	}
+	return nil
+}
+
+func authorize(tmpl *template.Template, db *sql.DB, content *contentFS, rt route) http.HandlerFunc {
+	h := rt.handler
+	if rt.path != nil {
+		next := h
+		h = func(w http.ResponseWriter, r *http.Request) {
+			rel := rt.path(r)
+			canon, err := content.resolve(rel)
+			if errors.Is(err, errLinkRefused) {
+				failRequest(w, r, http.StatusForbidden, errCodeForbidden, "403 "+err.Error())
+				return
+			} else if err != nil {
+				failRequest(w, r, http.StatusNotFound, errCodeNotFound, "404 page not found")
+				return
+			}
+			if canon != rel {
+				// hand the spelling on disk on, so the handler serves exactly what was checked
+				r = r.Clone(r.Context())
+				r.URL.Path = strings.TrimSuffix(r.URL.Path, rel) + canon
+				if canon != "" && strings.HasSuffix(rel, "/") {
+					r.URL.Path += "/"
+				}
+				r.URL.RawPath = ""
+			}
+			if checkPathAccess(tmpl, db, w, r, canon) {
+				next(w, r)
+			}
+		}
+	}
+	if rt.role != "" {
+		h = requireRole(db, rt.role, h)
+	}
+	h = sched.serve(rt.lane, h)
+	if rt.timeout > 0 {
+		h = withDeadline(rt.timeout, h)
+	}
+	return h
+}
+
+// withDeadline gives the request context a deadline. It can't stop a handler,
+// but every call to the outside passed r.Context() gives up by then.
+func withDeadline(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// refuseReadOnly stands in for every writing route with -read-only.
+func refuseReadOnly(w http.ResponseWriter, r *http.Request) {
+	failRequest(w, r, http.StatusForbidden, errCodeReadOnly, "This is a read-only archive, comments and changes are switched off.")
+}
+
+func registerRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB, content *contentFS, houseRules *terms, routes []route, readOnly bool) error {
+	if err := checkRoutes(routes); err != nil {
+		return err
+	}
+	for _, rt := range routes {
+		if readOnly && rt.writes {
+			rt.handler = refuseReadOnly
+		} else if houseRules != nil && rt.writes {
+			rt.handler = requireTerms(db, houseRules, rt.handler)
+		}
+		mux.HandleFunc(rt.pattern, authorize(tmpl, db, content, rt))
+	}
+	return nil
+}
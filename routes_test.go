@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := openDB(filepath.Join(t.TempDir(), "consus.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestAuthorizeHandsOnDiskSpelling(t *testing.T) {
+	db := testDB(t)
+	c := testContent(t, "Music/Album/", "Secret/")
+	c.foldCase = true
+	if _, err := db.Exec("INSERT INTO folder_rules (path, visibility, min_role) VALUES (?, ?, ?)",
+		"Secret", visibilityRestricted, roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	h := authorize(nil, db, c, route{path: below("/api/v1/watch/"), handler: func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Path
+	}})
+	for _, tc := range []struct {
+		path, want string
+		status     int
+	}{
+		{"/api/v1/watch/music/album/", "/api/v1/watch/Music/Album/", http.StatusOK},
+		{"/api/v1/watch/MUSIC/Album", "/api/v1/watch/Music/Album", http.StatusOK},
+		{"/api/v1/watch/Music/Album/", "/api/v1/watch/Music/Album/", http.StatusOK},
+		{"/api/v1/watch/", "/api/v1/watch/", http.StatusOK},
+		{"/api/v1/watch/music/new/", "/api/v1/watch/Music/new/", http.StatusOK},
+		{"/api/v1/watch/music/../../etc/", "", http.StatusNotFound},
+		{"/api/v1/watch/secret/", "", http.StatusUnauthorized},
+	} {
+		got = ""
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.status || got != tc.want {
+			t.Errorf("GET %s: %d, handler saw %q; want %d, %q", tc.path, w.Code, got, tc.status, tc.want)
+		}
+	}
+}
+
+// probed marks requests the route matrix sends: the handler they reach only
+// says which route it is instead of doing anything.
+const probed = "X-Probe"
+
+type testUser struct {
+	name, email, role string
+	token             string
+}
+
+// testServer runs NewMainServer on a content tree with a restricted, an
+// authenticated and an open folder, returning the handler it serves, the
+// routing table and the users with their tokens.
+func testServer(t *testing.T) (http.Handler, []route, *sql.DB, []testUser) {
+	t.Helper()
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	makeTree(t, data, "open/sub/", "members/", "secret/inner/")
+	for name, text := range map[string]string{
+		"open/readme.txt":    "open to all",
+		"members/list.txt":   "for members",
+		"secret/notes.txt":   "SECRET-MARKER",
+		"secret/inner/a.txt": "SECRET-MARKER",
+	} {
+		if err := os.WriteFile(filepath.Join(data, filepath.FromSlash(name)), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acl := filepath.Join(dir, "acl.txt")
+	if err := os.WriteFile(acl, []byte(`restrict secret admin
+grant secret bob@example.com
+grant secret group:crew
+group crew carol@example.com
+authenticated members
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dbPath := filepath.Join(dir, "consus.db")
+	db, err := openDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// the first account becomes an admin whatever it asks for
+	users := []testUser{
+		{name: "anonymous"},
+		{name: "ada", email: "ada@example.com", role: roleAdmin},
+		{name: "vic", email: "vic@example.com", role: roleViewer},
+		{name: "eve", email: "eve@example.com", role: roleEditor},
+		{name: "bob", email: "bob@example.com", role: roleViewer},
+		{name: "carol", email: "carol@example.com", role: roleViewer},
+	}
+	for i, u := range users {
+		if u.email == "" {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := createUser(tx, u.name, u.email, "correct horse battery", u.role); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if users[i].token, err = createToken(db, u.email, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	done := make(chan error, 1)
+	var handler http.Handler
+	var table []route
+	go func() {
+		done <- NewMainServer(ctx, ServerConfig{
+			data:             data,
+			Comments:         filepath.Join(dir, "comments"),
+			DB:               dbPath,
+			Cache:            filepath.Join(dir, "cache"),
+			ACL:              acl,
+			Memory:           defaultProfile,
+			ReviewMinQuality: reviewQuality,
+			ExternalTimeout:  time.Second,
+			SessionIdle:      time.Hour,
+			UploadExpiry:     time.Hour,
+			FollowSymlinks:   "always",
+			IDFormat:         "ulid",
+			routed: func(routes []route) []route {
+				for i, rt := range routes {
+					pattern, next := rt.pattern, rt.handler
+					routes[i].handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.Header.Get(probed) == "" {
+							next(w, r)
+							return
+						}
+						w.Header().Set(probed, pattern)
+						w.WriteHeader(http.StatusNoContent)
+					}
+				}
+				table = routes
+				return routes
+			},
+			serving: func(h http.Handler) {
+				handler = h
+				close(ready)
+			},
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		events, disks, sched, sessions, downloads = nil, nil, nil, nil, bandwidth{}
+	})
+	select {
+	case <-ready:
+	case err := <-done:
+		done <- nil // nothing left to shut down
+		t.Fatal(err)
+	}
+	return handler, table, db, users
+}
+
+// send has h answer method url as u, with a matching CSRF cookie and header
+// so anonymous writes get as far as the access checks.
+func send(h http.Handler, u testUser, method, url string, probe bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	csrf := strings.Repeat("c", 64)
+	r.AddCookie(&http.Cookie{Name: "csrf", Value: csrf})
+	r.Header.Set("X-CSRF-Token", csrf)
+	if u.token != "" {
+		r.Header.Set("Authorization", "Bearer "+u.token)
+	}
+	if probe {
+		r.Header.Set(probed, "1")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// routeURL fills the wildcards of pattern, the content path with target.
+func routeURL(rt route, target string) (string, string) {
+	method, p, ok := strings.Cut(rt.pattern, " ")
+	if !ok {
+		method, p = "GET", rt.pattern
+	}
+	p = strings.ReplaceAll(p, "{path...}", target)
+	p = strings.ReplaceAll(p, "{$}", "")
+	for strings.Contains(p, "{") {
+		start, end := strings.Index(p, "{"), strings.Index(p, "}")
+		p = p[:start] + "1" + p[end+1:]
+	}
+	if rt.path != nil {
+		p += target
+	}
+	return method, p
+}
+
+// TestRouteMatrix sends every route of the table, on an open, a members only
+// and a restricted path, as each kind of user and checks it reaches its
+// handler exactly when the role and the folder rules let it.
+func TestRouteMatrix(t *testing.T) {
+	h, routes, _, users := testServer(t)
+	sees := map[string]map[string]bool{
+		"open/readme.txt":    {"anonymous": true, "vic": true, "eve": true, "ada": true, "bob": true, "carol": true},
+		"members/list.txt":   {"vic": true, "eve": true, "ada": true, "bob": true, "carol": true},
+		"secret/notes.txt":   {"ada": true, "bob": true, "carol": true},
+		"secret/inner/a.txt": {"ada": true, "bob": true, "carol": true},
+		"secret/":            {"ada": true, "bob": true, "carol": true},
+	}
+
+	for _, rt := range routes {
+		targets := []string{""}
+		if rt.path != nil {
+			targets = slices.Sorted(maps.Keys(sees))
+		}
+		for _, target := range targets {
+			method, url := routeURL(rt, target)
+			for _, u := range users {
+				want := rt.role == "" || (u.role != "" && roleAtLeast(u.role, rt.role))
+				if rt.path != nil {
+					want = want && sees[target][u.name]
+				}
+				w := send(h, u, method, url, true)
+				reached := w.Header().Get(probed)
+				switch {
+				case want && reached != rt.pattern:
+					t.Errorf("%s %s as %s: %d, reached %q; want it to reach %q", method, url, u.name, w.Code, reached, rt.pattern)
+				case !want && reached != "":
+					t.Errorf("%s %s as %s: reached %q", method, url, u.name, reached)
+				}
+			}
+		}
+	}
+}
+
+// TestRestrictedContentStaysHidden asks the real handlers for restricted
+// content the ways around the routing table: searching, share links and
+// paths climbing out of them.
+func TestRestrictedContentStaysHidden(t *testing.T) {
+	h, _, db, users := testServer(t)
+	anonymous, ada, vic := users[0], users[1], users[2]
+
+	// the index is built in the background, wait until admins find the notes
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(send(h, ada, "GET", "/search?q=notes", false).Body.String(), "notes.txt") {
+		if time.Now().After(deadline) {
+			t.Fatal("search never found secret/notes.txt")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, u := range []testUser{anonymous, vic} {
+		if body := send(h, u, "GET", "/search?q=notes", false).Body.String(); strings.Contains(body, "notes.txt") {
+			t.Errorf("search as %s finds secret/notes.txt", u.name)
+		}
+	}
+
+	secret, err := loadSecret(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := &Share{Path: "open", CreatedBy: ada.email, CanView: true, CanDownload: true}
+	closed := &Share{Path: "secret", CreatedBy: ada.email, CanView: true, CanDownload: true}
+	revoked := &Share{Path: "secret", CreatedBy: ada.email, CanView: true, CanDownload: true,
+		RevokedAt: sql.NullTime{Time: time.Now(), Valid: true}}
+	for _, s := range []*Share{open, closed, revoked} {
+		if err := createShare(db, secret, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		url  string
+		want bool // shows the marker
+	}{
+		{"/s/" + open.Token + "/files/readme.txt", false},
+		{"/s/" + open.Token + "/files/../secret/notes.txt", false},
+		{"/s/" + open.Token + "/files/%2e%2e/secret/notes.txt", false},
+		{"/s/" + open.Token + "/files/..%2fsecret/notes.txt", false},
+		{"/s/" + open.Token + "/view/../secret/notes.txt", false},
+		{"/s/" + open.Token + "/checksum/../secret/notes.txt", false},
+		{"/s/" + open.Token + "/files/secret/notes.txt", false},
+		{"/files/secret/notes.txt", false},
+		{"/files/open/../secret/notes.txt", false},
+		{"/dav/secret/notes.txt", false},
+		{"/zip/secret/", false},
+		{"/s/" + closed.Token + "/files/notes.txt", true},
+		{"/s/" + closed.Token + "/files/inner/a.txt", true},
+		{"/s/" + revoked.Token + "/files/notes.txt", false},
+	} {
+		w := send(h, anonymous, "GET", tc.url, false)
+		if got := strings.Contains(w.Body.String(), "SECRET-MARKER"); got != tc.want {
+			t.Errorf("GET %s anonymously: %d, shows the secret: %v, want %v", tc.url, w.Code, got, tc.want)
+		}
+	}
+	if body := send(h, anonymous, "GET", "/s/"+open.Token+"/files/readme.txt", false).Body.String(); body != "open to all" {
+		t.Errorf("share of open does not serve readme.txt: %q", body)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3ListingFresh is how long a folder listing of a bucket is reused. There
+	// is no folder mtime to go by, so folders get a new one this often.
+	s3ListingFresh = time.Minute
+	// s3PresignTTL is how long a handed out link to an object works.
+	s3PresignTTL = time.Hour
+	// emptySHA256 is the payload hash of requests without a body.
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Store serves the objects of a bucket below a prefix as a folder, keys
+// split into folders at "/". It speaks just enough S3 for listing, HEAD and
+// ranged GETs, signed with the access key from AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY, against AWS or anything compatible like MinIO.
+// Objects of passthrough bytes or more are not streamed through Consus but
+// handed out as presigned links, see presign.
+type s3Store struct {
+	endpoint    *url.URL // requests go path-style, endpoint/bucket/key
+	bucket      string
+	prefix      string // "" or ending in /
+	region      string
+	accessKey   string
+	secretKey   string
+	passthrough int64 // 0 for never
+	client      *http.Client
+}
+
+// newS3Store reads s3://bucket/prefix?endpoint=https://minio:9000&region=eu-west-1&passthrough=100MB.
+// Without an endpoint it talks to AWS in region, us-east-1 by default.
+func newS3Store(spec string) (*s3Store, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("%q: want s3://bucket/prefix", spec)
+	}
+	q := u.Query()
+	s := &s3Store{
+		bucket:    u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+		region:    q.Get("region"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		}},
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	endpoint := q.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("%q: invalid endpoint %q", spec, endpoint)
+	}
+	if v := q.Get("passthrough"); v != "" {
+		if s.passthrough, err = parseSize(v); err != nil {
+			return nil, fmt.Errorf("%q: invalid passthrough size %q", spec, v)
+		}
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("%q: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", spec)
+	}
+	return s, nil
+}
+
+// s3Info is an object or a folder of a bucket.
+type s3Info struct {
+	name string
+	size int64
+	mod  time.Time
+	dir  bool
+}
+
+func (i s3Info) Name() string       { return i.name }
+func (i s3Info) Size() int64        { return i.size }
+func (i s3Info) ModTime() time.Time { return i.mod }
+func (i s3Info) IsDir() bool        { return i.dir }
+func (i s3Info) Sys() any           { return nil }
+
+func (i s3Info) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+func s3Folder(name string) s3Info {
+	return s3Info{name: path.Base(name), mod: time.Now().Truncate(s3ListingFresh), dir: true}
+}
+
+func (s *s3Store) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return s3Folder("."), nil
+	}
+	resp, err := s.do(http.MethodHead, s.prefix+name, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		return objectInfo(name, resp.Header), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	// folders only exist as the prefix of some key
+	list, err := s.list(s.prefix+name+"/", "", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(list.Contents) == 0 && len(list.CommonPrefixes) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return s3Folder(name), nil
+}
+
+func objectInfo(name string, h http.Header) s3Info {
+	info := s3Info{name: path.Base(name)}
+	info.size, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	info.mod, _ = http.ParseTime(h.Get("Last-Modified"))
+	return info
+}
+
+func (s *s3Store) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	prefix := s.prefix
+	if name != "." {
+		prefix += name + "/"
+	}
+	var entries []fs.DirEntry
+	token := ""
+	for {
+		list, err := s.list(prefix, token, 1000)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		for _, p := range list.CommonPrefixes {
+			entries = append(entries, fs.FileInfoToDirEntry(s3Folder(strings.TrimSuffix(p.Prefix, "/"))))
+		}
+		for _, o := range list.Contents {
+			// the empty objects some tools create to make a folder show up,
+			// the folder itself is among the prefixes
+			if strings.HasSuffix(o.Key, "/") {
+				continue
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(s3Info{name: path.Base(o.Key), size: o.Size, mod: o.LastModified}))
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+	if len(entries) == 0 && name != "." {
+		if _, err := s.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (s *s3Store) Open(name string) (fs.File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &s3Dir{info: info}, nil
+	}
+	return &s3File{store: s, key: s.prefix + name, info: info}, nil
+}
+
+// s3File reads an object with one streaming GET from the current offset,
+// seeking starts a new one. That is all http.ServeContent needs for ranges.
+type s3File struct {
+	store *s3Store
+	key   string
+	info  fs.FileInfo
+	off   int64
+	body  io.ReadCloser
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.off >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		resp, err := f.store.do(http.MethodGet, f.key, nil, http.Header{"Range": {fmt.Sprintf("bytes=%d-", f.off)}})
+		if err != nil {
+			return 0, err
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the object")
+	}
+	if offset != f.off && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+type s3Dir struct {
+	info fs.FileInfo
+}
+
+func (d *s3Dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *s3Dir) Read([]byte) (int, error)   { return 0, errors.New("is a folder") }
+func (d *s3Dir) Close() error               { return nil }
+
+type s3List struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// list asks for one page of what is right below prefix.
+func (s *s3Store) list(prefix, token string, max int) (*s3List, error) {
+	q := url.Values{"list-type": {"2"}, "delimiter": {"/"}, "prefix": {prefix}, "max-keys": {strconv.Itoa(max)}}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	resp, err := s.do(http.MethodGet, "", q, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list s3List
+	if err := xml.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("s3 %s: %w", s.bucket, err)
+	}
+	for i := range list.CommonPrefixes {
+		list.CommonPrefixes[i].Prefix = strings.TrimPrefix(list.CommonPrefixes[i].Prefix, prefix)
+	}
+	return &list, nil
+}
+
+// objectURL is the path-style URL of key, "" for the bucket itself.
+func (s *s3Store) objectURL(key string, q url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + s3Escape(s.bucket, false) + "/" + s3Escape(key, true)
+	u.RawQuery = s3Query(q)
+	return &u
+}
+
+// do sends a signed request and turns failures into errors, missing keys into
+// fs.ErrNotExist.
+func (s *s3Store) do(method, key string, q url.Values, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, q).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	signV4(req, s.region, s.accessKey, s.secretKey, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, fs.ErrNotExist
+	case http.StatusForbidden:
+		return nil, fmt.Errorf("s3 %s: %w", s.bucket, fs.ErrPermission)
+	}
+	return nil, fmt.Errorf("s3 %s: %s %s: %s", s.bucket, method, key, resp.Status)
+}
+
+// presign returns a link to the object name that works without credentials
+// for a while, when it is big enough to not go through Consus.
+func (s *s3Store) presign(name string, size int64) string {
+	if s.passthrough == 0 || size < s.passthrough {
+		return ""
+	}
+	now := time.Now().UTC()
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.accessKey + "/" + scope},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(s3PresignTTL.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u := s.objectURL(s.prefix+name, q)
+	canonical := strings.Join([]string{http.MethodGet, u.EscapedPath(), u.RawQuery, "host:" + u.Host + "\n", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	q.Set("X-Amz-Signature", s3Signature(s.secretKey, now, s.region, canonical))
+	u.RawQuery = s3Query(q)
+	return u.String()
+}
+
+// signV4 signs req with AWS Signature Version 4, covering the host and every
+// header set so far.
+func signV4(req *http.Request, region, accessKey, secretKey string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		names = append(names, k)
+		values[k] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, k := range names {
+		headers.WriteString(k + ":" + values[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), s3Query(req.URL.Query()), headers.String(), signed, emptySHA256}, "\n")
+	scope := now.Format("20060102") + "/" + region + "/s3/aws4_request"
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		",SignedHeaders="+signed+",Signature="+s3Signature(secretKey, now, region, canonical))
+}
+
+func s3Signature(secretKey string, now time.Time, region, canonical string) string {
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	date := now.Format("20060102")
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + date + "/" + region + "/s3/aws4_request\n" + hex.EncodeToString(hash[:])
+	key := mac(mac(mac(mac([]byte("AWS4"+secretKey), date), region), "s3"), "aws4_request")
+	return hex.EncodeToString(mac(key, toSign))
+}
+
+// s3Query encodes q sorted by key the way signatures want it, spaces as %20.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, and the
+// slashes if asked to.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	scanMaxDepth  = 24
+	scanMaxIssues = 1000
+)
+
+type scanIssue struct {
+	Path   string
+	Kind   string
+	Detail string
+}
+
+type scanReport struct {
+	Started  time.Time
+	Duration time.Duration
+	Files    int
+	Dirs     int
+	Reread   int         // folders read from disk, the others came from the index
+	Full     bool        // every folder was read
+	Issues   []scanIssue `json:"-"`
+	// Truncated is set when more than scanMaxIssues problems were found.
+	Truncated bool `json:"-"`
+}
+
+type issueList []scanIssue
+
+func (l *issueList) add(rel, kind, format string, args ...any) {
+	*l = append(*l, scanIssue{Path: rel, Kind: kind, Detail: fmt.Sprintf(format, args...)})
+}
+
+// contentScanner looks for content that will misbehave once served: things
+// that cannot be read, dangling links, names that break URLs, and names that
+// only differ in case, which end up as one file on a case-insensitive disk.
+// What it finds is kept in the content index, see index.go.
+type contentScanner struct {
+	db      *sql.DB
+	content *contentFS
+	skip    []string // directories in the content that belong to consus itself
+	workers int      // top level folders walked at the same time
+	done    func()   // called after every scan, may be nil
+	tidy    bool     // removes the temporary files crashes left in the content
+	// sizes are added up again after every scan, may be nil
+	sizes *folderSizes
+	// watched is set while a watcher keeps the index current, see watch.go
+	watched atomic.Bool
+	// rereads of folders whose mtime didn't change, for the listings cache
+	stampMu sync.Mutex
+	stamps  map[string]uint64
+
+	mu       sync.Mutex
+	last     *scanReport
+	running  bool
+	progress atomic.Int64 // folders done by the running check
+}
+
+func newContentScanner(db *sql.DB, content *contentFS, skip []string, workers int) *contentScanner {
+	cs := &contentScanner{db: db, content: content, skip: skip, workers: workers}
+	last, err := loadScanReport(db, content.id())
+	if err != nil {
+		log.Printf("content scan: could not load the last report: %v", err)
+	}
+	cs.last = last
+	return cs
+}
+
+// start scans the content root in the background unless a scan is already
+// going on, and logs the outcome. Unless full is set, folders that did not
+// change since the last scan are taken from the index.
+func (cs *contentScanner) start(full bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.running {
+		return
+	}
+	cs.running = true
+	cs.progress.Store(0)
+
+	go func() {
+		rep := cs.scan(full)
+		logReport(rep)
+
+		cs.mu.Lock()
+		cs.last, cs.running = rep, false
+		cs.mu.Unlock()
+		cs.sizes.changed()
+		if cs.done != nil {
+			cs.done()
+		}
+	}()
+}
+
+// refresh starts a scan like start(false) if the last one began more than
+// maxAge ago.
+func (cs *contentScanner) refresh(maxAge time.Duration) {
+	cs.mu.Lock()
+	stale := !cs.watched.Load() && (cs.last == nil || time.Since(cs.last.Started) > maxAge)
+	cs.mu.Unlock()
+	if stale {
+		cs.start(false)
+	}
+}
+
+func (cs *contentScanner) status() (*scanReport, bool, int64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.last, cs.running, cs.progress.Load()
+}
+
+func (cs *contentScanner) scan(full bool) *scanReport {
+	rep := &scanReport{Started: time.Now(), Full: full}
+	skip := cs.skipped()
+
+	// an index of some other folder is no use
+	root := cs.content.id()
+	var savedRoot string
+	cs.db.QueryRow("SELECT value FROM settings WHERE key = 'index.root'").Scan(&savedRoot)
+	if savedRoot != root {
+		if err := clearIndex(cs.db); err != nil {
+			log.Printf("content scan: %v", err)
+		}
+		rep.Full = true
+	}
+
+	// the top level folders are walked side by side, with a deep queue network
+	// shares and spinning disks answer much faster overall
+	folders := make(chan string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range max(cs.workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			part := &scanReport{}
+			for rel := range folders {
+				cs.walk(rel, 1, rep.Full, skip, part)
+			}
+			mu.Lock()
+			rep.Files, rep.Dirs, rep.Reread = rep.Files+part.Files, rep.Dirs+part.Dirs, rep.Reread+part.Reread
+			mu.Unlock()
+		}()
+	}
+	for _, e := range cs.folder(".", 0, rep.Full, skip, rep) {
+		if e.IsDir {
+			folders <- e.Name
+		}
+	}
+	close(folders)
+	wg.Wait()
+	rep.Duration = time.Since(rep.Started)
+
+	if err := saveScanReport(cs.db, root, rep); err != nil {
+		log.Printf("content scan: could not save the report: %v", err)
+	}
+	var err error
+	if rep.Issues, rep.Truncated, err = indexIssues(cs.db); err != nil {
+		log.Printf("content scan: %v", err)
+	}
+	return rep
+}
+
+// update checks just the folders below the root that are known to have
+// changed, instead of walking the whole tree. Folders in changed are checked
+// along with the subfolders that are new to the index; folders in reread are
+// read again even if their mtime says otherwise, which is what a file written
+// in place needs. It does not touch the report of the last scan.
+func (cs *contentScanner) update(changed, reread []string) {
+	skip := cs.skipped()
+	rep := &scanReport{}
+	gone := func(rel string) bool {
+		// the read of its parent drops it from the index
+		_, err := cs.content.stat(rel)
+		return err != nil
+	}
+	for _, rel := range changed {
+		if gone(rel) {
+			continue
+		}
+		depth := folderDepth(rel)
+		for _, e := range cs.folder(rel, depth, false, skip, rep) {
+			if e.IsDir && e.Mod == 0 && depth+1 <= scanMaxDepth {
+				cs.walk(path.Join(rel, e.Name), depth+1, false, skip, rep)
+			}
+		}
+	}
+	for _, rel := range reread {
+		if !gone(rel) {
+			cs.folder(rel, folderDepth(rel), true, skip, rep)
+			cs.stampMu.Lock()
+			if cs.stamps == nil {
+				cs.stamps = map[string]uint64{}
+			}
+			cs.stamps[cleanRel(rel)]++
+			cs.stampMu.Unlock()
+		}
+	}
+	cs.sizes.changed()
+	if cs.done != nil {
+		cs.done()
+	}
+}
+
+// skipped holds the absolute paths of the skip directories.
+func (cs *contentScanner) skipped() map[string]bool {
+	skip := map[string]bool{}
+	for _, dir := range cs.skip {
+		if abs, err := filepath.Abs(dir); err == nil {
+			skip[abs] = true
+		}
+	}
+	return skip
+}
+
+// folderDepth counts the levels of rel below the root.
+func folderDepth(rel string) int {
+	if rel == "." {
+		return 0
+	}
+	return strings.Count(rel, "/") + 1
+}
+
+// walk checks the folder rel and everything below it, depth levels down from
+// the root.
+func (cs *contentScanner) walk(rel string, depth int, full bool, skip map[string]bool, rep *scanReport) {
+	for _, e := range cs.folder(rel, depth, full, skip, rep) {
+		if e.IsDir && depth+1 <= scanMaxDepth {
+			cs.walk(path.Join(rel, e.Name), depth+1, full, skip, rep)
+		}
+	}
+}
+
+// folder checks the entries of rel, or takes them from the index if it did not
+// change, and counts them.
+func (cs *contentScanner) folder(rel string, depth int, full bool, skip map[string]bool, rep *scanReport) []indexEntry {
+	cs.progress.Add(1)
+	mod, children, known, err := indexedFolder(cs.db, rel)
+	if err != nil {
+		log.Printf("content scan: %v", err)
+	}
+
+	info, err := cs.content.stat(rel)
+	if full || !known || err != nil || info.ModTime().UnixNano() != mod {
+		rep.Reread++
+		children = cs.read(rel, depth, info, err, children, skip)
+	}
+
+	for _, e := range children {
+		if e.IsDir {
+			rep.Dirs++
+		} else {
+			rep.Files++
+		}
+	}
+	return children
+}
+
+// read checks every entry of the folder rel on disk and stores the result.
+// old are the entries the index had for it.
+func (cs *contentScanner) read(rel string, depth int, info os.FileInfo, err error, old []indexEntry, skip map[string]bool) []indexEntry {
+	var entries []os.DirEntry
+	if err == nil {
+		chaosDisk()
+		entries, err = cs.content.readDir(rel)
+	}
+
+	var issues issueList
+	var children []indexEntry
+	var mod int64 // stays 0 for unreadable folders, so they are tried again next time
+	if err != nil {
+		issues.add(rel, "unreadable", "%v", err)
+	} else {
+		mod = info.ModTime().UnixNano()
+	}
+
+	oldMod := map[string]int64{}
+	for _, e := range old {
+		if e.IsDir {
+			oldMod[e.Name] = e.Mod
+		}
+	}
+
+	seen := map[string]string{}
+	for _, d := range entries {
+		name := d.Name()
+		entryRel := path.Join(rel, name)
+		full := cs.content.abs(entryRel)
+		if abs, _ := filepath.Abs(full); full != "" && skip[abs] {
+			continue
+		}
+		if strings.HasPrefix(name, tmpPrefix) {
+			// an upload being written, it shows once it has its name
+			if fi, err := d.Info(); err == nil && cs.tidy && full != "" && isLeftover(name, fi, tmpStale) {
+				if err := os.Remove(full); err == nil {
+					log.Printf("content scan: removed %s, left half written", entryRel)
+				}
+			}
+			continue
+		}
+
+		if problem := urlNameProblem(name); problem != "" {
+			issues.add(entryRel, "name", "%s", problem)
+		} else if problem := windowsNameProblem(name); problem != "" {
+			// fine here, but lost or refused once the folder is copied to Windows
+			issues.add(entryRel, "windows", "%s", problem)
+		}
+		folded := strings.ToLower(name)
+		if other, ok := seen[folded]; ok {
+			issues.add(entryRel, "case", "only differs in case from %q", other)
+		} else {
+			seen[folded] = name
+		}
+
+		e := indexEntry{Name: name, IsDir: d.IsDir()}
+		fi, infoErr := d.Info()
+		if infoErr == nil {
+			e.MTime, e.Mode = fi.ModTime().UnixNano(), fi.Mode().Perm()
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			if _, err := cs.content.stat(entryRel); err != nil {
+				issues.add(entryRel, "symlink", "broken link: %v", err)
+			}
+		case d.IsDir():
+			// the folder's own read records its mtime, until then it counts as changed
+			e.Mod = oldMod[name]
+			if depth+1 > scanMaxDepth {
+				issues.add(entryRel, "depth", "nested %d levels deep", depth+1)
+			}
+		default:
+			if infoErr == nil {
+				e.Size, e.Mod = fi.Size(), e.MTime
+			}
+			f, err := cs.content.open(entryRel)
+			if err != nil {
+				issues.add(entryRel, "unreadable", "%v", err)
+			} else {
+				f.Close()
+			}
+		}
+		children = append(children, e)
+	}
+
+	if changed, err := storeFolder(cs.db, rel, mod, old, children, issues); err != nil {
+		log.Printf("content scan: %v", err)
+	} else if changed {
+		events.publish(eventFolderChanged, "", rel, nil)
+	}
+	return children
+}
+
+// stamp goes up whenever rel is read again with the same mtime, a file in
+// it written over in place, so cached listings keyed by both go stale.
+func (cs *contentScanner) stamp(rel string) uint64 {
+	cs.stampMu.Lock()
+	defer cs.stampMu.Unlock()
+	return cs.stamps[cleanRel(rel)]
+}
+
+// onFileWritten reads the folder of a file written over again, its mtime
+// doesn't tell.
+func (cs *contentScanner) onFileWritten(e event) error {
+	dir := cleanRel(path.Dir(e.Path))
+	if dir == "" {
+		dir = "."
+	}
+	cs.update(nil, []string{dir})
+	return nil
+}
+
+// current returns the index's snapshot of the folder rel, reading it first if
+// it changed since. A folder that changes again while it is read is read once
+// more, up to three times, so what comes back is the folder at one moment.
+func (cs *contentScanner) current(rel string) (folderSnapshot, error) {
+	key := rel
+	if key == "" {
+		key = "."
+	}
+	for attempt := 0; ; attempt++ {
+		info, err := cs.content.stat(rel)
+		if err != nil {
+			return folderSnapshot{}, err
+		}
+		snap, known, err := snapshotFolder(cs.db, key)
+		if err != nil {
+			return snap, err
+		}
+		if known && snap.Mod != 0 && (snap.Mod == info.ModTime().UnixNano() || attempt == 3) {
+			return snap, nil
+		}
+		if attempt == 3 {
+			return snap, fmt.Errorf("could not read /%s, see the content check", rel)
+		}
+		cs.read(key, folderDepth(key), info, nil, snap.Entries, cs.skipped())
+	}
+}
+
+// urlNameProblem explains why name would break links or rendering, if it does.
+func urlNameProblem(name string) string {
+	if !utf8.ValidString(name) {
+		return "name is not valid UTF-8"
+	}
+	if strings.TrimSpace(name) != name {
+		return "name starts or ends with whitespace"
+	}
+	for _, r := range name {
+		switch {
+		case unicode.IsControl(r):
+			return "name contains control characters"
+		case r == '?' || r == '#' || r == '%':
+			return fmt.Sprintf("name contains %q, which breaks links", r)
+		case r == '\\':
+			return "name contains a backslash"
+		}
+	}
+	return ""
+}
+
+// logReport prints a summary of rep and its first few issues.
+func logReport(rep *scanReport) {
+	log.Printf("content scan: %d files, %d folders (%d read from disk), %d issues in %s", rep.Files, rep.Dirs, rep.Reread, len(rep.Issues), rep.Duration.Round(time.Millisecond))
+	for i, issue := range rep.Issues {
+		if i == 10 {
+			log.Printf("content scan: ... see /scan for the full report")
+			break
+		}
+		log.Printf("content scan: %s: %s (%s)", issue.Path, issue.Detail, issue.Kind)
+	}
+}
+
+func renderScan(tmpl *template.Template, cs *contentScanner) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep, running, progress := cs.status()
+		data := struct {
+			Version   string
+			CSRF      string
+			UserEmail string
+			Report    *scanReport
+			Running   bool
+			Progress  int64
+			Disks     []DiskStatus
+		}{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: emailFromRequest(r),
+			Report:    rep,
+			Running:   running,
+			Progress:  progress,
+			Disks:     disks.status(),
+		}
+		if err := tmpl.ExecuteTemplate(w, "scan.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// scanSubmit starts a new scan in the background, the page shows it once done.
+// It reads every folder again, also catching files changed in place, which
+// leave the mtime of their folder alone.
+func scanSubmit(cs *contentScanner) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cs.start(true)
+		http.Redirect(w, r, "/scan", http.StatusSeeOther)
+	}
+}
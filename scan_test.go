@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// BenchmarkContentScan runs a full content check over 100,000 files in 50
+// top level folders, walking one of them at a time and eight.
+func BenchmarkContentScan(b *testing.B) {
+	root := b.TempDir()
+	for t := 0; t < 50; t++ {
+		for s := 0; s < 20; s++ {
+			dir := filepath.Join(root, fmt.Sprintf("archive %02d", t), fmt.Sprintf("roll %02d", s))
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("photo %03d.jpg", i)), nil, 0o644); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	content := newContentFS(root, nil)
+	content.ignore = newIgnoreRules(content, false)
+
+	for _, workers := range []int{1, 8} {
+		b.Run(strconv.Itoa(workers)+" workers", func(b *testing.B) {
+			db, err := openDB(filepath.Join(b.TempDir(), "consus.db"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			cs := newContentScanner(db, content, nil, workers)
+			for b.Loop() {
+				if rep := cs.scan(true); rep.Files != 50*20*100 {
+					b.Fatalf("scan found %d files", rep.Files)
+				}
+			}
+		})
+	}
+}
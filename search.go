@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	searchLimit = 200
+	// searchFresh is how old the content index may get before a search has it
+	// looked over again
+	searchFresh = time.Minute
+)
+
+// SearchHit is one file or folder whose name matched.
+type SearchHit struct {
+	Path        string // below the content root
+	Name        string
+	IsDir       bool
+	Breadcrumbs []Breadcrumb
+	Snippet     template.HTML // around the match, for full-text hits
+	score       int
+}
+
+// matchName tells how well name matches q, 0 for not at all. A substring
+// beats a fuzzy match, where the letters of q come in order but with gaps,
+// and the closer a match is to the full name the better.
+func matchName(name, q string) int {
+	name, q = strings.ToLower(name), strings.ToLower(q)
+	if i := strings.Index(name, q); i >= 0 {
+		score := 2000 - len(name) + len(q)
+		if i == 0 {
+			score += 500
+		}
+		return score
+	}
+
+	gaps := 0
+	rest := []rune(name)
+	for _, c := range q {
+		i := 0
+		for i < len(rest) && rest[i] != c {
+			i++
+		}
+		if i == len(rest) {
+			return 0
+		}
+		gaps += i
+		rest = rest[i+1:]
+	}
+	return max(1000-gaps, 1)
+}
+
+// foldedIntoASCII are the letters matchName finds for letters beyond ASCII,
+// İ lowers to i and the Kelvin sign to k.
+const foldedIntoASCII = "ik"
+
+// likeLetters is a LIKE pattern for names with the letters of q in order,
+// which every name matchName scores has. LIKE only folds the case of ASCII,
+// so ok is false for queries with other letters, which have to look at all
+// names, and the letters of foldedIntoASCII match any one character.
+func likeLetters(q string) (pattern string, ok bool) {
+	var b strings.Builder
+	b.WriteByte('%')
+	for _, c := range q {
+		switch {
+		case c >= utf8.RuneSelf:
+			return "", false
+		case strings.ContainsRune(foldedIntoASCII, unicode.ToLower(c)):
+			c = '_'
+		case c == '%' || c == '_' || c == '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+		b.WriteByte('%')
+	}
+	return b.String(), true
+}
+
+// searchIndex looks through the names in the content index below in, best
+// matches first.
+func searchIndex(db *sql.DB, in, q string) ([]SearchHit, error) {
+	query, args := "SELECT path, name, is_dir FROM content_index WHERE path != '.'", []any{}
+	if in != "" {
+		// '0' comes right after '/', so this is everything below in, off the primary key
+		query += " AND path > ? AND path < ?"
+		args = append(args, in+"/", in+"0")
+	}
+	if pattern, ok := likeLetters(q); ok {
+		query += ` AND name LIKE ? ESCAPE '\'`
+		args = append(args, pattern)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []SearchHit
+	for rows.Next() {
+		var h SearchHit
+		if err := rows.Scan(&h.Path, &h.Name, &h.IsDir); err != nil {
+			return nil, err
+		}
+		if h.score = matchName(h.Name, q); h.score > 0 {
+			hits = append(hits, h)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return naturalLess(hits[i].Path, hits[j].Path)
+	})
+	return hits, nil
+}
+
+// renderSearch finds files by name, or with ?mode=text by what is written in
+// them when texts is set up. The names come from the content index, so files
+// added since the last content check show up from the search after the next
+// one, which a search starts when the index is older than searchFresh, unless
+// -watch keeps the index current anyway.
+func renderSearch(tmpl *template.Template, db *sql.DB, scanner *contentScanner, texts *textIndex, ig *ignoreRules) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		in := cleanRel(r.URL.Query().Get("in"))
+		text := texts != nil && r.URL.Query().Get("mode") == "text"
+		email := emailFromRequest(r)
+
+		var visible []SearchHit
+		more := false
+		if q != "" {
+			scanner.refresh(searchFresh)
+			var hits []SearchHit
+			var err error
+			if text {
+				hits, err = texts.search(in, q)
+			} else {
+				hits, err = searchIndex(db, in, q)
+			}
+			if err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			// folder rules are inherited, one check per folder covers its files
+			allowed := map[string]bool{}
+			for _, h := range hits {
+				// the index has everything, .consusignore changes apply at once
+				if ig.hiddenEntry(h.Path, h.IsDir) {
+					continue
+				}
+				dir := h.Path
+				if !h.IsDir {
+					dir = cleanRel(path.Dir(h.Path))
+				}
+				ok, seen := allowed[dir]
+				if !seen {
+					var err error
+					if ok, err = canAccessPath(db, email, dir); err != nil {
+						log.Printf("%s", err.Error())
+					}
+					allowed[dir] = ok
+				}
+				if !ok {
+					continue
+				}
+				if len(visible) == searchLimit {
+					more = true
+					break
+				}
+				h.Breadcrumbs = GenerateBreadcrumbs("/files/", cleanRel(path.Dir(h.Path)))
+				visible = append(visible, h)
+			}
+		}
+
+		data := struct {
+			Version   string
+			UserEmail string
+			UserRole  string
+			Query     string
+			In        string
+			Text      bool
+			CanText   bool
+			Hits      []SearchHit
+			More      bool
+		}{
+			Version:   GetVersion(),
+			UserEmail: email,
+			UserRole:  roleFromRequest(db, r),
+			Query:     q,
+			In:        in,
+			Text:      text,
+			CanText:   texts != nil,
+			Hits:      visible,
+			More:      more,
+		}
+		if err := tmpl.ExecuteTemplate(w, "search.html", data); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestSearchIndex(t *testing.T) {
+	db := testDB(t)
+	for _, f := range []struct {
+		rel   string
+		names []string
+	}{
+		{".", []string{"music/", "music2/", "Ärger/"}},
+		{"music", []string{"Album/", "100%_done.txt", "100 done.txt", `back\slash.txt`}},
+		{"music/Album", []string{"01 Intro.flac", "02 Outro.flac"}},
+		{"music2", []string{"Intro.flac"}},
+		{"Ärger", []string{"Ärger.txt", "ärger.txt", "İstanbul.jpg", "3K.png"}},
+	} {
+		var entries []indexEntry
+		for _, name := range f.names {
+			e := indexEntry{Name: name}
+			if e.Name[len(e.Name)-1] == '/' {
+				e.Name, e.IsDir = e.Name[:len(e.Name)-1], true
+			}
+			entries = append(entries, e)
+		}
+		if _, err := storeFolder(db, f.rel, 1, nil, entries, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		in, q string
+		want  []string
+	}{
+		{"", "intro", []string{"music2/Intro.flac", "music/Album/01 Intro.flac"}},
+		{"", "INTRO", []string{"music2/Intro.flac", "music/Album/01 Intro.flac"}},
+		{"", "itr", []string{"music2/Intro.flac", "music/Album/01 Intro.flac"}},
+		{"music", "intro", []string{"music/Album/01 Intro.flac"}},
+		{"music/Album", "flac", []string{"music/Album/01 Intro.flac", "music/Album/02 Outro.flac"}},
+		{"", "100%_", []string{"music/100%_done.txt"}},
+		{"", "0_d", []string{"music/100%_done.txt"}},
+		{"", `k\s`, []string{`music/back\slash.txt`}},
+		{"", "ärger", []string{"Ärger", "Ärger/Ärger.txt", "Ärger/ärger.txt"}},
+		{"", "istanbul", []string{"Ärger/İstanbul.jpg"}},
+		{"", "3k", []string{"Ärger/3K.png"}},
+		{"", "nothing", nil},
+	} {
+		hits, err := searchIndex(db, tc.in, tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, h := range hits {
+			got = append(got, h.Path)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("searchIndex(%q, %q) = %q, want %q", tc.in, tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestFoldedIntoASCII(t *testing.T) {
+	var folded []rune
+	for r := rune(utf8.RuneSelf); r <= unicode.MaxRune; r++ {
+		for _, l := range strings.ToLower(string(r)) {
+			if l < utf8.RuneSelf && !slices.Contains(folded, l) {
+				folded = append(folded, l)
+			}
+		}
+	}
+	slices.Sort(folded)
+	if string(folded) != foldedIntoASCII {
+		t.Errorf("letters beyond ASCII lower to %q, foldedIntoASCII is %q", string(folded), foldedIntoASCII)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// loadSecret returns the instance key used to sign cookies and links, creating
+// it on first start so signatures stay valid across restarts.
+func loadSecret(db *sql.DB) ([]byte, error) {
+	var encoded string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = 'secret'").Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		encoded = hex.EncodeToString(key)
+		if _, err := db.Exec("INSERT INTO settings (key, value) VALUES ('secret', ?)", encoded); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(encoded)
+}
+
+// sign returns an HMAC over the NUL separated parts.
+func sign(secret []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verify(secret []byte, signature string, parts ...string) bool {
+	return hmac.Equal([]byte(signature), []byte(sign(secret, parts...)))
+}
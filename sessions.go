@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Sessions live in the database, so they survive restarts and can be ended
+// from anywhere. Only a hash of the cookie is stored. Every request pushes the
+// expiry out again: a plain session lasts until the browser closes or it sits
+// idle for too long, a remembered one keeps its cookie for the remember period.
+
+const sessionEmailKey contextKey = "session-email"
+
+// sessionTouchEvery keeps busy sessions from writing to the database on every request.
+const sessionTouchEvery = time.Minute
+
+type Session struct {
+	ID         int64
+	Email      string
+	CreatedAt  time.Time
+	LastSeen   time.Time
+	ExpiresAt  time.Time
+	Remember   bool
+	UserAgent  string
+	RemoteAddr string
+	Current    bool
+}
+
+type sessionStore struct {
+	db       *sql.DB
+	idle     time.Duration
+	remember time.Duration // 0 turns "remember me" off
+}
+
+// sessions is set up by NewMainServer.
+var sessions *sessionStore
+
+func (ss *sessionStore) lifetime(remember bool) time.Duration {
+	if remember && ss.remember > 0 {
+		return ss.remember
+	}
+	return ss.idle
+}
+
+func (ss *sessionStore) setCookie(w http.ResponseWriter, token string, remember bool) {
+	c := &http.Cookie{
+		Name:     "session",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if remember {
+		c.MaxAge = int(ss.remember.Seconds())
+	}
+	http.SetCookie(w, c)
+}
+
+// start issues a fresh session cookie for email.
+func (ss *sessionStore) start(w http.ResponseWriter, r *http.Request, email string, remember bool) error {
+	remember = remember && ss.remember > 0
+	token := newSessionToken()
+	now := time.Now()
+	if _, err := ss.db.Exec("DELETE FROM sessions WHERE expires_at < ?", now); err != nil {
+		return err
+	}
+	_, err := ss.db.Exec(`INSERT INTO sessions (token_hash, email, created_at, last_seen, expires_at, remember, user_agent, remote_addr)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(token), email, now, now, now.Add(ss.lifetime(remember)), remember, r.UserAgent(), remoteIP(r))
+	if err != nil {
+		return err
+	}
+	ss.setCookie(w, token, remember)
+	return nil
+}
+
+// end forgets the session of this request, if any.
+func (ss *sessionStore) end(r *http.Request) error {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return nil
+	}
+	_, err = ss.db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(c.Value))
+	return err
+}
+
+// endAllSessions logs email out on every device.
+func endAllSessions(db *sql.DB, email string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE email = ?", email)
+	return err
+}
+
+func listSessions(db *sql.DB, email string) ([]Session, error) {
+	rows, err := db.Query(`SELECT id, email, created_at, last_seen, expires_at, remember, user_agent, remote_addr
+		FROM sessions WHERE email = ? AND expires_at > ? ORDER BY last_seen DESC`, email, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.Email, &s.CreatedAt, &s.LastSeen, &s.ExpiresAt, &s.Remember, &s.UserAgent, &s.RemoteAddr); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// sessionAuth resolves the session cookie once per request and slides its expiry.
+func sessionAuth(ss *sessionStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("session")
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := r.Context().Value(tokenEmailKey).(string); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var s Session
+		err = ss.db.QueryRow("SELECT id, email, last_seen, expires_at, remember FROM sessions WHERE token_hash = ?",
+			hashToken(c.Value)).Scan(&s.ID, &s.Email, &s.LastSeen, &s.ExpiresAt, &s.Remember)
+		now := time.Now()
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && now.After(s.ExpiresAt)) {
+			http.SetCookie(w, &http.Cookie{Name: "session", Path: "/", MaxAge: -1})
+			next.ServeHTTP(w, r)
+			return
+		} else if err != nil {
+			log.Printf("session lookup error: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if now.Sub(s.LastSeen) > sessionTouchEvery {
+			if _, err := ss.db.Exec("UPDATE sessions SET last_seen = ?, expires_at = ? WHERE id = ?",
+				now, now.Add(ss.lifetime(s.Remember)), s.ID); err != nil {
+				log.Printf("session bookkeeping error: %v", err)
+			}
+			if s.Remember {
+				ss.setCookie(w, c.Value, true)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionEmailKey, s.Email)))
+	})
+}
+
+func renderSessions(tmpl *template.Template, db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := emailFromRequest(r)
+		list, err := listSessions(db, email)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if c, err := r.Cookie("session"); err == nil {
+			var current int64
+			db.QueryRow("SELECT id FROM sessions WHERE token_hash = ?", hashToken(c.Value)).Scan(&current)
+			for i := range list {
+				list[i].Current = list[i].ID == current
+			}
+		}
+
+		data := struct {
+			Version   string
+			CSRF      string
+			UserEmail string
+			Sessions  []Session
+		}{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: email,
+			Sessions:  list,
+		}
+		if err := tmpl.ExecuteTemplate(w, "sessions.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func sessionRevoke(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := db.Exec("DELETE FROM sessions WHERE id = ? AND email = ?", r.PathValue("id"), emailFromRequest(r)); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not end session", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+	}
+}
+
+// logoutEverywhere ends every session of the user, this one included.
+func logoutEverywhere(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := emailFromRequest(r)
+		if err := endAllSessions(db, email); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not end sessions", http.StatusInternalServerError)
+			return
+		}
+		audit(db, r, email, auditLogoutAll, email, "")
+		http.SetCookie(w, &http.Cookie{Name: "session", Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpServer gives the content tree to SFTP clients, with the accounts, rights
+// and rules of the web UI: it hands every path to the WebDAV file system, which
+// already does all the checking.
+type sftpServer struct {
+	db         *sql.DB
+	dav        *davFS
+	wmr        *watermarker
+	houseRules *terms
+	readOnly   bool
+	allowed    []*net.IPNet
+	denied     []*net.IPNet
+	config     *ssh.ServerConfig
+}
+
+func newSFTPServer(db *sql.DB, directory *ldapAuth, content *contentFS, wmr *watermarker, houseRules *terms, rules uploadRules, config ServerConfig) (*sftpServer, error) {
+	key, err := loadHostKey(config.SFTPHostKey)
+	if err != nil {
+		return nil, fmt.Errorf("sftp host key: %w", err)
+	}
+	s := &sftpServer{db: db, dav: &davFS{db: db, content: content, comments: config.Comments, rules: rules}, wmr: wmr, houseRules: houseRules, readOnly: config.ReadOnly}
+	if s.allowed, err = parseNets(config.Allow); err != nil {
+		return nil, fmt.Errorf("-allow: %w", err)
+	}
+	if s.denied, err = parseNets(config.Deny); err != nil {
+		return nil, fmt.Errorf("-deny: %w", err)
+	}
+
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			login, ip := conn.User(), addrIP(conn.RemoteAddr())
+			if wait, err := loginLockout(db, login, ip); err != nil {
+				log.Printf("login throttle error: %v", err)
+			} else if wait > 0 {
+				return nil, errors.New("too many failed attempts")
+			}
+
+			email := ""
+			if strings.HasPrefix(string(password), "consus_") {
+				if _, email, err = tokenOwner(db, string(password)); errors.Is(err, sql.ErrNoRows) {
+					err = nil
+				}
+			} else {
+				ctx, cancel := context.WithTimeout(context.Background(), config.ExternalTimeout)
+				defer cancel()
+				var user *User
+				if user, err = authenticate(ctx, db, directory, login, string(password)); user != nil {
+					email = user.Email
+				}
+			}
+			if err != nil {
+				log.Printf("login lookup error: %v", err)
+				return nil, errors.New("could not look up user")
+			}
+			if email == "" {
+				if err := recordLoginFailure(db, login, ip); err != nil {
+					log.Printf("%s", err.Error())
+				}
+				auditFrom(db, ip, "", auditLoginFailed, login, "sftp")
+				return nil, errors.New("wrong user name or password")
+			}
+			if err := clearLoginFailures(db, login); err != nil {
+				log.Printf("%s", err.Error())
+			}
+			auditFrom(db, ip, email, auditLogin, email, "sftp")
+			return &ssh.Permissions{Extensions: map[string]string{"email": email}}, nil
+		},
+	}
+	s.config.AddHostKey(key)
+	log.Printf("SFTP: port %d, host key %s", config.SFTPPort, ssh.FingerprintSHA256(key.PublicKey()))
+	return s, nil
+}
+
+// loadHostKey reads the host key of the SFTP server, making one on first
+// start. Clients remember it, so it has to outlive restarts.
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "consus")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := writeFile(path, data, 0o600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+func (s *sftpServer) serve(ctx context.Context, port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+func (s *sftpServer) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	ip := net.ParseIP(addrIP(conn.RemoteAddr()))
+	if ip == nil || containsIP(s.denied, ip) || (len(s.allowed) > 0 && !containsIP(s.allowed, ip)) {
+		log.Printf("refused sftp from %s", ip)
+		return
+	}
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	session := &sftpSession{server: s, email: sconn.Permissions.Extensions["email"], ip: ip.String()}
+	session.ctx = context.WithValue(ctx, tokenEmailKey, session.email)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range requests {
+				// the payload is the length prefixed name of the subsystem
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					handlers := sftp.Handlers{FileGet: session, FilePut: session, FileCmd: session, FileList: session}
+					if err := sftp.NewRequestServer(ch, handlers).Serve(); err != nil && !errors.Is(err, io.EOF) {
+						log.Printf("sftp %s: %v", session.email, err)
+					}
+					return
+				}
+			}
+		}()
+	}
+}
+
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// sftpSession answers the requests of one logged in user.
+type sftpSession struct {
+	server *sftpServer
+	ctx    context.Context
+	email  string
+	ip     string
+}
+
+// mayChange is what the writing routes check: an editor, the house rules
+// accepted and no -read-only.
+func (ss *sftpSession) mayChange() error {
+	s := ss.server
+	if s.readOnly || !roleAtLeast(userRole(s.db, ss.email), roleEditor) {
+		return fs.ErrPermission
+	}
+	if s.houseRules != nil {
+		if ok, err := s.houseRules.accepted(s.db, ss.email); err != nil {
+			return err
+		} else if !ok {
+			return errors.New("accept the terms at /terms first")
+		}
+	}
+	return nil
+}
+
+func (ss *sftpSession) Fileread(r *sftp.Request) (_ io.ReaderAt, err error) {
+	defer func() { err = sftpError(err) }()
+	s := ss.server
+	rel, err := s.dav.resolve(ss.ctx, r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.dav.content.stat(rel)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, errors.New("is a folder")
+	}
+	if s.wmr.defaults.Enabled() && isWatermarkable(rel) && !roleAtLeast(userRole(s.db, ss.email), roleEditor) {
+		// viewers only ever get the review copy
+		data, err := s.wmr.copy(s.dav.content, rel, info, s.wmr.defaults)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+	f, err := s.dav.OpenFile(ss.ctx, r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &seekReaderAt{f: f}, nil
+}
+
+// Filewrite only replaces files whole, like PUT over HTTP. Clients that want to
+// change a file in place or append to it get an error.
+func (ss *sftpSession) Filewrite(r *sftp.Request) (_ io.WriterAt, err error) {
+	defer func() { err = sftpError(err) }()
+	if err := ss.mayChange(); err != nil {
+		return nil, err
+	}
+	flag := os.O_WRONLY | os.O_CREATE
+	if _, err := ss.server.dav.Stat(ss.ctx, r.Filepath); r.Pflags().Trunc || errors.Is(err, fs.ErrNotExist) {
+		flag |= os.O_TRUNC
+	}
+	f, err := ss.server.dav.OpenFile(ss.ctx, r.Filepath, flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	auditFrom(ss.server.db, ss.ip, ss.email, auditFilePut, cleanRel(r.Filepath), "sftp")
+	return f.(io.WriterAt), nil
+}
+
+func (ss *sftpSession) Filecmd(r *sftp.Request) (err error) {
+	defer func() { err = sftpError(err) }()
+	if r.Method == "Setstat" {
+		// times and modes of uploads are up to the server
+		return nil
+	}
+	if err := ss.mayChange(); err != nil {
+		return err
+	}
+	d, rel := ss.server.dav, cleanRel(r.Filepath)
+	var action, detail string
+	switch r.Method {
+	case "Rename":
+		if err := d.Rename(ss.ctx, r.Filepath, r.Target); err != nil {
+			return err
+		}
+		action, detail = auditFileMove, cleanRel(r.Target)
+	case "Remove":
+		rel, _, err := d.writable(ss.ctx, r.Filepath)
+		if err != nil {
+			return err
+		}
+		if err := trashEntry(d.db, d.content, d.comments, rel, ss.email); err != nil {
+			return err
+		}
+		action = auditFileDelete
+	case "Rmdir":
+		// empty, nothing to keep
+		rel, full, err := d.writable(ss.ctx, r.Filepath)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(full); err != nil {
+			return err
+		}
+		if err := dropMetadata(d.db, d.comments, rel); err != nil {
+			return err
+		}
+		action = auditFileDelete
+	case "Mkdir":
+		if err := d.Mkdir(ss.ctx, r.Filepath, 0o755); err != nil {
+			return err
+		}
+		action = auditFolderCreate
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	auditFrom(ss.server.db, ss.ip, ss.email, action, rel, detail)
+	return nil
+}
+
+func (ss *sftpSession) Filelist(r *sftp.Request) (_ sftp.ListerAt, err error) {
+	defer func() { err = sftpError(err) }()
+	d := ss.server.dav
+	switch r.Method {
+	case "List":
+		f, err := d.OpenFile(ss.ctx, r.Filepath, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		infos, err := f.Readdir(-1)
+		return listerAt(infos), err
+	case "Stat":
+		info, err := d.Stat(ss.ctx, r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// sftpError makes clients say "permission denied" rather than "failure" for
+// what the checks refuse.
+func sftpError(err error) error {
+	if errors.Is(err, fs.ErrPermission) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return err
+}
+
+type listerAt []fs.FileInfo
+
+func (l listerAt) ListAt(ls []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// seekReaderAt reads at offsets from a file that can only seek, which is all
+// buckets offer. Clients read in order, so for those it's one GET still.
+type seekReaderAt struct {
+	mu sync.Mutex
+	f  io.ReadSeekCloser
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.f, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *seekReaderAt) Close() error { return s.f.Close() }
@@ -0,0 +1,810 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Share grants anonymous access to a file or folder through /s/{token}/.
+// The capability flags decide what the recipient may do with it.
+type Share struct {
+	Token       string
+	Path        string
+	CreatedBy   string
+	CreatedAt   time.Time
+	CanView     bool
+	CanDownload bool
+	CanComment  bool
+	Watermark   string
+	// Title and Message are shown on a landing page before the content. With
+	// RequireAccept the recipient has to click through it, and that is recorded.
+	Title         string
+	Message       string
+	RequireAccept bool
+	// ExpiresAt is unset for links that live forever. Renewing moves it
+	// LifetimeDays from now.
+	ExpiresAt          sql.NullTime
+	LifetimeDays       int
+	RenewalRequestedAt sql.NullTime
+	RevokedAt          sql.NullTime
+	// PasswordHash is set for links that need a passphrase, entered on the landing page.
+	PasswordHash string
+	// NotifyDownloads tells the creator about every complete download, see
+	// receipts.go. The receipts themselves are kept either way.
+	NotifyDownloads bool
+
+	Downloads     []ShareDownload // the latest, for the shares page
+	DownloadCount int
+}
+
+const shareColumns = "token, path, created_by, created_at, can_view, can_download, can_comment, watermark, title, message, require_accept, " +
+	"expires_at, lifetime_days, renewal_requested_at, revoked_at, password_hash, notify_downloads"
+
+// shareExpiryWarning is how long before expiry the creator gets notified.
+const shareExpiryWarning = 24 * time.Hour
+
+func scanShare(row interface{ Scan(...any) error }) (*Share, error) {
+	var s Share
+	if err := row.Scan(&s.Token, &s.Path, &s.CreatedBy, &s.CreatedAt, &s.CanView, &s.CanDownload, &s.CanComment, &s.Watermark,
+		&s.Title, &s.Message, &s.RequireAccept, &s.ExpiresAt, &s.LifetimeDays, &s.RenewalRequestedAt, &s.RevokedAt, &s.PasswordHash, &s.NotifyDownloads); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func shareByToken(db *sql.DB, token string) (*Share, error) {
+	return scanShare(db.QueryRow("SELECT "+shareColumns+" FROM shares WHERE token = ?", token))
+}
+
+// newShareToken returns a random id followed by its signature, so made up links
+// are turned away before they reach the database.
+func newShareToken(secret []byte) string {
+	id := newSessionToken()[:16]
+	return id + "." + sign(secret, "share", id)[:22]
+}
+
+// validShareToken checks the signature of a token made by newShareToken. Links
+// created before they were signed have no dot and are only looked up.
+func validShareToken(secret []byte, token string) bool {
+	id, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return len(token) == 32
+	}
+	return hmac.Equal([]byte(signature), []byte(sign(secret, "share", id)[:22]))
+}
+
+func createShare(db *sql.DB, secret []byte, s *Share) error {
+	s.Token = newShareToken(secret)
+	s.CreatedAt = time.Now()
+	if s.LifetimeDays > 0 {
+		s.ExpiresAt = sql.NullTime{Time: s.CreatedAt.AddDate(0, 0, s.LifetimeDays), Valid: true}
+	}
+	_, err := db.Exec("INSERT INTO shares ("+shareColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		s.Token, s.Path, s.CreatedBy, s.CreatedAt, s.CanView, s.CanDownload, s.CanComment, s.Watermark,
+		s.Title, s.Message, s.RequireAccept, s.ExpiresAt, s.LifetimeDays, s.RenewalRequestedAt, s.RevokedAt, s.PasswordHash, s.NotifyDownloads)
+	return err
+}
+
+// renewShare pushes the expiry of the share another lifetime into the future.
+func renewShare(db *sql.DB, s *Share) error {
+	s.ExpiresAt = sql.NullTime{Time: time.Now().AddDate(0, 0, s.LifetimeDays), Valid: true}
+	s.RenewalRequestedAt = sql.NullTime{}
+	_, err := db.Exec("UPDATE shares SET expires_at = ?, expiry_notified = FALSE, renewal_requested_at = NULL WHERE token = ?",
+		s.ExpiresAt, s.Token)
+	return err
+}
+
+// notifyExpiringShares tells creators about their links running out within
+// shareExpiryWarning. Every link is only mentioned once per lifetime.
+func notifyExpiringShares(db *sql.DB, n *notifier) error {
+	now := time.Now()
+	rows, err := db.Query(`SELECT token, path, created_by, expires_at FROM shares
+		WHERE expires_at IS NOT NULL AND expires_at > ? AND expires_at < ? AND NOT expiry_notified AND revoked_at IS NULL`,
+		now, now.Add(shareExpiryWarning))
+	if err != nil {
+		return err
+	}
+	var expiring []Share
+	for rows.Next() {
+		var s Share
+		if err := rows.Scan(&s.Token, &s.Path, &s.CreatedBy, &s.ExpiresAt); err != nil {
+			rows.Close()
+			return err
+		}
+		expiring = append(expiring, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// the rows have to be closed first, there is only one connection
+	for _, s := range expiring {
+		if _, err := db.Exec("UPDATE shares SET expiry_notified = TRUE WHERE token = ?", s.Token); err != nil {
+			return err
+		}
+		n.notify(s.CreatedBy, fmt.Sprintf("Your share link for /%s expires on %s", s.Path, s.ExpiresAt.Time.Format("2006-01-02 15:04")),
+			"/shares#share-"+s.Token)
+	}
+	return nil
+}
+
+// watchShareExpiry runs notifyExpiringShares every interval until ctx is done.
+func watchShareExpiry(ctx context.Context, db *sql.DB, n *notifier, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := notifyExpiringShares(db, n); err != nil {
+			log.Printf("share expiry check failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// listShares returns the shares created by email, or every share when all is set.
+func listShares(db *sql.DB, email string, all bool) ([]Share, error) {
+	query := "SELECT " + shareColumns + " FROM shares WHERE created_by = ? OR ? ORDER BY created_at DESC"
+	rows, err := db.Query(query, email, all)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []Share
+	for rows.Next() {
+		s, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, *s)
+	}
+	return shares, rows.Err()
+}
+
+// resolve checks a path below the share root like every path into the content
+// folder, and returns it below the content root. rel is not cleaned first, so
+// a .. in it is refused rather than clamped at the top of the share.
+func (s *Share) resolve(content *contentFS, rel string) (string, error) {
+	return content.resolve(s.Path + "/" + rel)
+}
+
+// id is the public half of the token, safe to show in logs.
+func (s *Share) id() string {
+	id, _, _ := strings.Cut(s.Token, ".")
+	return id
+}
+
+func (s *Share) base() string {
+	return "/s/" + s.Token + "/"
+}
+
+// watermark is what the files of the share are marked with, the share's own
+// text or else the server's.
+func (s *Share) watermark(wmr *watermarker) Watermark {
+	if wm := (Watermark{Text: s.Watermark}); wm.Enabled() {
+		return wm
+	}
+	return wmr.defaults
+}
+
+func (s *Share) expired() bool {
+	return s.ExpiresAt.Valid && time.Now().After(s.ExpiresAt.Time)
+}
+
+func (s *Share) hasLanding() bool {
+	return s.Title != "" || s.Message != "" || s.gated()
+}
+
+// gated reports whether the content stays locked until the landing page is passed.
+func (s *Share) gated() bool {
+	return s.RequireAccept || s.PasswordHash != ""
+}
+
+// entered reports whether the visitor already went through the landing page.
+// The passphrase hash is part of the signature so changing it locks everybody out.
+func (s *Share) entered(r *http.Request, secret []byte) bool {
+	c, err := r.Cookie("entered")
+	return err == nil && verify(secret, c.Value, "entered", s.Token, s.PasswordHash)
+}
+
+func renderShares(tmpl *template.Template, db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := emailFromRequest(r)
+		shares, err := listShares(db, email, roleAtLeast(userRole(db, email), roleAdmin))
+		if err == nil {
+			err = attachDownloads(db, shares)
+		}
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Version   string
+			CSRF      string
+			UserEmail string
+			Shares    []Share
+			NewPath   string
+			Now       time.Time
+		}{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: email,
+			Shares:    shares,
+			NewPath:   r.URL.Query().Get("path"),
+			Now:       time.Now(),
+		}
+		if err := tmpl.ExecuteTemplate(w, "shares.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func shareCreate(db *sql.DB, secret []byte, content *contentFS) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		sharePath, err := content.resolve(r.FormValue("path"))
+		if err != nil {
+			http.Error(w, "nothing to share at that path", http.StatusBadRequest)
+			return
+		}
+		// sharing is handing out access, so only what you can see yourself
+		if ok, err := canAccessPath(db, emailFromRequest(r), sharePath); err != nil || !ok {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if _, err := content.stat(sharePath); err != nil {
+			http.Error(w, "nothing to share at that path", http.StatusBadRequest)
+			return
+		}
+
+		s := &Share{
+			Path:        sharePath,
+			CreatedBy:   emailFromRequest(r),
+			CanView:     r.FormValue("can_view") != "",
+			CanDownload: r.FormValue("can_download") != "",
+			CanComment:  r.FormValue("can_comment") != "",
+			Watermark:   strings.TrimSpace(r.FormValue("watermark")),
+
+			Title:         strings.TrimSpace(r.FormValue("title")),
+			Message:       strings.TrimSpace(r.FormValue("message")),
+			RequireAccept: r.FormValue("require_accept") != "",
+
+			NotifyDownloads: r.FormValue("notify_downloads") != "",
+		}
+		if !s.CanView && !s.CanDownload {
+			http.Error(w, "a share must allow viewing or downloading", http.StatusBadRequest)
+			return
+		}
+		if passphrase := r.FormValue("passphrase"); passphrase != "" {
+			hash, err := hashPassword(passphrase)
+			if err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, "could not create share", http.StatusInternalServerError)
+				return
+			}
+			s.PasswordHash = hash
+		}
+		if days := r.FormValue("expires_days"); days != "" {
+			n, err := strconv.Atoi(days)
+			if err != nil || n < 1 || n > 3650 {
+				http.Error(w, "expiry must be between 1 and 3650 days", http.StatusBadRequest)
+				return
+			}
+			s.LifetimeDays = n
+		}
+
+		if err := createShare(db, secret, s); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not create share", http.StatusInternalServerError)
+			return
+		}
+		audit(db, r, s.CreatedBy, auditShareCreate, s.Path, s.id())
+		http.Redirect(w, r, "/shares", http.StatusSeeOther)
+	}
+}
+
+// shareFromRequest resolves the token in the URL, writing a 404 when it is
+// forged or unknown and a 410 once the link has been revoked.
+func shareFromRequest(w http.ResponseWriter, r *http.Request, db *sql.DB, secret []byte) *Share {
+	token := r.PathValue("token")
+	if !validShareToken(secret, token) {
+		http.NotFound(w, r)
+		return nil
+	}
+	s, err := shareByToken(db, token)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return nil
+	} else if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if s.RevokedAt.Valid {
+		http.Error(w, "this share link has been revoked", http.StatusGone)
+		return nil
+	}
+	return s
+}
+
+// ownedShare is shareFromRequest for the management endpoints, only the creator
+// and admins get past it.
+func ownedShare(w http.ResponseWriter, r *http.Request, db *sql.DB, secret []byte) *Share {
+	s := shareFromRequest(w, r, db, secret)
+	if s == nil {
+		return nil
+	}
+	email := emailFromRequest(r)
+	if s.CreatedBy != email && !roleAtLeast(userRole(db, email), roleAdmin) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil
+	}
+	return s
+}
+
+// shareContent is shareFromRequest for everything behind the landing page: expired
+// links and links that need a passphrase or accepting the message bounce back to it.
+func shareContent(w http.ResponseWriter, r *http.Request, db *sql.DB, secret []byte) *Share {
+	s := shareFromRequest(w, r, db, secret)
+	if s == nil {
+		return nil
+	}
+	if s.expired() {
+		if r.Method == http.MethodGet {
+			http.Redirect(w, r, s.base(), http.StatusSeeOther)
+		} else {
+			http.Error(w, "this share link has expired", http.StatusGone)
+		}
+		return nil
+	}
+	if s.gated() && !s.entered(r, secret) {
+		if r.Method == http.MethodGet {
+			http.Redirect(w, r, s.base(), http.StatusSeeOther)
+		} else {
+			http.Error(w, "please unlock this share first", http.StatusForbidden)
+		}
+		return nil
+	}
+	return s
+}
+
+// shareRoot shows the landing page, or sends the recipient straight to the
+// listing or player of the shared item. Expired links get a page offering to
+// ask the creator for a renewal instead.
+func shareRoot(tmpl *template.Template, db *sql.DB, secret []byte) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := shareFromRequest(w, r, db, secret)
+		if s == nil {
+			return
+		}
+
+		if s.expired() {
+			data := struct {
+				Version   string
+				CSRF      string
+				Share     *Share
+				Requested bool
+			}{
+				Version:   GetVersion(),
+				CSRF:      csrfToken(r),
+				Share:     s,
+				Requested: r.URL.Query().Has("requested"),
+			}
+			w.WriteHeader(http.StatusGone)
+			if err := tmpl.ExecuteTemplate(w, "share_expired.html", data); err != nil {
+				log.Printf("%s", err.Error())
+			}
+			return
+		}
+
+		if s.hasLanding() && !s.entered(r, secret) {
+			renderShareLanding(tmpl, w, r, s, "")
+			return
+		}
+
+		http.Redirect(w, r, s.contentURL(), http.StatusTemporaryRedirect)
+	}
+}
+
+func renderShareLanding(tmpl *template.Template, w http.ResponseWriter, r *http.Request, s *Share, formError string) {
+	data := struct {
+		Version string
+		CSRF    string
+		Share   *Share
+		Error   string
+	}{
+		Version: GetVersion(),
+		CSRF:    csrfToken(r),
+		Share:   s,
+		Error:   formError,
+	}
+	if err := tmpl.ExecuteTemplate(w, "share_landing.html", data); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+func (s *Share) contentURL() string {
+	if s.CanView && isMediaFile(s.Path) {
+		return s.base() + "view/"
+	}
+	return s.base() + "files/"
+}
+
+// shareEnter is the button on the landing page. It checks the passphrase, and
+// accepting the terms is recorded together with whoever clicked it.
+func shareEnter(tmpl *template.Template, db *sql.DB, secret []byte) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := shareFromRequest(w, r, db, secret)
+		if s == nil {
+			return
+		}
+		if s.expired() {
+			http.Error(w, "this share link has expired", http.StatusGone)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		if s.PasswordHash != "" && !checkPassword(s.PasswordHash, r.FormValue("passphrase")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			renderShareLanding(tmpl, w, r, s, "Wrong passphrase, please try again.")
+			return
+		}
+
+		if s.RequireAccept {
+			if r.FormValue("accept") == "" {
+				http.Error(w, "please tick the box to accept the terms", http.StatusBadRequest)
+				return
+			}
+			_, err := db.Exec("INSERT INTO share_acceptances (token, accepted_at, remote_addr, user_agent) VALUES (?, ?, ?, ?)",
+				s.Token, time.Now(), r.RemoteAddr, r.UserAgent())
+			if err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, "could not record acceptance", http.StatusInternalServerError)
+				return
+			}
+			audit(db, r, emailFromRequest(r), auditShareAccept, s.Path, s.id())
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     "entered",
+			Value:    sign(secret, "entered", s.Token, s.PasswordHash),
+			Path:     s.base(),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   30 * 86400,
+		})
+		http.Redirect(w, r, s.contentURL(), http.StatusSeeOther)
+	}
+}
+
+// shareRequestRenewal lets the recipient of an expired link nudge its creator.
+// Requests are only passed on once a day so the button cannot be used to spam.
+func shareRequestRenewal(db *sql.DB, secret []byte, n *notifier) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := shareFromRequest(w, r, db, secret)
+		if s == nil {
+			return
+		}
+		if !s.expired() {
+			http.Redirect(w, r, s.base(), http.StatusSeeOther)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !s.RenewalRequestedAt.Valid || time.Since(s.RenewalRequestedAt.Time) > 24*time.Hour {
+			if _, err := db.Exec("UPDATE shares SET renewal_requested_at = ? WHERE token = ?", time.Now(), s.Token); err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, "could not request renewal", http.StatusInternalServerError)
+				return
+			}
+
+			who := strings.TrimSpace(r.FormValue("name"))
+			if who == "" || len(who) > 64 {
+				who = "Someone"
+			}
+			n.notify(s.CreatedBy, fmt.Sprintf("%s asked to renew the expired share link for /%s", who, s.Path), "/shares#share-"+s.Token)
+		}
+
+		http.Redirect(w, r, s.base()+"?requested", http.StatusSeeOther)
+	}
+}
+
+// shareRenew is the renew button next to a share, available to its creator.
+func shareRenew(db *sql.DB, secret []byte) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := ownedShare(w, r, db, secret)
+		if s == nil {
+			return
+		}
+		if s.LifetimeDays == 0 {
+			http.Error(w, "this share link does not expire", http.StatusBadRequest)
+			return
+		}
+
+		if err := renewShare(db, s); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not renew share", http.StatusInternalServerError)
+			return
+		}
+		audit(db, r, emailFromRequest(r), auditShareRenew, s.Path, s.id())
+		http.Redirect(w, r, "/shares#share-"+s.Token, http.StatusSeeOther)
+	}
+}
+
+// shareRevoke kills a link for good, unlike expiry it cannot be renewed.
+func shareRevoke(db *sql.DB, secret []byte) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := ownedShare(w, r, db, secret)
+		if s == nil {
+			return
+		}
+
+		if _, err := db.Exec("UPDATE shares SET revoked_at = ? WHERE token = ?", time.Now(), s.Token); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not revoke share", http.StatusInternalServerError)
+			return
+		}
+		audit(db, r, emailFromRequest(r), auditShareRevoke, s.Path, s.id())
+		http.Redirect(w, r, "/shares", http.StatusSeeOther)
+	}
+}
+
+// shareFiles mirrors /files/ below the shared path.
+func shareFiles(tmpl *template.Template, db *sql.DB, secret []byte, content *contentFS, wmr *watermarker, listings *meteredCache, scanner *contentScanner, board *announcements, notes *notifier) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := shareContent(w, r, db, secret)
+		if s == nil {
+			return
+		}
+
+		rel := r.PathValue("path")
+		canon, err := s.resolve(content, rel)
+		if errors.Is(err, errLinkRefused) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		info, err := content.stat(canon)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if info.IsDir() {
+			if !s.CanView {
+				http.Error(w, "this share does not allow browsing", http.StatusForbidden)
+				return
+			}
+			data, err := newListView(db, listings, scanner, canon, s.base(), rel)
+			if err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			data.Share = s
+			data.sortFiles(r.URL.Query())
+			data.paginate(r.URL.Query())
+			data.chooseLayout(w, r)
+
+			w.Header().Set("X-Folder-Generation", strconv.FormatInt(data.Generation, 10))
+			if notModified(w, r, pageETag(r, board, data.Generation, data.Files, data.Total, data.CommentCount, data.FolderSizes, s, data.Layout), info.ModTime()) {
+				return
+			}
+			streamTemplate(w, tmpl, "list.html", data)
+			return
+		}
+
+		// streaming media inline only needs view, anything that ends up on disk needs download
+		download := r.URL.Query().Has("download") || !isMediaFile(canon)
+		if download && !s.CanDownload || !download && !s.CanView {
+			http.Error(w, "this share does not allow downloading", http.StatusForbidden)
+			return
+		}
+		if download {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(canon)))
+		} else {
+			w.Header().Set("Content-Disposition", "inline")
+		}
+
+		rw := &receiptWriter{ResponseWriter: w}
+		if wm := s.watermark(wmr); reviewCopyOnly(wm, canon) {
+			wmr.serve(rw, r, content, canon, wm)
+		} else {
+			serveContent(rw, r, content, canon)
+		}
+		if download && rw.complete(r) {
+			recordDownload(db, notes, s, cleanRel(rel), r, rw.written)
+		}
+	}
+}
+
+// shareView mirrors /view/ below the shared path.
+func shareView(tmpl *template.Template, db *sql.DB, secret []byte, commentPath string, content *contentFS, wmr *watermarker, board *announcements) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := shareContent(w, r, db, secret)
+		if s == nil {
+			return
+		}
+		if !s.CanView {
+			http.Error(w, "this share does not allow viewing", http.StatusForbidden)
+			return
+		}
+
+		canon, err := s.resolve(content, r.PathValue("path"))
+		if errors.Is(err, errLinkRefused) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		rel := cleanRel(r.PathValue("path"))
+		data := ItemView{
+			Base:            s.base(),
+			Path:            rel,
+			MimeType:        GetMimeTypeFromFilename(canon),
+			Version:         GetVersion(),
+			CSRF:            csrfToken(r),
+			CommentsEnabled: commentPath != "" && s.CanComment,
+			Share:           s,
+			GuestName:       guestName(r, secret, s),
+			GuestRename:     r.URL.Query().Has("rename"),
+			Checksums:       s.CanDownload && !reviewCopyOnly(s.watermark(wmr), canon),
+		}
+
+		if r.URL.Query().Has("comments") {
+			renderComments(w, r, tmpl, data, filepath.Join(commentPath, filepath.FromSlash(canon)))
+			return
+		}
+		if data.License, err = fileLicense(db, canon); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if notModified(w, r, pageETag(r, board, data.License, data.Checksums, data.CommentsEnabled, data.GuestName, s), time.Time{}) {
+			return
+		}
+		if err := tmpl.ExecuteTemplate(w, "view.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// guestName returns the name the visitor picked for this share, if the signed cookie is intact.
+func guestName(r *http.Request, secret []byte, s *Share) string {
+	c, err := r.Cookie("guest")
+	if err != nil {
+		return ""
+	}
+	encoded, signature, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return ""
+	}
+	name, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !verify(secret, signature, "guest", s.Token, string(name)) {
+		return ""
+	}
+	return string(name)
+}
+
+// shareGuest remembers the guest name for the share it was entered on. The cookie is
+// scoped to the share path, so every link gets its own identity.
+func shareGuest(db *sql.DB, secret []byte) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := shareContent(w, r, db, secret)
+		if s == nil {
+			return
+		}
+		if !s.CanComment {
+			http.Error(w, "this share does not allow commenting", http.StatusForbidden)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("guest"))
+		if name == "" || len(name) > 64 {
+			http.Error(w, "please tell us your name", http.StatusBadRequest)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     "guest",
+			Value:    base64.RawURLEncoding.EncodeToString([]byte(name)) + "." + sign(secret, "guest", s.Token, name),
+			Path:     s.base(),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   365 * 86400,
+		})
+
+		rel := cleanRel(r.FormValue("return"))
+		http.Redirect(w, r, s.base()+"view/"+rel, http.StatusSeeOther)
+	}
+}
+
+// shareComment lets share recipients comment under the guest name they picked.
+func shareComment(db *sql.DB, secret []byte, commentPath string, content *contentFS) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := shareContent(w, r, db, secret)
+		if s == nil {
+			return
+		}
+		if !s.CanComment {
+			http.Error(w, "this share does not allow commenting", http.StatusForbidden)
+			return
+		}
+
+		guest := guestName(r, secret, s)
+		if guest == "" {
+			http.Error(w, "please tell us your name first", http.StatusUnauthorized)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		comment := Commentv1{
+			ID:      newID(),
+			User:    guest + " (guest)",
+			Content: r.FormValue("content"),
+			When:    time.Now(),
+		}
+
+		// comments go with the spelling on disk, like every other way in
+		canon, err := s.resolve(content, r.PathValue("path"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		rel := cleanRel(r.PathValue("path"))
+		if err := addComment(db, commentPath, canon, comment); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(db, r, comment.User, auditCommentAdd, canon, comment.ID+" via "+s.id())
+		events.publish(eventCommentPosted, comment.User, canon, map[string]string{"id": comment.ID, "share": s.Token})
+
+		http.Redirect(w, r, s.base()+"view/"+rel, http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShareCommentsFollowOnDiskSpelling(t *testing.T) {
+	db := testDB(t)
+	c := testContent(t, "Album/Photo.jpg")
+	c.foldCase = true
+	comments := t.TempDir()
+	secret := []byte("secret")
+	s := &Share{Path: "Album", CreatedBy: "ada@example.com", CanView: true, CanComment: true}
+	if err := createShare(db, secret, s); err != nil {
+		t.Fatal(err)
+	}
+	guest := &http.Cookie{Name: "guest", Value: base64.RawURLEncoding.EncodeToString([]byte("Bob")) + "." + sign(secret, "guest", s.Token, "Bob")}
+
+	h := shareComment(db, secret, comments, c)
+	for _, rel := range []string{"photo.JPG", "Photo.jpg"} {
+		form := url.Values{"content": {"nice, " + rel}}
+		r := httptest.NewRequest("POST", "/s/"+s.Token+"/comment/"+rel, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(guest)
+		r.SetPathValue("token", s.Token)
+		r.SetPathValue("path", rel)
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("comment on %s: %d %s", rel, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+
+	got, err := loadComments(filepath.Join(comments, "Album", "Photo.jpg"))
+	if err != nil || len(got) != 2 {
+		t.Errorf("Album/Photo.jpg has %d comments, %v; want both", len(got), err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(comments, "Album")); len(entries) != 1 {
+		t.Errorf("%d comment files for one photo, want 1", len(entries))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Short links, /l/<code>, stand in for long paths in chat and QR codes. They
+// point at the ID of a file or folder rather than its path, so they keep
+// working after a rename or a move. Codes are made up, or picked by whoever
+// makes the link, and are the same in upper and lower case. A short link
+// gives nothing away: whoever follows it needs to be allowed to see what it
+// points at, like with /id/.
+
+var errCodeTaken = errors.New("that code is taken")
+
+// shortCodeLen is how long made up codes are, 32^7 of them.
+const shortCodeLen = 7
+
+func newShortCode() string {
+	b := make([]byte, shortCodeLen)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = strings.ToLower(crockford)[b[i]&31]
+	}
+	return string(b)
+}
+
+// shortCodeProblem tells what is wrong with a code somebody picked, "" if
+// nothing is.
+func shortCodeProblem(code string) string {
+	if len(code) < 3 || len(code) > 64 {
+		return "a code has 3 to 64 characters"
+	}
+	if strings.Trim(code, "abcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		return "a code has only letters, digits, - and _"
+	}
+	return ""
+}
+
+// shortLink is the code of a link to rel, code if it is picked, made up and
+// kept otherwise.
+func shortLink(db *sql.DB, rel, code, email string) (string, error) {
+	id, err := entryID(db, rel)
+	if err != nil {
+		return "", err
+	}
+	if code != "" {
+		res, err := db.Exec("INSERT INTO short_links (code, id, generated, created_by, created_at) VALUES (?, ?, 0, ?, ?) ON CONFLICT (code) DO NOTHING",
+			code, id, email, time.Now())
+		if err != nil {
+			return "", err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			var other string
+			if err := db.QueryRow("SELECT id FROM short_links WHERE code = ?", code).Scan(&other); err != nil || other != id {
+				return "", errCodeTaken
+			}
+		}
+		return code, nil
+	}
+
+	// one made up code per file is enough
+	err = db.QueryRow("SELECT code FROM short_links WHERE id = ? AND generated ORDER BY created_at LIMIT 1", id).Scan(&code)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return code, err
+	}
+	for tries := 0; tries < 5; tries++ {
+		code = newShortCode()
+		res, err := db.Exec("INSERT INTO short_links (code, id, generated, created_by, created_at) VALUES (?, ?, 1, ?, ?) ON CONFLICT (code) DO NOTHING",
+			code, id, email, time.Now())
+		if err != nil {
+			return "", err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			return code, nil
+		}
+	}
+	return "", errors.New("could not find a free code")
+}
+
+// shortLinkRedirect is GET /l/{code}.
+func shortLinkRedirect(db *sql.DB, content *contentFS) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id string
+		err := db.QueryRow("SELECT id FROM short_links WHERE code = ?", strings.ToLower(r.PathValue("code"))).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		redirectToEntry(w, r, db, content, id)
+	}
+}
+
+// shortLinkCreate is POST /links with path= and optionally code=, answering
+// with the code and the link as JSON.
+func shortLinkCreate(db *sql.DB, content *contentFS) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := emailFromRequest(r)
+		canon, err := content.resolve(r.FormValue("path"))
+		if err == nil {
+			_, err = content.stat(canon)
+		}
+		if err != nil {
+			http.Error(w, "no such file or folder", http.StatusNotFound)
+			return
+		}
+		if ok, err := canAccessPath(db, email, canon); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, "no such file or folder", http.StatusNotFound)
+			return
+		}
+		code := strings.ToLower(strings.TrimSpace(r.FormValue("code")))
+		if code != "" {
+			if problem := shortCodeProblem(code); problem != "" {
+				http.Error(w, problem, http.StatusBadRequest)
+				return
+			}
+		}
+
+		code, err = shortLink(db, canon, code, email)
+		if errors.Is(err, errCodeTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"code": code, "link": "/l/" + code})
+	}
+}
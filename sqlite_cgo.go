@@ -0,0 +1,15 @@
+//go:build cgo_sqlite
+
+package main
+
+// mattn/go-sqlite3 wraps the C library. It needs a C toolchain for the target,
+// but is faster on big databases. Both drivers write timestamps the same way,
+// so a database can move between builds.
+
+import _ "github.com/mattn/go-sqlite3"
+
+const sqliteDriver = "sqlite3"
+
+func sqliteDSN(path string) string {
+	return path + "?_foreign_keys=1&_busy_timeout=5000"
+}
@@ -0,0 +1,14 @@
+//go:build !cgo_sqlite
+
+package main
+
+// The default driver is pure Go, so CGO_ENABLED=0 cross-compiles to a static
+// binary for any NAS box. Build with -tags cgo_sqlite for sqlite_cgo.go instead.
+
+import _ "modernc.org/sqlite"
+
+const sqliteDriver = "sqlite"
+
+func sqliteDSN(path string) string {
+	return path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite"
+}
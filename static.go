@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// The pages link the stylesheet, the script and the icons with a hash of
+// their content in the name, style.3f9a1c0b2e.css, worked out at start from
+// what is built in. Those names change with the content, so browsers may keep
+// them for a year without asking again, and a new version of Consus gets its
+// new CSS on the next page without a shift-reload. The plain names still work
+// for anything linking them, but are asked about again every time.
+
+// staticHashLen is how many hex digits of the SHA-256 go into a name.
+const staticHashLen = 10
+
+type staticAsset struct {
+	data []byte
+	hash string
+}
+
+type staticAssets struct {
+	files  map[string]staticAsset // by plain name
+	hashed map[string]string      // fingerprinted name to plain
+}
+
+func loadStaticAssets(dir fs.FS) (*staticAssets, error) {
+	sa := &staticAssets{files: map[string]staticAsset{}, hashed: map[string]string{}}
+	err := fs.WalkDir(dir, "static", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(dir, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		name = strings.TrimPrefix(name, "static/")
+		sa.files[name] = staticAsset{data: data, hash: hex.EncodeToString(sum[:])[:staticHashLen]}
+		sa.hashed[fingerprinted(name, sa.files[name].hash)] = name
+		return nil
+	})
+	return sa, err
+}
+
+// fingerprinted puts hash in name before the extension.
+func fingerprinted(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// url is the link to the asset name for templates, {{ asset "style.css" }}.
+func (sa *staticAssets) url(name string) string {
+	a, ok := sa.files[name]
+	if !ok {
+		return "/static/" + name
+	}
+	return "/static/" + fingerprinted(name, a.hash)
+}
+
+// serve is GET /static/.
+func (sa *staticAssets) serve(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	plain, immutable := sa.hashed[name]
+	if !immutable {
+		plain = name
+	}
+	a, ok := sa.files[plain]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if immutable {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", `"`+a.hash+`"`)
+	http.ServeContent(w, r, plain, time.Time{}, bytes.NewReader(a.data))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+)
+
+// contentStore is what the content tree is read from. Handlers, the content
+// check, search and the caches only read content through contentFS, which
+// hands every path to the store of the root or of its mount, so a bucket, an
+// SFTP server or a zip file can serve as one by implementing it. Names are
+// slash separated and valid for fs.ValidPath, "." being the top. Files from
+// Open should be io.Seekers, or downloads go out whole without ranges.
+//
+// Following symlinks out of the content folder and case-insensitive names are
+// about disks, those checks only apply to content on disk.
+type contentStore interface {
+	fs.StatFS
+	fs.ReadDirFS
+}
+
+// presigner is a store that can hand out links clients fetch a big file with
+// from it directly, instead of through Consus.
+type presigner interface {
+	presign(name string, size int64) string
+}
+
+// diskStore serves the folder dir.
+func diskStore(dir string) contentStore {
+	return os.DirFS(dir).(contentStore)
+}
+
+// storeOf returns the store rel is in and its name there, nil for paths in no
+// store at all.
+func (c *contentFS) storeOf(rel string) (contentStore, string) {
+	if len(c.mounts) == 0 {
+		return c.store, storeName(rel)
+	}
+	m, rest := c.mountOf(rel)
+	if m == nil {
+		return nil, ""
+	}
+	return m.store, storeName(rest)
+}
+
+func storeName(rel string) string {
+	if rel = cleanRel(rel); rel == "" {
+		return "."
+	}
+	return rel
+}
+
+func (c *contentFS) stat(rel string) (fs.FileInfo, error) {
+	if c.virtual(rel) {
+		return virtualRoot{}, nil
+	}
+	store, name := c.storeOf(rel)
+	if store == nil {
+		return nil, &fs.PathError{Op: "stat", Path: rel, Err: fs.ErrNotExist}
+	}
+	return store.Stat(name)
+}
+
+func (c *contentFS) readDir(rel string) ([]fs.DirEntry, error) {
+	if c.virtual(rel) {
+		var entries []fs.DirEntry
+		for _, m := range c.mounts {
+			info, err := m.store.Stat(".")
+			if err != nil {
+				continue
+			}
+			entries = append(entries, mountEntry{fs.FileInfoToDirEntry(info), m.name})
+		}
+		return entries, nil
+	}
+	store, name := c.storeOf(rel)
+	if store == nil {
+		return nil, &fs.PathError{Op: "open", Path: rel, Err: fs.ErrNotExist}
+	}
+	return store.ReadDir(name)
+}
+
+func (c *contentFS) open(rel string) (fs.File, error) {
+	store, name := c.storeOf(rel)
+	if store == nil || c.virtual(rel) {
+		return nil, &fs.PathError{Op: "open", Path: rel, Err: fs.ErrNotExist}
+	}
+	return store.Open(name)
+}
+
+func (c *contentFS) readFile(rel string) ([]byte, error) {
+	store, name := c.storeOf(rel)
+	if store == nil || c.virtual(rel) {
+		return nil, &fs.PathError{Op: "open", Path: rel, Err: fs.ErrNotExist}
+	}
+	return fs.ReadFile(store, name)
+}
+
+// passthrough is the link to fetch the file rel from its store directly, ""
+// when it should go through Consus.
+func (c *contentFS) passthrough(rel string, info fs.FileInfo) string {
+	store, name := c.storeOf(rel)
+	if p, ok := store.(presigner); ok {
+		return p.presign(name, info.Size())
+	}
+	return ""
+}
+
+// key tells rel apart from any other file in any content tree, for caches
+// that are shared between instances.
+func (c *contentFS) key(rel string) string {
+	return c.ident + "\x00" + cleanRel(rel)
+}
+
+// serveContent sends the file rel, with ranges if its store can seek.
+func serveContent(w http.ResponseWriter, r *http.Request, content *contentFS, rel string) {
+	chaosDisk()
+	f, err := content.open(rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", fileETag(info))
+	w = downloads.writer(w, r)
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, info.Name(), info.ModTime(), rs)
+		return
+	}
+	if ctype := mime.TypeByExtension(path.Ext(info.Name())); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+}
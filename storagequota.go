@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every file uploaded, from the listing, resumably, with PUT, over WebDAV or
+// SFTP, is put down in stored_files with who uploaded it. What somebody has
+// there, leaving out what is in the trash, is their storage, which
+// -storage-quota caps for everybody but admins. Admins give single users a
+// quota of their own on the profile page. Moves take the rows along like the
+// rest kept about a path, files gone from the disk are forgotten once a day.
+
+var errStorageQuota = errors.New("that is more than is left of your storage quota")
+
+// notInTrash is the SQL condition for path not being in a trash folder, no
+// upload ever goes to a folder of that name.
+const notInTrash = "instr('/' || path, '/" + trashName + "/') = 0"
+
+// storageUsed is how many bytes of uploads of email are kept.
+func storageUsed(db *sql.DB, email string) (int64, error) {
+	var used int64
+	err := db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM stored_files WHERE email = ? AND "+notInTrash, email).Scan(&used)
+	return used, err
+}
+
+// storageQuota is the quota of email, 0 for no limit, and whether an admin
+// set it rather than -storage-quota.
+func (rules uploadRules) storageQuota(db *sql.DB, email string) (int64, bool, error) {
+	var quota int64
+	err := db.QueryRow("SELECT bytes FROM storage_quotas WHERE email = ?", email).Scan(&quota)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rules.storage, false, nil
+	}
+	return quota, err == nil, err
+}
+
+// storageLeft is how many bytes email may still upload, -1 for no limit.
+// Admins have none.
+func (rules uploadRules) storageLeft(db *sql.DB, email string) (int64, error) {
+	if roleAtLeast(userRole(db, email), roleAdmin) {
+		return -1, nil
+	}
+	quota, _, err := rules.storageQuota(db, email)
+	if err != nil || quota <= 0 {
+		return -1, err
+	}
+	used, err := storageUsed(db, email)
+	return max(quota-used, 0), err
+}
+
+// storageLimit cuts body off at what is left of the storage quota, -1 for no
+// limit.
+func storageLimit(body io.Reader, left int64) io.Reader {
+	if left < 0 {
+		return body
+	}
+	return &sizeLimit{r: body, left: left, err: errStorageQuota}
+}
+
+// countStored puts rel down as uploaded by email, whoever had it before.
+func countStored(db *sql.DB, email, rel string, size int64) {
+	if email == "" {
+		return
+	}
+	if _, err := db.Exec(`INSERT INTO stored_files (path, email, size) VALUES (?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET email = excluded.email, size = excluded.size`, cleanRel(rel), email, size); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+// recountStorage forgets the uploads no longer there and updates the sizes
+// of those changed on the disk.
+func recountStorage(db *sql.DB, content *contentFS) error {
+	rows, err := db.Query("SELECT path, size FROM stored_files")
+	if err != nil {
+		return err
+	}
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var rel string
+		var size int64
+		if err := rows.Scan(&rel, &size); err != nil {
+			rows.Close()
+			return err
+		}
+		sizes[rel] = size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for rel, size := range sizes {
+		info, err := content.stat(rel)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) || err == nil && info.IsDir():
+			_, err = db.Exec("DELETE FROM stored_files WHERE path = ?", rel)
+		case err != nil:
+			// a bucket that can't be reached keeps its uploads
+			continue
+		case info.Size() != size:
+			_, err = db.Exec("UPDATE stored_files SET size = ? WHERE path = ?", info.Size(), rel)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func watchStorage(ctx context.Context, db *sql.DB, content *contentFS, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if err := recountStorage(db, content); err != nil {
+				log.Printf("storage: %v", err)
+			}
+		}
+	}
+}
+
+// StorageUsage is what the profile page tells about somebody's uploads.
+type StorageUsage struct {
+	Used   int64
+	Quota  int64 // 0 for no limit
+	Custom bool  // set by an admin
+	Exempt bool  // an admin, no quota applies
+}
+
+func (u StorageUsage) Percent() int64 {
+	if u.Quota <= 0 {
+		return 0
+	}
+	return min(u.Used*100/u.Quota, 100)
+}
+
+func (rules uploadRules) storageUsage(db *sql.DB, email string) (StorageUsage, error) {
+	var u StorageUsage
+	var err error
+	if u.Used, err = storageUsed(db, email); err != nil {
+		return u, err
+	}
+	u.Quota, u.Custom, err = rules.storageQuota(db, email)
+	u.Exempt = roleAtLeast(userRole(db, email), roleAdmin)
+	return u, err
+}
+
+// userQuotaSubmit is POST /users/{name}/quota with quota=: a size like 50GB,
+// 0 for no limit, or nothing for -storage-quota again.
+func userQuotaSubmit(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		email := name
+		if user, err := userByLogin(db, name); err == nil {
+			email = user.Email
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !isAllowedEmail(name) {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+
+		value := strings.TrimSpace(r.FormValue("quota"))
+		var err error
+		detail := "default"
+		if value == "" {
+			_, err = db.Exec("DELETE FROM storage_quotas WHERE email = ?", email)
+		} else {
+			quota, perr := parseSize(value)
+			if perr != nil || quota < 0 {
+				http.Error(w, fmt.Sprintf("invalid size %q, try 50GB, or 0 for no limit", value), http.StatusBadRequest)
+				return
+			}
+			_, err = db.Exec(`INSERT INTO storage_quotas (email, bytes) VALUES (?, ?)
+				ON CONFLICT (email) DO UPDATE SET bytes = excluded.bytes`, email, quota)
+			detail = strconv.FormatInt(quota, 10)
+		}
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(db, r, emailFromRequest(r), auditStorageQuota, email, detail)
+		http.Redirect(w, r, "/users/"+url.PathEscape(name), http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+const (
+	// flushFirst is about the head and menu of a page, sent before the rest so
+	// the browser fetches the stylesheet and paints while rows are still coming
+	flushFirst = 2 << 10
+	flushEvery = 16 << 10
+)
+
+// streamTemplate renders a page straight to the client, pushing it out in
+// pieces instead of leaving it all in net/http's buffer until the end. The
+// headers are settled before the first byte; once the page is under way a
+// failure can only be logged, the status has gone out already.
+func streamTemplate(w http.ResponseWriter, tmpl *template.Template, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// nginx would otherwise hold the page back until it is complete
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	fw := &flushingWriter{w: w, rc: http.NewResponseController(w), next: flushFirst}
+	if err := tmpl.ExecuteTemplate(fw, name, data); err != nil {
+		log.Printf("%s", err.Error())
+		if fw.written == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+type flushingWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	written int
+	next    int // flush once written gets past this
+}
+
+func (fw *flushingWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.written += n
+	if err == nil && fw.written >= fw.next {
+		fw.next = fw.written + flushEvery
+		// a writer that can't flush only costs the early paint
+		fw.rc.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// terms are the house rules people have to accept before they comment, from
+// -terms. Acceptance is per version: changing the version, or the text when no
+// version was given, asks everybody again. Reading stays open to all.
+type terms struct {
+	Version string
+	Text    string
+}
+
+func loadTerms(path, version string) (*terms, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if version == "" {
+		sum := sha256.Sum256(data)
+		version = hex.EncodeToString(sum[:6])
+	}
+	return &terms{Version: version, Text: string(data)}, nil
+}
+
+func (t *terms) accepted(db *sql.DB, email string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM terms_acceptances WHERE email = ? AND version = ?", email, t.Version).Scan(&n)
+	return n > 0, err
+}
+
+// requireTerms sends logged in users who haven't accepted the current terms
+// to /terms instead of next. Guests of share links are not asked.
+func requireTerms(db *sql.DB, t *terms, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := emailFromRequest(r)
+		if email == "" {
+			next(w, r)
+			return
+		}
+		ok, err := t.accepted(db, email)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			failRequest(w, r, http.StatusInternalServerError, errCodeInternal, "could not check the terms")
+			return
+		}
+		if ok {
+			next(w, r)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+			failRequest(w, r, http.StatusForbidden, errCodeTerms, "accept the terms at /terms first")
+			return
+		}
+		// back to the page the form was on, the comment has to be written again
+		back := "/files/"
+		if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host {
+			back = ref.RequestURI()
+		}
+		http.Redirect(w, r, "/terms?next="+url.QueryEscape(back), http.StatusSeeOther)
+	}
+}
+
+func renderTerms(tmpl *template.Template, db *sql.DB, t *terms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := emailFromRequest(r)
+		accepted := false
+		if email != "" {
+			var err error
+			if accepted, err = t.accepted(db, email); err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		data := struct {
+			Version   string
+			CSRF      string
+			UserEmail string
+			Terms     *terms
+			Accepted  bool
+			Next      string
+		}{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: email,
+			Terms:     t,
+			Accepted:  accepted,
+			Next:      safeRedirect(r.URL.Query().Get("next")),
+		}
+		if err := tmpl.ExecuteTemplate(w, "terms.html", data); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// termsAccept records that the user accepted the version of the terms the form
+// was shown with, a form from before a change doesn't count for the new one.
+func termsAccept(db *sql.DB, t *terms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "could not parse form", http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("version") != t.Version {
+			http.Redirect(w, r, "/terms?next="+url.QueryEscape(safeRedirect(r.FormValue("next"))), http.StatusSeeOther)
+			return
+		}
+		email := emailFromRequest(r)
+		if _, err := db.Exec("INSERT OR IGNORE INTO terms_acceptances (email, version, accepted_at) VALUES (?, ?, ?)",
+			email, t.Version, time.Now()); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not record the acceptance", http.StatusInternalServerError)
+			return
+		}
+		audit(db, r, email, auditTermsAccept, t.Version, "")
+		http.Redirect(w, r, safeRedirect(r.FormValue("next")), http.StatusSeeOther)
+	}
+}
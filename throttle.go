@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	loginFreeAttempts = 5                // failures allowed before the backoff kicks in
+	loginWindow       = 24 * time.Hour   // failures older than this are forgotten
+	loginMaxLockout   = 60 * time.Minute // the backoff never grows beyond this
+)
+
+type LoginFailure struct {
+	Login      string
+	RemoteAddr string
+	At         time.Time
+}
+
+// remoteIP is the client address, as worked out by ipFilter when the request
+// came through it.
+func remoteIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginLockout returns how much longer login attempts from ip or for login are
+// refused. Every failure past loginFreeAttempts doubles the wait, so guessing
+// slows to a crawl while a user with a typo barely notices.
+func loginLockout(db *sql.DB, login, ip string) (time.Duration, error) {
+	var longest time.Duration
+	for _, q := range []struct{ column, value string }{{"login", strings.ToLower(login)}, {"remote_addr", ip}} {
+		where := " FROM login_failures WHERE " + q.column + " = ? AND at > ?"
+		since := time.Now().Add(-loginWindow)
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*)"+where, q.value, since).Scan(&n); err != nil {
+			return 0, err
+		}
+		if n < loginFreeAttempts {
+			continue
+		}
+		var last time.Time
+		if err := db.QueryRow("SELECT at"+where+" ORDER BY at DESC LIMIT 1", q.value, since).Scan(&last); err != nil {
+			return 0, err
+		}
+		lockout := min(time.Minute<<min(n-loginFreeAttempts, 10), loginMaxLockout)
+		if wait := time.Until(last.Add(lockout)); wait > longest {
+			longest = wait
+		}
+	}
+	return longest, nil
+}
+
+func recordLoginFailure(db *sql.DB, login, ip string) error {
+	_, err := db.Exec("INSERT INTO login_failures (login, remote_addr, at) VALUES (?, ?, ?)", strings.ToLower(login), ip, time.Now())
+	return err
+}
+
+// clearLoginFailures forgets the failures for login after it got in, the
+// address keeps its record so one account cannot be used to reset another.
+func clearLoginFailures(db *sql.DB, login string) error {
+	_, err := db.Exec("DELETE FROM login_failures WHERE login = ? OR at < ?", strings.ToLower(login), time.Now().Add(-loginWindow))
+	return err
+}
+
+func listLoginFailures(db *sql.DB) ([]LoginFailure, error) {
+	rows, err := db.Query("SELECT login, remote_addr, at FROM login_failures ORDER BY at DESC LIMIT 100")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures []LoginFailure
+	for rows.Next() {
+		var f LoginFailure
+		if err := rows.Scan(&f.Login, &f.RemoteAddr, &f.At); err != nil {
+			return nil, err
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type APIToken struct {
+	ID         int64
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+}
+
+type contextKey string
+
+const (
+	tokenEmailKey contextKey = "token-email"
+	tokenIDKey    contextKey = "token-id"
+)
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createToken returns the plain token, which is only ever shown once. The table
+// keeps a hash, a leaked database does not leak working credentials.
+func createToken(db *sql.DB, email, name string) (string, error) {
+	token := "consus_" + newSessionToken()
+	_, err := db.Exec(`INSERT INTO api_tokens (user_id, name, hash, created_at)
+		SELECT id, ?, ?, ? FROM users WHERE email = ?`, name, hashToken(token), time.Now(), email)
+	return token, err
+}
+
+func listTokens(db *sql.DB, email string) ([]APIToken, error) {
+	rows, err := db.Query(`SELECT t.id, t.name, t.created_at, t.last_used_at FROM api_tokens t
+		JOIN users u ON u.id = t.user_id WHERE u.email = ? ORDER BY t.created_at DESC`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.Name, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// bearerAuth resolves "Authorization: Bearer <token>" to the owning user, so every
+// handler that asks emailFromRequest sees scripts the same way as browsers.
+// WebDAV clients only speak Basic, they get to send the token as the password.
+func bearerAuth(db *sql.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		challenge := `Bearer realm="Consus"`
+		if _, password, basic := r.BasicAuth(); basic && strings.HasPrefix(password, "consus_") {
+			token, ok = password, true
+			challenge = `Basic realm="Consus", charset="UTF-8"`
+		}
+		if !ok {
+			if strings.HasPrefix(r.URL.Path, "/dav/") {
+				// or clients never ask for the token and stay anonymous
+				w.Header().Set("WWW-Authenticate", `Basic realm="Consus", charset="UTF-8"`)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, email, err := tokenOwner(db, token)
+		if errors.Is(err, sql.ErrNoRows) {
+			w.Header().Set("WWW-Authenticate", challenge)
+			failRequest(w, r, http.StatusUnauthorized, errCodeInvalidToken, "invalid or revoked token")
+			return
+		} else if err != nil {
+			log.Printf("token lookup error: %v", err)
+			failRequest(w, r, http.StatusInternalServerError, errCodeInternal, "could not check token")
+			return
+		}
+		ctx := context.WithValue(r.Context(), tokenEmailKey, email)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, tokenIDKey, id)))
+	})
+}
+
+// tokenOwner returns the id of token and the email of the user it belongs to
+// and marks it used, sql.ErrNoRows for tokens that don't exist (anymore).
+func tokenOwner(db *sql.DB, token string) (int64, string, error) {
+	var id int64
+	var email string
+	err := db.QueryRow(`SELECT t.id, u.email FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.hash = ?`, hashToken(strings.TrimSpace(token))).Scan(&id, &email)
+	if err != nil {
+		return 0, "", err
+	}
+	if _, err := db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", time.Now(), id); err != nil {
+		log.Printf("token bookkeeping error: %v", err)
+	}
+	return id, email, nil
+}
+
+func renderTokens(tmpl *template.Template, db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := emailFromRequest(r)
+		tokens, err := listTokens(db, email)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Version   string
+			CSRF      string
+			UserEmail string
+			Tokens    []APIToken
+			NewToken  string
+		}{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: email,
+			Tokens:    tokens,
+		}
+
+		// a freshly created token is handed over exactly once, via a short lived cookie
+		if c, err := r.Cookie("new_token"); err == nil {
+			data.NewToken = c.Value
+			http.SetCookie(w, &http.Cookie{Name: "new_token", Path: "/tokens", MaxAge: -1})
+		}
+
+		if err := tmpl.ExecuteTemplate(w, "tokens.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func tokenCreate(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			http.Error(w, "give the token a name so you recognise it later", http.StatusBadRequest)
+			return
+		}
+
+		token, err := createToken(db, emailFromRequest(r), name)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not create token", http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     "new_token",
+			Value:    token,
+			Path:     "/tokens",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+			MaxAge:   60,
+		})
+		http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+	}
+}
+
+func tokenRevoke(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid token id", http.StatusBadRequest)
+			return
+		}
+
+		res, err := db.Exec(`DELETE FROM api_tokens WHERE id = ?
+			AND user_id = (SELECT id FROM users WHERE email = ?)`, id, emailFromRequest(r))
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "could not revoke token", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "token not found", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Deleting, from the listing, over WebDAV or SFTP, doesn't destroy anything
+// right away: the file or folder goes to the .trash folder at the top of its
+// tree, its comments and license with it, and the trash table remembers where
+// it was. Admins put it back or throw it away for good at /trash, and
+// -trash-keep empties the trash of what has been there longer.
+const trashName = ".trash"
+
+// trashedTables are the tables whose rows go to the trash with an entry. The
+// access rules stay where it was, a folder made again under the same name is
+// as restricted as the old one.
+var trashedTables = []string{"file_licenses", "shares", "stored_files", "file_checksums", "file_ids"}
+
+var errTrashGone = errors.New("not in the trash (anymore)")
+
+// TrashEntry is something deleted.
+type TrashEntry struct {
+	ID        int64
+	Path      string // where it was
+	IsDir     bool
+	Size      int64 // of a file, 0 for folders
+	DeletedBy string
+	DeletedAt time.Time
+}
+
+// trashRel is where the entry id, deleted from rel, is kept: in the trash of
+// the tree rel was in, under its id and its old name.
+func trashRel(content *contentFS, rel string, id int64) string {
+	top := ""
+	if m, _ := content.mountOf(rel); m != nil {
+		top = m.name
+	}
+	return path.Join(top, trashName, strconv.FormatInt(id, 10), path.Base(rel))
+}
+
+// trashDirs are the trash folders of all trees, which the content check and
+// the watcher leave alone.
+func trashDirs(content *contentFS) []string {
+	var dirs []string
+	for _, d := range content.dirs() {
+		if d.dir != "" {
+			dirs = append(dirs, filepath.Join(d.dir, trashName))
+		}
+	}
+	return dirs
+}
+
+// trashEntry moves rel, a folder with all in it, to the trash, deleted by
+// email.
+func trashEntry(db *sql.DB, content *contentFS, commentPath, rel, email string) error {
+	full, err := changeablePath(content, rel)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(full)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if !info.IsDir() {
+		size = info.Size()
+	}
+	res, err := db.Exec("INSERT INTO trash (path, is_dir, size, deleted_by, deleted_at) VALUES (?, ?, ?, ?, ?)",
+		rel, info.IsDir(), size, email, time.Now())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	to := trashRel(content, rel, id)
+	dest := content.abs(to)
+	if err = os.MkdirAll(filepath.Dir(dest), 0o700); err == nil {
+		err = os.Rename(full, dest)
+	}
+	if err != nil {
+		db.Exec("DELETE FROM trash WHERE id = ?", id)
+		return err
+	}
+	return relocateMetadata(db, commentPath, rel, to, trashedTables)
+}
+
+func trashItem(db *sql.DB, id int64) (TrashEntry, error) {
+	var e TrashEntry
+	err := db.QueryRow("SELECT id, path, is_dir, size, deleted_by, deleted_at FROM trash WHERE id = ?", id).
+		Scan(&e.ID, &e.Path, &e.IsDir, &e.Size, &e.DeletedBy, &e.DeletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return e, errTrashGone
+	}
+	return e, err
+}
+
+func listTrash(db *sql.DB) ([]TrashEntry, error) {
+	rows, err := db.Query("SELECT id, path, is_dir, size, deleted_by, deleted_at FROM trash ORDER BY deleted_at DESC, id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []TrashEntry
+	for rows.Next() {
+		var e TrashEntry
+		if err := rows.Scan(&e.ID, &e.Path, &e.IsDir, &e.Size, &e.DeletedBy, &e.DeletedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// restoreTrash puts entry id back where it was, making the folders missing on
+// the way. Something there under the same name meanwhile is not replaced.
+func restoreTrash(db *sql.DB, content *contentFS, commentPath string, id int64) (TrashEntry, error) {
+	e, err := trashItem(db, id)
+	if err != nil {
+		return e, err
+	}
+	from := trashRel(content, e.Path, id)
+	src, dest := content.abs(from), content.abs(e.Path)
+	if src == "" || dest == "" {
+		// its tree isn't mounted anymore
+		return e, errNotWritable
+	}
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	if _, err := os.Lstat(dest); err == nil {
+		return e, errTaken
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return e, disks.noticed(dest, err)
+	}
+	if err := os.Rename(src, dest); err != nil {
+		return e, err
+	}
+	if err := relocateMetadata(db, commentPath, from, e.Path, trashedTables); err != nil {
+		return e, err
+	}
+	removeTrashFolder(content, commentPath, from)
+	_, err = db.Exec("DELETE FROM trash WHERE id = ?", id)
+	return e, err
+}
+
+// removeTrashFolder removes the folder of the trash entry at rel, in the
+// content and the comments, once it is empty.
+func removeTrashFolder(content *contentFS, commentPath, rel string) {
+	if full := content.abs(rel); full != "" {
+		os.Remove(filepath.Dir(full))
+	}
+	if commentPath != "" {
+		os.Remove(filepath.Dir(filepath.Join(commentPath, filepath.FromSlash(rel))))
+	}
+}
+
+// purgeTrash deletes entry id for good.
+func purgeTrash(db *sql.DB, content *contentFS, commentPath string, id int64) (TrashEntry, error) {
+	e, err := trashItem(db, id)
+	if err != nil {
+		return e, err
+	}
+	from := trashRel(content, e.Path, id)
+	if full := content.abs(from); full != "" {
+		if err := os.RemoveAll(full); err != nil {
+			return e, err
+		}
+	}
+	if err := dropMetadata(db, commentPath, from); err != nil {
+		return e, err
+	}
+	removeTrashFolder(content, commentPath, from)
+	_, err = db.Exec("DELETE FROM trash WHERE id = ?", id)
+	return e, err
+}
+
+// expireTrash purges what was deleted before then and tells how much.
+func expireTrash(db *sql.DB, content *contentFS, commentPath string, before time.Time) (int, error) {
+	rows, err := db.Query("SELECT id FROM trash WHERE deleted_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for i, id := range ids {
+		if _, err := purgeTrash(db, content, commentPath, id); err != nil && !errors.Is(err, errTrashGone) {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
+
+// keepTrash empties the trash of old entries every interval, unless keep is 0.
+func keepTrash(ctx context.Context, db *sql.DB, content *contentFS, commentPath string, keep, interval time.Duration) {
+	if keep <= 0 {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		if n, err := expireTrash(db, content, commentPath, time.Now().Add(-keep)); err != nil {
+			log.Printf("trash: %v", err)
+		} else if n > 0 {
+			log.Printf("trash: purged %d entries deleted more than %s ago", n, keep)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func renderTrash(tmpl *template.Template, db *sql.DB, keep time.Duration) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := listTrash(db)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data := struct {
+			Version   string
+			CSRF      string
+			UserEmail string
+			Entries   []TrashEntry
+			Keep      string // how long entries stay, "" for until purged
+		}{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: emailFromRequest(r),
+			Entries:   list,
+		}
+		switch {
+		case keep <= 0:
+		case keep%(24*time.Hour) == 0:
+			data.Keep = fmt.Sprintf("%d days", keep/(24*time.Hour))
+		default:
+			data.Keep = keep.String()
+		}
+		if err := tmpl.ExecuteTemplate(w, "trash.html", data); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// trashAction is POST /trash/{id}/restore and /trash/{id}/purge.
+func trashAction(db *sql.DB, content *contentFS, commentPath string, restore bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid trash id", http.StatusBadRequest)
+			return
+		}
+		var e TrashEntry
+		action := auditTrashPurge
+		if restore {
+			e, err = restoreTrash(db, content, commentPath, id)
+			action = auditTrashRestore
+		} else {
+			e, err = purgeTrash(db, content, commentPath, id)
+		}
+		if errors.Is(err, errTrashGone) || errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), manageStatus(err))
+			return
+		}
+		audit(db, r, emailFromRequest(r), action, e.Path, "")
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+	}
+}
+
+// trashEmpty is POST /trash/empty, everything in the trash goes for good.
+func trashEmpty(db *sql.DB, content *contentFS, commentPath string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := expireTrash(db, content, commentPath, time.Now().Add(time.Second))
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(db, r, emailFromRequest(r), auditTrashPurge, "", strconv.Itoa(n)+" entries, the whole trash")
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+	}
+}
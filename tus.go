@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads speak tus 1.0.0 (https://tus.io) with the creation,
+// termination and expiration extensions, so any tus client can send a file
+// over a line that keeps dropping. A POST to /upload/dir/ with Tus-Resumable
+// makes the upload, the PATCHes to /uploads/<id> that follow add to it from
+// where the last one stopped.
+const tusVersion = "1.0.0"
+
+// tusUpload is a resumable upload, the bytes so far are in a file of its own
+// under -cache until the last one came in.
+type tusUpload struct {
+	ID        string
+	Email     string
+	Dir       string
+	Name      string
+	Collision string
+	Length    int64
+	ExpiresAt time.Time
+	Done      string // where the file went, once it is complete
+}
+
+type tusStore struct {
+	db      *sql.DB
+	content *contentFS
+	rules   uploadRules
+	dir     string        // where the unfinished uploads are
+	expire  time.Duration // after the last PATCH
+
+	mu   sync.Mutex
+	busy map[string]bool // uploads a PATCH is writing to
+}
+
+func newTusStore(db *sql.DB, content *contentFS, rules uploadRules, dir string, expire time.Duration) (*tusStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &tusStore{db: db, content: content, rules: rules, dir: dir, expire: expire, busy: map[string]bool{}}, nil
+}
+
+// room tells whether there is space for an upload into dir, both for the
+// pieces and for the file once complete.
+func (ts *tusStore) room(dir string) error {
+	if err := disks.room(ts.dir); err != nil {
+		return err
+	}
+	if full := ts.content.abs(dir); full != "" {
+		return disks.room(full)
+	}
+	return nil
+}
+
+func (ts *tusStore) partial(id string) string {
+	return filepath.Join(ts.dir, id+".part")
+}
+
+func (ts *tusStore) load(id, email string) (*tusUpload, error) {
+	u := &tusUpload{}
+	err := ts.db.QueryRow(`SELECT id, email, dir, name, collision, length, expires_at, done_path FROM tus_uploads
+		WHERE id = ? AND email = ? AND expires_at > ?`, id, email, time.Now()).
+		Scan(&u.ID, &u.Email, &u.Dir, &u.Name, &u.Collision, &u.Length, &u.ExpiresAt, &u.Done)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return u, err
+}
+
+// offset is how much of u came in.
+func (ts *tusStore) offset(u *tusUpload) (int64, error) {
+	if u.Done != "" {
+		return u.Length, nil
+	}
+	info, err := os.Stat(ts.partial(u.ID))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func tusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// tusVersionOK refuses clients of another version of the protocol.
+func tusVersionOK(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") == tusVersion {
+		return true
+	}
+	w.Header().Set("Tus-Version", tusVersion)
+	http.Error(w, "only tus "+tusVersion+" is spoken here", http.StatusPreconditionFailed)
+	return false
+}
+
+// parseTusMetadata reads Upload-Metadata, pairs of a key and its value in
+// base64.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s is not base64", key)
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
+
+// options is OPTIONS /uploads/, what a client asks to find out what is
+// supported.
+func (ts *tusStore) options(w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,creation-with-upload,termination,expiration")
+	if ts.rules.maxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(ts.rules.maxSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// create starts an upload into dir. The name comes in the filename (or name)
+// metadata, collision works as for the form.
+func (ts *tusStore) create(w http.ResponseWriter, r *http.Request, db *sql.DB, dir string) {
+	tusHeaders(w)
+	if !tusVersionOK(w, r) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length is needed, uploads of a length told later aren't supported", http.StatusBadRequest)
+		return
+	}
+	if ts.rules.maxSize > 0 && length > ts.rules.maxSize {
+		http.Error(w, errTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := ts.room(dir); err != nil {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if allowance, err := ts.rules.allowance(db, r); err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if allowance >= 0 && length > allowance {
+		http.Error(w, errQuota.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if left, err := ts.rules.storageLeft(db, emailFromRequest(r)); err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if left >= 0 && length > left {
+		http.Error(w, errStorageQuota.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sent := meta["filename"]
+	if sent == "" {
+		sent = meta["name"]
+	}
+	name, status, problem := ts.rules.check(ts.content, dir, sent, meta["collision"])
+	if problem != "" {
+		http.Error(w, problem, status)
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	u := &tusUpload{ID: hex.EncodeToString(b), Email: emailFromRequest(r), Dir: dir, Name: name,
+		Collision: meta["collision"], Length: length, ExpiresAt: time.Now().Add(ts.expire)}
+	f, err := os.OpenFile(ts.partial(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	if _, err := ts.db.Exec(`INSERT INTO tus_uploads (id, email, dir, name, collision, length, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, u.ID, u.Email, u.Dir, u.Name, u.Collision, u.Length, time.Now(), u.ExpiresAt); err != nil {
+		os.Remove(ts.partial(u.ID))
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/uploads/"+u.ID)
+	if r.Header.Get("Content-Type") == "application/offset+octet-stream" {
+		// creation-with-upload, the first chunk comes along
+		if !ts.write(w, r, db, u, 0) {
+			return
+		}
+	} else if length == 0 {
+		if !ts.finish(w, r, db, u) {
+			return
+		}
+	} else {
+		w.Header().Set("Upload-Offset", "0")
+	}
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// upload is HEAD, PATCH and DELETE of /uploads/<id>, only for whoever started
+// it.
+func (ts *tusStore) upload(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tusHeaders(w)
+		if !tusVersionOK(w, r) {
+			return
+		}
+		u, err := ts.load(r.PathValue("id"), emailFromRequest(r))
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if u == nil {
+			http.NotFound(w, r)
+			return
+		}
+		offset, err := ts.offset(u)
+		if err != nil {
+			// the part file is gone, there's nothing to resume
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodHead:
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+			w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+			if u.Done != "" {
+				w.Header().Set("Content-Location", "/files/"+u.Done)
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodPatch:
+			if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+				http.Error(w, "send the bytes as application/offset+octet-stream", http.StatusUnsupportedMediaType)
+				return
+			}
+			if sent, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64); err != nil || sent != offset {
+				w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+				http.Error(w, "Upload-Offset has to be where the upload is", http.StatusConflict)
+				return
+			}
+			if u.Done != "" {
+				w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if !ts.write(w, r, db, u, offset) {
+				return
+			}
+			w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			ts.drop(u.ID)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// write appends the body to u at offset and puts the file in place once it
+// is complete. What came in stays when the connection breaks, the client goes
+// on from there. It returns false when it answered with an error.
+func (ts *tusStore) write(w http.ResponseWriter, r *http.Request, db *sql.DB, u *tusUpload, offset int64) bool {
+	ts.mu.Lock()
+	if ts.busy[u.ID] {
+		ts.mu.Unlock()
+		http.Error(w, "another PATCH is still writing to this upload", http.StatusConflict)
+		return false
+	}
+	ts.busy[u.ID] = true
+	ts.mu.Unlock()
+	defer func() {
+		ts.mu.Lock()
+		delete(ts.busy, u.ID)
+		ts.mu.Unlock()
+	}()
+	if err := ts.room(u.Dir); err != nil {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return false
+	}
+
+	f, err := os.OpenFile(ts.partial(u.ID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	n, err := io.Copy(f, io.LimitReader(r.Body, u.Length-offset))
+	// the offset the client is told has to be there after a crash too
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	err = disks.noticed(f.Name(), err)
+	offset += n
+	u.ExpiresAt = time.Now().Add(ts.expire)
+	if _, err := ts.db.Exec("UPDATE tus_uploads SET expires_at = ? WHERE id = ?", u.ExpiresAt, u.ID); err != nil {
+		log.Printf("%s", err.Error())
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if errors.Is(err, errDiskFull) {
+		http.Error(w, fmt.Errorf("upload stopped at %d: %w", offset, err).Error(), http.StatusInsufficientStorage)
+		return false
+	} else if err != nil {
+		// mostly the client going away, it asks with HEAD where to go on
+		http.Error(w, fmt.Errorf("upload broke off at %d: %w", offset, err).Error(), http.StatusBadRequest)
+		return false
+	}
+	if offset < u.Length {
+		return true
+	}
+	return ts.finish(w, r, db, u)
+}
+
+// finish moves the complete upload into its folder.
+func (ts *tusStore) finish(w http.ResponseWriter, r *http.Request, db *sql.DB, u *tusUpload) bool {
+	f, err := os.Open(ts.partial(u.ID))
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	rel, info, created, err := saveUpload(ts.content, u.Dir, u.Name, u.Collision, f)
+	f.Close()
+	if err != nil {
+		// it won't go better the next time, a taken name stays taken
+		ts.drop(u.ID)
+		http.Error(w, fmt.Sprintf("%s: %s", u.Name, err), uploadStatus(err))
+		return false
+	}
+	os.Remove(ts.partial(u.ID))
+	// kept until it expires, for a client asking after the last answer got lost
+	if _, err := ts.db.Exec("UPDATE tus_uploads SET done_path = ? WHERE id = ?", rel, u.ID); err != nil {
+		log.Printf("%s", err.Error())
+	}
+	u.Done = rel
+	audit(db, r, u.Email, auditFilePut, rel, strconv.FormatInt(info.Size(), 10)+", resumable upload")
+	countUpload(db, u.Email, info.Size())
+	countStored(db, u.Email, rel, info.Size())
+	if created {
+		events.publish(eventFileAdded, u.Email, rel, nil)
+	} else {
+		events.publish(eventFileWritten, u.Email, rel, nil)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Content-Location", "/files/"+rel)
+	w.Header().Set("ETag", fileETag(info))
+	return true
+}
+
+func (ts *tusStore) drop(id string) {
+	if _, err := ts.db.Exec("DELETE FROM tus_uploads WHERE id = ?", id); err != nil {
+		log.Printf("%s", err.Error())
+	}
+	os.Remove(ts.partial(id))
+}
+
+// run throws away the uploads nobody went on with for -upload-expiry, part
+// files left without an upload by a crash and the quotas of past days, every
+// interval until ctx is done.
+func (ts *tusStore) run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		if err := ts.cleanup(); err != nil {
+			log.Printf("resumable uploads: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (ts *tusStore) cleanup() error {
+	if _, err := ts.db.Exec("DELETE FROM upload_usage WHERE day < ?", usageDay(time.Now())); err != nil {
+		return err
+	}
+	rows, err := ts.db.Query("SELECT id FROM tus_uploads WHERE expires_at <= ?", time.Now())
+	if err != nil {
+		return err
+	}
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range expired {
+		ts.drop(id)
+	}
+
+	entries, err := os.ReadDir(ts.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".part")
+		if !ok {
+			continue
+		}
+		var known int
+		if err := ts.db.QueryRow("SELECT COUNT(*) FROM tus_uploads WHERE id = ?", id).Scan(&known); err != nil {
+			return err
+		}
+		if info, err := e.Info(); known == 0 && err == nil && time.Since(info.ModTime()) > ts.expire {
+			os.Remove(filepath.Join(ts.dir, e.Name()))
+		}
+	}
+	if len(expired) > 0 {
+		log.Printf("resumable uploads: dropped %d expired", len(expired))
+	}
+	return nil
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileETag is what clients compare versions of a file by. Size and mtime like
+// most servers, hashing big files on every listing would be too slow. On disks
+// with coarse mtimes two writes of the same size within one tick look the same.
+func fileETag(info fs.FileInfo) string {
+	return `"` + strconv.FormatInt(info.Size(), 36) + "-" + strconv.FormatInt(info.ModTime().UnixNano(), 36) + `"`
+}
+
+// etagListed tells whether header, an If-Match or If-None-Match list, names
+// etag. "*" names every version, but no missing file.
+func etagListed(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		if t = strings.TrimSpace(t); t == "*" || t == etag {
+			return etag != ""
+		}
+	}
+	return false
+}
+
+// preconditionsHold checks If-Match and If-None-Match of a write against the
+// file as it is now, info is nil if there is none yet. A client that read a
+// version sends its ETag in If-Match and gets a 412 once somebody else changed
+// it, If-None-Match: * only creates.
+func preconditionsHold(r *http.Request, info fs.FileInfo) bool {
+	etag := ""
+	if info != nil {
+		etag = fileETag(info)
+	}
+	if h := r.Header.Get("If-Match"); h != "" && !etagListed(h, etag) {
+		return false
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" && etagListed(h, etag) {
+		return false
+	}
+	return true
+}
+
+// writeLock makes checking the preconditions and putting the file in place
+// one step. Another instance on the same folder can still slip in between.
+var writeLock sync.Mutex
+
+var (
+	errNotWritable  = errors.New("this folder is read only")
+	errNoParent     = errors.New("the folder to put it in doesn't exist")
+	errIsFolder     = errors.New("that is a folder")
+	errPrecondition = errors.New("the file changed in the meantime")
+)
+
+// writeContent replaces the file rel with what body holds, or creates it. The
+// new version is written next to it and renamed over, nobody downloads half a
+// file. allowed is asked about the file there is now, nil if none, before a
+// byte is read and again before the rename, somebody may have changed it
+// while body came in. It returns the new file and whether it is new,
+// errPrecondition when allowed said no.
+func writeContent(content *contentFS, rel string, body io.Reader, allowed func(old fs.FileInfo) bool) (fs.FileInfo, bool, error) {
+	p, err := receiveContent(content, rel, body, allowed)
+	if err != nil {
+		return nil, false, err
+	}
+	info, created, err := placeContent(p, allowed)
+	if err != nil {
+		p.abort()
+	}
+	return info, created, err
+}
+
+// receiveContent writes body into a new version of rel, flushed and ready
+// for placeContent. Nothing is locked meanwhile, a slow client only holds up
+// itself.
+func receiveContent(content *contentFS, rel string, body io.Reader, allowed func(old fs.FileInfo) bool) (*pendingFile, error) {
+	full := content.abs(rel)
+	if full == "" || content.virtual(rel) {
+		return nil, errNotWritable
+	}
+	if content.linkRefused(path.Dir(rel)) {
+		return nil, errLinkRefused
+	}
+	dir, err := content.stat(path.Dir(rel))
+	if err != nil || !dir.IsDir() {
+		return nil, errNoParent
+	}
+
+	chaosDisk()
+	old, err := existingFile(full)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed(old) {
+		return nil, errPrecondition
+	}
+	if err := disks.room(full); err != nil {
+		return nil, err
+	}
+
+	mode := fs.FileMode(0o644)
+	if old != nil {
+		mode = old.Mode().Perm()
+	}
+	p, err := newPendingFile(full, mode)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(p, body); err != nil {
+		p.abort()
+		return nil, disks.noticed(full, err)
+	}
+	if err := p.flush(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// placeContent renames p over its destination if allowed still agrees with
+// the file there now. On errPrecondition p is left for the caller to put
+// elsewhere or abort.
+func placeContent(p *pendingFile, allowed func(old fs.FileInfo) bool) (fs.FileInfo, bool, error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	old, err := existingFile(p.dest)
+	if err != nil {
+		return nil, false, err
+	}
+	if !allowed(old) {
+		return nil, false, errPrecondition
+	}
+	if err := p.place(); err != nil {
+		return nil, false, err
+	}
+	info, err := os.Stat(p.dest)
+	return info, old == nil, err
+}
+
+// existingFile is the file at full, nil if there is none.
+func existingFile(full string) (fs.FileInfo, error) {
+	old, err := os.Stat(full)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case old.IsDir():
+		return nil, errIsFolder
+	}
+	return old, nil
+}
+
+// writeStatus is the response to a failed writeContent.
+func writeStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotWritable):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, errNoParent), errors.Is(err, errIsFolder):
+		return http.StatusConflict
+	case errors.Is(err, errPrecondition):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errEscape):
+		return http.StatusNotFound
+	case errors.Is(err, errLinkRefused):
+		return http.StatusForbidden
+	case errors.Is(err, errDiskFull):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// filePut is PUT /files/: upload a file with the request body, for scripts
+// with an API token. Send If-Match with the ETag of the download it started
+// from so a change somebody else made in between isn't overwritten.
+func filePut(db *sql.DB, content *contentFS, rules uploadRules) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		putContent(w, r, db, content, rules, strings.TrimPrefix(r.URL.Path, "/files/"))
+	}
+}
+
+// putContent answers an upload of rel, from /files/ or WebDAV.
+func putContent(w http.ResponseWriter, r *http.Request, db *sql.DB, content *contentFS, rules uploadRules, rel string) {
+	if rel == "" || strings.HasSuffix(rel, "/") {
+		http.Error(w, "PUT needs a file name", http.StatusBadRequest)
+		return
+	}
+	// the same rules as the upload form, a PUT is just another way in
+	if _, status, problem := rules.check(content, path.Dir(cleanRel(rel)), path.Base(rel), "replace"); problem != "" {
+		http.Error(w, problem, status)
+		return
+	}
+	email := emailFromRequest(r)
+	allowance, err := rules.allowance(db, r)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	left, err := rules.storageLeft(db, email)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	body := rules.limit(storageLimit(r.Body, left), allowance)
+	info, created, err := writeContent(content, rel, body, func(old fs.FileInfo) bool { return preconditionsHold(r, old) })
+	if err != nil {
+		http.Error(w, err.Error(), uploadStatus(err))
+		return
+	}
+	audit(db, r, email, auditFilePut, rel, strconv.FormatInt(info.Size(), 10))
+	countUpload(db, email, info.Size())
+	countStored(db, email, rel, info.Size())
+	w.Header().Set("ETag", fileETag(info))
+	if created {
+		events.publish(eventFileAdded, email, rel, nil)
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		events.publish(eventFileWritten, email, rel, nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// uploadRules are what POST /upload/ takes.
+type uploadRules struct {
+	maxSize    int64           // per file, 0 for any size
+	extensions map[string]bool // lower case with the dot, empty for any
+	quota      int64           // bytes per user and day (UTC), 0 for no limit
+	storage    int64           // bytes kept per user, unless an admin set another, 0 for no limit
+}
+
+func parseUploadRules(maxSize, extensions, quota, storage string) (uploadRules, error) {
+	var rules uploadRules
+	if maxSize != "" {
+		n, err := parseSize(maxSize)
+		if err != nil || n <= 0 {
+			return rules, fmt.Errorf("-upload-max-size: invalid size %q", maxSize)
+		}
+		rules.maxSize = n
+	}
+	if quota != "" {
+		n, err := parseSize(quota)
+		if err != nil || n <= 0 {
+			return rules, fmt.Errorf("-upload-quota: invalid size %q", quota)
+		}
+		rules.quota = n
+	}
+	if storage != "" {
+		n, err := parseSize(storage)
+		if err != nil || n < 0 {
+			return rules, fmt.Errorf("-storage-quota: invalid size %q", storage)
+		}
+		rules.storage = n
+	}
+	for _, ext := range strings.Split(extensions, ",") {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if rules.extensions == nil {
+			rules.extensions = map[string]bool{}
+		}
+		rules.extensions[ext] = true
+	}
+	return rules, nil
+}
+
+var (
+	errTooLarge     = errors.New("the file is larger than uploads may be")
+	errBadExtension = errors.New("files of this type can't be uploaded")
+	errExists       = errors.New("a file of that name is there already")
+	errQuota        = errors.New("that is more than is left of your upload quota for today")
+)
+
+// sizeLimit fails a read past max bytes with err, so writeContent throws the
+// file away.
+type sizeLimit struct {
+	r    io.Reader
+	left int64
+	err  error
+}
+
+func (l *sizeLimit) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, l.err
+	}
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	if l.left -= int64(n); l.left < 0 {
+		return n, l.err
+	}
+	return n, err
+}
+
+// limit cuts the upload body off at the size limit, or at what is left of the
+// quota if that is less. allowance is -1 without a quota.
+func (rules uploadRules) limit(body io.Reader, allowance int64) io.Reader {
+	most, err := rules.most(allowance)
+	if most < 0 {
+		return body
+	}
+	return &sizeLimit{r: body, left: most, err: err}
+}
+
+// most is how large a file may be with allowance left of the quota, and the
+// error past that; -1 for any size.
+func (rules uploadRules) most(allowance int64) (int64, error) {
+	switch {
+	case allowance >= 0 && (rules.maxSize == 0 || allowance < rules.maxSize):
+		return allowance, errQuota
+	case rules.maxSize > 0:
+		return rules.maxSize, errTooLarge
+	}
+	return -1, nil
+}
+
+// allowance is how many bytes whoever sent r may still upload today, -1 for
+// no limit. Admins have none.
+func (rules uploadRules) allowance(db *sql.DB, r *http.Request) (int64, error) {
+	return rules.allowanceOf(db, emailFromRequest(r))
+}
+
+// allowanceOf is allowance for email, who isn't behind a request.
+func (rules uploadRules) allowanceOf(db *sql.DB, email string) (int64, error) {
+	if rules.quota <= 0 || roleAtLeast(userRole(db, email), roleAdmin) {
+		return -1, nil
+	}
+	var used int64
+	err := db.QueryRow("SELECT COALESCE(SUM(bytes), 0) FROM upload_usage WHERE day = ? AND email = ?",
+		usageDay(time.Now()), email).Scan(&used)
+	return max(rules.quota-used, 0), err
+}
+
+// countUpload adds a file email uploaded to their quota of today.
+func countUpload(db *sql.DB, email string, size int64) {
+	if _, err := db.Exec(`INSERT INTO upload_usage (day, email, bytes) VALUES (?, ?, ?)
+		ON CONFLICT (day, email) DO UPDATE SET bytes = bytes + excluded.bytes`, usageDay(time.Now()), email, size); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+// uploadName is the file name a browser sent, without the folders some put in
+// front, or "" with why it can't be one here.
+func uploadName(content *contentFS, dir, sent string) (string, string) {
+	name := path.Base(strings.ReplaceAll(sent, "\\", "/"))
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "", "no file name"
+	}
+	if content.ignore.hiddenEntry(path.Join(dir, name), false) {
+		return "", "name would be hidden"
+	}
+	if problem := urlNameProblem(name); problem != "" {
+		return "", problem
+	}
+	return name, ""
+}
+
+// renamed is the n-th name tried for an upload colliding with a file there,
+// photo.jpg becoming "photo (2).jpg".
+func renamed(name string, n int) string {
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// check tells whether a file called sent may be uploaded into dir, and what
+// it is called there. If not, it returns the status and why.
+func (rules uploadRules) check(content *contentFS, dir, sent, collision string) (string, int, string) {
+	switch collision {
+	case "", "rename", "replace", "refuse":
+	default:
+		return "", http.StatusBadRequest, "collision is rename, replace or refuse"
+	}
+	name, problem := uploadName(content, dir, sent)
+	if problem != "" {
+		return "", http.StatusBadRequest, fmt.Sprintf("%q: %s", sent, problem)
+	}
+	if len(rules.extensions) > 0 && !rules.extensions[strings.ToLower(path.Ext(name))] {
+		return "", http.StatusUnsupportedMediaType, fmt.Sprintf("%s: %s", name, errBadExtension)
+	}
+	return name, 0, ""
+}
+
+// saveUpload writes body as the file name in dir, handling a name that is
+// taken the way collision says. It returns where the file went.
+func saveUpload(content *contentFS, dir, name, collision string, body io.Reader) (string, fs.FileInfo, bool, error) {
+	rel, n := path.Join(dir, name), 1
+	allowed := func(old fs.FileInfo) bool { return old == nil || collision == "replace" }
+	// a taken name gets a number, before the file comes in and again if
+	// somebody took it while it did
+	next := func(err error) bool {
+		if !errors.Is(err, errPrecondition) || (collision != "" && collision != "rename") || n == 100 {
+			return false
+		}
+		n++
+		rel = path.Join(dir, renamed(name, n))
+		allowed = func(old fs.FileInfo) bool { return old == nil }
+		return true
+	}
+	p, err := receiveContent(content, rel, body, allowed)
+	for next(err) {
+		p, err = receiveContent(content, rel, body, allowed)
+	}
+	var info fs.FileInfo
+	var created bool
+	if err == nil {
+		info, created, err = placeContent(p, allowed)
+		for next(err) {
+			p.dest = content.abs(rel)
+			info, created, err = placeContent(p, allowed)
+		}
+		if err != nil {
+			p.abort()
+		}
+	}
+	if errors.Is(err, errPrecondition) {
+		err = errExists
+	}
+	return rel, info, created, err
+}
+
+// uploadStatus is the response to a failed saveUpload.
+func uploadStatus(err error) int {
+	status := writeStatus(err)
+	switch {
+	case errors.Is(err, errTooLarge), errors.Is(err, errQuota), errors.Is(err, errStorageQuota):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, errExists):
+		status = http.StatusConflict
+	case status == http.StatusInternalServerError:
+		log.Printf("%s", err.Error())
+	}
+	return status
+}
+
+// UploadedFile is a file of an upload, as answered to scripts.
+type UploadedFile struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	ETag  string `json:"etag,omitempty"`
+	Error string `json:"error,omitempty"` // with X-Upload-Id, why this one failed
+}
+
+// fileUpload is POST /upload/dir/: the files of a multipart form into dir, from
+// the form of the listing or a script. A name taken already gets a number
+// added, unless collision=replace or collision=refuse, which gets a 409. Put
+// collision in the query or the form before the files. The files are
+// streamed, none larger than -upload-max-size or what is left of the
+// uploader's -upload-quota and storage quota gets written. Browsers are sent back to the
+// listing, anybody else gets the files as JSON. With Tus-Resumable it starts a
+// resumable upload instead.
+//
+// With an X-Upload-Id the progress of every file can be followed at
+// /uploads/progress/<id> meanwhile, and a file that fails doesn't stop the
+// ones after it: the answer tells what became of each.
+func fileUpload(db *sql.DB, content *contentFS, rules uploadRules, resumable *tusStore, tracker *uploadTracker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dir := cleanRel(strings.TrimPrefix(r.URL.Path, "/upload/"))
+		if info, err := content.stat(dir); err != nil || !info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Tus-Resumable") != "" {
+			resumable.create(w, r, db, dir)
+			return
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "send the files as multipart/form-data", http.StatusBadRequest)
+			return
+		}
+		collision := r.URL.Query().Get("collision")
+		email := emailFromRequest(r)
+		id := r.Header.Get("X-Upload-Id")
+		if id != "" {
+			if !validUploadID(id) {
+				http.Error(w, "X-Upload-Id is up to 64 letters, digits, - and _", http.StatusBadRequest)
+				return
+			}
+			if !tracker.start(id, email) {
+				http.Error(w, "an upload with that X-Upload-Id is still running", http.StatusConflict)
+				return
+			}
+			defer tracker.end(id)
+		}
+
+		var uploaded []UploadedFile
+		failed := 0 // status of the first file that failed
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, fmt.Errorf("could not read upload: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+			if part.FileName() == "" {
+				if part.FormName() == "collision" {
+					value, _ := io.ReadAll(io.LimitReader(part, 16))
+					collision = string(value)
+				}
+				continue
+			}
+			n := -1
+			var body io.Reader = part
+			if id != "" {
+				n = tracker.file(id, part.FileName())
+				body = tracker.reader(id, n, part)
+			}
+			// fail ends the upload with status, or with X-Upload-Id only this
+			// file of it
+			fail := func(status int, err error) bool {
+				if id == "" {
+					http.Error(w, err.Error(), status)
+					return false
+				}
+				tracker.update(id, n, "failed", err)
+				uploaded = append(uploaded, UploadedFile{Name: part.FileName(), Error: err.Error()})
+				if failed == 0 {
+					failed = status
+				}
+				return true
+			}
+
+			name, status, problem := rules.check(content, dir, part.FileName(), collision)
+			if problem != "" {
+				if !fail(status, errors.New(problem)) {
+					return
+				}
+				continue
+			}
+			allowance, err := rules.allowance(db, r)
+			if err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			left, err := rules.storageLeft(db, email)
+			if err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			rel, info, created, err := saveUpload(content, dir, name, collision, rules.limit(storageLimit(body, left), allowance))
+			if err != nil {
+				if !fail(uploadStatus(err), fmt.Errorf("%s: %w", name, err)) {
+					return
+				}
+				continue
+			}
+			audit(db, r, email, auditFilePut, rel, strconv.FormatInt(info.Size(), 10)+", upload")
+			countUpload(db, email, info.Size())
+			countStored(db, email, rel, info.Size())
+			if created {
+				events.publish(eventFileAdded, email, rel, nil)
+			} else {
+				events.publish(eventFileWritten, email, rel, nil)
+			}
+			if id != "" {
+				tracker.update(id, n, "saved", nil)
+			}
+			uploaded = append(uploaded, UploadedFile{Name: path.Base(rel), Size: info.Size(), ETag: fileETag(info)})
+		}
+		if len(uploaded) == 0 {
+			http.Error(w, "pick the files to upload first", http.StatusBadRequest)
+			return
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			back := "/files/"
+			if dir != "" {
+				back += dir + "/"
+			}
+			http.Redirect(w, r, (&url.URL{Path: back}).String(), http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if failed != 0 {
+			w.WriteHeader(failed)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(uploaded)
+	}
+}
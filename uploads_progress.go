@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// uploadsKeep is how long the progress of an upload can be asked for after
+// its answer went out, for a page polling a little behind.
+const uploadsKeep = 5 * time.Minute
+
+// uploadTracker follows the uploads sent with an X-Upload-Id, which is how the
+// listing uploads dropped files: the page asks how far the server got with
+// every one while it sends them.
+type uploadTracker struct {
+	mu      sync.Mutex
+	uploads map[string]*trackedUpload
+}
+
+type trackedUpload struct {
+	email string
+	ended time.Time      // zero while it runs
+	Done  bool           `json:"done"`
+	Files []FileProgress `json:"files"`
+}
+
+// FileProgress is a file of an upload, in the order they were sent.
+type FileProgress struct {
+	Name     string `json:"name"`
+	Received int64  `json:"received"`        // bytes written so far
+	State    string `json:"state"`           // receiving, saved or failed
+	Error    string `json:"error,omitempty"` // why it failed
+}
+
+func newUploadTracker() *uploadTracker {
+	return &uploadTracker{uploads: map[string]*trackedUpload{}}
+}
+
+// validUploadID keeps what clients make up as ids short and plain.
+func validUploadID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// start begins following the upload id of email, false if one of that id is
+// still running.
+func (t *uploadTracker) start(id, email string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, u := range t.uploads {
+		if !u.ended.IsZero() && time.Since(u.ended) > uploadsKeep {
+			delete(t.uploads, k)
+		}
+	}
+	if u, ok := t.uploads[id]; ok && u.ended.IsZero() {
+		return false
+	}
+	t.uploads[id] = &trackedUpload{email: email, Files: []FileProgress{}}
+	return true
+}
+
+// file adds the next file of the upload id and returns its number.
+func (t *uploadTracker) file(id, name string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.uploads[id]
+	u.Files = append(u.Files, FileProgress{Name: name, State: "receiving"})
+	return len(u.Files) - 1
+}
+
+// update sets what became of file n of the upload id.
+func (t *uploadTracker) update(id string, n int, state string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := &t.uploads[id].Files[n]
+	f.State = state
+	if err != nil {
+		f.Error = err.Error()
+	}
+}
+
+func (t *uploadTracker) end(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.uploads[id]
+	u.Done, u.ended = true, time.Now()
+}
+
+// reader counts what is read of body towards file n of the upload id.
+func (t *uploadTracker) reader(id string, n int, body io.Reader) io.Reader {
+	return &progressReader{r: body, t: t, id: id, n: n}
+}
+
+type progressReader struct {
+	r  io.Reader
+	t  *uploadTracker
+	id string
+	n  int
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.t.mu.Lock()
+	p.t.uploads[p.id].Files[p.n].Received += int64(n)
+	p.t.mu.Unlock()
+	return n, err
+}
+
+// uploadProgress is GET /uploads/progress/<id>: the files of an upload so far,
+// only for whoever sends it.
+func uploadProgress(t *uploadTracker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		u, ok := t.uploads[r.PathValue("id")]
+		if !ok || u.email != emailFromRequest(r) {
+			t.mu.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		data, err := json.Marshal(u)
+		t.mu.Unlock()
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(data)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// meanwhile is a body that has something else happen while it is read.
+type meanwhile struct {
+	io.Reader
+	then func()
+}
+
+func (m *meanwhile) Read(b []byte) (int, error) {
+	if m.then != nil {
+		m.then()
+		m.then = nil
+	}
+	return m.Reader.Read(b)
+}
+
+func TestWriteContentWhileAnotherWrites(t *testing.T) {
+	c := testContent(t, "up/")
+	created := func(old fs.FileInfo) bool { return old == nil }
+
+	// a second upload finishes while the first is still coming in
+	body := &meanwhile{Reader: strings.NewReader("slow"), then: func() {
+		if _, _, err := writeContent(c, "up/b.txt", strings.NewReader("fast"), created); err != nil {
+			t.Errorf("write next to a running one: %v", err)
+		}
+		if _, _, err := writeContent(c, "up/a.txt", strings.NewReader("first"), created); err != nil {
+			t.Errorf("write of the same name: %v", err)
+		}
+	}}
+	if _, _, err := writeContent(c, "up/a.txt", body, created); !errors.Is(err, errPrecondition) {
+		t.Errorf("writeContent of a name taken meanwhile = %v, want %v", err, errPrecondition)
+	}
+	for name, want := range map[string]string{"a.txt": "first", "b.txt": "fast"} {
+		if got, _ := os.ReadFile(filepath.Join(c.root, "up", name)); string(got) != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(c.root, "up")); len(entries) != 2 {
+		t.Errorf("up holds %d entries, want the 2 files and no leftovers", len(entries))
+	}
+}
+
+func TestSaveUploadRenamesWhenTakenMeanwhile(t *testing.T) {
+	c := testContent(t, "up/")
+	body := &meanwhile{Reader: strings.NewReader("mine"), then: func() {
+		if err := os.WriteFile(filepath.Join(c.root, "up", "a.txt"), []byte("theirs"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	rel, _, created, err := saveUpload(c, "up", "a.txt", "rename", body)
+	if err != nil || rel != "up/a (2).txt" || !created {
+		t.Fatalf("saveUpload = %q, %v, %v; want up/a (2).txt", rel, created, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(c.root, "up", "a (2).txt")); string(got) != "mine" {
+		t.Errorf("a (2).txt holds %q", got)
+	}
+
+	body = &meanwhile{Reader: strings.NewReader("mine"), then: func() {
+		os.WriteFile(filepath.Join(c.root, "up", "b.txt"), []byte("theirs"), 0o644)
+	}}
+	if _, _, _, err := saveUpload(c, "up", "b.txt", "refuse", body); !errors.Is(err, errExists) {
+		t.Errorf("saveUpload refusing a name taken meanwhile = %v, want %v", err, errExists)
+	}
+}
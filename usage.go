@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// usageFlush is how often the counts go to the database, what a crash
+	// loses at most
+	usageFlush = time.Minute
+	usageKeep  = 90 // days
+)
+
+// apiMeter counts the calls of every client of the API per day: requests under
+// /api/ and anything sent with an API token, the way scripts talk to Consus.
+// Clients are the token, else the account, else the address. With a quota,
+// a client past it gets 429s until midnight UTC.
+type apiMeter struct {
+	db    *sql.DB
+	quota int64 // calls per client and day, 0 for no limit
+
+	mu      sync.Mutex
+	day     string
+	counts  map[string]int64 // today, including what is in the database
+	pending map[string]int64 // not in the database yet
+}
+
+func newAPIMeter(db *sql.DB, quota int64) (*apiMeter, error) {
+	m := &apiMeter{db: db, quota: quota}
+	// counts of today survive a restart, or a restart would reset the quota
+	if err := m.load(usageDay(time.Now())); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+func (m *apiMeter) load(day string) error {
+	counts := map[string]int64{}
+	rows, err := m.db.Query("SELECT client, calls FROM api_usage WHERE day = ?", day)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var client string
+		var calls int64
+		if err := rows.Scan(&client, &calls); err != nil {
+			return err
+		}
+		counts[client] = calls
+	}
+	m.day, m.counts, m.pending = day, counts, map[string]int64{}
+	return rows.Err()
+}
+
+// usageClient names who sent r, "" if it isn't an API call.
+func usageClient(r *http.Request) string {
+	if id, ok := r.Context().Value(tokenIDKey).(int64); ok {
+		return "token:" + strconv.FormatInt(id, 10)
+	}
+	if !isAPI(r) {
+		return ""
+	}
+	if email := emailFromRequest(r); email != "" {
+		return "user:" + email
+	}
+	return "ip:" + remoteIP(r)
+}
+
+// count adds a call of client and returns how many it made today.
+func (m *apiMeter) count(client string, now time.Time) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if day := usageDay(now); day != m.day {
+		// the last minute of yesterday goes to the database with the rest
+		m.flushLocked()
+		m.day, m.counts, m.pending = day, map[string]int64{}, map[string]int64{}
+	}
+	m.counts[client]++
+	m.pending[client]++
+	return m.counts[client]
+}
+
+// limit counts every API call and refuses those over the quota. Calls refused
+// count too, a script hammering away after its 429 stays refused.
+func (m *apiMeter) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := usageClient(r)
+		if client == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now()
+		calls := m.count(client, now)
+		if m.quota <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reset := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.FormatInt(m.quota, 10))
+		h.Set("X-RateLimit-Remaining", strconv.FormatInt(max(m.quota-calls, 0), 10))
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		if calls > m.quota {
+			h.Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+			failRequest(w, r, http.StatusTooManyRequests, errCodeQuota,
+				fmt.Sprintf("over the quota of %d calls a day, it resets at midnight UTC", m.quota))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// run writes the counts to the database now and then, and once more when ctx
+// ends.
+func (m *apiMeter) run(ctx context.Context) {
+	tick := time.NewTicker(usageFlush)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			m.mu.Lock()
+			m.flushLocked()
+			m.mu.Unlock()
+			return
+		case <-tick.C:
+			m.mu.Lock()
+			m.flushLocked()
+			m.mu.Unlock()
+			cutoff := usageDay(time.Now().AddDate(0, 0, -usageKeep))
+			if _, err := m.db.Exec("DELETE FROM api_usage WHERE day < ?", cutoff); err != nil {
+				log.Printf("%s", err.Error())
+			}
+		}
+	}
+}
+
+func (m *apiMeter) flushLocked() {
+	if len(m.pending) == 0 {
+		return
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		log.Printf("api usage: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	for client, calls := range m.pending {
+		if _, err := tx.Exec(`INSERT INTO api_usage (day, client, calls) VALUES (?, ?, ?)
+			ON CONFLICT (day, client) DO UPDATE SET calls = calls + excluded.calls`, m.day, client, calls); err != nil {
+			log.Printf("api usage: %v", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("api usage: %v", err)
+		return
+	}
+	m.pending = map[string]int64{}
+}
+
+// UsageRow is a client and its calls on the usage page.
+type UsageRow struct {
+	Client string // as counted, token:7, user:a@example.com or ip:10.0.0.1
+	Label  string // for people
+	Calls  int64
+	Days   int // with calls, in the range shown
+}
+
+// topUsage returns the clients with the most calls from since to today.
+func (m *apiMeter) topUsage(since string, limit int) ([]UsageRow, error) {
+	m.mu.Lock()
+	m.flushLocked()
+	m.mu.Unlock()
+
+	rows, err := m.db.Query(`SELECT u.client, SUM(u.calls), COUNT(*), COALESCE(t.name, ''), COALESCE(o.email, '')
+		FROM api_usage u
+		LEFT JOIN api_tokens t ON u.client = 'token:' || t.id
+		LEFT JOIN users o ON o.id = t.user_id
+		WHERE u.day >= ? GROUP BY u.client ORDER BY SUM(u.calls) DESC LIMIT ?`, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var usage []UsageRow
+	for rows.Next() {
+		var u UsageRow
+		var token, owner string
+		if err := rows.Scan(&u.Client, &u.Calls, &u.Days, &token, &owner); err != nil {
+			return nil, err
+		}
+		kind, who, _ := strings.Cut(u.Client, ":")
+		switch {
+		case kind == "token" && owner != "":
+			u.Label = fmt.Sprintf("token %q of %s", token, owner)
+		case kind == "token":
+			u.Label = "a revoked token"
+		case kind == "user":
+			u.Label = who + " (logged in)"
+		default:
+			u.Label = who + " (anonymous)"
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// renderUsage is the admin page of the top API consumers, of today or the last
+// ?days= days.
+func renderUsage(tmpl *template.Template, m *apiMeter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		days, err := strconv.Atoi(r.URL.Query().Get("days"))
+		if err != nil || days < 1 {
+			days = 1
+		}
+		days = min(days, usageKeep)
+		usage, err := m.topUsage(usageDay(time.Now().AddDate(0, 0, 1-days)), 50)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Version   string
+			UserEmail string
+			Usage     []UsageRow
+			Days      int
+			Quota     int64
+		}{
+			Version:   GetVersion(),
+			UserEmail: emailFromRequest(r),
+			Usage:     usage,
+			Days:      days,
+			Quota:     m.quota,
+		}
+		if err := tmpl.ExecuteTemplate(w, "usage.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type User struct {
+	ID           int64
+	Name         string
+	Email        string
+	PasswordHash string
+	Role         string
+	CreatedAt    time.Time
+}
+
+var errUserExists = errors.New("user name or email already taken")
+
+const userColumns = "id, name, email, password_hash, role, created_at"
+
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
+	var u User
+	if err := row.Scan(&u.ID, &u.Name, &u.Email, &u.PasswordHash, &u.Role, &u.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// userByLogin looks a user up by either name or email.
+func userByLogin(db *sql.DB, login string) (*User, error) {
+	return scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE name = ? OR email = ?", login, login))
+}
+
+func countUsers(db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n)
+	return n, err
+}
+
+// createUser inserts a new account. The very first account always becomes admin,
+// regardless of the requested role.
+func createUser(tx *sql.Tx, name, email, password, role string) error {
+	var taken int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE name = ? OR email = ?", name, email).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return errUserExists
+	}
+
+	var total int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users").Scan(&total); err != nil {
+		return err
+	}
+	if total == 0 {
+		role = roleAdmin
+	}
+
+	// accounts coming from an identity provider have no password of their own
+	var hash string
+	if password != "" {
+		h, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+		hash = h
+	}
+	_, err := tx.Exec("INSERT INTO users (name, email, password_hash, role, created_at) VALUES (?, ?, ?, ?, ?)",
+		name, email, hash, role, time.Now())
+	return err
+}
+
+// startSession issues a fresh session cookie for the given email. On failure
+// it has already answered the request.
+func startSession(w http.ResponseWriter, r *http.Request, email string, remember bool) bool {
+	if err := sessions.start(w, r, email, remember); err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, "could not start session", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// safeRedirect only allows relative paths to prevent open redirect. Browsers
+// read \ as / and drop tabs and newlines, so /\host and /<tab>/host are
+// //host to them.
+func safeRedirect(target string) string {
+	t := strings.ReplaceAll(target, `\`, "/")
+	u, err := url.Parse(t)
+	if err != nil || strings.ContainsFunc(t, unicode.IsControl) || !strings.HasPrefix(t, "/") || strings.HasPrefix(t, "//") ||
+		u.Scheme != "" || u.Host != "" {
+		return "/files/"
+	}
+	return target
+}
+
+type loginView struct {
+	Version   string
+	CSRF      string
+	UserEmail string
+	Redirect  string
+	Error     string
+	Providers []*loginProvider
+}
+
+func sortedProviders(providers map[string]*loginProvider) []*loginProvider {
+	list := make([]*loginProvider, 0, len(providers))
+	for _, p := range providers {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Title < list[j].Title })
+	return list
+}
+
+func renderLogin(tmpl *template.Template, providers map[string]*loginProvider) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := loginView{
+			Version:   GetVersion(),
+			CSRF:      csrfToken(r),
+			UserEmail: emailFromRequest(r),
+			Redirect:  r.URL.Query().Get("redirect"),
+			Providers: sortedProviders(providers),
+		}
+		if err := tmpl.ExecuteTemplate(w, "login.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// authenticate checks a login form, returning a nil user for wrong credentials. With a
+// directory configured it is asked first; local passwords only remain for accounts it
+// does not know (such as the bootstrap admin) or while it cannot be reached.
+func authenticate(ctx context.Context, db *sql.DB, directory *ldapAuth, login, password string) (*User, error) {
+	if directory != nil {
+		dn, email, err := directory.authenticate(ctx, login, password)
+		switch {
+		case err == nil:
+			return userForIdentity(db, "ldap", dn, email, true)
+		case errors.Is(err, errLDAPBadPassword), errors.Is(err, errLDAPNotInGroup):
+			return nil, nil
+		case !errors.Is(err, errLDAPNoUser):
+			log.Printf("ldap error, falling back to local accounts: %v", err)
+		}
+	}
+
+	user, err := userByLogin(db, login)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !checkPassword(user.PasswordHash, password) {
+		return nil, nil
+	}
+	return user, nil
+}
+
+func loginSubmit(tmpl *template.Template, db *sql.DB, providers map[string]*loginProvider, directory *ldapAuth) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Errorf("could not parse form: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		login, ip := strings.TrimSpace(r.FormValue("login")), remoteIP(r)
+		fail := func(status int, message string) {
+			w.WriteHeader(status)
+			data := loginView{
+				Version:   GetVersion(),
+				CSRF:      csrfToken(r),
+				Redirect:  r.FormValue("redirect"),
+				Error:     message,
+				Providers: sortedProviders(providers),
+			}
+			if err := tmpl.ExecuteTemplate(w, "login.html", data); err != nil {
+				log.Printf("%s", err.Error())
+			}
+		}
+
+		wait, err := loginLockout(db, login, ip)
+		if err != nil {
+			log.Printf("login throttle error: %v", err)
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			fail(http.StatusTooManyRequests, fmt.Sprintf("Too many failed attempts, try again in %s.", wait.Round(time.Second)))
+			return
+		}
+
+		user, err := authenticate(r.Context(), db, directory, login, r.FormValue("password"))
+		if err != nil {
+			log.Printf("login lookup error: %v", err)
+			http.Error(w, "could not look up user", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			if err := recordLoginFailure(db, login, ip); err != nil {
+				log.Printf("%s", err.Error())
+			}
+			audit(db, r, "", auditLoginFailed, login, "")
+			fail(http.StatusUnauthorized, "Wrong user name or password.")
+			return
+		}
+
+		if err := clearLoginFailures(db, login); err != nil {
+			log.Printf("%s", err.Error())
+		}
+		audit(db, r, user.Email, auditLogin, user.Email, "password")
+		if !startSession(w, r, user.Email, r.FormValue("remember") != "") {
+			return
+		}
+		http.Redirect(w, r, safeRedirect(r.FormValue("redirect")), http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestSafeRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		target, want string
+	}{
+		{"/files/music/", "/files/music/"},
+		{"/view/a b.mp3?comments", "/view/a b.mp3?comments"},
+		{"/", "/"},
+		{"", "/files/"},
+		{"files/", "/files/"},
+		{"//evil.example", "/files/"},
+		{`/\evil.example`, "/files/"},
+		{`\\evil.example`, "/files/"},
+		{`\/evil.example`, "/files/"},
+		{"/\t/evil.example", "/files/"},
+		{"/\n/evil.example", "/files/"},
+		{"https://evil.example/", "/files/"},
+		{"javascript:alert(1)", "/files/"},
+	} {
+		if got := safeRedirect(tc.target); got != tc.want {
+			t.Errorf("safeRedirect(%q) = %q, want %q", tc.target, got, tc.want)
+		}
+	}
+}
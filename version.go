@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// buildDate is set by the Makefile, -ldflags "-X main.buildDate=...".
+var buildDate string
+
+// buildInfo is what /api/v2/version tells, for keeping track of what a fleet
+// of instances runs. The commit and its date come from the VCS stamp go build
+// puts into every binary built from a checkout.
+type buildInfo struct {
+	Version    string    `json:"version"`
+	Commit     string    `json:"commit,omitempty"`
+	Modified   bool      `json:"modified,omitempty"` // built with uncommitted changes
+	CommitDate time.Time `json:"commit_date,omitzero"`
+	BuildDate  string    `json:"build_date,omitempty"`
+	Go         string    `json:"go"`
+	Platform   string    `json:"platform"`
+	Tags       []string  `json:"tags"`
+	SQLite     string    `json:"sqlite_driver"`
+	Features   []string  `json:"features"`
+}
+
+func newBuildInfo(features []string) buildInfo {
+	info := buildInfo{
+		Version:   strings.TrimSpace(GetVersion()),
+		BuildDate: buildDate,
+		Go:        runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Tags:      []string{},
+		SQLite:    sqliteDriver,
+		Features:  features,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Commit = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			case "vcs.time":
+				info.CommitDate, _ = time.Parse(time.RFC3339, s.Value)
+			case "-tags":
+				info.Tags = strings.Split(s.Value, ",")
+			}
+		}
+	}
+	return info
+}
+
+// enabledFeatures lists the optional parts of Consus this instance runs with.
+func enabledFeatures(config ServerConfig, providers map[string]*loginProvider, directory *ldapAuth, mail *mailer) []string {
+	var features []string
+	for name, on := range map[string]bool{
+		"read-only":     config.ReadOnly,
+		"fulltext":      config.FullText,
+		"watch":         config.Watch,
+		"warm":          config.Warm,
+		"show-perms":    config.ShowPerms,
+		"show-dotfiles": config.ShowDotfiles,
+		"low-memory":    config.Memory.Name == lowMemoryProfile.Name,
+		"basic-auth":    config.BasicAuth != "",
+		"acl-file":      config.ACL != "",
+		"terms":         config.Terms != "",
+		"sftp":          config.SFTPPort != 0,
+		"ip-filter":     config.Allow != "" || config.Deny != "",
+		"watermark":     config.Watermark.Enabled(),
+		"bandwidth":     config.MaxRate != "" || config.MaxRatePerConn != "",
+		"events":        config.Events != "",
+		"ldap":          directory != nil,
+		"smtp":          mail != nil,
+	} {
+		if on {
+			features = append(features, name)
+		}
+	}
+	for name := range providers {
+		features = append(features, "login:"+name)
+	}
+	sort.Strings(features)
+	return features
+}
+
+func renderVersion(info buildInfo) func(http.ResponseWriter, *http.Request) {
+	out, _ := json.MarshalIndent(info, "", "  ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(out, '\n'))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// warmer fills the caches ahead of the first visitors: the listing of every
+// folder and the review copy of every image, so a big library isn't slow the
+// first time somebody clicks through it. It only does what a visit would do.
+type warmer struct {
+	content  *contentFS
+	skip     []string // directories in the content that belong to consus itself
+	wmr      *watermarker
+	listings *meteredCache
+	scanner  *contentScanner
+	workers  int
+
+	folders atomic.Int64
+	images  atomic.Int64
+	failed  atomic.Int64
+}
+
+// run walks the content tree once and logs how it went. Stopping ctx stops the
+// walk, renders that already started finish.
+func (wr *warmer) run(ctx context.Context) {
+	started := time.Now()
+	skip := map[string]bool{}
+	for _, dir := range wr.skip {
+		if abs, err := filepath.Abs(dir); err == nil {
+			skip[abs] = true
+		}
+	}
+
+	images := make(chan string)
+	var wg sync.WaitGroup
+	for range max(wr.workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range images {
+				wr.image(rel)
+			}
+		}()
+	}
+
+	var err error
+	for _, d := range wr.content.dirs() {
+		err = fs.WalkDir(d.store, ".", func(name string, e fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			sched.yield(ctx)
+			rel := cleanRel(path.Join(d.name, name))
+			if e.IsDir() {
+				if dir := wr.content.abs(rel); dir != "" {
+					if abs, _ := filepath.Abs(dir); skip[abs] {
+						return fs.SkipDir
+					}
+				}
+				if _, _, err := readListing(wr.listings, wr.scanner, rel); err != nil {
+					log.Printf("warm: %v", err)
+				}
+				wr.folders.Add(1)
+				return nil
+			}
+			if wr.wmr.defaults.Enabled() && isWatermarkable(rel) {
+				select {
+				case images <- rel:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	close(images)
+	wg.Wait()
+
+	if err != nil {
+		log.Printf("Warm-up stopped after %s: %d folders, %d images", time.Since(started).Round(time.Second), wr.folders.Load(), wr.images.Load())
+		return
+	}
+	log.Printf("Warm-up done in %s: %d folders, %d images, %d failed", time.Since(started).Round(time.Second), wr.folders.Load(), wr.images.Load(), wr.failed.Load())
+}
+
+func (wr *warmer) image(rel string) {
+	info, err := wr.content.stat(rel)
+	if err == nil {
+		_, err = wr.wmr.copy(wr.content, rel, info, wr.wmr.defaults)
+	}
+	if err != nil {
+		log.Printf("warm: %s: %v", rel, err)
+		wr.failed.Add(1)
+		return
+	}
+	wr.images.Add(1)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettle is how long changes are collected before the index is updated,
+// so copying an album in is one update rather than one per file.
+const watchSettle = 2 * time.Second
+
+// contentWatcher keeps the content index current from file system events, so
+// new, renamed and deleted files show up in search without a content check.
+// The events only say which folders to look at again; what ends up in the index
+// is always read from disk, the same way a scan does.
+type contentWatcher struct {
+	scanner *contentScanner
+	feed    *changeFeed
+	w       *fsnotify.Watcher
+	skip    map[string]bool
+}
+
+// watchContent starts watching every folder of the content. When the system
+// runs out of watches, or the watcher fails later on, it says so and leaves
+// the index to the content checks that searches start.
+func watchContent(ctx context.Context, scanner *contentScanner, feed *changeFeed) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	cw := &contentWatcher{scanner: scanner, feed: feed, w: w, skip: scanner.skipped()}
+	everything := true
+	for _, d := range scanner.content.dirs() {
+		if d.dir == "" {
+			// buckets don't tell, searches keep checking the content for them
+			everything = false
+			continue
+		}
+		dir, _ := filepath.Abs(d.dir)
+		if err := cw.add(dir); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	scanner.watched.Store(everything)
+	go cw.run(ctx)
+	return nil
+}
+
+// add watches dir and every folder below it.
+func (cw *contentWatcher) add(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// unreadable folders are the content check's business
+			if d != nil && d.IsDir() && p != dir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if cw.skip[p] {
+			return fs.SkipDir
+		}
+		if err := cw.w.Add(p); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func (cw *contentWatcher) run(ctx context.Context) {
+	defer cw.w.Close()
+	defer cw.scanner.watched.Store(false)
+
+	changed, reread := map[string]bool{}, map[string]bool{}
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err, ok := <-cw.w.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// events were lost, only a full look tells what changed
+				log.Printf("content watch: %v, checking everything", err)
+				cw.scanner.start(false)
+				continue
+			}
+			log.Printf("content watch: %v", err)
+		case ev, ok := <-cw.w.Events:
+			if !ok {
+				return
+			}
+			if !cw.event(ev, changed, reread) {
+				log.Printf("content watch: giving up, searches check the content again when it is older than %s", searchFresh)
+				return
+			}
+			if settle == nil {
+				settle = time.After(watchSettle)
+			}
+		case <-settle:
+			cw.scanner.update(sortedKeys(changed), sortedKeys(reread))
+			changed, reread = map[string]bool{}, map[string]bool{}
+			settle = nil
+		}
+	}
+}
+
+// event notes which folders ev changed, and watches new folders. It returns
+// false when they can't be watched any more.
+func (cw *contentWatcher) event(ev fsnotify.Event, changed, reread map[string]bool) bool {
+	if cw.skip[ev.Name] {
+		return true
+	}
+	dir, ok := cw.scanner.content.rel(filepath.Dir(ev.Name))
+	if !ok {
+		return true
+	}
+	// clients waiting for the folder hear right away, the index can wait
+	cw.feed.publish(dir)
+	if dir == "" {
+		dir = "."
+	}
+
+	switch {
+	case ev.Has(fsnotify.Create):
+		changed[dir] = true
+		if err := cw.add(ev.Name); err != nil {
+			log.Printf("content watch: %v", err)
+			return false
+		}
+	case ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename):
+		changed[dir] = true
+		// a folder moved away keeps its watch under the old name otherwise
+		cw.w.Remove(ev.Name)
+	case ev.Has(fsnotify.Write) || ev.Has(fsnotify.Chmod):
+		// sizes and mtimes of files don't change the one of their folder
+		reread[dir] = true
+	}
+	return true
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
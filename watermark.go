@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var watermarkExtensions = []string{".jpg", ".jpeg", ".png"}
+
+// Watermark is one overlay variant. The zero value means no watermark.
+type Watermark struct {
+	Text  string
+	Image string // path to a PNG drawn in the bottom right corner
+}
+
+func (wm Watermark) Enabled() bool {
+	return wm.Text != "" || wm.Image != ""
+}
+
+// key identifies the variant in the cache, so changing the text or the overlay
+// never serves a stale copy.
+func (wm Watermark) key() string {
+	sum := sha256.Sum256([]byte(wm.Text + "\x00" + wm.Image))
+	return hex.EncodeToString(sum[:8])
+}
+
+func isWatermarkable(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range watermarkExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// watermarker renders watermarked copies of images and keeps them in cache.
+// defaults is the instance-wide variant applied to review copies.
+type watermarker struct {
+	cache    *meteredCache
+	defaults Watermark
+	renders  chan struct{} // one slot per render allowed to run at once
+	quality  *qualityGovernor
+}
+
+// serve writes a watermarked copy of the image rel, generating it on first use.
+func (wmr *watermarker) serve(w http.ResponseWriter, r *http.Request, content *contentFS, rel string, wm Watermark) {
+	info, err := content.stat(rel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := wmr.copy(content, rel, info, wm)
+	if err != nil {
+		http.Error(w, fmt.Errorf("could not watermark image: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(downloads.writer(w, r), r, path.Base(rel), info.ModTime(), bytes.NewReader(data))
+}
+
+// copy returns the watermarked image from cache, rendering it if needed.
+func (wmr *watermarker) copy(content *contentFS, rel string, info fs.FileInfo, wm Watermark) ([]byte, error) {
+	// the source mtime is part of the key, replaced files get a fresh copy
+	q := wmr.quality.quality()
+	key := fmt.Sprintf("watermark2\x00%s\x00%s\x00%s\x00%d\x00%d", wm.key(), q.key(), content.key(rel), info.ModTime().UnixNano(), info.Size())
+
+	return wmr.cache.fetch(key, func() ([]byte, error) {
+		wmr.renders <- struct{}{}
+		defer func() { <-wmr.renders }()
+		in, err := content.open(rel)
+		if err != nil {
+			return nil, err
+		}
+		defer in.Close()
+		return renderWatermark(in, wm, q)
+	})
+}
+
+func renderWatermark(in io.Reader, wm Watermark, q renderQuality) ([]byte, error) {
+	img, format, err := image.Decode(in)
+	if err != nil {
+		return nil, err
+	}
+
+	ib := img.Bounds()
+	var canvas *image.RGBA
+	if long := max(ib.Dx(), ib.Dy()); q.edge > 0 && long > q.edge {
+		canvas = image.NewRGBA(image.Rect(0, 0, max(ib.Dx()*q.edge/long, 1), max(ib.Dy()*q.edge/long, 1)))
+		draw.ApproxBiLinear.Scale(canvas, canvas.Bounds(), img, ib, draw.Src, nil)
+	} else {
+		canvas = image.NewRGBA(ib)
+		draw.Draw(canvas, canvas.Bounds(), img, ib.Min, draw.Src)
+	}
+
+	bounds := canvas.Bounds()
+	margin := bounds.Dy() / 40
+	right := bounds.Max.X - margin
+	bottom := bounds.Max.Y - margin
+
+	if wm.Image != "" {
+		overlay, err := loadPNG(wm.Image)
+		if err != nil {
+			return nil, fmt.Errorf("could not load watermark image: %w", err)
+		}
+		// never cover more than a quarter of the width
+		ob := overlay.Bounds()
+		width := min(ob.Dx(), bounds.Dx()/4)
+		height := ob.Dy() * width / max(ob.Dx(), 1)
+		target := image.Rect(right-width, bottom-height, right, bottom)
+		draw.BiLinear.Scale(canvas, target, overlay, ob, draw.Over, nil)
+		bottom = target.Min.Y - margin
+	}
+
+	if wm.Text != "" {
+		label := textImage(wm.Text)
+		// basicfont is tiny, scale it to roughly 1/20th of the image height
+		height := max(bounds.Dy()/20, label.Bounds().Dy())
+		width := label.Bounds().Dx() * height / label.Bounds().Dy()
+		target := image.Rect(right-width, bottom-height, right, bottom)
+		draw.BiLinear.Scale(canvas, target, label, label.Bounds(), draw.Over, nil)
+	}
+
+	var out bytes.Buffer
+	switch format {
+	case "png":
+		err = png.Encode(&out, canvas)
+	default:
+		err = jpeg.Encode(&out, canvas, &jpeg.Options{Quality: q.jpeg})
+	}
+	return out.Bytes(), err
+}
+
+// textImage renders text as semi-transparent white with a dark outline so it
+// stays readable on both light and dark footage.
+func textImage(text string) image.Image {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil() + 2
+	height := face.Metrics().Height.Ceil() + 2
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	d := font.Drawer{Dst: img, Face: face}
+	baseline := face.Metrics().Ascent.Ceil() + 1
+	d.Src = image.NewUniform(color.NRGBA{0, 0, 0, 160})
+	for _, off := range [][2]int{{0, 1}, {2, 1}, {1, 0}, {1, 2}} {
+		d.Dot = fixed.P(off[0], baseline+off[1]-1)
+		d.DrawString(text)
+	}
+	d.Src = image.NewUniform(color.NRGBA{255, 255, 255, 200})
+	d.Dot = fixed.P(1, baseline)
+	d.DrawString(text)
+	return img
+}
+
+func loadPNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}